@@ -0,0 +1,428 @@
+package backends
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego"
+	"github.com/lunny/axmlParser"
+)
+
+//
+// Android App Bundle(.aab)
+// 测试人员不能直接安装aab, 因此每个aab都需要一个universal apk:
+//   1. 和aab一起上传(apk, 或者bundletool --mode=universal生成的apks)
+//   2. 使用bundletool_command生成, 例如:
+//      bundletool_command = java -jar /opt/bundletool.jar build-apks --mode=universal --bundle={aab} --output={apks} --ks=/opt/release.jks --ks-pass=file:/opt/ks.pass --ks-key-alias=release
+//      参数中有空格时使用引号, 例如: java -jar "/opt/android tools/bundletool.jar" ...
+// 只支持universal apk, 不支持split apk: 没有universal.apk的apks(默认的--mode)会被拒绝
+//
+// aab中的AndroidManifest.xml是aapt2的protobuf格式(Resources.proto中的XmlNode)
+//
+
+const aabManifest = "base/manifest/AndroidManifest.xml"
+
+// protoField protobuf中的一个字段, varint类型时Bytes为nil
+type protoField struct {
+	Number int
+	Varint uint64
+	Bytes  []byte
+}
+
+// readProtoFields 解析protobuf消息中的所有字段, 只支持varint, 64-bit, length-delimited, 32-bit
+func readProtoFields(data []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid protobuf key")
+		}
+		data = data[n:]
+		field := protoField{Number: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			if field.Varint, n = binary.Uvarint(data); n <= 0 {
+				return nil, fmt.Errorf("invalid protobuf varint")
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("truncated protobuf fixed64")
+			}
+			field.Varint, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return nil, fmt.Errorf("invalid protobuf length")
+			}
+			field.Bytes, data = data[n:n+int(length)], data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return nil, fmt.Errorf("truncated protobuf fixed32")
+			}
+			field.Varint, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// protoXmlAttribute XmlAttribute: namespace_uri = 1, name = 2, value = 3, compiled_item = 6
+func protoXmlAttribute(data []byte) (*axmlParser.Attribute, error) {
+	fields, err := readProtoFields(data)
+	if err != nil {
+		return nil, err
+	}
+	attr := new(axmlParser.Attribute)
+	var compiled []byte
+	for _, f := range fields {
+		switch f.Number {
+		case 1:
+			attr.Namespace = string(f.Bytes)
+		case 2:
+			attr.Name = string(f.Bytes)
+		case 3:
+			attr.Value = string(f.Bytes)
+		case 6:
+			compiled = f.Bytes
+		}
+	}
+	if attr.Value == "" && compiled != nil {
+		attr.Value = protoPrimitiveValue(compiled)
+	}
+	return attr, nil
+}
+
+// protoPrimitiveValue Item中的prim(= 7): int_decimal_value = 6, int_hexadecimal_value = 7, boolean_value = 8, float_value = 3
+func protoPrimitiveValue(item []byte) string {
+	fields, _ := readProtoFields(item)
+	for _, f := range fields {
+		if f.Number != 7 || f.Bytes == nil {
+			continue
+		}
+		prims, _ := readProtoFields(f.Bytes)
+		for _, p := range prims {
+			switch p.Number {
+			case 6:
+				return strconv.Itoa(int(int32(p.Varint)))
+			case 7:
+				return fmt.Sprintf("0x%08x", uint32(p.Varint))
+			case 8:
+				return strconv.FormatBool(p.Varint != 0)
+			case 3:
+				return strconv.FormatFloat(float64(math.Float32frombits(uint32(p.Varint))), 'g', -1, 32)
+			}
+		}
+	}
+	return ""
+}
+
+// walkProtoXml 遍历XmlNode(element = 1), 回调listener
+// XmlElement: namespace_uri = 2, name = 3, attribute = 4, child = 5
+func walkProtoXml(node []byte, listener axmlParser.Listener) error {
+	fields, err := readProtoFields(node)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if f.Number != 1 || f.Bytes == nil {
+			continue
+		}
+		elementFields, err := readProtoFields(f.Bytes)
+		if err != nil {
+			return err
+		}
+		var uri, name string
+		var attrs []*axmlParser.Attribute
+		var children [][]byte
+		for _, ef := range elementFields {
+			switch ef.Number {
+			case 2:
+				uri = string(ef.Bytes)
+			case 3:
+				name = string(ef.Bytes)
+			case 4:
+				attr, err := protoXmlAttribute(ef.Bytes)
+				if err != nil {
+					return err
+				}
+				attrs = append(attrs, attr)
+			case 5:
+				children = append(children, ef.Bytes)
+			}
+		}
+
+		listener.StartElement(uri, name, name, attrs)
+		for _, child := range children {
+			if err := walkProtoXml(child, listener); err != nil {
+				return err
+			}
+		}
+		listener.EndElement(uri, name, name)
+	}
+	return nil
+}
+
+// ParseAab 解析aab中base模块的AndroidManifest.xml, 所有模块的native库的ABI以及签名证书
+func ParseAab(name string) (*models.ApkMetadata, error) {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var manifest *zip.File
+	abis := make(map[string]bool)
+	for _, f := range r.File {
+		if f.Name == aabManifest {
+			manifest = f
+		}
+		// <module>/lib/<abi>/libxxx.so
+		if parts := strings.Split(f.Name, "/"); len(parts) == 4 && parts[1] == "lib" && strings.HasSuffix(f.Name, ".so") {
+			abis[parts[2]] = true
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%s not found", aabManifest)
+	}
+	data, err := readZipFile(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	listener := new(ManifestListener)
+	if err := walkProtoXml(data, listener); err != nil {
+		return nil, fmt.Errorf("%s: %v", aabManifest, err)
+	}
+	meta := &listener.Metadata
+	if meta.PackageName == "" {
+		return nil, fmt.Errorf("package not found in %s", aabManifest)
+	}
+	for abi := range abis {
+		meta.Abis = append(meta.Abis, abi)
+	}
+	sort.Strings(meta.Abis)
+
+	// aab只有v1(jarsigner)签名
+	signer, err := ReadApkSigner(name, r.File)
+	if err != nil {
+		return nil, fmt.Errorf("read signer certificate failed: %v", err)
+	}
+	if signer != nil {
+		meta.SignatureScheme = signer.Scheme
+		meta.SignerCertSHA256 = signer.CertSHA256
+		meta.SignerSubject = signer.Subject
+	}
+	return meta, nil
+}
+
+// ExtractUniversalApk 从bundletool生成的apks中解压universal.apk
+func ExtractUniversalApk(apks string, dst string) error {
+	found, err := extractZipEntry(apks, func(name string) bool {
+		return name == "universal.apk"
+	}, dst)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("universal.apk not found in %s, build it with --mode=universal", filepath.Base(apks))
+	}
+	return nil
+}
+
+// BundletoolCommand 配置的bundletool命令, 没有配置时为空
+func BundletoolCommand() string {
+	return strings.TrimSpace(beego.AppConfig.String("bundletool_command"))
+}
+
+// BuildUniversalApk 使用bundletool_command从aab生成universal apk, 命令中的{aab}, {apks}替换为对应的路径
+func BuildUniversalApk(aab string, dst string) error {
+	command := BundletoolCommand()
+	if command == "" {
+		return fmt.Errorf("bundletool_command is not configured")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "bundletool-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	apks := path.Join(tmpDir, "app.apks")
+
+	args, err := splitCommand(command)
+	if err != nil {
+		return fmt.Errorf("invalid bundletool_command: %v", err)
+	}
+	for i, arg := range args {
+		arg = strings.Replace(arg, "{aab}", aab, -1)
+		args[i] = strings.Replace(arg, "{apks}", apks, -1)
+	}
+
+	timeout := time.Duration(beego.AppConfig.DefaultInt("bundletool_timeout", 300)) * time.Second
+	var output bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		err = fmt.Errorf("timeout after %v", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("bundletool failed: %v: %s", err, strings.TrimSpace(lastLines(output.String(), 5)))
+	}
+	return ExtractUniversalApk(apks, dst)
+}
+
+// splitCommand 按照空格分割命令行参数, 支持单引号, 双引号以及反斜杠转义
+func splitCommand(command string) ([]string, error) {
+	var args []string
+	var arg []rune
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range command {
+		switch {
+		case escaped:
+			arg = append(arg, c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				arg = append(arg, c)
+			}
+		case c == '"' || c == '\'':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, string(arg))
+				arg, inArg = nil, false
+			}
+		default:
+			arg = append(arg, c)
+			inArg = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, fmt.Errorf("unterminated quote or escape")
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return args, nil
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 生成失败的aab, 文件没有变化时不再重试
+var universalApkFailures = newFileCache()
+
+// 正在生成universal apk的aab => 生成结束时关闭
+var gUniversalApkJobs = make(map[string]chan struct{})
+var gUniversalApkLock sync.Mutex
+
+// ensureUniversalApk 扫描时aab没有对应的app.apk, 配置了bundletool时在后台生成, 生成结束之后重新扫描
+// 扫描不等待bundletool; 同一个aab同时只有一个bundletool在运行(watcher, 管理后台, replication都会触发扫描)
+func ensureUniversalApk(aabPath string, apkPath string) error {
+	info, err := os.Stat(aabPath)
+	if err != nil {
+		return err
+	}
+	if failure, ok := universalApkFailures.get(aabPath, info); ok {
+		return failure.(error)
+	}
+	if BundletoolCommand() == "" {
+		return fmt.Errorf("app.apk not found, upload it together with app.aab or configure bundletool_command")
+	}
+
+	gUniversalApkLock.Lock()
+	defer gUniversalApkLock.Unlock()
+	if _, ok := gUniversalApkJobs[aabPath]; !ok {
+		done := make(chan struct{})
+		gUniversalApkJobs[aabPath] = done
+		go func() {
+			if err := buildUniversalApkFile(aabPath, apkPath, info); err != nil {
+				log.WarnErrorf(err, "Build universal apk for %s failed", aabPath)
+			}
+			// 重新扫描之后才结束, 扫描时不会再次生成
+			if err := ScanAppRootDir(path.Dir(path.Dir(aabPath))); err != nil {
+				log.WarnErrorf(err, "Scan after building universal apk failed")
+			}
+			gUniversalApkLock.Lock()
+			delete(gUniversalApkJobs, aabPath)
+			gUniversalApkLock.Unlock()
+			close(done)
+		}()
+	}
+	return fmt.Errorf("app.apk is being built by bundletool_command")
+}
+
+// buildUniversalApkFile 先生成临时文件再rename, watcher忽略.tmp文件; 失败时aab没有变化不再重试
+func buildUniversalApkFile(aabPath string, apkPath string, info os.FileInfo) error {
+	tmp := apkPath + ".tmp"
+	err := BuildUniversalApk(aabPath, tmp)
+	if err == nil {
+		err = os.Rename(tmp, apkPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		universalApkFailures.put(aabPath, info, err)
+		return err
+	}
+	return nil
+}
+
+// copyUniversalApk 上传的universal apk, 或者bundletool --mode=universal生成的apks
+func copyUniversalApk(src string, dst string) error {
+	if strings.ToLower(filepath.Ext(src)) == ".apks" {
+		return ExtractUniversalApk(src, dst)
+	}
+	return copyFile(src, dst)
+}
+
+// checkUniversalApk universal apk必须是从同一个aab生成的
+func checkUniversalApk(aabMeta *models.ApkMetadata, apkMeta *models.ApkMetadata) error {
+	if aabMeta.PackageName != apkMeta.PackageName || aabMeta.VersionCode != apkMeta.VersionCode {
+		return fmt.Errorf("app.apk (%s %s) does not match app.aab (%s %s)",
+			apkMeta.PackageName, apkMeta.VersionCode, aabMeta.PackageName, aabMeta.VersionCode)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/astaxie/beego"
+	"github.com/stretchr/testify/assert"
+)
+
+// protoMessage 按照字段的顺序拼接protobuf, []byte和string为length-delimited, int为varint
+func protoMessage(fields ...interface{}) []byte {
+	var buf bytes.Buffer
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for i := 0; i+1 < len(fields); i += 2 {
+		number := uint64(fields[i].(int))
+		switch v := fields[i+1].(type) {
+		case int:
+			buf.Write(tmp[:binary.PutUvarint(tmp, number<<3)])
+			buf.Write(tmp[:binary.PutUvarint(tmp, uint64(v))])
+		case string:
+			buf.Write(tmp[:binary.PutUvarint(tmp, number<<3|2)])
+			buf.Write(tmp[:binary.PutUvarint(tmp, uint64(len(v)))])
+			buf.WriteString(v)
+		case []byte:
+			buf.Write(tmp[:binary.PutUvarint(tmp, number<<3|2)])
+			buf.Write(tmp[:binary.PutUvarint(tmp, uint64(len(v)))])
+			buf.Write(v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// protoElement XmlNode{element: XmlElement{name, attribute..., child...}}
+func protoElement(name string, attrs [][]byte, children ...[]byte) []byte {
+	fields := []interface{}{3, name}
+	for _, attr := range attrs {
+		fields = append(fields, 4, attr)
+	}
+	for _, child := range children {
+		fields = append(fields, 5, child)
+	}
+	return protoMessage(1, protoMessage(fields...))
+}
+
+func protoStringAttr(name string, value string) []byte {
+	return protoMessage(1, androidNamespace, 2, name, 3, value)
+}
+
+// protoIntAttr 编译之后的整数: compiled_item{prim{int_decimal_value}}
+func protoIntAttr(name string, value int) []byte {
+	return protoMessage(1, androidNamespace, 2, name, 6, protoMessage(7, protoMessage(6, value)))
+}
+
+func testAabManifest() []byte {
+	launcher := protoElement("intent-filter", nil,
+		protoElement("action", [][]byte{protoStringAttr("name", "android.intent.action.MAIN")}),
+		protoElement("category", [][]byte{protoStringAttr("name", "android.intent.category.LAUNCHER")}))
+	return protoElement("manifest",
+		[][]byte{
+			protoMessage(2, "package", 3, "me.chunyu.demo"),
+			protoIntAttr("versionCode", 42),
+			protoStringAttr("versionName", "1.2.0"),
+		},
+		protoElement("uses-sdk", [][]byte{protoIntAttr("minSdkVersion", 21), protoIntAttr("targetSdkVersion", 28)}),
+		protoElement("uses-permission", [][]byte{protoStringAttr("name", "android.permission.INTERNET")}),
+		protoElement("application", nil,
+			protoElement("activity", [][]byte{protoStringAttr("name", ".MainActivity")}, launcher)))
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestParseAab"
+//
+func TestParseAab(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "aab")
+	defer os.RemoveAll(dir)
+
+	aabPath := path.Join(dir, "app.aab")
+	assert.NoError(t, ioutil.WriteFile(aabPath, testZip(t, map[string][]byte{
+		aabManifest:                           testAabManifest(),
+		"base/dex/classes.dex":                []byte("dex"),
+		"base/lib/arm64-v8a/libdemo.so":       []byte("so"),
+		"base/lib/armeabi-v7a/libdemo.so":     []byte("so"),
+		"feature/lib/x86/libfeature.so":       []byte("so"),
+		"BUNDLE-METADATA/com.android.tools/x": []byte("x"),
+	}), 0644))
+
+	meta, err := ParseAab(aabPath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "me.chunyu.demo", meta.PackageName)
+		assert.Equal(t, "42", meta.VersionCode)
+		assert.Equal(t, "1.2.0", meta.VersionName)
+		assert.Equal(t, "21", meta.MinSdkVersion)
+		assert.Equal(t, "28", meta.TargetSdkVersion)
+		assert.Equal(t, "me.chunyu.demo.MainActivity", meta.LauncherActivity)
+		assert.Equal(t, []string{"android.permission.INTERNET"}, meta.Permissions)
+		assert.Equal(t, []string{"arm64-v8a", "armeabi-v7a", "x86"}, meta.Abis)
+		assert.Equal(t, "", meta.SignatureScheme)
+	}
+
+	badPath := path.Join(dir, "bad.aab")
+	ioutil.WriteFile(badPath, testZip(t, map[string][]byte{"base/dex/classes.dex": []byte("dex")}), 0644)
+	_, err = ParseAab(badPath)
+	assert.Error(t, err)
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestUniversalApk"
+//
+func TestUniversalApk(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "aab")
+	defer os.RemoveAll(dir)
+
+	apks := path.Join(dir, "app.apks")
+	ioutil.WriteFile(apks, testZip(t, map[string][]byte{"universal.apk": []byte("apk"), "toc.pb": []byte("toc")}), 0644)
+	assert.NoError(t, copyUniversalApk(apks, path.Join(dir, "a.apk")))
+	data, _ := ioutil.ReadFile(path.Join(dir, "a.apk"))
+	assert.Equal(t, "apk", string(data))
+
+	splits := path.Join(dir, "splits.apks")
+	ioutil.WriteFile(splits, testZip(t, map[string][]byte{"splits/base-master.apk": []byte("apk")}), 0644)
+	assert.Error(t, ExtractUniversalApk(splits, path.Join(dir, "b.apk")))
+
+	// 没有配置bundletool时不生成
+	os.MkdirAll(path.Join(dir, "aab_1"), 0755)
+	aabPath := path.Join(dir, "aab_1", "app.aab")
+	apkPath := path.Join(dir, "aab_1", "app.apk")
+	ioutil.WriteFile(aabPath, []byte("aab"), 0644)
+	assert.Error(t, ensureUniversalApk(aabPath, apkPath))
+	assert.Len(t, gUniversalApkJobs, 0)
+
+	// 使用cp模拟bundletool, 检查{aab}, {apks}的替换以及引号
+	beego.AppConfig.Set("bundletool_command", "cp '"+apks+"' {apks}")
+	defer beego.AppConfig.Set("bundletool_command", "")
+	assert.NoError(t, BuildUniversalApk(aabPath, path.Join(dir, "c.apk")))
+	assert.True(t, IsExist(path.Join(dir, "c.apk")))
+
+	// 生成失败之后, aab没有变化时不再重试
+	beego.AppConfig.Set("bundletool_command", "cp {aab} {apks}")
+	assert.Error(t, ensureUniversalApk(aabPath, apkPath))
+	waitUniversalApk(aabPath)
+	err := ensureUniversalApk(aabPath, apkPath)
+	assert.Error(t, err)
+	beego.AppConfig.Set("bundletool_command", "cp "+apks+" {apks}")
+	assert.Equal(t, err, ensureUniversalApk(aabPath, apkPath))
+	assert.False(t, IsExist(apkPath))
+	assert.False(t, IsExist(apkPath+".tmp"))
+
+	// 在后台生成, 生成的过程中再次扫描不会启动新的bundletool
+	ioutil.WriteFile(aabPath, []byte("aab2"), 0644)
+	beego.AppConfig.Set("bundletool_command", "sh -c 'sleep 0.2 && cp "+apks+" {apks}'")
+	assert.Error(t, ensureUniversalApk(aabPath, apkPath))
+	assert.Error(t, ensureUniversalApk(aabPath, apkPath))
+	assert.Len(t, gUniversalApkJobs, 1)
+	waitUniversalApk(aabPath)
+	assert.True(t, IsExist(apkPath))
+	assert.Len(t, gUniversalApkJobs, 0)
+}
+
+func waitUniversalApk(aabPath string) {
+	gUniversalApkLock.Lock()
+	done, ok := gUniversalApkJobs[aabPath]
+	gUniversalApkLock.Unlock()
+	if ok {
+		<-done
+	}
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestSplitCommand"
+//
+func TestSplitCommand(t *testing.T) {
+	args, err := splitCommand(`java -jar "/opt/android tools/bundletool.jar" build-apks --ks-pass='pass:a b' --output={apks} a\ b`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"java", "-jar", "/opt/android tools/bundletool.jar", "build-apks", "--ks-pass=pass:a b", "--output={apks}", "a b"}, args)
+
+	args, err = splitCommand(`echo '' "a\"b"`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"echo", "", `a"b`}, args)
+
+	_, err = splitCommand(`java -jar "/opt/bundletool.jar`)
+	assert.Error(t, err)
+	_, err = splitCommand("  ")
+	assert.Error(t, err)
+}
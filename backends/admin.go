@@ -0,0 +1,174 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 管理后台对Build的修改依次进行
+var gAdminLock sync.Mutex
+
+// ValidAppId 目录名不能为空, 不能是隐藏目录, 不能包含路径分隔符
+func ValidAppId(appId string) bool {
+	return appId != "" && !isHiddenDir(appId) && !strings.ContainsAny(appId, `/\`)
+}
+
+func appDirExists(appsRootDir string, appId string) bool {
+	if !ValidAppId(appId) {
+		return false
+	}
+	info, err := os.Stat(path.Join(appsRootDir, appId))
+	return err == nil && info.IsDir()
+}
+
+// GetBuildInfo 读取Build的build.json, 包括Android的app.json中的默认值
+func GetBuildInfo(appsRootDir string, appId string) (*BuildInfo, error) {
+	if !appDirExists(appsRootDir, appId) {
+		return nil, fmt.Errorf("build not found: %s", appId)
+	}
+	appDir := path.Join(appsRootDir, appId)
+	var appJson map[string]interface{}
+	if data, err := ioutil.ReadFile(path.Join(appDir, "app.json")); err == nil {
+		json.Unmarshal(data, &appJson)
+	}
+	return ReadBuildInfo(appDir, appJson)
+}
+
+// UpdateBuildInfo 修改Build的build.json, 使用s3等存储时同时上传
+func UpdateBuildInfo(appsRootDir string, appId string, update func(info *BuildInfo)) error {
+	gAdminLock.Lock()
+	defer gAdminLock.Unlock()
+
+	if !appDirExists(appsRootDir, appId) {
+		return fmt.Errorf("build not found: %s", appId)
+	}
+	info, err := GetBuildInfo(appsRootDir, appId)
+	if err != nil {
+		return err
+	}
+	update(info)
+	if err := WriteBuildInfo(path.Join(appsRootDir, appId), info); err != nil {
+		return err
+	}
+	return PushAppDir(GetStorage(), appsRootDir, appId)
+}
+
+// RenameBuild 修改Build的目录名, 下载链接随之改变
+func RenameBuild(appsRootDir string, appId string, newId string) error {
+	gAdminLock.Lock()
+	defer gAdminLock.Unlock()
+
+	if !appDirExists(appsRootDir, appId) {
+		return fmt.Errorf("build not found: %s", appId)
+	}
+	if !ValidAppId(newId) {
+		return fmt.Errorf("invalid build id: %s", newId)
+	}
+	if IsExist(path.Join(appsRootDir, newId)) {
+		return fmt.Errorf("build already exists: %s", newId)
+	}
+	if err := os.Rename(path.Join(appsRootDir, appId), path.Join(appsRootDir, newId)); err != nil {
+		return err
+	}
+	if err := PushAppDir(GetStorage(), appsRootDir, newId); err != nil {
+		return err
+	}
+	return DeleteAppDir(GetStorage(), appsRootDir, appId)
+}
+
+// TrashBuild 将Build移动到trash目录, 可以通过RestoreBuild恢复
+func TrashBuild(appsRootDir string, appId string) (string, error) {
+	gAdminLock.Lock()
+	defer gAdminLock.Unlock()
+
+	if !appDirExists(appsRootDir, appId) {
+		return "", fmt.Errorf("build not found: %s", appId)
+	}
+	trashId, err := MoveToTrash(appsRootDir, appId)
+	if err != nil {
+		return "", err
+	}
+	// 存储中的文件直接删除, trash中仍然保留一份
+	return trashId, DeleteAppDir(GetStorage(), appsRootDir, appId)
+}
+
+// TrashEntry trash目录中的Build, 名字为 <app_id>.<删除时间>
+type TrashEntry struct {
+	TrashId   string
+	AppId     string
+	DeletedAt time.Time
+}
+
+// ListTrash 按照删除的时间降序排列
+func ListTrash(appsRootDir string) ([]*TrashEntry, error) {
+	dir, err := ioutil.ReadDir(TrashDir(appsRootDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []*TrashEntry
+	for _, fi := range dir {
+		if !fi.IsDir() {
+			continue
+		}
+		entry := &TrashEntry{TrashId: fi.Name(), AppId: fi.Name(), DeletedAt: fi.ModTime()}
+		if idx := strings.LastIndex(fi.Name(), "."); idx > 0 {
+			if ts, err := strconv.ParseInt(fi.Name()[idx+1:], 10, 64); err == nil {
+				entry.AppId = fi.Name()[:idx]
+				entry.DeletedAt = time.Unix(ts, 0)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	sort.Sort(trashEntries(entries))
+	return entries, nil
+}
+
+type trashEntries []*TrashEntry
+
+func (a trashEntries) Len() int {
+	return len(a)
+}
+func (a trashEntries) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a trashEntries) Less(i, j int) bool {
+	return a[j].DeletedAt.Before(a[i].DeletedAt)
+}
+
+// RestoreBuild 将trash中的Build恢复到apps_root, 返回恢复之后的目录名
+func RestoreBuild(appsRootDir string, trashId string) (string, error) {
+	gAdminLock.Lock()
+	defer gAdminLock.Unlock()
+
+	entries, err := ListTrash(appsRootDir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry.TrashId != trashId {
+			continue
+		}
+		if !ValidAppId(entry.AppId) {
+			return "", fmt.Errorf("invalid build id: %s", entry.AppId)
+		}
+		if IsExist(path.Join(appsRootDir, entry.AppId)) {
+			return "", fmt.Errorf("build already exists: %s", entry.AppId)
+		}
+		if err := os.Rename(path.Join(TrashDir(appsRootDir), trashId), path.Join(appsRootDir, entry.AppId)); err != nil {
+			return "", err
+		}
+		return entry.AppId, PushAppDir(GetStorage(), appsRootDir, entry.AppId)
+	}
+	return "", fmt.Errorf("not found in trash: %s", trashId)
+}
@@ -0,0 +1,82 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestAdminBuilds"
+//
+func TestAdminBuilds(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+	storageRoot, _ := ioutil.TempDir("", "storage")
+	defer os.RemoveAll(storageRoot)
+	SetStorage(NewLocalStorage(storageRoot))
+	defer SetStorage(nil)
+
+	writeBuild(t, appsRoot, "demo_1", map[string]string{"app.ipa": "ipa", "app.png": "png"}, time.Now())
+	ioutil.WriteFile(path.Join(appsRoot, "demo_1", "app.json"), []byte(`{"notes": "from app.json"}`), 0644)
+
+	// 修改build.json, 同时上传到存储
+	assert.NoError(t, UpdateBuildInfo(appsRoot, "demo_1", func(info *BuildInfo) {
+		info.Pinned = true
+		info.Channel = "beta"
+	}))
+	info, err := GetBuildInfo(appsRoot, "demo_1")
+	assert.NoError(t, err)
+	assert.Equal(t, &BuildInfo{Notes: "from app.json", Channel: "beta", Pinned: true}, info)
+	assert.True(t, IsExist(path.Join(storageRoot, "demo_1", BuildInfoFile)))
+
+	// 清空之后不再使用app.json中的值
+	assert.NoError(t, UpdateBuildInfo(appsRoot, "demo_1", func(info *BuildInfo) {
+		info.Notes = ""
+	}))
+	info, err = GetBuildInfo(appsRoot, "demo_1")
+	assert.NoError(t, err)
+	assert.Equal(t, &BuildInfo{Channel: "beta", Pinned: true}, info)
+
+	for _, appId := range []string{"", "demo_2", ".trash", "../demo_1"} {
+		assert.Error(t, UpdateBuildInfo(appsRoot, appId, func(info *BuildInfo) {}), appId)
+	}
+
+	// 重命名
+	writeBuild(t, appsRoot, "demo_2", map[string]string{"app.ipa": "ipa2"}, time.Now())
+	assert.Error(t, RenameBuild(appsRoot, "demo_1", "demo_2"))
+	assert.Error(t, RenameBuild(appsRoot, "demo_1", "a/b"))
+	assert.NoError(t, RenameBuild(appsRoot, "demo_1", "demo_1_beta"))
+	assert.False(t, IsExist(path.Join(appsRoot, "demo_1")))
+	assert.False(t, IsExist(path.Join(storageRoot, "demo_1", "app.ipa")))
+	assert.True(t, IsExist(path.Join(storageRoot, "demo_1_beta", "app.ipa")))
+
+	// 删除到trash, 然后恢复
+	trashId, err := TrashBuild(appsRoot, "demo_1_beta")
+	assert.NoError(t, err)
+	assert.False(t, IsExist(path.Join(appsRoot, "demo_1_beta")))
+	assert.False(t, IsExist(path.Join(storageRoot, "demo_1_beta", "app.ipa")))
+
+	entries, err := ListTrash(appsRoot)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, trashId, entries[0].TrashId)
+	assert.Equal(t, "demo_1_beta", entries[0].AppId)
+
+	_, err = RestoreBuild(appsRoot, "demo_3.1462068000")
+	assert.Error(t, err)
+	appId, err := RestoreBuild(appsRoot, trashId)
+	assert.NoError(t, err)
+	assert.Equal(t, "demo_1_beta", appId)
+	assert.True(t, IsExist(path.Join(storageRoot, "demo_1_beta", "app.ipa")))
+	info, err = GetBuildInfo(appsRoot, appId)
+	assert.NoError(t, err)
+	assert.True(t, info.Pinned)
+
+	entries, _ = ListTrash(appsRoot)
+	assert.Empty(t, entries)
+}
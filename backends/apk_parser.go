@@ -0,0 +1,208 @@
+package backends
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/lunny/axmlParser"
+)
+
+const androidNamespace = "http://schemas.android.com/apk/res/android"
+
+// ManifestListener 从二进制的AndroidManifest.xml中读取元数据
+// axmlParser.AppNameListener 只能获取包名和版本, 并且不区分LAUNCHER
+type ManifestListener struct {
+	Metadata models.ApkMetadata
+
+	// 当前的activity以及intent-filter中的action, category
+	activity   string
+	isMain     bool
+	isLauncher bool
+}
+
+func androidAttr(attrs []*axmlParser.Attribute, name string) (string, bool) {
+	for _, attr := range attrs {
+		if attr.Name == name && (attr.Namespace == androidNamespace || attr.Namespace == "") {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// 相对的类名(.MainActivity或者MainActivity)转换为完整的类名
+func (listener *ManifestListener) className(name string) string {
+	pkg := listener.Metadata.PackageName
+	if strings.HasPrefix(name, ".") {
+		return pkg + name
+	}
+	if name != "" && !strings.Contains(name, ".") {
+		return pkg + "." + name
+	}
+	return name
+}
+
+func (listener *ManifestListener) StartDocument()                        {}
+func (listener *ManifestListener) EndDocument()                          {}
+func (listener *ManifestListener) StartPrefixMapping(prefix, uri string) {}
+func (listener *ManifestListener) EndPrefixMapping(prefix, uri string)   {}
+func (listener *ManifestListener) Text(data string)                      {}
+func (listener *ManifestListener) CharacterData(data string)             {}
+func (listener *ManifestListener) ProcessingInstruction(target, data string) {
+}
+
+func (listener *ManifestListener) StartElement(uri, localName, qName string, attrs []*axmlParser.Attribute) {
+	meta := &listener.Metadata
+	switch localName {
+	case "manifest":
+		meta.PackageName, _ = androidAttr(attrs, "package")
+		meta.VersionCode, _ = androidAttr(attrs, "versionCode")
+		meta.VersionName, _ = androidAttr(attrs, "versionName")
+
+	case "uses-sdk":
+		meta.MinSdkVersion, _ = androidAttr(attrs, "minSdkVersion")
+		meta.TargetSdkVersion, _ = androidAttr(attrs, "targetSdkVersion")
+
+	case "uses-permission", "uses-permission-sdk-23", "uses-permission-sdk-m":
+		if name, ok := androidAttr(attrs, "name"); ok {
+			meta.Permissions = append(meta.Permissions, name)
+		}
+
+	case "uses-feature":
+		name, ok := androidAttr(attrs, "name")
+		if !ok {
+			// <uses-feature android:glEsVersion="0x00020000"/>
+			if gl, ok := androidAttr(attrs, "glEsVersion"); ok {
+				name = "glEsVersion=" + gl
+			}
+		}
+		if name == "" {
+			return
+		}
+		if required, ok := androidAttr(attrs, "required"); ok && required == "false" {
+			name += " (optional)"
+		}
+		meta.Features = append(meta.Features, name)
+
+	case "application":
+		if debuggable, ok := androidAttr(attrs, "debuggable"); ok {
+			meta.Debuggable = debuggable == "true"
+		}
+
+	case "activity", "activity-alias":
+		name, _ := androidAttr(attrs, "name")
+		listener.activity = listener.className(name)
+
+	case "intent-filter":
+		listener.isMain = false
+		listener.isLauncher = false
+
+	case "action":
+		if name, _ := androidAttr(attrs, "name"); name == "android.intent.action.MAIN" {
+			listener.isMain = true
+		}
+
+	case "category":
+		if name, _ := androidAttr(attrs, "name"); name == "android.intent.category.LAUNCHER" {
+			listener.isLauncher = true
+		}
+	}
+}
+
+func (listener *ManifestListener) EndElement(uri, localName, qName string) {
+	switch localName {
+	case "intent-filter":
+		if listener.isMain && listener.isLauncher && listener.Metadata.LauncherActivity == "" {
+			listener.Metadata.LauncherActivity = listener.activity
+		}
+	case "activity", "activity-alias":
+		listener.activity = ""
+	}
+}
+
+// ParseApk 解析apk中的AndroidManifest.xml, native库的ABI以及签名证书
+func ParseApk(name string) (*models.ApkMetadata, error) {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var manifest *zip.File
+	abis := make(map[string]bool)
+	for _, f := range r.File {
+		switch {
+		case f.Name == "AndroidManifest.xml":
+			manifest = f
+		case strings.HasPrefix(f.Name, "lib/") && strings.HasSuffix(f.Name, ".so"):
+			// lib/<abi>/libxxx.so
+			if parts := strings.Split(f.Name, "/"); len(parts) == 3 {
+				abis[parts[1]] = true
+			}
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("AndroidManifest.xml not found")
+	}
+
+	rc, err := manifest.Open()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	listener := new(ManifestListener)
+	if err := parseAxml(data, listener); err != nil {
+		return nil, fmt.Errorf("AndroidManifest.xml: %v", err)
+	}
+	if listener.Metadata.PackageName == "" {
+		return nil, fmt.Errorf("package not found in AndroidManifest.xml")
+	}
+
+	meta := &listener.Metadata
+	for abi := range abis {
+		meta.Abis = append(meta.Abis, abi)
+	}
+	sort.Strings(meta.Abis)
+
+	signer, err := ReadApkSigner(name, r.File)
+	if err != nil {
+		return nil, fmt.Errorf("read signer certificate failed: %v", err)
+	}
+	if signer != nil {
+		meta.SignatureScheme = signer.Scheme
+		meta.SignerCertSHA256 = signer.CertSHA256
+		meta.SignerSubject = signer.Subject
+	}
+	return meta, nil
+}
+
+// parseAxml axmlParser在遇到无法识别的数据时可能panic
+func parseAxml(data []byte, listener axmlParser.Listener) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid binary xml: %v", r)
+		}
+	}()
+	return axmlParser.New(listener).Parse(data)
+}
+
+// isSignatureFile META-INF/CERT.RSA, META-INF/CERT.DSA, META-INF/CERT.EC
+func isSignatureFile(name string) bool {
+	if path.Dir(name) != "META-INF" {
+		return false
+	}
+	switch strings.ToUpper(path.Ext(name)) {
+	case ".RSA", ".DSA", ".EC":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,352 @@
+package backends
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+//
+// apk的签名: v1(JAR签名, META-INF/*.RSA) 以及 v2/v3(APK Signing Block)
+// 参考: https://source.android.com/security/apksigning/v2
+//
+
+const (
+	apkSigBlockMagic = "APK Sig Block 42"
+	apkSigV2BlockId  = 0x7109871a
+	apkSigV3BlockId  = 0xf05368c0
+
+	zipEocdSignature = 0x06054b50
+	zipEocdMinSize   = 22
+)
+
+// ApkSigner 签名者的证书
+type ApkSigner struct {
+	// v1, v2, v3
+	Scheme string
+	// 证书(DER)的SHA-256
+	CertSHA256  string
+	Subject     string
+	Certificate []byte
+}
+
+func newApkSigner(scheme string, cert []byte) *ApkSigner {
+	sum := sha256.Sum256(cert)
+	signer := &ApkSigner{
+		Scheme:      scheme,
+		CertSHA256:  hex.EncodeToString(sum[:]),
+		Certificate: cert,
+	}
+	if c, err := x509.ParseCertificate(cert); err == nil {
+		signer.Subject = c.Subject.String()
+	}
+	return signer
+}
+
+// ReadApkSigner 返回apk的签名证书, 优先使用v3, v2, 最后是v1; 没有签名时返回nil
+func ReadApkSigner(name string, files []*zip.File) (*ApkSigner, error) {
+	block, err := readApkSigningBlock(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, scheme := range []struct {
+		name string
+		id   uint32
+	}{{"v3", apkSigV3BlockId}, {"v2", apkSigV2BlockId}} {
+		value, ok := block[scheme.id]
+		if !ok {
+			continue
+		}
+		signers, err := parseApkV2Signers(value, scheme.id == apkSigV3BlockId)
+		if err != nil {
+			return nil, fmt.Errorf("%s signature: %v", scheme.name, err)
+		}
+		if len(signers) > 0 && len(signers[0].Certificates) > 0 {
+			return newApkSigner(scheme.name, signers[0].Certificates[0]), nil
+		}
+	}
+
+	for _, f := range files {
+		if !isSignatureFile(f.Name) {
+			continue
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := parsePkcs7Certificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		if len(certs) > 0 {
+			return newApkSigner("v1", certs[0]), nil
+		}
+	}
+	return nil, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// zipCentralDirectory 返回central directory的位置, 以及EOCD的位置
+func zipCentralDirectory(f *os.File) (cdOffset int64, eocdOffset int64, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := info.Size()
+
+	// EOCD在文件末尾, 之后最多有65535字节的注释
+	tailSize := int64(zipEocdMinSize + 65535)
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	if _, err := f.ReadAt(tail, size-tailSize); err != nil {
+		return 0, 0, err
+	}
+	for i := len(tail) - zipEocdMinSize; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) == zipEocdSignature {
+			eocdOffset = size - tailSize + int64(i)
+			cdOffset = int64(binary.LittleEndian.Uint32(tail[i+16:]))
+			if cdOffset > eocdOffset {
+				return 0, 0, fmt.Errorf("invalid central directory offset")
+			}
+			return cdOffset, eocdOffset, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("zip end of central directory not found")
+}
+
+// readApkSigningBlock 读取central directory之前的APK Signing Block, 返回 id => value
+func readApkSigningBlock(name string) (map[uint32][]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cdOffset, _, err := zipCentralDirectory(f)
+	if err != nil {
+		return nil, err
+	}
+	block, _, err := apkSigningBlockAt(f, cdOffset)
+	return block, err
+}
+
+// apkSigningBlockAt 返回签名块的内容以及签名块的起始位置, 没有签名块时返回nil
+func apkSigningBlockAt(f io.ReaderAt, cdOffset int64) (map[uint32][]byte, int64, error) {
+	// | size (uint64) | pairs | size (uint64) | magic (16 bytes) |
+	if cdOffset < 32 {
+		return nil, 0, nil
+	}
+	footer := make([]byte, 24)
+	if _, err := f.ReadAt(footer, cdOffset-24); err != nil {
+		return nil, 0, err
+	}
+	if string(footer[8:]) != apkSigBlockMagic {
+		return nil, 0, nil
+	}
+
+	size := int64(binary.LittleEndian.Uint64(footer))
+	start := cdOffset - size - 8
+	if size < 24 || start < 0 {
+		return nil, 0, fmt.Errorf("invalid APK Signing Block size: %d", size)
+	}
+	data := make([]byte, size+8)
+	if _, err := f.ReadAt(data, start); err != nil {
+		return nil, 0, err
+	}
+	if int64(binary.LittleEndian.Uint64(data)) != size {
+		return nil, 0, fmt.Errorf("APK Signing Block sizes mismatch")
+	}
+
+	block := make(map[uint32][]byte)
+	pairs := data[8 : len(data)-24]
+	for len(pairs) > 0 {
+		if len(pairs) < 12 {
+			return nil, 0, fmt.Errorf("truncated APK Signing Block")
+		}
+		pairLen := binary.LittleEndian.Uint64(pairs)
+		if pairLen < 4 || pairLen > uint64(len(pairs)-8) {
+			return nil, 0, fmt.Errorf("invalid APK Signing Block pair size: %d", pairLen)
+		}
+		id := binary.LittleEndian.Uint32(pairs[8:])
+		block[id] = pairs[12 : 8+pairLen]
+		pairs = pairs[8+pairLen:]
+	}
+	return block, start, nil
+}
+
+// v2/v3中的签名者
+type apkV2Signer struct {
+	// 被签名的数据
+	SignedData   []byte
+	Digests      []apkSigValue
+	Certificates [][]byte
+	Signatures   []apkSigValue
+	PublicKey    []byte
+}
+
+// 算法以及对应的digest或者签名
+type apkSigValue struct {
+	Algorithm uint32
+	Value     []byte
+}
+
+// readLengthPrefixed 读取uint32长度前缀的数据
+func readLengthPrefixed(data []byte) (value []byte, rest []byte, err error) {
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("truncated length prefix")
+	}
+	n := binary.LittleEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return nil, nil, fmt.Errorf("length %d out of range", n)
+	}
+	return data[4 : 4+n], data[4+n:], nil
+}
+
+// readLengthPrefixedSequence 读取长度前缀的序列, 序列的每个元素也是长度前缀的
+func readLengthPrefixedSequence(data []byte) (items [][]byte, rest []byte, err error) {
+	seq, rest, err := readLengthPrefixed(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	for len(seq) > 0 {
+		var item []byte
+		if item, seq, err = readLengthPrefixed(seq); err != nil {
+			return nil, nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rest, nil
+}
+
+func parseSigValues(items [][]byte) ([]apkSigValue, error) {
+	values := make([]apkSigValue, 0, len(items))
+	for _, item := range items {
+		if len(item) < 4 {
+			return nil, fmt.Errorf("truncated algorithm id")
+		}
+		value, _, err := readLengthPrefixed(item[4:])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, apkSigValue{Algorithm: binary.LittleEndian.Uint32(item), Value: value})
+	}
+	return values, nil
+}
+
+// parseApkV2Signers 解析v2/v3签名块中的signers
+// v3的signer和signed data中多了minSdk/maxSdk, 其余的结构和v2相同
+func parseApkV2Signers(value []byte, v3 bool) ([]*apkV2Signer, error) {
+	items, _, err := readLengthPrefixedSequence(value)
+	if err != nil {
+		return nil, err
+	}
+
+	signers := make([]*apkV2Signer, 0, len(items))
+	for _, item := range items {
+		signer := new(apkV2Signer)
+
+		rest := item
+		if signer.SignedData, rest, err = readLengthPrefixed(rest); err != nil {
+			return nil, err
+		}
+		if v3 {
+			// minSdk, maxSdk
+			if len(rest) < 8 {
+				return nil, fmt.Errorf("truncated v3 signer")
+			}
+			rest = rest[8:]
+		}
+		signatures, rest, err := readLengthPrefixedSequence(rest)
+		if err != nil {
+			return nil, err
+		}
+		if signer.Signatures, err = parseSigValues(signatures); err != nil {
+			return nil, err
+		}
+		if signer.PublicKey, _, err = readLengthPrefixed(rest); err != nil {
+			return nil, err
+		}
+
+		// signed data: digests, certificates, (v3: minSdk, maxSdk), additional attributes
+		digests, signedRest, err := readLengthPrefixedSequence(signer.SignedData)
+		if err != nil {
+			return nil, err
+		}
+		if signer.Digests, err = parseSigValues(digests); err != nil {
+			return nil, err
+		}
+		if signer.Certificates, _, err = readLengthPrefixedSequence(signedRest); err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// PKCS#7 SignedData, 参考 RFC 2315
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+var oidPkcs7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+func parsePkcs7SignedData(data []byte) (*pkcs7SignedData, error) {
+	var info pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	if !info.ContentType.Equal(oidPkcs7SignedData) {
+		return nil, fmt.Errorf("not a PKCS#7 SignedData: %v", info.ContentType)
+	}
+	var signedData pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &signedData); err != nil {
+		return nil, err
+	}
+	return &signedData, nil
+}
+
+// parsePkcs7Certificates 返回PKCS#7中的所有证书(DER)
+func parsePkcs7Certificates(data []byte) ([][]byte, error) {
+	signedData, err := parsePkcs7SignedData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs [][]byte
+	rest := signedData.Certificates.Bytes
+	for len(rest) > 0 {
+		var cert asn1.RawValue
+		if rest, err = asn1.Unmarshal(rest, &cert); err != nil {
+			return nil, err
+		}
+		certs = append(certs, append([]byte(nil), cert.FullBytes...))
+	}
+	return certs, nil
+}
@@ -0,0 +1,161 @@
+package backends
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCertificate(t *testing.T, cn string) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return key, cert
+}
+
+func lengthPrefixed(items ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, item := range items {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(item)))
+		buf.Write(item)
+	}
+	return buf.Bytes()
+}
+
+// insertSigningBlock 在central directory之前插入APK Signing Block
+func insertSigningBlock(t *testing.T, apk []byte, pairs map[uint32][]byte) []byte {
+	var body bytes.Buffer
+	for id, value := range pairs {
+		binary.Write(&body, binary.LittleEndian, uint64(len(value)+4))
+		binary.Write(&body, binary.LittleEndian, id)
+		body.Write(value)
+	}
+	size := uint64(body.Len() + 24)
+
+	var block bytes.Buffer
+	binary.Write(&block, binary.LittleEndian, size)
+	block.Write(body.Bytes())
+	binary.Write(&block, binary.LittleEndian, size)
+	block.WriteString(apkSigBlockMagic)
+
+	eocd := bytes.LastIndex(apk, []byte{0x50, 0x4b, 0x05, 0x06})
+	assert.True(t, eocd > 0)
+	cdOffset := binary.LittleEndian.Uint32(apk[eocd+16:])
+
+	result := append([]byte(nil), apk[:cdOffset]...)
+	result = append(result, block.Bytes()...)
+	result = append(result, apk[cdOffset:]...)
+	binary.LittleEndian.PutUint32(result[eocd+block.Len()+16:], cdOffset+uint32(block.Len()))
+	return result
+}
+
+func testZip(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range files {
+		f, err := w.Create(name)
+		assert.NoError(t, err)
+		f.Write(data)
+	}
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func fingerprint(cert []byte) string {
+	sum := sha256.Sum256(cert)
+	return hex.EncodeToString(sum[:])
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestReadApkSigner"
+//
+func TestReadApkSigner(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apk")
+	defer os.RemoveAll(dir)
+
+	_, v1Cert := testCertificate(t, "v1 signer")
+	_, v2Cert := testCertificate(t, "v2 signer")
+
+	// v1: PKCS#7 SignedData 中只包含证书
+	signedData, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue `asn1:"tag:0"`
+		SignerInfos      asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true},
+		ContentInfo:      asn1.RawValue{FullBytes: []byte{0x30, 0x0b, 0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x07, 0x01}},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: v1Cert},
+		SignerInfos:      asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true},
+	})
+	assert.NoError(t, err)
+	pkcs7, err := asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidPkcs7SignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+	assert.NoError(t, err)
+
+	apk := testZip(t, map[string][]byte{
+		"AndroidManifest.xml":  []byte("manifest"),
+		"META-INF/MANIFEST.MF": []byte("Manifest-Version: 1.0\r\n\r\n"),
+		"META-INF/CERT.RSA":    pkcs7,
+	})
+	v1Path := path.Join(dir, "v1.apk")
+	ioutil.WriteFile(v1Path, apk, 0644)
+
+	r, err := zip.OpenReader(v1Path)
+	assert.NoError(t, err)
+	signer, err := ReadApkSigner(v1Path, r.File)
+	r.Close()
+	assert.NoError(t, err)
+	if assert.NotNil(t, signer) {
+		assert.Equal(t, "v1", signer.Scheme)
+		assert.Equal(t, fingerprint(v1Cert), signer.CertSHA256)
+		assert.Equal(t, "CN=v1 signer", signer.Subject)
+	}
+
+	// v2签名块优先于v1
+	// signed data: digests, certificates, additional attributes
+	signedDataV2 := lengthPrefixed([]byte{}, lengthPrefixed(v2Cert), []byte{})
+	// signer: signed data, signatures, public key
+	v2Signer := lengthPrefixed(signedDataV2, []byte{}, []byte("public key"))
+	v2Path := path.Join(dir, "v2.apk")
+	ioutil.WriteFile(v2Path, insertSigningBlock(t, apk, map[uint32][]byte{
+		apkSigV2BlockId: lengthPrefixed(lengthPrefixed(v2Signer)),
+	}), 0644)
+
+	r, err = zip.OpenReader(v2Path)
+	assert.NoError(t, err)
+	signer, err = ReadApkSigner(v2Path, r.File)
+	r.Close()
+	assert.NoError(t, err)
+	if assert.NotNil(t, signer) {
+		assert.Equal(t, "v2", signer.Scheme)
+		assert.Equal(t, fingerprint(v2Cert), signer.CertSHA256)
+	}
+}
@@ -0,0 +1,225 @@
+package backends
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.chunyu.me/feiwang/appserver/models"
+)
+
+//
+// 一个Android Build可以包含多个apk:
+//   app.apk       默认的apk(一般为universal)
+//   app-*.apk     按照flavor/ABI/density区分的apk, 例如: app-arm64-v8a.apk, app-free-x86.apk, app-xxhdpi.apk
+//
+// ABI从apk中的native库获取; density和flavor从文件名中获取, 也可以在app.json中指定:
+//   "variants": {"app-free-arm64-v8a.apk": {"flavor": "free", "density": ""}}
+//
+
+var apkVariantRegexp = regexp.MustCompile(`^app-[\w.-]+\.apk$`)
+
+// 按照长度降序, 避免armeabi匹配armeabi-v7a
+var knownAbis = []string{"armeabi-v7a", "arm64-v8a", "x86_64", "armeabi", "mips64", "mips", "x86"}
+
+// density以及对应的最大dpi
+var apkDensities = []struct {
+	Name string
+	Dpi  int
+}{
+	{"ldpi", 120}, {"mdpi", 160}, {"tvdpi", 213}, {"hdpi", 240},
+	{"xhdpi", 320}, {"xxhdpi", 480}, {"xxxhdpi", 640},
+}
+
+// IsApkArtifactFile app.apk或者app-*.apk
+func IsApkArtifactFile(name string) bool {
+	return name == "app.apk" || apkVariantRegexp.MatchString(name)
+}
+
+// ApkArtifactFiles 返回App目录中的所有apk, app.apk在最前面, 其他的按照文件名排序
+func ApkArtifactFiles(appDir string) ([]string, error) {
+	names, err := filepath.Glob(path.Join(appDir, "app-*.apk"))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range names {
+		if apkVariantRegexp.MatchString(filepath.Base(name)) {
+			files = append(files, filepath.Base(name))
+		}
+	}
+	sort.Strings(files)
+	if IsExist(path.Join(appDir, "app.apk")) {
+		files = append([]string{"app.apk"}, files...)
+	}
+	return files, nil
+}
+
+// parseVariantName 从文件名中获取flavor和density, ABI相关的部分忽略
+// 例如: app-free-release-arm64-v8a-xxhdpi.apk => free-release, xxhdpi
+func parseVariantName(file string) (flavor string, density string) {
+	if file == "app.apk" {
+		return "", ""
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(file, "app-"), ".apk")
+	for _, abi := range knownAbis {
+		name = strings.Replace(name, abi, "", -1)
+	}
+
+	var tokens []string
+	for _, token := range strings.Split(name, "-") {
+		switch {
+		case token == "" || token == "universal":
+		case densityDpi(token) > 0:
+			density = token
+		default:
+			tokens = append(tokens, token)
+		}
+	}
+	return strings.Join(tokens, "-"), density
+}
+
+func densityDpi(density string) int {
+	for _, d := range apkDensities {
+		if d.Name == density {
+			return d.Dpi
+		}
+	}
+	return 0
+}
+
+// artifactLabel 页面上显示的名字, 例如: free arm64-v8a xxhdpi, 没有任何区分时为universal
+func artifactLabel(artifact *models.ApkArtifact) string {
+	var parts []string
+	if artifact.Flavor != "" {
+		parts = append(parts, artifact.Flavor)
+	}
+	if len(artifact.Abis) == 1 {
+		parts = append(parts, artifact.Abis[0])
+	} else if artifact.Density == "" {
+		parts = append(parts, "universal")
+	}
+	if artifact.Density != "" {
+		parts = append(parts, artifact.Density)
+	}
+	return strings.Join(parts, " ")
+}
+
+// newApkArtifact 根据apk的元数据以及app.json中的variants生成ApkArtifact
+func newApkArtifact(apiBase string, appId string, file string, info os.FileInfo, apkMeta *models.ApkMetadata,
+	variants map[string]interface{}) *models.ApkArtifact {
+
+	artifact := &models.ApkArtifact{
+		File:        file,
+		Url:         fmt.Sprintf("%s/apk/%s/%s", apiBase, appId, file),
+		Abis:        apkMeta.Abis,
+		VersionCode: apkMeta.VersionCode,
+		Size:        formatSize(info.Size()),
+		SizeBytes:   info.Size(),
+	}
+	artifact.Flavor, artifact.Density = parseVariantName(file)
+	if variant, ok := variants[file].(map[string]interface{}); ok {
+		if flavor, ok := variant["flavor"].(string); ok {
+			artifact.Flavor = flavor
+		}
+		if density, ok := variant["density"].(string); ok {
+			artifact.Density = density
+		}
+	}
+	artifact.Label = artifactLabel(artifact)
+	return artifact
+}
+
+// ApkHints 下载时用于选择apk的设备信息, 为空时表示未知
+type ApkHints struct {
+	Abi     string
+	Density string
+	Flavor  string
+}
+
+// User-Agent中的CPU架构, 例如: Linux; Android 7.0; aarch64 或者 Linux armv7l
+var userAgentAbis = []struct {
+	Pattern *regexp.Regexp
+	Abi     string
+}{
+	{regexp.MustCompile(`(?i)\b(aarch64|arm64)\b`), "arm64-v8a"},
+	{regexp.MustCompile(`(?i)\b(armv7\w*|armv8l)\b`), "armeabi-v7a"},
+	{regexp.MustCompile(`(?i)\bx86_64\b`), "x86_64"},
+	{regexp.MustCompile(`(?i)\b(i[3-6]86|x86)\b`), "x86"},
+}
+
+// ApkHintsFromRequest 从User-Agent中获取ABI, 从DPR(Client Hints)中获取density
+func ApkHintsFromRequest(userAgent string, dpr string) ApkHints {
+	var hints ApkHints
+	for _, ua := range userAgentAbis {
+		if ua.Pattern.MatchString(userAgent) {
+			hints.Abi = ua.Abi
+			break
+		}
+	}
+	if ratio, err := strconv.ParseFloat(dpr, 64); err == nil && ratio > 0 {
+		dpi := int(ratio * 160)
+		for _, d := range apkDensities {
+			hints.Density = d.Name
+			if dpi <= d.Dpi {
+				break
+			}
+		}
+	}
+	return hints
+}
+
+// PickApkArtifact 选择最适合设备的apk:
+//   排除ABI, density或者flavor不匹配的apk, 没有指定flavor时只考虑和默认apk相同的flavor
+//   ABI(density)已知时优先选择对应的split, 未知时优先选择universal
+//   都不匹配时返回默认的apk
+func PickApkArtifact(artifacts []*models.ApkArtifact, hints ApkHints) *models.ApkArtifact {
+	if len(artifacts) == 0 {
+		return nil
+	}
+	flavor := hints.Flavor
+	if flavor == "" {
+		flavor = artifacts[0].Flavor
+	}
+
+	var best *models.ApkArtifact
+	bestScore := -1
+	for _, a := range artifacts {
+		if a.Flavor != flavor {
+			continue
+		}
+		score := 0
+		switch {
+		case hints.Abi == "" && len(a.Abis) != 1:
+			score += 2
+		case hints.Abi == "" || len(a.Abis) == 0:
+		case !containsString(a.Abis, hints.Abi):
+			continue
+		case len(a.Abis) == 1:
+			score += 2
+		}
+		switch {
+		case a.Density == "":
+			if hints.Density == "" {
+				score++
+			}
+		case hints.Density == "":
+		case a.Density != hints.Density:
+			continue
+		default:
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = a, score
+		}
+	}
+	if best == nil {
+		return artifacts[0]
+	}
+	return best
+}
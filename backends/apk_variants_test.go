@@ -0,0 +1,77 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestApkVariants"
+//
+func TestApkVariants(t *testing.T) {
+	for file, expected := range map[string][2]string{
+		"app.apk":                     {"", ""},
+		"app-universal.apk":           {"", ""},
+		"app-arm64-v8a.apk":           {"", ""},
+		"app-armeabi-v7a-xxhdpi.apk":  {"", "xxhdpi"},
+		"app-free-release-x86_64.apk": {"free-release", ""},
+		"app-paid-armeabi-xhdpi.apk":  {"paid", "xhdpi"},
+	} {
+		flavor, density := parseVariantName(file)
+		assert.Equal(t, expected[0], flavor, file)
+		assert.Equal(t, expected[1], density, file)
+	}
+
+	assert.True(t, IsApkArtifactFile("app.apk"))
+	assert.True(t, IsApkArtifactFile("app-x86.apk"))
+	assert.False(t, IsApkArtifactFile("app-.apk"))
+	assert.False(t, IsApkArtifactFile("../app.json"))
+
+	dir, _ := ioutil.TempDir("", "variants")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"app-x86.apk", "app.apk", "app-arm64-v8a.apk", "app.json", "app-x86.apk.tmp"} {
+		ioutil.WriteFile(path.Join(dir, name), nil, 0644)
+	}
+	files, err := ApkArtifactFiles(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"app.apk", "app-arm64-v8a.apk", "app-x86.apk"}, files)
+
+	artifact := &models.ApkArtifact{Flavor: "free", Abis: []string{"arm64-v8a"}, Density: "xxhdpi"}
+	assert.Equal(t, "free arm64-v8a xxhdpi", artifactLabel(artifact))
+	assert.Equal(t, "universal", artifactLabel(&models.ApkArtifact{Abis: []string{"x86", "arm64-v8a"}}))
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestPickApkArtifact"
+//
+func TestPickApkArtifact(t *testing.T) {
+	assert.Equal(t, ApkHints{Abi: "arm64-v8a", Density: "xxhdpi"},
+		ApkHintsFromRequest("Mozilla/5.0 (Linux; Android 7.0; SM-G930F Build/NRD90M; aarch64)", "3"))
+	assert.Equal(t, ApkHints{Abi: "armeabi-v7a", Density: "xhdpi"},
+		ApkHintsFromRequest("Mozilla/5.0 (Linux; U; Android 4.4.2; zh-cn; armv7l)", "2"))
+	assert.Equal(t, ApkHints{Abi: "x86_64", Density: "hdpi"}, ApkHintsFromRequest("Mozilla/5.0 (X11; Linux x86_64)", "1.5"))
+	assert.Equal(t, ApkHints{Abi: "x86"}, ApkHintsFromRequest("Mozilla/5.0 (Linux; Android 4.4; i686)", ""))
+	assert.Equal(t, ApkHints{Density: "xxxhdpi"}, ApkHintsFromRequest("Mozilla/5.0 (Linux; Android 9; K)", "5"))
+
+	universal := &models.ApkArtifact{File: "app.apk", Abis: []string{"arm64-v8a", "armeabi-v7a", "x86"}}
+	arm64 := &models.ApkArtifact{File: "app-arm64-v8a.apk", Abis: []string{"arm64-v8a"}}
+	armv7 := &models.ApkArtifact{File: "app-armeabi-v7a.apk", Abis: []string{"armeabi-v7a"}}
+	arm64Hdpi := &models.ApkArtifact{File: "app-arm64-v8a-xxhdpi.apk", Abis: []string{"arm64-v8a"}, Density: "xxhdpi"}
+	free := &models.ApkArtifact{File: "app-free.apk", Flavor: "free", Abis: []string{"arm64-v8a", "x86"}}
+	artifacts := []*models.ApkArtifact{universal, arm64, armv7, arm64Hdpi, free}
+
+	assert.Equal(t, universal, PickApkArtifact(artifacts, ApkHints{}))
+	assert.Equal(t, arm64, PickApkArtifact(artifacts, ApkHints{Abi: "arm64-v8a"}))
+	assert.Equal(t, arm64Hdpi, PickApkArtifact(artifacts, ApkHints{Abi: "arm64-v8a", Density: "xxhdpi"}))
+	assert.Equal(t, arm64, PickApkArtifact(artifacts, ApkHints{Abi: "arm64-v8a", Density: "mdpi"}))
+	assert.Equal(t, universal, PickApkArtifact(artifacts, ApkHints{Abi: "x86"}))
+	assert.Equal(t, free, PickApkArtifact(artifacts, ApkHints{Abi: "x86", Flavor: "free"}))
+	// 没有匹配的apk时返回默认的apk
+	assert.Equal(t, universal, PickApkArtifact(artifacts, ApkHints{Abi: "mips"}))
+	assert.Nil(t, PickApkArtifact(nil, ApkHints{}))
+}
@@ -0,0 +1,778 @@
+package backends
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/astaxie/beego"
+)
+
+//
+// apk的签名校验, 在app.conf中配置:
+//   apk_signature_policy: off 不校验, warn 只标记有问题的Build(默认), reject 不发布签名有问题的Build
+//   ios_signature_policy: 同上, 用于ipa的签名和profile的校验
+//   apk_signer_fingerprints: 每个App期望的签名证书的SHA-256, 例如: me.chunyu.demo:97:91:a8...;me.chunyu.demo:<新证书>
+//
+
+const (
+	SignaturePolicyOff    = "off"
+	SignaturePolicyWarn   = "warn"
+	SignaturePolicyReject = "reject"
+)
+
+// 最多列出的问题的数目, 避免一个损坏的apk产生几千条记录
+const maxSignatureProblems = 10
+
+func signaturePolicy(key string) string {
+	switch policy := strings.ToLower(beego.AppConfig.String(key)); policy {
+	case SignaturePolicyOff, SignaturePolicyReject:
+		return policy
+	}
+	return SignaturePolicyWarn
+}
+
+func ApkSignaturePolicy() string {
+	return signaturePolicy("apk_signature_policy")
+}
+
+func IosSignaturePolicy() string {
+	return signaturePolicy("ios_signature_policy")
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(fingerprint), ":", "", -1))
+}
+
+// ExpectedSignerFingerprints 返回App允许的签名证书, 没有配置时返回nil
+func ExpectedSignerFingerprints(packageName string) []string {
+	var fingerprints []string
+	for _, item := range ConfigStrings("apk_signer_fingerprints") {
+		idx := strings.Index(item, ":")
+		if idx <= 0 || strings.TrimSpace(item[:idx]) != packageName {
+			continue
+		}
+		fingerprints = append(fingerprints, normalizeFingerprint(item[idx+1:]))
+	}
+	return fingerprints
+}
+
+// ApkVerifyResult 签名校验的结果
+type ApkVerifyResult struct {
+	// 校验通过的签名方案, 例如: [v1 v2]
+	Verified []string
+	Problems []string
+	Signer   *ApkSigner
+}
+
+func (r *ApkVerifyResult) addProblem(format string, a ...interface{}) {
+	if len(r.Problems) < maxSignatureProblems {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, a...))
+	} else if len(r.Problems) == maxSignatureProblems {
+		r.Problems = append(r.Problems, "...")
+	}
+}
+
+// checkSigner 检查签名证书的一致性, 以及是否为期望的证书
+func (r *ApkVerifyResult) checkSigner(scheme string, cert []byte) {
+	signer := newApkSigner(scheme, cert)
+	if r.Signer == nil {
+		r.Signer = signer
+	} else if r.Signer.CertSHA256 != signer.CertSHA256 {
+		r.addProblem("%s signer %s differs from %s signer %s", scheme, signer.CertSHA256, r.Signer.Scheme, r.Signer.CertSHA256)
+	}
+}
+
+// VerifyApk 校验apk的v1, v2, v3签名, 以及签名证书是否为期望的证书
+// 只有在读取文件失败时返回error, 签名的问题记录在Problems中
+func VerifyApk(name string, packageName string) (*ApkVerifyResult, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(ApkVerifyResult)
+
+	cdOffset, eocdOffset, err := zipCentralDirectory(f)
+	if err != nil {
+		return nil, err
+	}
+	block, blockStart, err := apkSigningBlockAt(f, cdOffset)
+	if err != nil {
+		result.addProblem("%v", err)
+	}
+
+	// v3优先, v2和v3的证书应该相同(没有key rotation时)
+	for _, scheme := range []struct {
+		name string
+		id   uint32
+	}{{"v3", apkSigV3BlockId}, {"v2", apkSigV2BlockId}} {
+		value, ok := block[scheme.id]
+		if !ok {
+			continue
+		}
+		sections := apkContentSections{f: f, blockStart: blockStart, cdOffset: cdOffset, eocdOffset: eocdOffset, size: info.Size()}
+		cert, err := verifyApkV2Block(value, scheme.id == apkSigV3BlockId, &sections)
+		if err != nil {
+			result.addProblem("%s signature: %v", scheme.name, err)
+			continue
+		}
+		result.Verified = append(result.Verified, scheme.name)
+		result.checkSigner(scheme.name, cert)
+	}
+
+	hasV1, stripped := verifyApkV1(r.File, result)
+	if !hasV1 && len(block) == 0 {
+		result.addProblem("apk is not signed")
+	}
+	// v1签名声明了有v2签名, 但是v2签名块被删除了
+	if stripped && block[apkSigV2BlockId] == nil && block[apkSigV3BlockId] == nil {
+		result.addProblem("v2 signature is stripped")
+	}
+
+	if result.Signer != nil {
+		if expected := ExpectedSignerFingerprints(packageName); len(expected) > 0 {
+			matched := false
+			for _, fingerprint := range expected {
+				if fingerprint == result.Signer.CertSHA256 {
+					matched = true
+				}
+			}
+			if !matched {
+				result.addProblem("signer %s is not the expected certificate of %s", result.Signer.CertSHA256, packageName)
+			}
+		}
+	}
+	return result, nil
+}
+
+// 缓存校验的结果, 扫描时不需要每次都重新计算整个apk的digest
+var apkVerifyCache = newFileCache()
+
+// CachedVerifyApk 文件没有变化时返回上次校验的结果
+func CachedVerifyApk(name string, packageName string, info os.FileInfo) (*ApkVerifyResult, error) {
+	if result, ok := apkVerifyCache.get(name, info); ok {
+		return result.(*ApkVerifyResult), nil
+	}
+	result, err := VerifyApk(name, packageName)
+	if err != nil {
+		return nil, err
+	}
+	apkVerifyCache.put(name, info, result)
+	return result, nil
+}
+
+//
+// v2/v3
+//
+
+// 签名算法, 参考: https://source.android.com/security/apksigning/v2#signature-algorithm-ids
+const (
+	apkSigRsaPssSha256   = 0x0101
+	apkSigRsaPssSha512   = 0x0102
+	apkSigRsaPkcs1Sha256 = 0x0103
+	apkSigRsaPkcs1Sha512 = 0x0104
+	apkSigEcdsaSha256    = 0x0201
+	apkSigEcdsaSha512    = 0x0202
+	apkSigDsaSha256      = 0x0301
+)
+
+func apkSigHash(algorithm uint32) (crypto.Hash, bool) {
+	switch algorithm {
+	case apkSigRsaPssSha256, apkSigRsaPkcs1Sha256, apkSigEcdsaSha256, apkSigDsaSha256:
+		return crypto.SHA256, true
+	case apkSigRsaPssSha512, apkSigRsaPkcs1Sha512, apkSigEcdsaSha512:
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+func newHash(h crypto.Hash) hash.Hash {
+	switch h {
+	case crypto.SHA1:
+		return sha1.New()
+	case crypto.SHA256:
+		return sha256.New()
+	case crypto.SHA384:
+		return sha512.New384()
+	}
+	return sha512.New()
+}
+
+func digestOf(h crypto.Hash, data []byte) []byte {
+	hh := newHash(h)
+	hh.Write(data)
+	return hh.Sum(nil)
+}
+
+// verifyApkV2Signature 使用公钥校验signed data的签名, 不支持的算法返回false
+func verifyApkV2Signature(pub interface{}, algorithm uint32, signed []byte, signature []byte) (bool, error) {
+	h, ok := apkSigHash(algorithm)
+	if !ok {
+		return false, nil
+	}
+	digest := digestOf(h, signed)
+
+	switch algorithm {
+	case apkSigRsaPssSha256, apkSigRsaPssSha512, apkSigRsaPkcs1Sha256, apkSigRsaPkcs1Sha512:
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return true, fmt.Errorf("public key is not RSA")
+		}
+		if algorithm == apkSigRsaPssSha256 || algorithm == apkSigRsaPssSha512 {
+			return true, rsa.VerifyPSS(key, h, digest, signature, &rsa.PSSOptions{SaltLength: h.Size()})
+		}
+		return true, rsa.VerifyPKCS1v15(key, h, digest, signature)
+
+	case apkSigEcdsaSha256, apkSigEcdsaSha512:
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return true, fmt.Errorf("public key is not ECDSA")
+		}
+		if !verifyEcdsa(key, digest, signature) {
+			return true, fmt.Errorf("ECDSA signature mismatch")
+		}
+		return true, nil
+	}
+	// DSA
+	return false, nil
+}
+
+func verifyEcdsa(key *ecdsa.PublicKey, digest []byte, signature []byte) bool {
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+		return false
+	}
+	return ecdsa.Verify(key, digest, sig.R, sig.S)
+}
+
+// verifyApkV2Block 校验v2/v3签名块, 返回第一个signer的证书
+func verifyApkV2Block(value []byte, v3 bool, sections *apkContentSections) ([]byte, error) {
+	signers, err := parseApkV2Signers(value, v3)
+	if err != nil {
+		return nil, err
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no signers")
+	}
+
+	contentDigests := make(map[crypto.Hash][]byte)
+	for i, signer := range signers {
+		if len(signer.Certificates) == 0 {
+			return nil, fmt.Errorf("signer #%d: no certificates", i+1)
+		}
+		pub, err := x509.ParsePKIXPublicKey(signer.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("signer #%d: %v", i+1, err)
+		}
+		cert, err := x509.ParseCertificate(signer.Certificates[0])
+		if err != nil {
+			return nil, fmt.Errorf("signer #%d: %v", i+1, err)
+		}
+		if !bytes.Equal(cert.RawSubjectPublicKeyInfo, signer.PublicKey) {
+			return nil, fmt.Errorf("signer #%d: public key does not match the certificate", i+1)
+		}
+
+		// 签名的算法必须和digest的算法一致
+		if len(signer.Signatures) != len(signer.Digests) {
+			return nil, fmt.Errorf("signer #%d: signatures and digests mismatch", i+1)
+		}
+
+		verified := 0
+		for j, sig := range signer.Signatures {
+			if signer.Digests[j].Algorithm != sig.Algorithm {
+				return nil, fmt.Errorf("signer #%d: signatures and digests mismatch", i+1)
+			}
+			supported, err := verifyApkV2Signature(pub, sig.Algorithm, signer.SignedData, sig.Value)
+			if !supported {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("signer #%d: algorithm %#04x: %v", i+1, sig.Algorithm, err)
+			}
+
+			h, _ := apkSigHash(sig.Algorithm)
+			if contentDigests[h] == nil {
+				if contentDigests[h], err = sections.digest(h); err != nil {
+					return nil, err
+				}
+			}
+			if !bytes.Equal(contentDigests[h], signer.Digests[j].Value) {
+				return nil, fmt.Errorf("signer #%d: apk content digest mismatch", i+1)
+			}
+			verified++
+		}
+		if verified == 0 {
+			return nil, fmt.Errorf("signer #%d: no supported signature algorithm", i+1)
+		}
+	}
+	return signers[0].Certificates[0], nil
+}
+
+// apkContentSections v2签名保护的三部分: zip entries, central directory, EOCD
+type apkContentSections struct {
+	f          io.ReaderAt
+	blockStart int64
+	cdOffset   int64
+	eocdOffset int64
+	size       int64
+}
+
+const apkDigestChunkSize = 1024 * 1024
+
+// digest 按照1M分块计算digest, 最后再计算所有分块digest的digest
+func (s *apkContentSections) digest(h crypto.Hash) ([]byte, error) {
+	eocd := make([]byte, s.size-s.eocdOffset)
+	if _, err := s.f.ReadAt(eocd, s.eocdOffset); err != nil {
+		return nil, err
+	}
+	// EOCD中central directory的位置替换为签名块的位置
+	binary.LittleEndian.PutUint32(eocd[16:], uint32(s.blockStart))
+
+	readers := []io.Reader{
+		io.NewSectionReader(s.f, 0, s.blockStart),
+		io.NewSectionReader(s.f, s.cdOffset, s.eocdOffset-s.cdOffset),
+		bytes.NewReader(eocd),
+	}
+
+	var chunkDigests bytes.Buffer
+	chunks := 0
+	buf := make([]byte, apkDigestChunkSize)
+	prefix := make([]byte, 5)
+	for _, r := range readers {
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				hh := newHash(h)
+				prefix[0] = 0xa5
+				binary.LittleEndian.PutUint32(prefix[1:], uint32(n))
+				hh.Write(prefix)
+				hh.Write(buf[:n])
+				chunkDigests.Write(hh.Sum(nil))
+				chunks++
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	hh := newHash(h)
+	prefix[0] = 0x5a
+	binary.LittleEndian.PutUint32(prefix[1:], uint32(chunks))
+	hh.Write(prefix)
+	hh.Write(chunkDigests.Bytes())
+	return hh.Sum(nil), nil
+}
+
+//
+// v1 (JAR签名)
+//
+
+// manifest中的一个section, Raw包含结尾的空行
+type jarSection struct {
+	Name  string
+	Attrs map[string]string
+	Raw   []byte
+}
+
+// parseJarManifest 解析MANIFEST.MF或者*.SF, 第一个section为main attributes
+func parseJarManifest(data []byte) []*jarSection {
+	var sections []*jarSection
+	current := &jarSection{Attrs: make(map[string]string)}
+	start := 0
+	lastKey := ""
+
+	reader := bufio.NewReader(bytes.NewReader(data))
+	offset := 0
+	for {
+		line, err := reader.ReadString('\n')
+		offset += len(line)
+		trimmed := strings.TrimRight(line, "\r\n")
+
+		if trimmed == "" && line != "" {
+			// 空行表示section结束
+			current.Raw = data[start:offset]
+			sections = append(sections, current)
+			current = &jarSection{Attrs: make(map[string]string)}
+			start = offset
+			lastKey = ""
+		} else if strings.HasPrefix(trimmed, " ") && lastKey != "" {
+			// 超过72字节的行被折行, 以空格开头
+			current.Attrs[lastKey] += trimmed[1:]
+			if lastKey == "Name" {
+				current.Name = current.Attrs[lastKey]
+			}
+		} else if idx := strings.Index(trimmed, ": "); idx > 0 {
+			lastKey = trimmed[:idx]
+			current.Attrs[lastKey] = trimmed[idx+2:]
+			if lastKey == "Name" {
+				current.Name = current.Attrs[lastKey]
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+	if start < len(data) {
+		current.Raw = data[start:]
+		sections = append(sections, current)
+	}
+	return sections
+}
+
+// 按照从强到弱的顺序
+var jarDigestAlgorithms = []struct {
+	name string
+	hash crypto.Hash
+}{
+	{"SHA-512", crypto.SHA512},
+	{"SHA-384", crypto.SHA384},
+	{"SHA-256", crypto.SHA256},
+	{"SHA1", crypto.SHA1},
+	{"SHA-1", crypto.SHA1},
+}
+
+// jarDigest 返回attrs中最强的digest, 例如: SHA-256-Digest; suffix为"-Digest"或者"-Digest-Manifest"
+func jarDigest(attrs map[string]string, suffix string) (crypto.Hash, []byte, bool) {
+	for _, alg := range jarDigestAlgorithms {
+		if value, ok := attrs[alg.name+suffix]; ok {
+			digest, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return 0, nil, false
+			}
+			return alg.hash, digest, true
+		}
+	}
+	return 0, nil, false
+}
+
+// v1签名中被排除的文件
+func isJarSignatureFile(name string) bool {
+	if name == "META-INF/MANIFEST.MF" {
+		return true
+	}
+	if path.Dir(name) != "META-INF" {
+		return false
+	}
+	return isSignatureFile(name) || strings.ToUpper(path.Ext(name)) == ".SF"
+}
+
+// verifyApkV1 校验JAR签名; 返回是否有v1签名, 以及.SF是否声明了v2签名
+func verifyApkV1(files []*zip.File, result *ApkVerifyResult) (hasV1 bool, stripped bool) {
+	entries := make(map[string]*zip.File)
+	var sfFiles []*zip.File
+	for _, f := range files {
+		entries[f.Name] = f
+		if path.Dir(f.Name) == "META-INF" && strings.ToUpper(path.Ext(f.Name)) == ".SF" {
+			sfFiles = append(sfFiles, f)
+		}
+	}
+	if len(sfFiles) == 0 {
+		return false, false
+	}
+
+	manifestFile := entries["META-INF/MANIFEST.MF"]
+	if manifestFile == nil {
+		result.addProblem("v1 signature: META-INF/MANIFEST.MF not found")
+		return true, false
+	}
+	manifest, err := readZipFile(manifestFile)
+	if err != nil {
+		result.addProblem("v1 signature: %v", err)
+		return true, false
+	}
+	manifestSections := parseJarManifest(manifest)
+
+	ok := true
+	var signerCert []byte
+	for _, sfFile := range sfFiles {
+		sf, err := readZipFile(sfFile)
+		if err != nil {
+			result.addProblem("v1 signature: %v", err)
+			return true, false
+		}
+
+		// 对应的签名文件: CERT.SF => CERT.RSA/CERT.DSA/CERT.EC
+		base := strings.TrimSuffix(sfFile.Name, path.Ext(sfFile.Name))
+		var sigFile *zip.File
+		for _, ext := range []string{".RSA", ".DSA", ".EC"} {
+			if f := entries[base+ext]; f != nil {
+				sigFile = f
+				break
+			}
+		}
+		if sigFile == nil {
+			result.addProblem("v1 signature: signature block of %s not found", sfFile.Name)
+			ok = false
+			continue
+		}
+		sigBlock, err := readZipFile(sigFile)
+		if err != nil {
+			result.addProblem("v1 signature: %v", err)
+			return true, false
+		}
+		cert, err := verifyPkcs7Signature(sigBlock, sf)
+		if err != nil {
+			result.addProblem("v1 signature: %s: %v", sigFile.Name, err)
+			ok = false
+			continue
+		}
+		if signerCert == nil {
+			signerCert = cert
+		}
+
+		sfSections := parseJarManifest(sf)
+		if len(sfSections) > 0 && strings.Contains(sfSections[0].Attrs["X-Android-APK-Signed"], "2") {
+			stripped = true
+		}
+		if !verifySignatureFile(sfFile.Name, sfSections, manifest, manifestSections, result) {
+			ok = false
+		}
+	}
+
+	// 校验每个文件的digest
+	listed := make(map[string]bool)
+	for _, section := range manifestSections[1:] {
+		if section.Name == "" {
+			continue
+		}
+		listed[section.Name] = true
+		f := entries[section.Name]
+		if f == nil {
+			result.addProblem("v1 signature: %s is listed in MANIFEST.MF but not found", section.Name)
+			ok = false
+			continue
+		}
+		h, expected, found := jarDigest(section.Attrs, "-Digest")
+		if !found {
+			result.addProblem("v1 signature: no digest of %s in MANIFEST.MF", section.Name)
+			ok = false
+			continue
+		}
+		actual, err := zipEntryDigest(f, h)
+		if err != nil {
+			result.addProblem("v1 signature: %s: %v", section.Name, err)
+			ok = false
+			continue
+		}
+		if !bytes.Equal(actual, expected) {
+			result.addProblem("v1 signature: digest of %s mismatch", section.Name)
+			ok = false
+		}
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name, "/") || isJarSignatureFile(f.Name) || listed[f.Name] {
+			continue
+		}
+		result.addProblem("v1 signature: %s is not signed", f.Name)
+		ok = false
+	}
+
+	if ok && signerCert != nil {
+		result.Verified = append(result.Verified, "v1")
+		result.checkSigner("v1", signerCert)
+	}
+	return true, stripped
+}
+
+// verifySignatureFile 校验.SF中记录的MANIFEST.MF的digest
+func verifySignatureFile(name string, sfSections []*jarSection, manifest []byte, manifestSections []*jarSection, result *ApkVerifyResult) bool {
+	if len(sfSections) == 0 {
+		result.addProblem("v1 signature: %s is empty", name)
+		return false
+	}
+
+	// 整个MANIFEST.MF的digest匹配时不需要再检查每个section
+	if h, expected, ok := jarDigest(sfSections[0].Attrs, "-Digest-Manifest"); ok && bytes.Equal(digestOf(h, manifest), expected) {
+		return true
+	}
+
+	sections := make(map[string]*jarSection)
+	for _, s := range manifestSections[1:] {
+		sections[s.Name] = s
+	}
+	ok := true
+	for _, s := range sfSections[1:] {
+		if s.Name == "" {
+			continue
+		}
+		h, expected, found := jarDigest(s.Attrs, "-Digest")
+		section := sections[s.Name]
+		if !found || section == nil || !bytes.Equal(digestOf(h, section.Raw), expected) {
+			result.addProblem("v1 signature: %s: digest of manifest section %s mismatch", name, s.Name)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func zipEntryDigest(f *zip.File, h crypto.Hash) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	hh := newHash(h)
+	if _, err := io.Copy(hh, rc); err != nil {
+		return nil, err
+	}
+	return hh.Sum(nil), nil
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+var (
+	oidSha1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSha256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSha384        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSha512        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+)
+
+func pkcs7DigestHash(oid asn1.ObjectIdentifier) (crypto.Hash, bool) {
+	switch {
+	case oid.Equal(oidSha1):
+		return crypto.SHA1, true
+	case oid.Equal(oidSha256):
+		return crypto.SHA256, true
+	case oid.Equal(oidSha384):
+		return crypto.SHA384, true
+	case oid.Equal(oidSha512):
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// pkcs7Signer 返回PKCS#7中第一个签名者的SignerInfo以及证书
+func pkcs7Signer(sigBlock []byte) (*pkcs7SignerInfo, []byte, *x509.Certificate, error) {
+	signedData, err := parsePkcs7SignedData(sigBlock)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rawCerts, err := parsePkcs7Certificates(sigBlock)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	rest := signedData.SignerInfos.Bytes
+	if len(rest) == 0 {
+		return nil, nil, nil, fmt.Errorf("no signer infos")
+	}
+	signerInfo := new(pkcs7SignerInfo)
+	if _, err := asn1.Unmarshal(rest, signerInfo); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// 根据issuer和序列号查找签名者的证书
+	for _, raw := range rawCerts {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(c.RawIssuer, signerInfo.IssuerAndSerialNumber.Issuer.FullBytes) &&
+			c.SerialNumber.Cmp(signerInfo.IssuerAndSerialNumber.SerialNumber) == 0 {
+			return signerInfo, raw, c, nil
+		}
+	}
+	return nil, nil, nil, fmt.Errorf("signer certificate not found")
+}
+
+// verifyPkcs7Signature 校验detached PKCS#7签名, 返回签名者的证书
+func verifyPkcs7Signature(sigBlock []byte, content []byte) ([]byte, error) {
+	signerInfo, rawCert, cert, err := pkcs7Signer(sigBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	h, ok := pkcs7DigestHash(signerInfo.DigestAlgorithm.Algorithm)
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm %v", signerInfo.DigestAlgorithm.Algorithm)
+	}
+
+	// 有authenticated attributes时, 签名的是attributes(DER编码的SET), 其中的messageDigest为内容的digest
+	signed := content
+	if len(signerInfo.AuthenticatedAttributes.FullBytes) > 0 {
+		var attrs []pkcs7Attribute
+		if _, err := asn1.UnmarshalWithParams(signerInfo.AuthenticatedAttributes.FullBytes, &attrs, "tag:0"); err != nil {
+			return nil, err
+		}
+		var messageDigest []byte
+		for _, attr := range attrs {
+			if attr.Type.Equal(oidMessageDigest) {
+				asn1.Unmarshal(attr.Values.Bytes, &messageDigest)
+			}
+		}
+		if !bytes.Equal(messageDigest, digestOf(h, content)) {
+			return nil, fmt.Errorf("message digest mismatch")
+		}
+		signed = append([]byte{0x31}, signerInfo.AuthenticatedAttributes.FullBytes[1:]...)
+	}
+
+	digest := digestOf(h, signed)
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, h, digest, signerInfo.EncryptedDigest); err != nil {
+			return nil, err
+		}
+	case *ecdsa.PublicKey:
+		if !verifyEcdsa(pub, digest, signerInfo.EncryptedDigest) {
+			return nil, fmt.Errorf("ECDSA signature mismatch")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported public key %T", pub)
+	}
+	return rawCert, nil
+}
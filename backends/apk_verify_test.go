@@ -0,0 +1,202 @@
+package backends
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/astaxie/beego"
+	"github.com/stretchr/testify/assert"
+)
+
+func sha256Base64(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// testPkcs7 使用ECDSA签名content, 生成不带authenticated attributes的PKCS#7 SignedData
+// detached为false时, content包含在SignedData中(例如: mobileprovision)
+func testPkcs7(t *testing.T, key *ecdsa.PrivateKey, cert []byte, content []byte, detached bool) []byte {
+	digest := sha256.Sum256(content)
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	c, err := x509.ParseCertificate(cert)
+	assert.NoError(t, err)
+	signerInfo, err := asn1.Marshal(pkcs7SignerInfo{
+		Version:                   1,
+		IssuerAndSerialNumber:     pkcs7IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: c.RawIssuer}, SerialNumber: c.SerialNumber},
+		DigestAlgorithm:           pkix.AlgorithmIdentifier{Algorithm: oidSha256},
+		DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		EncryptedDigest:           signature,
+	})
+	assert.NoError(t, err)
+
+	// id-data
+	contentInfo := pkcs7ContentInfo{ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}}
+	if !detached {
+		octets, err := asn1.Marshal(content)
+		assert.NoError(t, err)
+		contentInfo.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: octets}
+	}
+	encodedContentInfo, err := asn1.Marshal(contentInfo)
+	assert.NoError(t, err)
+
+	signedData, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue `asn1:"tag:0"`
+		SignerInfos      asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true},
+		ContentInfo:      asn1.RawValue{FullBytes: encodedContentInfo},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert},
+		SignerInfos:      asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: signerInfo},
+	})
+	assert.NoError(t, err)
+	pkcs7, err := asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidPkcs7SignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+	assert.NoError(t, err)
+	return pkcs7
+}
+
+// signV1 生成MANIFEST.MF, CERT.SF 以及 CERT.EC(不带authenticated attributes的PKCS#7)
+func signV1(t *testing.T, files map[string][]byte, key *ecdsa.PrivateKey, cert []byte) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	manifest := "Manifest-Version: 1.0\r\n\r\n"
+	sf := ""
+	for _, name := range names {
+		section := fmt.Sprintf("Name: %s\r\nSHA-256-Digest: %s\r\n\r\n", name, sha256Base64(files[name]))
+		manifest += section
+		sf += fmt.Sprintf("Name: %s\r\nSHA-256-Digest: %s\r\n\r\n", name, sha256Base64([]byte(section)))
+	}
+	sf = fmt.Sprintf("Signature-Version: 1.0\r\nX-Android-APK-Signed: 2\r\nSHA-256-Digest-Manifest: %s\r\n\r\n", sha256Base64([]byte(manifest))) + sf
+
+	pkcs7 := testPkcs7(t, key, cert, []byte(sf), true)
+
+	files["META-INF/MANIFEST.MF"] = []byte(manifest)
+	files["META-INF/CERT.SF"] = []byte(sf)
+	files["META-INF/CERT.EC"] = pkcs7
+}
+
+// signV2 计算apk的content digest, 使用ECDSA签名之后插入v2签名块
+func signV2(t *testing.T, apk []byte, key *ecdsa.PrivateKey, cert []byte, tamper bool) []byte {
+	eocd := int64(bytes.LastIndex(apk, []byte{0x50, 0x4b, 0x05, 0x06}))
+	cdOffset := int64(binary.LittleEndian.Uint32(apk[eocd+16:]))
+	sections := &apkContentSections{f: bytes.NewReader(apk), blockStart: cdOffset, cdOffset: cdOffset, eocdOffset: eocd, size: int64(len(apk))}
+	digest, err := sections.digest(crypto.SHA256)
+	assert.NoError(t, err)
+	if tamper {
+		digest[0] ^= 0xff
+	}
+
+	algorithm := make([]byte, 4)
+	binary.LittleEndian.PutUint32(algorithm, apkSigEcdsaSha256)
+	signedData := lengthPrefixed(
+		lengthPrefixed(append(append([]byte(nil), algorithm...), lengthPrefixed(digest)...)),
+		lengthPrefixed(cert),
+		[]byte{})
+	sum := sha256.Sum256(signedData)
+	signature, err := key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	signer := lengthPrefixed(
+		signedData,
+		lengthPrefixed(append(append([]byte(nil), algorithm...), lengthPrefixed(signature)...)),
+		publicKey)
+	return insertSigningBlock(t, apk, map[uint32][]byte{
+		apkSigV2BlockId: lengthPrefixed(lengthPrefixed(signer)),
+	})
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestVerifyApk"
+//
+func TestVerifyApk(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apk")
+	defer os.RemoveAll(dir)
+
+	key, cert := testCertificate(t, "signer")
+	verify := func(name string, apk []byte) *ApkVerifyResult {
+		apkPath := path.Join(dir, name)
+		ioutil.WriteFile(apkPath, apk, 0644)
+		result, err := VerifyApk(apkPath, "me.chunyu.demo")
+		assert.NoError(t, err)
+		return result
+	}
+	newFiles := func() map[string][]byte {
+		return map[string][]byte{
+			"AndroidManifest.xml": []byte("manifest"),
+			"classes.dex":         []byte("dex"),
+		}
+	}
+
+	// v1 + v2
+	files := newFiles()
+	signV1(t, files, key, cert)
+	apk := testZip(t, files)
+	result := verify("signed.apk", signV2(t, apk, key, cert, false))
+	assert.Empty(t, result.Problems)
+	assert.Equal(t, []string{"v2", "v1"}, result.Verified)
+	if assert.NotNil(t, result.Signer) {
+		assert.Equal(t, fingerprint(cert), result.Signer.CertSHA256)
+	}
+
+	// v2签名被删除
+	result = verify("stripped.apk", apk)
+	assert.Equal(t, []string{"v1"}, result.Verified)
+	assert.Equal(t, []string{"v2 signature is stripped"}, result.Problems)
+
+	// content digest不匹配
+	result = verify("tampered-v2.apk", signV2(t, apk, key, cert, true))
+	assert.Equal(t, []string{"v1"}, result.Verified)
+	assert.Equal(t, []string{"v2 signature: signer #1: apk content digest mismatch"}, result.Problems)
+
+	// 签名之后修改了文件, 增加了文件
+	files = newFiles()
+	signV1(t, files, key, cert)
+	files["classes.dex"] = []byte("patched")
+	files["extra.txt"] = []byte("extra")
+	result = verify("tampered-v1.apk", testZip(t, files))
+	assert.Empty(t, result.Verified)
+	assert.Contains(t, result.Problems, "v1 signature: digest of classes.dex mismatch")
+	assert.Contains(t, result.Problems, "v1 signature: extra.txt is not signed")
+
+	result = verify("unsigned.apk", testZip(t, newFiles()))
+	assert.Equal(t, []string{"apk is not signed"}, result.Problems)
+
+	// 期望的签名证书
+	_, other := testCertificate(t, "other")
+	beego.AppConfig.Set("apk_signer_fingerprints", "me.chunyu.demo:"+fingerprint(other))
+	defer beego.AppConfig.Set("apk_signer_fingerprints", "")
+	result = verify("signed.apk", signV2(t, apk, key, cert, false))
+	assert.Equal(t, []string{fmt.Sprintf("signer %s is not the expected certificate of me.chunyu.demo", fingerprint(cert))}, result.Problems)
+
+	beego.AppConfig.Set("apk_signer_fingerprints", "me.chunyu.demo:"+fingerprint(other)+";me.chunyu.demo:"+fingerprint(cert))
+	result = verify("signed.apk", signV2(t, apk, key, cert, false))
+	assert.Empty(t, result.Problems)
+}
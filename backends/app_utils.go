@@ -10,12 +10,21 @@ import (
 	"encoding/json"
 	"github.com/astaxie/beego"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 var gDirScanned bool = false
 var gIosAppDirs[]*models.IosAppDirMeta
 var gAndroidAppDirs[]*models.AndroidAppDirMeta
 
+// 解析失败的目录
+var gAppDirErrors []*models.AppDirError
+
+// 保护上面的扫描结果, 扫描在watcher的goroutine中进行
+var gIndexLock sync.RWMutex
+
 // http://stackoverflow.com/questions/12518876/how-to-check-if-a-file-exists-in-go
 func IsExist(filePath string) bool {
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
@@ -32,8 +41,13 @@ func ListAppDir(appRootDir string) (iosAppDirs[]*models.IosAppDirMeta, androidAp
 	log.Infof("AppRootDir: %s", appRootDir)
 
 	// 如果已经扫描了，则直接返回
-	if gDirScanned {
-		return gIosAppDirs, gAndroidAppDirs, nil
+	gIndexLock.RLock()
+	scanned := gDirScanned
+	iosAppDirs, androidAppDirs = gIosAppDirs, gAndroidAppDirs
+	gIndexLock.RUnlock()
+
+	if scanned {
+		return iosAppDirs, androidAppDirs, nil
 	} else {
 
 		err = ScanAppRootDir(appRootDir)
@@ -42,6 +56,8 @@ func ListAppDir(appRootDir string) (iosAppDirs[]*models.IosAppDirMeta, androidAp
 		if err != nil {
 			return nil, nil, err
 		} else {
+			gIndexLock.RLock()
+			defer gIndexLock.RUnlock()
 			return gIosAppDirs, gAndroidAppDirs, nil
 		}
 
@@ -49,11 +65,47 @@ func ListAppDir(appRootDir string) (iosAppDirs[]*models.IosAppDirMeta, androidAp
 
 }
 
-func ScanAppRootDir(appsRootDir string) error {
+// GetAppDir 根据目录名查找Build, 不存在时都返回nil
+func GetAppDir(appRootDir string, appId string) (*models.IosAppDirMeta, *models.AndroidAppDirMeta) {
+	iosAppDirs, androidAppDirs, err := ListAppDir(appRootDir)
+	if err != nil {
+		return nil, nil
+	}
+	for _, app := range iosAppDirs {
+		if app.Id == appId {
+			return app, nil
+		}
+	}
+	for _, app := range androidAppDirs {
+		if app.Id == appId {
+			return nil, app
+		}
+	}
+	return nil, nil
+}
+
+// ListAppDirErrors 返回最近一次扫描中解析失败的目录
+func ListAppDirErrors() []*models.AppDirError {
+	gIndexLock.RLock()
+	defer gIndexLock.RUnlock()
+	return gAppDirErrors
+}
+
+// .trash, .import-xxx 等目录不是App目录
+func isHiddenDir(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+func ScanAppRootDir(appsRootDir string) (err error) {
 
 	log.Infof("%s %s", GreenF("Begin Scan Root Dir"), appsRootDir)
-	// 扫描目录
+	start := time.Now()
+	defer func() {
+		ObserveScan(start, err)
+		recordScan(start, err)
+	}()
 
+	// 扫描目录
 	dir, err := ioutil.ReadDir(appsRootDir)
 	if err != nil {
 		return err
@@ -61,34 +113,58 @@ func ScanAppRootDir(appsRootDir string) error {
 
 	iosAppDirs := make([]*models.IosAppDirMeta, 0, 10)
 	androidAppDirs := make([]*models.AndroidAppDirMeta, 0, 10)
+	appDirErrors := make([]*models.AppDirError, 0)
 	appHost := beego.AppConfig.String("server_host")
 
 	apiBase := fmt.Sprintf("https://%s/api", appHost)
+	scanTime := time.Now().Format("2006-01-02 15:04:05")
+
+	addError := func(appId string, platform string, err error) {
+		log.Warnf("Parse app dir %s failed: %v", appId, err)
+		appDirErrors = append(appDirErrors, &models.AppDirError{
+			Id:       appId,
+			Platform: platform,
+			Reason:   err.Error(),
+			ScanTime: scanTime,
+		})
+	}
 
 	// 遍历所有的目录
 	for _, fi := range dir {
-		if !fi.IsDir() {
-			// 忽略目录
+		if !fi.IsDir() || isHiddenDir(fi.Name()) {
+			// 忽略文件以及.trash等隐藏目录
 			continue
 		}
 		appId := fi.Name()
 		appDir := path.Join(appsRootDir, appId)
 		ipaPath := path.Join(appDir, "app.ipa")
-		androidPath := path.Join(appDir, "app.apk")
+		aabPath := path.Join(appDir, "app.aab")
 
 
 		// 判断是否为 iOs目录
 		if IsExist(ipaPath) {
-			appMeta := parseIosAppDir(apiBase, appId, appDir)
-			if appMeta != nil {
+			var appMeta *models.IosAppDirMeta
+			err := safeParse(func() (err error) {
+				appMeta, err = parseIosAppDir(apiBase, appId, appDir)
+				return err
+			})
+			if err != nil {
+				addError(appId, "ios", err)
+			} else {
 				iosAppDirs = append(iosAppDirs, appMeta)
 			}
 		}
 
-		// 判断是否为 Android目录
-		if IsExist(androidPath) {
-			appMeta := parseAndroidAppDir(apiBase, appId, appDir)
-			if appMeta != nil {
+		// 判断是否为 Android目录(app.apk, app-*.apk, 或者aab + universal apk)
+		if apks, _ := ApkArtifactFiles(appDir); len(apks) > 0 || IsExist(aabPath) {
+			var appMeta *models.AndroidAppDirMeta
+			err := safeParse(func() (err error) {
+				appMeta, err = parseAndroidAppDir(apiBase, appId, appDir)
+				return err
+			})
+			if err != nil {
+				addError(appId, "android", err)
+			} else {
 				androidAppDirs = append(androidAppDirs, appMeta)
 			}
 		}
@@ -100,25 +176,119 @@ func ScanAppRootDir(appsRootDir string) error {
 	sort.Sort(models.IosAppDirMetas(iosAppDirs))
 
 	// 记录扫描的结果
+	gIndexLock.Lock()
+	// 在锁内发布, 保证并发的扫描的事件顺序和结果一致
+	if gDirScanned {
+		publishBuildEvents(diffBuilds(gIosAppDirs, gAndroidAppDirs, iosAppDirs, androidAppDirs))
+	}
 	gIosAppDirs = iosAppDirs
 	gAndroidAppDirs = androidAppDirs
+	gAppDirErrors = appDirErrors
 	gDirScanned = true
+	gIndexLock.Unlock()
+	ScanErrorsGauge.Set(float64(len(appDirErrors)))
+
+	// 删除的Build不再占用缓存
+	evictMissingFiles()
 	return nil
 }
 
-func parseIosAppDir(apiBase string, appId string, appDir string) *models.IosAppDirMeta {
+var (
+	gScheduleLock  sync.Mutex
+	gScanScheduled bool
+	gScanCallbacks []func()
+	// 后台的扫描依次执行
+	gScheduledScanLock sync.Mutex
+)
+
+// ScheduleScan 在后台扫描apps_root(和watcher相同, 请求不需要等待扫描), 扫描结束之后执行then(可以为nil);
+// 还没有开始的扫描会合并, 正在扫描时再安排一次
+func ScheduleScan(appsRootDir string, then func()) {
+	gScheduleLock.Lock()
+	defer gScheduleLock.Unlock()
+	if then != nil {
+		gScanCallbacks = append(gScanCallbacks, then)
+	}
+	if gScanScheduled {
+		return
+	}
+	gScanScheduled = true
+	go func() {
+		gScheduledScanLock.Lock()
+		defer gScheduledScanLock.Unlock()
+
+		gScheduleLock.Lock()
+		callbacks := gScanCallbacks
+		gScanScheduled, gScanCallbacks = false, nil
+		gScheduleLock.Unlock()
+
+		if err := ScanAppRootDir(appsRootDir); err != nil {
+			log.WarnErrorf(err, "Scheduled scan of %s failed", appsRootDir)
+		}
+		for _, then := range callbacks {
+			then()
+		}
+	}()
+}
+
+// safeParse 执行解析, 将panic转换为error, 单个目录的问题不能导致整个进程退出
+func safeParse(parse func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return parse()
+}
+
+// 文件大小, 例如: 12.34M
+func formatSize(size int64) string {
+	return fmt.Sprintf("%.2fM", float64(size) / 1024.0 / 1024.0)
+}
+
+// firstString 返回第一个非空的字符串类型的值
+func firstString(info map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		if v, ok := info[key].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func parseIosAppDir(apiBase string, appId string, appDir string) (*models.IosAppDirMeta, error) {
 	ipaPath := path.Join(appDir, "app.ipa")
 
 	if !IsExist(path.Join(appDir, "app.plist")) {
-		return nil
+		return nil, fmt.Errorf("app.plist not found")
 	}
 
-	metaInfo, _ := ParseIpa(ipaPath, "chunyu")
-
-	state, _ := os.Stat(ipaPath)
-	size := fmt.Sprintf("%.2fM", float32(state.Size() / 1024.0 / 1024.0))
+	bundle, err := ParseIpaBundle(ipaPath)
+	if err != nil {
+		return nil, fmt.Errorf("parse app.ipa failed: %v", err)
+	}
+	metaInfo := bundle.Info
+	if err := checkBundleId(metaInfo, AllowedBundleIds()); err != nil {
+		return nil, err
+	}
 
+	state, err := os.Stat(ipaPath)
+	if err != nil {
+		return nil, err
+	}
+	blobs := cachedBuildBlobs(appDir)
 
+	name := firstString(metaInfo, "CFBundleDisplayName", "CFBundleName", "CFBundleExecutable")
+	if name == "" {
+		return nil, fmt.Errorf("none of CFBundleDisplayName, CFBundleName, CFBundleExecutable found in Info.plist")
+	}
+	buildInfo, err := ReadBuildInfo(appDir, nil)
+	if err != nil {
+		return nil, fmt.Errorf("parse build.json failed: %v", err)
+	}
+	if buildInfo.Name != "" {
+		name = buildInfo.Name
+	}
 
 	appMeta := &models.IosAppDirMeta{
 		Id: appId,
@@ -126,43 +296,197 @@ func parseIosAppDir(apiBase string, appId string, appDir string) *models.IosAppD
 		MobileProvision: fmt.Sprintf("%s/mp/%s", apiBase, appId),
 		AppIcon: fmt.Sprintf("%s/icon/%s", apiBase, appId),
 
-		Name: metaInfo["CFBundleDisplayName"].(string),
-		Version: metaInfo["CFBundleShortVersionString"].(string),
-		ReleaseDate: state.ModTime().Format("2006-01-02 15:04"),
-		Size:size,
+		BundleId: firstString(metaInfo, "CFBundleIdentifier"),
+		Org: organizationId(firstString(metaInfo, "CFBundleIdentifier")),
+		Name: name,
+		Version: firstString(metaInfo, "CFBundleShortVersionString", "CFBundleVersion"),
+		Author: buildInfo.Uploader,
+		Notes: buildInfo.Notes,
+		Channel: buildInfo.Channel,
+		Pinned: buildInfo.Pinned,
+		Hidden: buildInfo.Hidden,
+		Mandatory: buildInfo.Mandatory,
+		ReleaseDate: blobs.ModTime("app.ipa", state).Format("2006-01-02 15:04"),
+		Size: formatSize(state.Size()),
+		Embedded: bundle.Embedded,
+
+		BuildNumber: firstString(metaInfo, "CFBundleVersion"),
+		MinimumOSVersion: firstString(metaInfo, "MinimumOSVersion"),
+		DeviceFamily: iosDeviceFamily(metaInfo["UIDeviceFamily"]),
+		RequiredCapabilities: iosCapabilities(metaInfo["UIRequiredDeviceCapabilities"]),
+		SDKName: firstString(metaInfo, "DTSDKName"),
+		XcodeVersion: xcodeVersion(firstString(metaInfo, "DTXcode")),
+		Architectures: bundle.Architectures,
 	}
 
+	switch IosSignaturePolicy() {
+	case SignaturePolicyOff:
+		// 不校验签名, 只读取profile
+		if appMeta.Profile, err = ReadIpaProfile(ipaPath, bundle); err != nil {
+			log.Warnf("Read profile of %s failed: %v", appId, err)
+		}
+	default:
+		result, err := CachedVerifyIpa(ipaPath, bundle, state)
+		if err != nil {
+			return nil, fmt.Errorf("verify app.ipa failed: %v", err)
+		}
+		problems := result.ProblemsAt(time.Now())
+		if len(problems) > 0 && IosSignaturePolicy() == SignaturePolicyReject {
+			return nil, fmt.Errorf("signature verification failed: %s", strings.Join(problems, "; "))
+		}
+		appMeta.Profile = result.Profile
+		appMeta.SignatureProblems = problems
+		if result.Signer != nil {
+			appMeta.SignerCertSHA256 = result.Signer.CertSHA256
+			appMeta.SignerSubject = result.Signer.Subject
+		}
+	}
+
+	setExpiry(appMeta, time.Now(), ExpiryWarningDays())
+
 	has_provinsion := IsExist(path.Join(appDir, "app.mobileprovision"))
 	if !has_provinsion {
 		appMeta.MobileProvision = ""
 	}
+	setIosChecksums(apiBase, appDir, appMeta)
 
-	return appMeta
+	return appMeta, nil
 }
 
-func parseAndroidAppDir(apiBase string, appId string, appDir string) *models.AndroidAppDirMeta {
-	apkPath := path.Join(appDir, "app.apk")
-
+func parseAndroidAppDir(apiBase string, appId string, appDir string) (*models.AndroidAppDirMeta, error) {
 	if !IsExist(path.Join(appDir, "app.json")) {
-		return nil
+		return nil, fmt.Errorf("app.json not found")
+	}
+
+	// aab没有对应的universal apk时尝试使用bundletool生成
+	aabPath := path.Join(appDir, "app.aab")
+	hasAab := IsExist(aabPath)
+	if hasAab && !IsExist(path.Join(appDir, "app.apk")) {
+		if err := ensureUniversalApk(aabPath, path.Join(appDir, "app.apk")); err != nil {
+			return nil, err
+		}
 	}
 
-	state, _ := os.Stat(apkPath)
-	size := fmt.Sprintf("%.2fM", float32(state.Size() / 1024.0 / 1024.0))
+	// 默认的apk为app.apk, 没有时为第一个app-*.apk
+	files, err := ApkArtifactFiles(appDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("app.apk not found")
+	}
+	apkPath := path.Join(appDir, files[0])
+
+	state, err := os.Stat(apkPath)
+	if err != nil {
+		return nil, err
+	}
+	blobs := cachedBuildBlobs(appDir)
 
 	appJsonFile := path.Join(appDir, "app.json")
-	data, _ := ioutil.ReadFile(appJsonFile)
+	data, err := ioutil.ReadFile(appJsonFile)
+	if err != nil {
+		return nil, err
+	}
 	var appJson map[string]interface{} = make(map[string]interface{})
-	json.Unmarshal(data, &appJson)
+	if err := json.Unmarshal(data, &appJson); err != nil {
+		return nil, fmt.Errorf("parse app.json failed: %v", err)
+	}
+
+	name := firstString(appJson, "title", "packageName")
+	if name == "" {
+		return nil, fmt.Errorf("title not found in app.json")
+	}
+	buildInfo, err := ReadBuildInfo(appDir, appJson)
+	if err != nil {
+		return nil, fmt.Errorf("parse build.json failed: %v", err)
+	}
+	if buildInfo.Name != "" {
+		name = buildInfo.Name
+	}
+
+	apkMeta, err := ParseApk(apkPath)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s failed: %v", files[0], err)
+	}
+
+	version := firstString(appJson, "versionName")
+	if version == "" {
+		version = apkMeta.VersionName
+	}
+
+	var aab string
+	if hasAab {
+		aabMeta, err := ParseAab(aabPath)
+		if err != nil {
+			return nil, fmt.Errorf("parse app.aab failed: %v", err)
+		}
+		if err := checkUniversalApk(aabMeta, apkMeta); err != nil {
+			return nil, err
+		}
+		aab = fmt.Sprintf("%s/aab/%s", apiBase, appId)
+	}
+
+	// 所有的apk必须是同一个App, 签名问题记录在Build上, 其他apk的问题以文件名开头
+	variants, _ := appJson["variants"].(map[string]interface{})
+	var artifacts []*models.ApkArtifact
+	var verified, problems []string
+	for i, file := range files {
+		filePath := path.Join(appDir, file)
+		info, meta := state, apkMeta
+		if i > 0 {
+			if info, err = os.Stat(filePath); err != nil {
+				return nil, err
+			}
+			if meta, err = ParseApk(filePath); err != nil {
+				return nil, fmt.Errorf("parse %s failed: %v", file, err)
+			}
+			if meta.PackageName != apkMeta.PackageName {
+				return nil, fmt.Errorf("%s: package %s does not match %s", file, meta.PackageName, apkMeta.PackageName)
+			}
+		}
+
+		if ApkSignaturePolicy() != SignaturePolicyOff {
+			result, err := CachedVerifyApk(filePath, meta.PackageName, info)
+			if err != nil {
+				return nil, fmt.Errorf("verify %s failed: %v", file, err)
+			}
+			if len(result.Problems) > 0 && ApkSignaturePolicy() == SignaturePolicyReject {
+				return nil, fmt.Errorf("signature verification of %s failed: %s", file, strings.Join(result.Problems, "; "))
+			}
+			if i == 0 {
+				verified, problems = result.Verified, result.Problems
+			} else {
+				for _, problem := range result.Problems {
+					problems = append(problems, file+": "+problem)
+				}
+			}
+		}
+		artifacts = append(artifacts, newApkArtifact(apiBase, appId, file, info, meta, variants))
+	}
 
 	appMeta := &models.AndroidAppDirMeta{
 		Id: appId,
 		AppIcon: fmt.Sprintf("%s/icon/%s", apiBase, appId),
 		Apk: fmt.Sprintf("%s/apk/%s", apiBase, appId),
-		ReleaseDate: state.ModTime().Format("2006-01-02 15:04"),
-		Size:size,
-		Name: appJson["title"].(string),
-		Version: appJson["versionName"].(string),
+		Aab: aab,
+		ReleaseDate: blobs.ModTime(files[0], state).Format("2006-01-02 15:04"),
+		Size: formatSize(state.Size()),
+		BundleId: apkMeta.PackageName,
+		Org: organizationId(apkMeta.PackageName),
+		Name: name,
+		Version: version,
+		Author: buildInfo.Uploader,
+		Notes: buildInfo.Notes,
+		Channel: buildInfo.Channel,
+		Pinned: buildInfo.Pinned,
+		Hidden: buildInfo.Hidden,
+		Mandatory: buildInfo.Mandatory,
+		ApkMetadata: *apkMeta,
+		SignatureVerified: verified,
+		SignatureProblems: problems,
+		Artifacts: artifacts,
 	}
-	return appMeta
-}
\ No newline at end of file
+	setAndroidChecksums(apiBase, appDir, appMeta)
+	return appMeta, nil
+}
@@ -0,0 +1,109 @@
+package backends
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 生成只包含Info.plist的ipa
+func writeTestIpa(t *testing.T, file string, infoPlist string) {
+	f, err := os.Create(file)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	entry, err := w.Create("Payload/Demo.app/Info.plist")
+	assert.NoError(t, err)
+	entry.Write([]byte(infoPlist))
+	assert.NoError(t, w.Close())
+}
+
+func writeTestAppDir(t *testing.T, appsRoot string, appId string, infoPlist string) {
+	appDir := path.Join(appsRoot, appId)
+	os.MkdirAll(appDir, 0755)
+	writeTestIpa(t, path.Join(appDir, "app.ipa"), infoPlist)
+	ioutil.WriteFile(path.Join(appDir, "app.plist"), []byte(GenerateManifest("com.chunyu.Demo", "1.0", "Demo")), 0644)
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestScanBrokenAppDirs"
+//
+func TestScanBrokenAppDirs(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+
+	// 没有CFBundleDisplayName, 使用CFBundleName
+	writeTestAppDir(t, appsRoot, "no_display_name", `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+  <key>CFBundleIdentifier</key><string>com.chunyu.Demo</string>
+  <key>CFBundleName</key><string>Demo</string>
+  <key>CFBundleShortVersionString</key><string>1.0</string>
+</dict></plist>`)
+
+	// 没有任何名字
+	writeTestAppDir(t, appsRoot, "no_name", `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+  <key>CFBundleIdentifier</key><string>com.chunyu.Demo</string>
+</dict></plist>`)
+
+	// 不是zip文件
+	os.MkdirAll(path.Join(appsRoot, "not_zip"), 0755)
+	ioutil.WriteFile(path.Join(appsRoot, "not_zip", "app.ipa"), []byte("garbage"), 0644)
+	ioutil.WriteFile(path.Join(appsRoot, "not_zip", "app.plist"), []byte(""), 0644)
+
+	// app.json 格式错误
+	os.MkdirAll(path.Join(appsRoot, "bad_json"), 0755)
+	ioutil.WriteFile(path.Join(appsRoot, "bad_json", "app.apk"), []byte(""), 0644)
+	ioutil.WriteFile(path.Join(appsRoot, "bad_json", "app.json"), []byte(`{"title": 1}`), 0644)
+
+	assert.NoError(t, ScanAppRootDir(appsRoot))
+
+	iosAppDirs, androidAppDirs, _ := ListAppDir(appsRoot)
+	assert.Equal(t, 1, len(iosAppDirs))
+	assert.Equal(t, "Demo", iosAppDirs[0].Name)
+	assert.Equal(t, 0, len(androidAppDirs))
+
+	reasons := make(map[string]string)
+	for _, e := range ListAppDirErrors() {
+		reasons[e.Id] = e.Reason
+	}
+	assert.Equal(t, 3, len(reasons))
+	assert.Contains(t, reasons["no_name"], "CFBundleDisplayName")
+	assert.Contains(t, reasons["not_zip"], "parse app.ipa failed")
+	assert.Contains(t, reasons["bad_json"], "title not found")
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestScheduleScan"
+//
+func TestScheduleScan(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+	assert.NoError(t, ScanAppRootDir(appsRoot))
+
+	// 扫描在后台进行, 结束之后执行所有的回调
+	writeTestAppDir(t, appsRoot, "demo_1", `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+  <key>CFBundleIdentifier</key><string>com.chunyu.Demo</string>
+  <key>CFBundleName</key><string>Demo</string>
+</dict></plist>`)
+	done := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		i := i
+		ScheduleScan(appsRoot, func() {
+			done <- i
+		})
+	}
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	iosAppDirs, _, _ := ListAppDir(appsRoot)
+	if assert.Len(t, iosAppDirs, 1) {
+		assert.Equal(t, "demo_1", iosAppDirs[0].Id)
+	}
+}
@@ -0,0 +1,392 @@
+package backends
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// itms-services 使用的manifest, __URL__ 在下载时被替换为ipa的地址
+const manifestTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+  <dict>
+    <key>items</key>
+    <array>
+      <dict>
+        <key>assets</key>
+        <array>
+          <dict>
+            <key>kind</key>
+            <string>software-package</string>
+            <key>url</key>
+            <string>__URL__</string>
+          </dict>
+        </array>
+        <key>metadata</key>
+        <dict>
+          <key>bundle-identifier</key>
+          <string>%s</string>
+          <key>bundle-version</key>
+          <string>%s</string>
+          <key>kind</key>
+          <string>software</string>
+          <key>title</key>
+          <string>%s</string>
+        </dict>
+      </dict>
+    </array>
+  </dict>
+</plist>
+`
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// GenerateManifest 根据Info.plist生成app.plist
+func GenerateManifest(bundleId string, version string, title string) string {
+	return fmt.Sprintf(manifestTemplate, xmlEscape(bundleId), xmlEscape(version), xmlEscape(title))
+}
+
+var unsafeIdChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// NewAppId 生成新的App目录名, 例如: com.chunyu.Foo_1.4.0_201607011230
+func NewAppId(bundleId string, version string) string {
+	id := fmt.Sprintf("%s_%s_%s", bundleId, version, time.Now().Format("200601021504"))
+	return unsafeIdChars.ReplaceAllString(id, "_")
+}
+
+type ImportOptions struct {
+	// 目录名, 为空时自动生成
+	Id string
+	// Android的App名字, 为空时使用包名
+	Title string
+	// 图标(png)
+	Icon string
+	// 导入aab时对应的universal apk(apk或者--mode=universal生成的apks), 为空时使用bundletool_command生成
+	Apk string
+	// 写入build.json的发布说明, 渠道, 上传者以及是否强制更新
+	Notes     string
+	Channel   string
+	Uploader  string
+	Mandatory bool
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// extractZipEntry 从zip中解压第一个满足match的文件
+func extractZipEntry(zipPath string, match func(name string) bool, dst string) (bool, error) {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if !match(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return false, err
+		}
+		defer rc.Close()
+
+		out, err := os.Create(dst)
+		if err != nil {
+			return false, err
+		}
+		if _, err := io.Copy(out, rc); err != nil {
+			out.Close()
+			return false, err
+		}
+		return true, out.Close()
+	}
+	return false, nil
+}
+
+// ImportBuild 将ipa/apk/aab导入到apps_root中, 返回新的目录名
+// 先在隐藏的临时目录中准备好所有文件, 最后rename, 避免watcher扫描到不完整的目录
+func ImportBuild(appsRootDir string, file string, options ImportOptions) (string, error) {
+	ext := strings.ToLower(filepath.Ext(file))
+	if ext != ".ipa" && ext != ".apk" && ext != ".aab" {
+		return "", fmt.Errorf("unsupported file type: %s", file)
+	}
+	// 命令行和后台上传都可能指定目录名, 不能跳出apps_root
+	if options.Id != "" && !ValidAppId(options.Id) {
+		return "", fmt.Errorf("invalid build id: %s", options.Id)
+	}
+
+	tmpDir, err := ioutil.TempDir(appsRootDir, ".import-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var appId string
+	switch ext {
+	case ".ipa":
+		appId, err = prepareIosBuild(tmpDir, file, options)
+	case ".aab":
+		appId, err = prepareAabBuild(tmpDir, file, options)
+	default:
+		appId, err = prepareAndroidBuild(tmpDir, file, options)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !ValidAppId(appId) {
+		return "", fmt.Errorf("invalid build id: %s", appId)
+	}
+
+	if options.Icon != "" {
+		if err := copyFile(options.Icon, path.Join(tmpDir, "app.png")); err != nil {
+			return "", err
+		}
+	}
+	if options.Notes != "" || options.Channel != "" || options.Uploader != "" || options.Mandatory {
+		info := &BuildInfo{Notes: options.Notes, Channel: options.Channel, Uploader: options.Uploader, Mandatory: options.Mandatory}
+		if err := WriteBuildInfo(tmpDir, info); err != nil {
+			return "", err
+		}
+	}
+
+	appDir := path.Join(appsRootDir, appId)
+	if IsExist(appDir) {
+		return "", fmt.Errorf("app dir already exists: %s", appDir)
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpDir, appDir); err != nil {
+		return "", err
+	}
+	// 使用s3等存储时同时上传, 其他的实例可以通过 storage pull 获取
+	if err := PushAppDir(GetStorage(), appsRootDir, appId); err != nil {
+		return appId, err
+	}
+	return appId, nil
+}
+
+func prepareIosBuild(dir string, file string, options ImportOptions) (string, error) {
+	bundle, err := ParseIpaBundle(file)
+	if err != nil {
+		return "", err
+	}
+	metaInfo := bundle.Info
+	if err := checkBundleId(metaInfo, AllowedBundleIds()); err != nil {
+		return "", err
+	}
+	if IosSignaturePolicy() == SignaturePolicyReject {
+		result, err := VerifyIpa(file, bundle)
+		if err != nil {
+			return "", err
+		}
+		if problems := result.ProblemsAt(time.Now()); len(problems) > 0 {
+			return "", fmt.Errorf("signature verification failed: %s", strings.Join(problems, "; "))
+		}
+	}
+	bundleId, _ := metaInfo["CFBundleIdentifier"].(string)
+	version, _ := metaInfo["CFBundleShortVersionString"].(string)
+	title, _ := metaInfo["CFBundleDisplayName"].(string)
+	if title == "" {
+		title, _ = metaInfo["CFBundleName"].(string)
+	}
+
+	if err := copyFile(file, path.Join(dir, "app.ipa")); err != nil {
+		return "", err
+	}
+	manifest := GenerateManifest(bundleId, version, title)
+	if err := ioutil.WriteFile(path.Join(dir, "app.plist"), []byte(manifest), 0644); err != nil {
+		return "", err
+	}
+
+	// Payload/Xxx.app/embedded.mobileprovision
+	_, err = extractZipEntry(file, func(name string) bool {
+		return strings.HasPrefix(name, "Payload/") && strings.Count(name, "/") == 2 &&
+			strings.HasSuffix(name, ".app/embedded.mobileprovision")
+	}, path.Join(dir, "app.mobileprovision"))
+	if err != nil {
+		return "", err
+	}
+
+	if options.Id != "" {
+		return options.Id, nil
+	}
+	return NewAppId(bundleId, version), nil
+}
+
+func prepareAndroidBuild(dir string, file string, options ImportOptions) (string, error) {
+	apkMeta, err := ParseApk(file)
+	if err != nil {
+		return "", err
+	}
+	if ApkSignaturePolicy() == SignaturePolicyReject {
+		result, err := VerifyApk(file, apkMeta.PackageName)
+		if err != nil {
+			return "", err
+		}
+		if len(result.Problems) > 0 {
+			return "", fmt.Errorf("signature verification failed: %s", strings.Join(result.Problems, "; "))
+		}
+	}
+
+	title := options.Title
+	if title == "" {
+		title = apkMeta.PackageName
+	}
+
+	if err := copyFile(file, path.Join(dir, "app.apk")); err != nil {
+		return "", err
+	}
+	appJson, err := json.MarshalIndent(map[string]interface{}{
+		"title":       title,
+		"versionName": apkMeta.VersionName,
+		"versionCode": apkMeta.VersionCode,
+		"packageName": apkMeta.PackageName,
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "app.json"), appJson, 0644); err != nil {
+		return "", err
+	}
+
+	if options.Id != "" {
+		return options.Id, nil
+	}
+	return NewAppId(apkMeta.PackageName, apkMeta.VersionName), nil
+}
+
+// prepareAabBuild 保存aab以及对应的universal apk, 其他的和apk相同
+func prepareAabBuild(dir string, file string, options ImportOptions) (string, error) {
+	aabMeta, err := ParseAab(file)
+	if err != nil {
+		return "", err
+	}
+
+	universalApk := path.Join(dir, "universal.apk")
+	if options.Apk != "" {
+		err = copyUniversalApk(options.Apk, universalApk)
+	} else {
+		err = BuildUniversalApk(file, universalApk)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(universalApk)
+
+	apkMeta, err := ParseApk(universalApk)
+	if err != nil {
+		return "", fmt.Errorf("parse universal apk failed: %v", err)
+	}
+	if err := checkUniversalApk(aabMeta, apkMeta); err != nil {
+		return "", err
+	}
+
+	if err := copyFile(file, path.Join(dir, "app.aab")); err != nil {
+		return "", err
+	}
+	return prepareAndroidBuild(dir, universalApk, options)
+}
+
+// FindBuilds 根据目录名, bundle id或者名字查找App的所有Build
+func FindBuilds(appsRootDir string, app string) ([]string, error) {
+	iosAppDirs, androidAppDirs, err := ListAppDir(appsRootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, meta := range iosAppDirs {
+		if meta.Id == app || meta.BundleId == app || meta.Name == app {
+			ids = append(ids, meta.Id)
+		}
+	}
+	for _, meta := range androidAppDirs {
+		if meta.Id == app || meta.BundleId == app || meta.Name == app {
+			ids = append(ids, meta.Id)
+		}
+	}
+	return ids, nil
+}
+
+// ExportBuilds 将多个App目录打包成tar.gz, 每个目录在包中保持原来的名字
+func ExportBuilds(appsRootDir string, ids []string, w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	for _, id := range ids {
+		appDir := path.Join(appsRootDir, id)
+		err := filepath.Walk(appDir, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(appsRootDir, file)
+			if err != nil {
+				return err
+			}
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(rel)
+			if info.IsDir() {
+				header.Name += "/"
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
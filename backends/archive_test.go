@@ -0,0 +1,25 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestImportBuildId"
+//
+func TestImportBuildId(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+
+	// 指定的目录名不能是隐藏目录, 也不能跳出apps_root
+	for _, appId := range []string{".trash", "../demo_3", "a/b"} {
+		_, err := ImportBuild(appsRoot, "demo.ipa", ImportOptions{Id: appId})
+		assert.Error(t, err, appId)
+	}
+	assert.False(t, IsExist(path.Join(appsRoot, "..", "demo_3")))
+}
@@ -0,0 +1,258 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego"
+)
+
+// 记录的操作
+const (
+	AuditUpload    = "upload"
+	AuditEdit      = "edit"
+	AuditRename    = "rename"
+	AuditPin       = "pin"
+	AuditUnpin     = "unpin"
+	AuditHide      = "hide"
+	AuditUnhide    = "unhide"
+	AuditTrash     = "trash"
+	AuditRestore   = "restore"
+	AuditPrune     = "prune"
+	AuditReplicate = "replicate"
+	AuditDownload  = "download"
+	AuditConfig    = "config"
+	AuditExport    = "export"
+
+	// 命令行的存储同步
+	AuditStoragePush = "storage_push"
+	AuditStoragePull = "storage_pull"
+	AuditBlobSync    = "blob_sync"
+	AuditBlobGC      = "blob_gc"
+
+	// 测试组
+	AuditGroup        = "group"
+	AuditDeleteGroup  = "delete_group"
+	AuditInvite       = "invite"
+	AuditRevoke       = "revoke"
+	AuditJoin         = "join"
+	AuditRemoveTester = "remove_tester"
+)
+
+// 不是由用户发起的操作
+const (
+	AuditActorAnonymous   = "anonymous"
+	AuditActorRetention   = "retention"
+	AuditActorReplication = "replication"
+	AuditActorSystem      = "system"
+)
+
+// 查询时默认返回的记录数
+const defaultAuditLimit = 500
+
+// AuditEntry 操作记录, 每行一个json
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	// 操作的Build, 修改配置时为配置文件
+	Target string `json:"target"`
+	IP     string `json:"ip,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+var gAuditLock sync.Mutex
+
+// AuditLogFile 操作记录的文件, 默认为 apps_root/.audit.log
+func AuditLogFile(appsRootDir string) string {
+	file := beego.AppConfig.String("audit_log")
+	if file == "" {
+		return path.Join(appsRootDir, ".audit.log")
+	}
+	return file
+}
+
+// RecordAudit 在操作记录的最后追加一条, 失败时只记录日志, 不影响操作本身;
+// 只追加, 不会修改或者删除已有的记录
+func RecordAudit(appsRootDir string, entry *AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.Actor == "" {
+		entry.Actor = AuditActorAnonymous
+	}
+	data, _ := json.Marshal(entry)
+
+	gAuditLock.Lock()
+	defer gAuditLock.Unlock()
+	f, err := os.OpenFile(AuditLogFile(appsRootDir), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.WarnErrorf(err, "Open audit log failed")
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.WarnErrorf(err, "Write audit log failed")
+	}
+}
+
+// AuditQuery 操作记录的过滤条件, 为空时不限
+type AuditQuery struct {
+	Actor  string
+	Action string
+	Target string
+	// 前缀匹配, 例如: 10.0.
+	IP   string
+	From time.Time
+	To   time.Time
+	// 最多返回的记录数, 导出时不限
+	Limit int
+}
+
+// ParseAuditQuery 从请求参数中解析过滤条件, 日期的格式和ParseBuildQuery相同
+func ParseAuditQuery(param func(key string) string) (*AuditQuery, error) {
+	query := &AuditQuery{
+		Actor:  strings.TrimSpace(param("actor")),
+		Action: strings.TrimSpace(param("action")),
+		Target: strings.TrimSpace(param("target")),
+		IP:     strings.TrimSpace(param("ip")),
+		Limit:  defaultAuditLimit,
+	}
+	var err error
+	if s := param("from"); s != "" {
+		if query.From, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return nil, fmt.Errorf("invalid from: %s", s)
+		}
+	}
+	if s := param("to"); s != "" {
+		if query.To, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return nil, fmt.Errorf("invalid to: %s", s)
+		}
+		query.To = query.To.AddDate(0, 0, 1)
+	}
+	if s := param("limit"); s != "" {
+		if query.Limit, err = strconv.Atoi(s); err != nil || query.Limit < 1 {
+			return nil, fmt.Errorf("invalid limit: %s", s)
+		}
+	}
+	return query, nil
+}
+
+// Match 记录是否满足过滤条件
+func (q *AuditQuery) Match(entry *AuditEntry) bool {
+	if q.Actor != "" && !strings.EqualFold(q.Actor, entry.Actor) {
+		return false
+	}
+	if q.Action != "" && q.Action != entry.Action {
+		return false
+	}
+	if q.Target != "" && q.Target != entry.Target {
+		return false
+	}
+	if q.IP != "" && !strings.HasPrefix(entry.IP, q.IP) {
+		return false
+	}
+	if !q.From.IsZero() && entry.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !entry.Time.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+// scanAuditLog 按照写入的顺序遍历满足条件的记录, line为文件中原始的一行
+func scanAuditLog(appsRootDir string, query *AuditQuery, fn func(entry *AuditEntry, line []byte) error) error {
+	f, err := os.Open(AuditLogFile(appsRootDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// 不使用bufio.Scanner: 超过64K的一行会导致之后的记录都无法读取
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		// 解析失败的行(例如: 写了一半)直接跳过
+		var entry AuditEntry
+		if len(line) > 0 && json.Unmarshal(line, &entry) == nil && query.Match(&entry) {
+			if err := fn(&entry, line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// QueryAuditLog 满足条件的最近的query.Limit条记录, 最新的在前
+func QueryAuditLog(appsRootDir string, query *AuditQuery) ([]*AuditEntry, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+	var entries []*AuditEntry
+	err := scanAuditLog(appsRootDir, query, func(entry *AuditEntry, line []byte) error {
+		entries = append(entries, entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+		return nil
+	})
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, err
+}
+
+// ExportAuditLog 按照写入的顺序导出满足条件的所有记录(JSON lines), 每行和文件中的完全一致
+func ExportAuditLog(appsRootDir string, query *AuditQuery, w io.Writer) error {
+	return scanAuditLog(appsRootDir, query, func(entry *AuditEntry, line []byte) error {
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		_, err := w.Write([]byte{'\n'})
+		return err
+	})
+}
+
+// RecordConfigChanges 启动时检查配置文件, 和上次记录的SHA-256不一致时记录一条config
+func RecordConfigChanges(appsRootDir string, files []string) {
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		checksum, err := HashFileChecksum(file)
+		if err != nil {
+			log.WarnErrorf(err, "Hash config file %s failed", file)
+			continue
+		}
+		detail := "sha256:" + checksum.SHA256
+		last, err := QueryAuditLog(appsRootDir, &AuditQuery{Action: AuditConfig, Target: file, Limit: 1})
+		if err != nil {
+			log.WarnErrorf(err, "Read audit log failed")
+			continue
+		}
+		if len(last) > 0 && last[0].Detail == detail {
+			continue
+		}
+		RecordAudit(appsRootDir, &AuditEntry{Actor: AuditActorSystem, Action: AuditConfig, Target: file, Detail: detail})
+	}
+}
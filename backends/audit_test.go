@@ -0,0 +1,100 @@
+package backends
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestAuditLog"
+//
+func TestAuditLog(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+
+	entries, err := QueryAuditLog(appsRoot, &AuditQuery{})
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	day := time.Date(2016, 7, 1, 10, 0, 0, 0, time.Local)
+	RecordAudit(appsRoot, &AuditEntry{Time: day, Actor: "admin", Action: AuditUpload, Target: "demo_1", IP: "10.0.0.1"})
+	// 超过64K的行不影响之后的记录
+	RecordAudit(appsRoot, &AuditEntry{Time: day.Add(30 * time.Minute), Actor: AuditActorSystem, Action: AuditConfig, Target: "app.conf", Detail: strings.Repeat("x", 100*1024)})
+	f, _ := os.OpenFile(AuditLogFile(appsRoot), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(strings.Repeat("broken", 20*1024) + "\n"))
+	f.Close()
+	RecordAudit(appsRoot, &AuditEntry{Time: day.Add(time.Hour), Action: AuditDownload, Target: "demo_1", IP: "192.168.1.2", Detail: "app.ipa"})
+	RecordAudit(appsRoot, &AuditEntry{Time: day.AddDate(0, 0, 1), Actor: "alice", Action: AuditDownload, Target: "demo_1", IP: "10.0.0.2", Detail: "app.ipa"})
+	RecordAudit(appsRoot, &AuditEntry{Time: day.AddDate(0, 0, 2), Actor: "admin", Action: AuditTrash, Target: "demo_1", IP: "10.0.0.1"})
+	// 写了一半的行被忽略
+	f, _ = os.OpenFile(AuditLogFile(appsRoot), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(`{"time":"2016-07-04T10:00:00+08:00","act`))
+	f.Close()
+
+	query := func(rawQuery string) []string {
+		values, _ := url.ParseQuery(rawQuery)
+		q, err := ParseAuditQuery(values.Get)
+		assert.NoError(t, err)
+		entries, err := QueryAuditLog(appsRoot, q)
+		assert.NoError(t, err)
+		var result []string
+		for _, entry := range entries {
+			result = append(result, entry.Actor+" "+entry.Action)
+		}
+		return result
+	}
+	assert.Equal(t, []string{"admin trash", "alice download", "anonymous download", "system config", "admin upload"}, query(""))
+	assert.Equal(t, []string{"alice download", "anonymous download"}, query("action=download"))
+	assert.Equal(t, []string{"alice download"}, query("action=download&actor=Alice"))
+	assert.Equal(t, []string{"admin trash", "alice download", "admin upload"}, query("ip=10.0."))
+	assert.Equal(t, []string{"anonymous download", "system config", "admin upload"}, query("to=2016-07-01"))
+	assert.Equal(t, []string{"admin trash", "alice download"}, query("from=2016-07-02&limit=5"))
+	assert.Equal(t, []string{"admin trash"}, query("limit=1"))
+	assert.Empty(t, query("target=demo_2"))
+
+	for _, rawQuery := range []string{"from=yesterday", "limit=0", "limit=all"} {
+		values, _ := url.ParseQuery(rawQuery)
+		_, err := ParseAuditQuery(values.Get)
+		assert.Error(t, err, rawQuery)
+	}
+
+	// 导出时按照写入的顺序, 不限制数目
+	var buf bytes.Buffer
+	assert.NoError(t, ExportAuditLog(appsRoot, &AuditQuery{Action: AuditDownload, Limit: 1}, &buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Contains(t, lines[0], `"actor":"anonymous"`)
+	assert.Contains(t, lines[1], `"actor":"alice"`)
+	assert.Contains(t, lines[1], `"ip":"10.0.0.2"`)
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestRecordConfigChanges"
+//
+func TestRecordConfigChanges(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+	confFile := path.Join(appsRoot, "app.conf")
+	ioutil.WriteFile(confFile, []byte("page_size = 20\n"), 0644)
+
+	// 第一次启动以及配置修改之后记录, 没有修改时不记录
+	RecordConfigChanges(appsRoot, []string{confFile, ""})
+	RecordConfigChanges(appsRoot, []string{confFile})
+	ioutil.WriteFile(confFile, []byte("page_size = 50\n"), 0644)
+	RecordConfigChanges(appsRoot, []string{confFile})
+
+	entries, err := QueryAuditLog(appsRoot, &AuditQuery{Action: AuditConfig})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, AuditActorSystem, entries[0].Actor)
+	assert.Equal(t, confFile, entries[0].Target)
+	assert.NotEqual(t, entries[0].Detail, entries[1].Detail)
+}
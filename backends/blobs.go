@@ -0,0 +1,470 @@
+package backends
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego"
+)
+
+//
+// 按照内容(SHA-256)去重的Build文件, 在app.conf中配置:
+//   blob_store: 启用之后导入/扫描到的Build都保存为blob, 默认false
+//   blob_gc_grace: 没有被引用的blob至少保留的小时数, 默认24
+//
+// blob的key为 .blobs/sha256/<前两位>/<sha256>, 每个App目录中的blobs.json记录文件对应的blob
+// local存储(apps_root)时App目录中的文件是blob的硬链接, 重复上传的ipa, 图标只占用一份空间;
+// blob(以及链接到blob的文件)设置为只读, 导入, 复制等替换文件时都是先写入新文件再rename, 不会修改共享的inode;
+// 仍然被直接覆盖时(例如: root用户), 扫描时删除旧的blob并重新计算
+// s3存储时只上传blob以及blobs.json, 下载时通过blobs.json找到对应的blob
+//
+// 引用计数在GC时根据存储中所有的blobs.json重新计算, 不会出现计数和实际引用不一致的情况
+//
+
+const BlobsFile = "blobs.json"
+
+const blobPrefix = ".blobs/sha256/"
+
+// BlobRef App目录中的一个文件对应的blob
+type BlobRef struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	// 文件原来的修改时间, 作为Build的发布时间; 硬链接之后文件的修改时间变为blob的修改时间
+	ModTime time.Time `json:"mod_time"`
+	// 记录时文件的修改时间, 用于判断文件是否被替换
+	FileModTime time.Time `json:"file_mod_time"`
+}
+
+// stale 文件在记录之后被替换了
+func (r *BlobRef) stale(info os.FileInfo) bool {
+	return info.Size() != r.Size || !info.ModTime().Equal(r.FileModTime)
+}
+
+// BuildBlobs 文件名 => blob, 即blobs.json的内容
+type BuildBlobs map[string]*BlobRef
+
+// ModTime 文件的修改时间, 文件已经链接到blob时返回原来的修改时间
+func (b BuildBlobs) ModTime(file string, info os.FileInfo) time.Time {
+	if ref := b[file]; ref != nil && !ref.stale(info) && !ref.ModTime.IsZero() {
+		return ref.ModTime
+	}
+	return info.ModTime()
+}
+
+func BlobStoreEnabled() bool {
+	return beego.AppConfig.DefaultBool("blob_store", false)
+}
+
+// BlobKey blob在存储中的key
+func BlobKey(sum string) string {
+	return blobPrefix + sum[:2] + "/" + sum
+}
+
+// HashFile 计算文件的SHA-256
+func HashFile(name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// ReadBuildBlobs 读取App目录中的blobs.json, 不存在时返回nil
+func ReadBuildBlobs(appDir string) (BuildBlobs, error) {
+	data, err := ioutil.ReadFile(path.Join(appDir, BlobsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeBuildBlobs(data)
+}
+
+func decodeBuildBlobs(data []byte) (BuildBlobs, error) {
+	var blobs BuildBlobs
+	if err := json.Unmarshal(data, &blobs); err != nil {
+		return nil, fmt.Errorf("parse %s failed: %v", BlobsFile, err)
+	}
+	for file, ref := range blobs {
+		if len(ref.SHA256) != sha256.Size*2 || strings.Contains(file, "/") {
+			return nil, fmt.Errorf("parse %s failed: invalid entry %s", BlobsFile, file)
+		}
+	}
+	return blobs, nil
+}
+
+var buildBlobsCache = newFileCache()
+
+// cachedBuildBlobs 扫描和下载时使用, blobs.json没有变化时不重复解析
+func cachedBuildBlobs(appDir string) BuildBlobs {
+	name := path.Join(appDir, BlobsFile)
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil
+	}
+	if blobs, ok := buildBlobsCache.get(name, info); ok {
+		return blobs.(BuildBlobs)
+	}
+	blobs, err := ReadBuildBlobs(appDir)
+	if err != nil {
+		log.WarnErrorf(err, "Read %s failed", name)
+	}
+	buildBlobsCache.put(name, info, blobs)
+	return blobs
+}
+
+func writeBuildBlobs(appDir string, blobs BuildBlobs) ([]byte, error) {
+	data, err := json.MarshalIndent(blobs, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	name := path.Join(appDir, BlobsFile)
+	if err := ioutil.WriteFile(name+".tmp", data, 0644); err != nil {
+		return nil, err
+	}
+	return data, os.Rename(name+".tmp", name)
+}
+
+// ResolveArtifactKey App目录中的文件在存储中的key, 已经保存为blob时为blob的key
+func ResolveArtifactKey(appsRootDir string, appId string, file string) string {
+	appDir := path.Join(appsRootDir, appId)
+	if ref := cachedBuildBlobs(appDir)[file]; ref != nil {
+		if info, err := os.Stat(path.Join(appDir, file)); err == nil && !ref.stale(info) {
+			return BlobKey(ref.SHA256)
+		}
+	}
+	return ArtifactKey(appId, file)
+}
+
+// 导入和GC不能同时进行: 导入时blob已经写入, 但是blobs.json还没有写入
+var gBlobLock sync.Mutex
+
+// StoreBuildBlobs 将App目录中新增或者被替换的文件保存为blob, 并且更新blobs.json
+// 返回blobs.json是否有变化
+func StoreBuildBlobs(storage Storage, appsRootDir string, appId string) (bool, error) {
+	gBlobLock.Lock()
+	defer gBlobLock.Unlock()
+
+	appDir := path.Join(appsRootDir, appId)
+	old, err := ReadBuildBlobs(appDir)
+	rebuild := err != nil
+	if rebuild {
+		log.WarnErrorf(err, "Rebuild %s/%s", appId, BlobsFile)
+		old = nil
+	}
+	files, err := ioutil.ReadDir(appDir)
+	if err != nil {
+		return false, err
+	}
+
+	blobs := make(BuildBlobs)
+	// blobs.json无法解析时重新写入; 没有文件的目录不写入空的blobs.json, 否则watcher会不停地重新扫描
+	changed := rebuild
+	for _, info := range files {
+		name := info.Name()
+		if !isArtifactFile(info) {
+			continue
+		}
+		if ref := old[name]; ref != nil {
+			if !ref.stale(info) {
+				blobs[name] = ref
+				continue
+			}
+			if isAppsRoot(storage, appsRootDir) {
+				removeOverwrittenBlob(path.Join(appsRootDir, BlobKey(ref.SHA256)), info)
+			}
+		}
+		ref, err := storeBlob(storage, appsRootDir, path.Join(appDir, name), info)
+		if err != nil {
+			return false, fmt.Errorf("store %s/%s failed: %v", appId, name, err)
+		}
+		blobs[name] = ref
+		changed = true
+	}
+	if len(blobs) != len(old) {
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+
+	data, err := writeBuildBlobs(appDir, blobs)
+	if err != nil {
+		return false, err
+	}
+	if !isAppsRoot(storage, appsRootDir) {
+		if err := storage.Put(ArtifactKey(appId, BlobsFile), strings.NewReader(string(data)), int64(len(data))); err != nil {
+			return false, fmt.Errorf("push %s/%s failed: %v", appId, BlobsFile, err)
+		}
+	}
+	return true, nil
+}
+
+func storeBlob(storage Storage, appsRootDir string, name string, info os.FileInfo) (*BlobRef, error) {
+	sum, size, err := HashFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key := BlobKey(sum)
+	if isAppsRoot(storage, appsRootDir) {
+		if err := linkBlob(path.Join(appsRootDir, key), name); err != nil {
+			return nil, err
+		}
+	} else if _, err := storage.Stat(key); os.IsNotExist(err) {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		err = storage.Put(key, f, size)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	// 硬链接之后文件的修改时间可能变化
+	linked, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobRef{SHA256: sum, Size: size, ModTime: info.ModTime(), FileModTime: linked.ModTime()}, nil
+}
+
+// linkBlob blob不存在时将文件链接为blob, 否则将文件替换为blob的硬链接
+// 文件系统不支持硬链接时blob保存一份副本, 文件保持不变
+func linkBlob(blob string, name string) error {
+	if err := os.MkdirAll(path.Dir(blob), 0755); err != nil {
+		return err
+	}
+	if !IsExist(blob) {
+		if err := os.Link(name, blob); err != nil {
+			log.Warnf("Link %s failed, copy it instead: %v", name, err)
+			if err := copyFile(name, blob+".tmp"); err != nil {
+				return err
+			}
+			if err := os.Rename(blob+".tmp", blob); err != nil {
+				return err
+			}
+		}
+		// 直接覆盖文件会修改所有链接到这个blob的Build
+		return os.Chmod(blob, 0444)
+	}
+
+	blobInfo, err := os.Stat(blob)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(blobInfo, info) {
+		return nil
+	}
+	tmp := name + ".tmp"
+	os.Remove(tmp)
+	if err := os.Link(blob, tmp); err != nil {
+		log.Warnf("Link %s failed, keep the duplicated file: %v", name, err)
+		return nil
+	}
+	return os.Rename(tmp, name)
+}
+
+// removeOverwrittenBlob 文件被直接覆盖时, 同一个inode的blob已经和sha256不一致, 删除之后按照新的内容重新保存;
+// 链接到这个blob的其它Build的文件也变化了, 扫描时同样重新计算
+func removeOverwrittenBlob(blob string, info os.FileInfo) {
+	blobInfo, err := os.Stat(blob)
+	if err != nil || !os.SameFile(blobInfo, info) {
+		return
+	}
+	log.Warnf("%s was overwritten in place, remove it", blob)
+	if err := os.Remove(blob); err != nil {
+		log.WarnErrorf(err, "Remove %s failed", blob)
+	}
+}
+
+// SyncBuildBlobs 将apps_root中所有的App目录保存为blob, 返回blobs.json有变化的目录
+// 单个目录失败时继续处理其他的目录, 返回最后一个错误
+func SyncBuildBlobs(storage Storage, appsRootDir string) ([]string, error) {
+	dirs, err := ioutil.ReadDir(appsRootDir)
+	if err != nil {
+		return nil, err
+	}
+	var synced []string
+	var lastErr error
+	for _, fi := range dirs {
+		if !fi.IsDir() || isHiddenDir(fi.Name()) {
+			continue
+		}
+		changed, err := StoreBuildBlobs(storage, appsRootDir, fi.Name())
+		if err != nil {
+			log.WarnErrorf(err, "Store blobs of %s failed", fi.Name())
+			lastErr = err
+			continue
+		}
+		if changed {
+			synced = append(synced, fi.Name())
+		}
+	}
+	return synced, lastErr
+}
+
+// BlobRefCounts 根据存储中所有的blobs.json计算每个blob的引用次数, 同时返回Build的数目
+func BlobRefCounts(storage Storage) (map[string]int, int, error) {
+	objects, err := storage.List("")
+	if err != nil {
+		return nil, 0, err
+	}
+	refs := make(map[string]int)
+	builds := 0
+	for _, object := range objects {
+		parts := strings.Split(object.Key, "/")
+		if len(parts) != 2 || parts[1] != BlobsFile || isHiddenDir(parts[0]) {
+			continue
+		}
+		r, err := storage.Get(object.Key)
+		if err != nil {
+			return nil, 0, err
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+		blobs, err := decodeBuildBlobs(data)
+		if err != nil {
+			// 无法确定引用了哪些blob, 不能继续GC
+			return nil, 0, fmt.Errorf("%s: %v", object.Key, err)
+		}
+		builds++
+		for _, ref := range blobs {
+			refs[ref.SHA256]++
+		}
+	}
+	return refs, builds, nil
+}
+
+type BlobGCResult struct {
+	Builds     int
+	Blobs      int
+	Referenced int
+	// 引用的总次数, 减去Referenced即为去重节省的文件数
+	References int
+	Removed    []*ObjectInfo
+	FreedBytes int64
+}
+
+// GCBlobs 删除没有被任何Build引用的blob, 最近grace时间内写入的blob不删除
+func GCBlobs(storage Storage, grace time.Duration, dryRun bool) (*BlobGCResult, error) {
+	gBlobLock.Lock()
+	defer gBlobLock.Unlock()
+
+	refs, builds, err := BlobRefCounts(storage)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := storage.List(blobPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BlobGCResult{Builds: builds}
+	for _, count := range refs {
+		result.References += count
+	}
+	for _, object := range objects {
+		sum := path.Base(object.Key)
+		if strings.HasSuffix(sum, ".tmp") {
+			continue
+		}
+		result.Blobs++
+		if refs[sum] > 0 {
+			result.Referenced++
+			continue
+		}
+		if time.Since(object.ModTime) < grace {
+			continue
+		}
+		if !dryRun {
+			if err := storage.Delete(object.Key); err != nil {
+				return result, err
+			}
+			log.Infof("Removed unreferenced blob %s (%d bytes)", sum, object.Size)
+		}
+		result.Removed = append(result.Removed, object)
+		result.FreedBytes += object.Size
+	}
+	return result, nil
+}
+
+// BlobGCGrace 配置的blob_gc_grace
+func BlobGCGrace() time.Duration {
+	return time.Duration(beego.AppConfig.DefaultInt("blob_gc_grace", 24)) * time.Hour
+}
+
+// pullBuildBlobs 根据blobs.json从存储中下载App目录中的文件, 并且校验SHA-256
+func pullBuildBlobs(storage Storage, appId string, dir string) error {
+	r, err := storage.Get(ArtifactKey(appId, BlobsFile))
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	blobs, err := decodeBuildBlobs(data)
+	if err != nil {
+		return err
+	}
+
+	files := make([]string, 0, len(blobs))
+	for file := range blobs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		ref := blobs[file]
+		dst := path.Join(dir, file)
+		if err := downloadObject(storage, &ObjectInfo{Key: BlobKey(ref.SHA256), Size: ref.Size}, dst); err != nil {
+			return fmt.Errorf("pull %s failed: %v", file, err)
+		}
+		if sum, _, err := HashFile(dst); err != nil {
+			return err
+		} else if sum != ref.SHA256 {
+			return fmt.Errorf("pull %s failed: sha256 mismatch, expected %s, got %s", file, ref.SHA256, sum)
+		}
+		// 保留原来的修改时间(发布时间)
+		if !ref.ModTime.IsZero() {
+			if err := os.Chtimes(dst, ref.ModTime, ref.ModTime); err != nil {
+				return err
+			}
+		}
+		info, err := os.Stat(dst)
+		if err != nil {
+			return err
+		}
+		ref.FileModTime = info.ModTime()
+	}
+	_, err = writeBuildBlobs(dir, blobs)
+	return err
+}
@@ -0,0 +1,163 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeBuild(t *testing.T, appsRoot string, appId string, files map[string]string, modTime time.Time) {
+	appDir := path.Join(appsRoot, appId)
+	assert.NoError(t, os.MkdirAll(appDir, 0755))
+	for name, content := range files {
+		assert.NoError(t, ioutil.WriteFile(path.Join(appDir, name), []byte(content), 0644))
+		assert.NoError(t, os.Chtimes(path.Join(appDir, name), modTime, modTime))
+	}
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestBlobStore"
+//
+func TestBlobStore(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+	storage := NewLocalStorage(appsRoot)
+
+	released := time.Date(2016, 5, 1, 10, 0, 0, 0, time.Local)
+	writeBuild(t, appsRoot, "demo_1", map[string]string{"app.ipa": "ipa", "app.png": "png"}, released)
+	writeBuild(t, appsRoot, "demo_2", map[string]string{"app.ipa": "ipa", "app.png": "png2"}, released.Add(time.Hour))
+	os.MkdirAll(path.Join(appsRoot, ".trash", "old_1"), 0755)
+	os.MkdirAll(path.Join(appsRoot, "empty_1"), 0755)
+
+	synced, err := SyncBuildBlobs(storage, appsRoot)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"demo_1", "demo_2"}, synced)
+	synced, err = SyncBuildBlobs(storage, appsRoot)
+	assert.NoError(t, err)
+	assert.Empty(t, synced)
+	// 没有文件的目录不写入blobs.json
+	assert.False(t, IsExist(path.Join(appsRoot, "empty_1", BlobsFile)))
+
+	// 相同的ipa只保存一份
+	sum, _, _ := HashFile(path.Join(appsRoot, "demo_1", "app.ipa"))
+	blob, _ := os.Stat(path.Join(appsRoot, BlobKey(sum)))
+	ipa1, _ := os.Stat(path.Join(appsRoot, "demo_1", "app.ipa"))
+	ipa2, _ := os.Stat(path.Join(appsRoot, "demo_2", "app.ipa"))
+	assert.True(t, os.SameFile(blob, ipa1))
+	assert.True(t, os.SameFile(blob, ipa2))
+	// 只读, 不能直接覆盖共享的inode
+	assert.Equal(t, os.FileMode(0444), ipa1.Mode().Perm())
+	assert.Equal(t, ".blobs/sha256/"+sum[:2]+"/"+sum, ResolveArtifactKey(appsRoot, "demo_2", "app.ipa"))
+	assert.Equal(t, "demo_2/app.plist", ResolveArtifactKey(appsRoot, "demo_2", "app.plist"))
+
+	// 发布时间仍然是原来的修改时间
+	blobs, err := ReadBuildBlobs(path.Join(appsRoot, "demo_2"))
+	assert.NoError(t, err)
+	assert.True(t, released.Add(time.Hour).Equal(blobs.ModTime("app.ipa", ipa2)))
+	assert.Equal(t, sha256Hex("ipa"), blobs["app.ipa"].SHA256)
+	assert.Equal(t, sha256Hex("png2"), blobs["app.png"].SHA256)
+
+	refs, builds, err := BlobRefCounts(storage)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, builds)
+	assert.Equal(t, 2, refs[sum])
+
+	// 替换的文件重新保存为blob
+	writeBuild(t, appsRoot, "demo_2", map[string]string{"app.png.tmp": "png3"}, time.Now())
+	os.Rename(path.Join(appsRoot, "demo_2", "app.png.tmp"), path.Join(appsRoot, "demo_2", "app.png"))
+	png, _ := os.Stat(path.Join(appsRoot, "demo_2", "app.png"))
+	assert.Equal(t, "demo_2/app.png", ResolveArtifactKey(appsRoot, "demo_2", "app.png"))
+	assert.True(t, png.ModTime().Equal(blobs.ModTime("app.png", png)))
+	synced, err = SyncBuildBlobs(storage, appsRoot)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"demo_2"}, synced)
+
+	// 删除demo_2之后, png2和png3没有被引用
+	os.RemoveAll(path.Join(appsRoot, "demo_2"))
+	result, err := GCBlobs(storage, time.Hour, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Builds)
+	assert.Equal(t, 4, result.Blobs)
+	assert.Equal(t, 2, result.Referenced)
+	// png3是刚刚写入的
+	assert.Len(t, result.Removed, 1)
+	assert.Equal(t, int64(4), result.FreedBytes)
+
+	result, err = GCBlobs(storage, 0, false)
+	assert.NoError(t, err)
+	assert.Len(t, result.Removed, 2)
+	objects, _ := storage.List(blobPrefix)
+	assert.Len(t, objects, 2)
+	data, _ := ioutil.ReadFile(path.Join(appsRoot, "demo_1", "app.ipa"))
+	assert.Equal(t, "ipa", string(data))
+
+	// 仍然被直接覆盖的文件(和blob是同一个inode)按照新的内容重新保存, 旧的blob被删除
+	ipa := path.Join(appsRoot, "demo_1", "app.ipa")
+	os.Chmod(ipa, 0644)
+	assert.NoError(t, ioutil.WriteFile(ipa, []byte("ipa-new"), 0644))
+	assert.Equal(t, "demo_1/app.ipa", ResolveArtifactKey(appsRoot, "demo_1", "app.ipa"))
+	synced, err = SyncBuildBlobs(storage, appsRoot)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"demo_1"}, synced)
+	assert.False(t, IsExist(path.Join(appsRoot, BlobKey(sum))))
+	blob, _ = os.Stat(path.Join(appsRoot, BlobKey(sha256Hex("ipa-new"))))
+	ipa1, _ = os.Stat(ipa)
+	assert.True(t, os.SameFile(blob, ipa1))
+	assert.Equal(t, BlobKey(sha256Hex("ipa-new")), ResolveArtifactKey(appsRoot, "demo_1", "app.ipa"))
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestBlobStoreSync"
+//
+func TestBlobStoreSync(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+	remoteRoot, _ := ioutil.TempDir("", "storage")
+	defer os.RemoveAll(remoteRoot)
+	storage := NewLocalStorage(remoteRoot)
+
+	released := time.Date(2016, 5, 1, 10, 0, 0, 0, time.Local)
+	writeBuild(t, appsRoot, "demo_1", map[string]string{"app.apk": "apk", "app.json": "{}"}, released)
+	writeBuild(t, appsRoot, "demo_2", map[string]string{"app.apk": "apk", "app.json": `{"title":"Demo"}`}, released)
+	_, err := SyncBuildBlobs(storage, appsRoot)
+	assert.NoError(t, err)
+
+	// 存储中只有blob和blobs.json
+	objects, _ := storage.List("")
+	assert.Equal(t, []string{"demo_1", "demo_2"}, StorageAppIds(objects))
+	for _, object := range objects {
+		assert.True(t, strings.HasSuffix(object.Key, "/"+BlobsFile), object.Key)
+	}
+	objects, _ = storage.List(blobPrefix)
+	assert.Len(t, objects, 3)
+
+	// 另一个实例下载时校验SHA-256, 并且保留发布时间
+	otherRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(otherRoot)
+	pulled, err := PullAppDirs(storage, otherRoot)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"demo_1", "demo_2"}, pulled)
+	data, _ := ioutil.ReadFile(path.Join(otherRoot, "demo_2", "app.json"))
+	assert.Equal(t, `{"title":"Demo"}`, string(data))
+	info, _ := os.Stat(path.Join(otherRoot, "demo_2", "app.apk"))
+	assert.True(t, released.Equal(info.ModTime()))
+	synced, err := SyncBuildBlobs(storage, otherRoot)
+	assert.NoError(t, err)
+	assert.Empty(t, synced)
+
+	// blob被修改时下载失败
+	sum, _, _ := HashFile(path.Join(appsRoot, "demo_1", "app.apk"))
+	os.Chmod(path.Join(remoteRoot, BlobKey(sum)), 0644)
+	ioutil.WriteFile(path.Join(remoteRoot, BlobKey(sum)), []byte("bad"), 0644)
+	os.RemoveAll(path.Join(otherRoot, "demo_1"))
+	_, err = PullAppDirs(storage, otherRoot)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "sha256 mismatch")
+	}
+	assert.False(t, IsExist(path.Join(otherRoot, "demo_1")))
+}
@@ -0,0 +1,79 @@
+package backends
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// BuildInfoFile Build目录中可选的元数据, 由import --notes等参数或者CI写入
+const BuildInfoFile = "build.json"
+
+type BuildInfo struct {
+	// 页面上显示的名字, 为空时使用ipa/apk中的名字
+	Name string `json:"name,omitempty"`
+	// 发布说明; notes, channel, uploader总是写入build.json, 空字符串表示在后台清空了
+	Notes string `json:"notes"`
+	// 例如: beta, nightly, 为空时不属于任何渠道
+	Channel  string `json:"channel"`
+	Uploader string `json:"uploader"`
+	// 置顶的Build显示在最前面, 并且不会被保留策略清理
+	Pinned bool `json:"pinned,omitempty"`
+	// 隐藏的Build不在首页和/api/builds中显示, 仍然可以通过链接下载
+	Hidden bool `json:"hidden,omitempty"`
+	// 强制更新, 低于这个版本的App检查更新时必须更新
+	Mandatory bool `json:"mandatory,omitempty"`
+}
+
+// ReadBuildInfo 读取build.json, 没有时返回空的BuildInfo;
+// build.json中没有notes, channel, uploader时(之前的版本写入的), 使用Android的app.json中的值作为默认值
+func ReadBuildInfo(appDir string, appJson map[string]interface{}) (*BuildInfo, error) {
+	info := &BuildInfo{
+		Notes:    firstString(appJson, "notes"),
+		Channel:  firstString(appJson, "channel"),
+		Uploader: firstString(appJson, "uploader"),
+	}
+	data, err := ioutil.ReadFile(path.Join(appDir, BuildInfoFile))
+	if os.IsNotExist(err) {
+		return info, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var saved BuildInfo
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	// 区分没有写入和写入了空字符串
+	var present struct {
+		Notes    *string `json:"notes"`
+		Channel  *string `json:"channel"`
+		Uploader *string `json:"uploader"`
+	}
+	json.Unmarshal(data, &present)
+	if present.Notes != nil {
+		info.Notes = saved.Notes
+	}
+	if present.Channel != nil {
+		info.Channel = saved.Channel
+	}
+	if present.Uploader != nil {
+		info.Uploader = saved.Uploader
+	}
+	info.Name, info.Pinned, info.Hidden, info.Mandatory = saved.Name, saved.Pinned, saved.Hidden, saved.Mandatory
+	return info, nil
+}
+
+// WriteBuildInfo 先写临时文件再rename, 扫描时不会读到一半的文件
+func WriteBuildInfo(appDir string, info *BuildInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := path.Join(appDir, BuildInfoFile+".tmp")
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path.Join(appDir, BuildInfoFile))
+}
@@ -0,0 +1,258 @@
+package backends
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+)
+
+//
+// 扫描时计算App目录中每个文件的SHA-256和MD5, 保存在checksums.json中
+// 文件的大小和修改时间没有变化时不重新计算, 因此磁盘上的文件损坏需要通过 verify --checksums 重新计算才能发现
+//
+
+const ChecksumsFile = "checksums.json"
+
+type fileChecksum struct {
+	SHA256  string    `json:"sha256"`
+	MD5     string    `json:"md5"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func (c *fileChecksum) stale(info os.FileInfo) bool {
+	return info.Size() != c.Size || !info.ModTime().Equal(c.ModTime)
+}
+
+func (c *fileChecksum) checksum() *models.Checksum {
+	return &models.Checksum{SHA256: c.SHA256, MD5: c.MD5, Size: c.Size}
+}
+
+// HashFileChecksum 同时计算文件的SHA-256和MD5
+func HashFileChecksum(name string) (*models.Checksum, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sha, md := sha256.New(), md5.New()
+	size, err := io.Copy(io.MultiWriter(sha, md), f)
+	if err != nil {
+		return nil, err
+	}
+	return &models.Checksum{SHA256: hex.EncodeToString(sha.Sum(nil)), MD5: hex.EncodeToString(md.Sum(nil)), Size: size}, nil
+}
+
+func readChecksums(appDir string) (map[string]*fileChecksum, error) {
+	data, err := ioutil.ReadFile(path.Join(appDir, ChecksumsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var checksums map[string]*fileChecksum
+	if err := json.Unmarshal(data, &checksums); err != nil {
+		return nil, fmt.Errorf("parse %s failed: %v", ChecksumsFile, err)
+	}
+	return checksums, nil
+}
+
+var checksumsCache = newFileCache()
+
+// cachedChecksums 下载时使用, checksums.json没有变化时不重复解析
+func cachedChecksums(appDir string) map[string]*fileChecksum {
+	name := path.Join(appDir, ChecksumsFile)
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil
+	}
+	if checksums, ok := checksumsCache.get(name, info); ok {
+		return checksums.(map[string]*fileChecksum)
+	}
+	checksums, err := readChecksums(appDir)
+	if err != nil {
+		log.WarnErrorf(err, "Read %s failed", name)
+	}
+	checksumsCache.put(name, info, checksums)
+	return checksums
+}
+
+// isArtifactFile App目录中的Build文件, 不包括checksums.json, blobs.json以及临时文件
+func isArtifactFile(info os.FileInfo) bool {
+	name := info.Name()
+	return info.Mode().IsRegular() && name != ChecksumsFile && name != BlobsFile && !strings.HasSuffix(name, ".tmp")
+}
+
+var gChecksumLock sync.Mutex
+
+// UpdateChecksums 计算App目录中新增或者变化的文件的校验和, 有变化时写入checksums.json
+// checksums.json写入失败(例如: apps_root只读)时只记录日志, 仍然返回计算的结果
+func UpdateChecksums(appDir string) (map[string]*models.Checksum, error) {
+	gChecksumLock.Lock()
+	defer gChecksumLock.Unlock()
+
+	old, err := readChecksums(appDir)
+	if err != nil {
+		log.WarnErrorf(err, "Rebuild %s", path.Join(appDir, ChecksumsFile))
+		old = nil
+	}
+	files, err := ioutil.ReadDir(appDir)
+	if err != nil {
+		return nil, err
+	}
+
+	checksums := make(map[string]*fileChecksum)
+	changed := false
+	for _, info := range files {
+		if !isArtifactFile(info) {
+			continue
+		}
+		if c := old[info.Name()]; c != nil && !c.stale(info) {
+			checksums[info.Name()] = c
+			continue
+		}
+		c, err := HashFileChecksum(path.Join(appDir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		checksums[info.Name()] = &fileChecksum{SHA256: c.SHA256, MD5: c.MD5, Size: c.Size, ModTime: info.ModTime()}
+		changed = true
+	}
+	if changed || len(checksums) != len(old) {
+		if err := writeChecksums(appDir, checksums); err != nil {
+			log.WarnErrorf(err, "Write %s failed", path.Join(appDir, ChecksumsFile))
+		}
+	}
+
+	result := make(map[string]*models.Checksum, len(checksums))
+	for file, c := range checksums {
+		result[file] = c.checksum()
+	}
+	return result, nil
+}
+
+func writeChecksums(appDir string, checksums map[string]*fileChecksum) error {
+	data, err := json.MarshalIndent(checksums, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := path.Join(appDir, ChecksumsFile)
+	if err := ioutil.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// setIosChecksums 扫描时计算校验和, 失败时只记录日志
+func setIosChecksums(apiBase string, appDir string, appMeta *models.IosAppDirMeta) {
+	checksums, err := UpdateChecksums(appDir)
+	if err != nil {
+		log.WarnErrorf(err, "Update checksums of %s failed", appMeta.Id)
+		return
+	}
+	appMeta.Checksums = checksums
+	appMeta.Checksum = checksums["app.ipa"]
+	appMeta.ChecksumsUrl = fmt.Sprintf("%s/checksums/%s", apiBase, appMeta.Id)
+}
+
+func setAndroidChecksums(apiBase string, appDir string, appMeta *models.AndroidAppDirMeta) {
+	checksums, err := UpdateChecksums(appDir)
+	if err != nil {
+		log.WarnErrorf(err, "Update checksums of %s failed", appMeta.Id)
+		return
+	}
+	appMeta.Checksums = checksums
+	for _, artifact := range appMeta.Artifacts {
+		artifact.Checksum = checksums[artifact.File]
+	}
+	if len(appMeta.Artifacts) > 0 {
+		appMeta.Checksum = appMeta.Artifacts[0].Checksum
+	}
+	appMeta.ChecksumsUrl = fmt.Sprintf("%s/checksums/%s", apiBase, appMeta.Id)
+}
+
+// ArtifactChecksum 下载时使用的校验和, 没有计算或者文件已经变化时返回nil
+func ArtifactChecksum(appsRootDir string, appId string, file string) *models.Checksum {
+	appDir := path.Join(appsRootDir, appId)
+	c := cachedChecksums(appDir)[file]
+	if c == nil {
+		return nil
+	}
+	if info, err := os.Stat(path.Join(appDir, file)); err != nil || c.stale(info) {
+		return nil
+	}
+	return c.checksum()
+}
+
+// DigestHeader RFC 3230的Digest, 例如: SHA-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=
+func DigestHeader(c *models.Checksum) string {
+	return "SHA-256=" + hexToBase64(c.SHA256)
+}
+
+// ContentMD5Header RFC 1864的Content-MD5
+func ContentMD5Header(c *models.Checksum) string {
+	return hexToBase64(c.MD5)
+}
+
+func hexToBase64(s string) string {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// VerifyChecksums 重新计算App目录中文件的校验和, 返回和checksums.json不一致的文件
+// 修改时间变化的文件是被替换的, 下次扫描时重新计算, 不作为问题
+func VerifyChecksums(appDir string) []string {
+	checksums, err := readChecksums(appDir)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if len(checksums) == 0 {
+		return []string{ChecksumsFile + " not found, run scan first"}
+	}
+
+	files := make([]string, 0, len(checksums))
+	for file := range checksums {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var problems []string
+	for _, file := range files {
+		expected := checksums[file]
+		info, err := os.Stat(path.Join(appDir, file))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", file, err))
+			continue
+		}
+		if !info.ModTime().Equal(expected.ModTime) {
+			continue
+		}
+		actual, err := HashFileChecksum(path.Join(appDir, file))
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %v", file, err))
+		case actual.Size != expected.Size:
+			problems = append(problems, fmt.Sprintf("%s: size mismatch, expected %d, got %d", file, expected.Size, actual.Size))
+		case actual.SHA256 != expected.SHA256 || actual.MD5 != expected.MD5:
+			problems = append(problems, fmt.Sprintf("%s: sha256 mismatch, expected %s, got %s", file, expected.SHA256, actual.SHA256))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,86 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestChecksums"
+//
+func TestChecksums(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+	appDir := path.Join(appsRoot, "demo_1")
+	released := time.Date(2016, 5, 1, 10, 0, 0, 0, time.Local)
+	writeBuild(t, appsRoot, "demo_1", map[string]string{"app.ipa": "hello", "app.png": "png", "app.ipa.tmp": "tmp"}, released)
+
+	checksums, err := UpdateChecksums(appDir)
+	assert.NoError(t, err)
+	assert.Len(t, checksums, 2)
+	c := checksums["app.ipa"]
+	if assert.NotNil(t, c) {
+		assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", c.SHA256)
+		assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", c.MD5)
+		assert.Equal(t, int64(5), c.Size)
+		assert.Equal(t, "SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=", DigestHeader(c))
+		assert.Equal(t, "XUFAKrxLKna5cZ2REBfFkg==", ContentMD5Header(c))
+	}
+	assert.True(t, IsExist(path.Join(appDir, ChecksumsFile)))
+	assert.Equal(t, c, ArtifactChecksum(appsRoot, "demo_1", "app.ipa"))
+	assert.Nil(t, ArtifactChecksum(appsRoot, "demo_1", "app.plist"))
+	assert.Empty(t, VerifyChecksums(appDir))
+
+	// 文件没有变化时使用保存的结果
+	ioutil.WriteFile(path.Join(appDir, ChecksumsFile),
+		[]byte(`{"app.ipa": {"sha256": "cached", "md5": "cached", "size": 5, "mod_time": "`+released.Format(time.RFC3339Nano)+`"}}`), 0644)
+	checksums, err = UpdateChecksums(appDir)
+	assert.NoError(t, err)
+	assert.Equal(t, "cached", checksums["app.ipa"].SHA256)
+	assert.NotEqual(t, "cached", checksums["app.png"].SHA256)
+
+	// 替换的文件重新计算, 并且不再使用旧的校验和
+	writeBuild(t, appsRoot, "demo_1", map[string]string{"app.ipa": "world!"}, time.Now())
+	assert.Nil(t, ArtifactChecksum(appsRoot, "demo_1", "app.ipa"))
+	checksums, err = UpdateChecksums(appDir)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), checksums["app.ipa"].Size)
+	assert.Equal(t, checksums["app.ipa"], ArtifactChecksum(appsRoot, "demo_1", "app.ipa"))
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestVerifyChecksums"
+//
+func TestVerifyChecksums(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+	appDir := path.Join(appsRoot, "demo_1")
+	released := time.Date(2016, 5, 1, 10, 0, 0, 0, time.Local)
+	writeBuild(t, appsRoot, "demo_1", map[string]string{"app.apk": "apk", "app.json": "{}", "app.png": "png"}, released)
+
+	assert.Equal(t, []string{"checksums.json not found, run scan first"}, VerifyChecksums(appDir))
+	_, err := UpdateChecksums(appDir)
+	assert.NoError(t, err)
+
+	// 修改时间不变的损坏, 扫描时发现不了
+	writeBuild(t, appsRoot, "demo_1", map[string]string{"app.apk": "APK", "app.json": "{} "}, released)
+	os.Remove(path.Join(appDir, "app.png"))
+	problems := VerifyChecksums(appDir)
+	if assert.Len(t, problems, 3) {
+		assert.Equal(t, "app.apk: sha256 mismatch, expected "+sha256Hex("apk")+", got "+sha256Hex("APK"), problems[0])
+		assert.Equal(t, "app.json: size mismatch, expected 2, got 3", problems[1])
+		assert.Contains(t, problems[2], "app.png: ")
+	}
+	checksums, err := UpdateChecksums(appDir)
+	assert.NoError(t, err)
+	assert.Equal(t, sha256Hex("apk"), checksums["app.apk"].SHA256)
+
+	// 替换的文件(修改时间变化)不是损坏
+	writeBuild(t, appsRoot, "demo_1", map[string]string{"app.apk": "new apk", "app.json": "{}"}, time.Now())
+	assert.Empty(t, VerifyChecksums(appDir))
+}
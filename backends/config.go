@@ -0,0 +1,20 @@
+package backends
+
+import (
+	"strings"
+
+	"github.com/astaxie/beego"
+)
+
+// ConfigStrings 读取以";"分隔的配置项
+// beego.AppConfig.Strings 在当前runmode下没有对应的配置时会panic, 因此这里自己解析
+func ConfigStrings(key string) []string {
+	var result []string
+	for _, item := range strings.Split(beego.AppConfig.String(key), ";") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
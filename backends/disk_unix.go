@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package backends
+
+import "syscall"
+
+// DiskFree 返回目录所在分区的可用空间(字节)
+func DiskFree(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
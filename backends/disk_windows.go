@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package backends
+
+import "errors"
+
+// DiskFree 返回目录所在分区的可用空间(字节)
+func DiskFree(dir string) (uint64, error) {
+	return 0, errors.New("disk free space is not supported on windows")
+}
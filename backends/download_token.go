@@ -0,0 +1,118 @@
+package backends
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego"
+)
+
+//
+// 私有组织的Build需要Basic Auth, 但是iOS安装App时系统下载plist和ipa不会带上Safari的认证信息;
+// 安装链接中带上签名的download_token, 有效期之内可以下载组织中的Build, 在app.conf中配置:
+//   download_token_secret: 签名的密钥, 为空时使用 apps_root/.download_secret (第一次使用时生成),
+//                          多个实例(例如: follower)提供下载时需要配置相同的密钥
+//   download_token_hours: 有效期(小时), 默认24
+//
+
+const downloadSecretFile = ".download_secret"
+
+var gDownloadSecretLock sync.Mutex
+
+// apps_root => 密钥
+var gDownloadSecrets = make(map[string][]byte)
+
+// DownloadTokenExpiration download_token的有效期, 默认24小时
+func DownloadTokenExpiration() time.Duration {
+	return time.Duration(beego.AppConfig.DefaultInt("download_token_hours", 24)) * time.Hour
+}
+
+func downloadSecret(appsRootDir string) ([]byte, error) {
+	if secret := beego.AppConfig.String("download_token_secret"); secret != "" {
+		return []byte(secret), nil
+	}
+
+	gDownloadSecretLock.Lock()
+	defer gDownloadSecretLock.Unlock()
+	if secret, ok := gDownloadSecrets[appsRootDir]; ok {
+		return secret, nil
+	}
+
+	file := path.Join(appsRootDir, downloadSecretFile)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		token, err := randomToken()
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(file+".tmp", []byte(token), 0600); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(file+".tmp", file); err != nil {
+			return nil, err
+		}
+		data = []byte(token)
+	} else if err != nil {
+		return nil, err
+	}
+	secret := []byte(strings.TrimSpace(string(data)))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s is empty", file)
+	}
+	gDownloadSecrets[appsRootDir] = secret
+	return secret, nil
+}
+
+func signDownload(secret []byte, orgId string, user string, expires int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", orgId, user, expires)
+	return mac.Sum(nil)
+}
+
+// SignDownloadToken 组织成员user的download_token, 格式为: <过期时间>.<user(hex)>.<签名>
+func SignDownloadToken(appsRootDir string, orgId string, user string, now time.Time) (string, error) {
+	secret, err := downloadSecret(appsRootDir)
+	if err != nil {
+		return "", err
+	}
+	expires := now.Add(DownloadTokenExpiration()).Unix()
+	sig := signDownload(secret, orgId, user, expires)
+	return fmt.Sprintf("%d.%s.%s", expires, hex.EncodeToString([]byte(user)), hex.EncodeToString(sig)), nil
+}
+
+// VerifyDownloadToken 校验token是否为组织orgId签发并且没有过期, 返回签发时的用户
+func VerifyDownloadToken(appsRootDir string, orgId string, token string, now time.Time) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return "", false
+	}
+	user, err := hex.DecodeString(parts[1])
+	if err != nil || len(user) == 0 {
+		return "", false
+	}
+	sig, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return "", false
+	}
+	secret, err := downloadSecret(appsRootDir)
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(sig, signDownload(secret, orgId, string(user), expires)) {
+		return "", false
+	}
+	return string(user), true
+}
@@ -0,0 +1,42 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestDownloadToken"
+//
+func TestDownloadToken(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+
+	now := time.Now()
+	token, err := SignDownloadToken(appsRoot, "partner", "bob", now)
+	assert.NoError(t, err)
+	assert.True(t, IsExist(path.Join(appsRoot, downloadSecretFile)))
+
+	user, ok := VerifyDownloadToken(appsRoot, "partner", token, now.Add(time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, "bob", user)
+
+	// 过期, 其他组织, 修改了用户或者签名
+	_, ok = VerifyDownloadToken(appsRoot, "partner", token, now.Add(DownloadTokenExpiration()))
+	assert.False(t, ok)
+	_, ok = VerifyDownloadToken(appsRoot, "chunyu", token, now)
+	assert.False(t, ok)
+	parts := strings.Split(token, ".")
+	_, ok = VerifyDownloadToken(appsRoot, "partner", parts[0]+".616c696365."+parts[2], now)
+	assert.False(t, ok)
+	_, ok = VerifyDownloadToken(appsRoot, "partner", parts[0]+"."+parts[1]+".00", now)
+	assert.False(t, ok)
+	_, ok = VerifyDownloadToken(appsRoot, "partner", "", now)
+	assert.False(t, ok)
+}
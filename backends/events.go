@@ -0,0 +1,224 @@
+package backends
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/models"
+)
+
+// Build的变化, 扫描完成之后通过/api/events推送给首页
+const (
+	BuildAdded   = "added"
+	BuildRemoved = "removed"
+	BuildUpdated = "updated"
+)
+
+// 重连时最多补发的事件数
+const maxRecentEvents = 100
+
+// 订阅者处理不过来时断开, 客户端重连时根据Last-Event-ID补发
+const eventBufferSize = 64
+
+type BuildEvent struct {
+	// 递增的序号, 作为SSE的id
+	Seq      int64     `json:"seq"`
+	Type     string    `json:"type"`
+	Id       string    `json:"id"`
+	Platform string    `json:"platform"`
+	Org      string    `json:"org,omitempty"`
+	// 用于判断订阅者是否可以看到指定给测试组的Build
+	BundleId string    `json:"bundle_id"`
+	Channel  string    `json:"channel,omitempty"`
+	Name     string    `json:"name"`
+	Version  string    `json:"version"`
+	Time     time.Time `json:"time"`
+}
+
+type EventSubscription struct {
+	// 被关闭时表示订阅者落后太多, 需要重新连接
+	Events chan *BuildEvent
+	broker *eventBroker
+}
+
+// Close 取消订阅
+func (s *EventSubscription) Close() {
+	s.broker.lock.Lock()
+	defer s.broker.lock.Unlock()
+	if s.broker.subscribers[s] {
+		delete(s.broker.subscribers, s)
+		close(s.Events)
+	}
+}
+
+type eventBroker struct {
+	lock        sync.Mutex
+	seq         int64
+	recent      []*BuildEvent
+	subscribers map[*EventSubscription]bool
+}
+
+// 序号从启动时间开始, 进程重启之后旧页面的Last-Event-ID不会和新的序号混淆
+var gEventBroker = &eventBroker{
+	seq:         time.Now().Unix() * 1000,
+	subscribers: make(map[*EventSubscription]bool),
+}
+
+// BuildEventSeq 最近一次事件的序号, 首页渲染时记录, 订阅时补发之后的事件
+func BuildEventSeq() int64 {
+	gEventBroker.lock.Lock()
+	defer gEventBroker.lock.Unlock()
+	return gEventBroker.seq
+}
+
+// SubscribeBuildEvents 订阅Build的变化, 同时返回lastSeq之后错过的事件;
+// lastSeq之后的事件已经无法补发(例如进程重启过)时ok为false, 客户端需要重新加载
+func SubscribeBuildEvents(lastSeq int64) (sub *EventSubscription, missed []*BuildEvent, ok bool) {
+	b := gEventBroker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ok = true
+	if lastSeq > 0 && lastSeq != b.seq {
+		if lastSeq > b.seq || len(b.recent) == 0 || b.recent[0].Seq > lastSeq+1 {
+			ok = false
+		} else {
+			for _, e := range b.recent {
+				if e.Seq > lastSeq {
+					missed = append(missed, e)
+				}
+			}
+		}
+	}
+
+	sub = &EventSubscription{
+		Events: make(chan *BuildEvent, eventBufferSize),
+		broker: b,
+	}
+	b.subscribers[sub] = true
+	EventSubscribers.Set(float64(len(b.subscribers)))
+	return sub, missed, ok
+}
+
+func publishBuildEvents(events []*BuildEvent) {
+	if len(events) == 0 {
+		return
+	}
+	b := gEventBroker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, e := range events {
+		b.seq++
+		e.Seq = b.seq
+		b.recent = append(b.recent, e)
+		BuildEventsTotal.Inc(e.Type)
+	}
+	if len(b.recent) > maxRecentEvents {
+		b.recent = append([]*BuildEvent{}, b.recent[len(b.recent)-maxRecentEvents:]...)
+	}
+
+	for sub := range b.subscribers {
+		for _, e := range events {
+			select {
+			case sub.Events <- e:
+			default:
+				// 不能因为一个慢的订阅者阻塞扫描
+				delete(b.subscribers, sub)
+				close(sub.Events)
+			}
+			if !b.subscribers[sub] {
+				break
+			}
+		}
+	}
+	EventSubscribers.Set(float64(len(b.subscribers)))
+}
+
+// 用于比较Build是否有变化的摘要: 文件的校验和, 发布时间以及所属的组织
+type buildSummary struct {
+	event       BuildEvent
+	fingerprint string
+}
+
+func buildFingerprint(org string, releaseDate string, size string, checksums map[string]*models.Checksum) string {
+	files := make([]string, 0, len(checksums))
+	for file, c := range checksums {
+		files = append(files, fmt.Sprintf("%s=%s", file, c.SHA256))
+	}
+	sort.Strings(files)
+	return strings.Join(append([]string{org, releaseDate, size}, files...), "\n")
+}
+
+func summarizeBuilds(iosAppDirs []*models.IosAppDirMeta, androidAppDirs []*models.AndroidAppDirMeta) map[string]*buildSummary {
+	result := make(map[string]*buildSummary, len(iosAppDirs)+len(androidAppDirs))
+	// 隐藏的Build对首页来说是被删除
+	for _, app := range iosAppDirs {
+		if app.Hidden {
+			continue
+		}
+		result["ios/"+app.Id] = &buildSummary{
+			event:       BuildEvent{Id: app.Id, Platform: "ios", Org: app.Org, BundleId: app.BundleId, Channel: app.Channel, Name: app.Name, Version: app.Version},
+			fingerprint: buildFingerprint(app.Org, app.ReleaseDate, app.Size, app.Checksums),
+		}
+	}
+	for _, app := range androidAppDirs {
+		if app.Hidden {
+			continue
+		}
+		result["android/"+app.Id] = &buildSummary{
+			event:       BuildEvent{Id: app.Id, Platform: "android", Org: app.Org, BundleId: app.BundleId, Channel: app.Channel, Name: app.Name, Version: app.Version},
+			fingerprint: buildFingerprint(app.Org, app.ReleaseDate, app.Size, app.Checksums),
+		}
+	}
+	return result
+}
+
+// diffBuilds 比较两次扫描的结果, 按照removed, updated, added的顺序返回
+func diffBuilds(oldIos []*models.IosAppDirMeta, oldAndroid []*models.AndroidAppDirMeta,
+	newIos []*models.IosAppDirMeta, newAndroid []*models.AndroidAppDirMeta) []*BuildEvent {
+	before := summarizeBuilds(oldIos, oldAndroid)
+	after := summarizeBuilds(newIos, newAndroid)
+
+	keys := make([]string, 0, len(before)+len(after))
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if before[key] == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	var removed, updated, added []*BuildEvent
+	for _, key := range keys {
+		old, build := before[key], after[key]
+		switch {
+		case build == nil:
+			e := old.event
+			e.Type, e.Time = BuildRemoved, now
+			removed = append(removed, &e)
+		case old == nil:
+			e := build.event
+			e.Type, e.Time = BuildAdded, now
+			added = append(added, &e)
+		case old.event.Org != build.event.Org || old.event.Channel != build.event.Channel:
+			// 换了组织(或者渠道, 可见的测试者可能不同), 对原来可以看到的页面是删除
+			r, a := old.event, build.event
+			r.Type, r.Time = BuildRemoved, now
+			a.Type, a.Time = BuildAdded, now
+			removed = append(removed, &r)
+			added = append(added, &a)
+		case old.fingerprint != build.fingerprint:
+			e := build.event
+			e.Type, e.Time = BuildUpdated, now
+			updated = append(updated, &e)
+		}
+	}
+	return append(append(removed, updated...), added...)
+}
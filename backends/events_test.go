@@ -0,0 +1,90 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func nextBuildEvent(t *testing.T, sub *EventSubscription) *BuildEvent {
+	select {
+	case e := <-sub.Events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no build event")
+	}
+	return nil
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestBuildEvents"
+//
+func TestBuildEvents(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+
+	released := time.Date(2016, 5, 1, 10, 0, 0, 0, time.Local)
+	writeTestAppDir(t, appsRoot, "demo_1", replicaInfoPlist)
+	writeBuild(t, appsRoot, "demo_1", map[string]string{"app.png": "png"}, released)
+	assert.NoError(t, ScanAppRootDir(appsRoot))
+
+	seq := BuildEventSeq()
+	sub, missed, ok := SubscribeBuildEvents(seq)
+	defer sub.Close()
+	assert.True(t, ok)
+	assert.Empty(t, missed)
+
+	// 没有变化时没有事件
+	assert.NoError(t, ScanAppRootDir(appsRoot))
+	assert.Equal(t, seq, BuildEventSeq())
+
+	writeTestAppDir(t, appsRoot, "demo_2", replicaInfoPlist)
+	assert.NoError(t, ScanAppRootDir(appsRoot))
+	e := nextBuildEvent(t, sub)
+	assert.Equal(t, BuildAdded, e.Type)
+	assert.Equal(t, "demo_2", e.Id)
+	assert.Equal(t, "ios", e.Platform)
+	assert.Equal(t, "com.chunyu.Demo", e.BundleId)
+	assert.Equal(t, seq+1, e.Seq)
+
+	writeBuild(t, appsRoot, "demo_1", map[string]string{"app.png": "new png"}, released)
+	os.RemoveAll(path.Join(appsRoot, "demo_2"))
+	assert.NoError(t, ScanAppRootDir(appsRoot))
+	e = nextBuildEvent(t, sub)
+	assert.Equal(t, BuildRemoved, e.Type)
+	assert.Equal(t, "demo_2", e.Id)
+	e = nextBuildEvent(t, sub)
+	assert.Equal(t, BuildUpdated, e.Type)
+	assert.Equal(t, "demo_1", e.Id)
+
+	// 重连时补发错过的事件
+	sub2, missed, ok := SubscribeBuildEvents(seq + 1)
+	sub2.Close()
+	assert.True(t, ok)
+	if assert.Len(t, missed, 2) {
+		assert.Equal(t, seq+2, missed[0].Seq)
+		assert.Equal(t, BuildUpdated, missed[1].Type)
+	}
+
+	// 其他进程的序号无法补发
+	sub3, missed, ok := SubscribeBuildEvents(seq + 100)
+	sub3.Close()
+	assert.False(t, ok)
+	assert.Empty(t, missed)
+
+	// 换了渠道时先删除再添加, 原来可以看到的测试者收到删除的事件
+	before := []*models.IosAppDirMeta{{Id: "demo_3", BundleId: "com.chunyu.Demo"}}
+	after := []*models.IosAppDirMeta{{Id: "demo_3", BundleId: "com.chunyu.Demo", Channel: "beta"}}
+	events := diffBuilds(before, nil, after, nil)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, BuildRemoved, events[0].Type)
+		assert.Equal(t, "", events[0].Channel)
+		assert.Equal(t, BuildAdded, events[1].Type)
+		assert.Equal(t, "beta", events[1].Channel)
+	}
+}
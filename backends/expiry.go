@@ -0,0 +1,355 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego"
+)
+
+//
+// provisioning profile以及签名证书的过期提醒, 在app.conf中配置:
+//   expiry_warning_days: 多少天之内过期的Build标记为即将过期, 默认14天
+//   expiry_notify_interval: 通知的间隔(小时), 默认24小时, 0表示不通知
+//   expiry_webhook: 通知的webhook(POST json)
+//   expiry_email_to: 通知的邮件地址, 以";"分隔, 通过 smtp_addr, smtp_from, smtp_user, smtp_password 发送
+// 通知的时间保存在 apps_root/.expiry_notified.json, 重启之后如果已经超过了间隔立即通知, 并且间隔之内不重复通知同一个Build
+//
+
+func ExpiryWarningDays() int {
+	return beego.AppConfig.DefaultInt("expiry_warning_days", 14)
+}
+
+// buildExpiration 返回profile和签名证书中较早的过期时间
+func buildExpiration(app *models.IosAppDirMeta) (time.Time, string) {
+	if app.Profile == nil {
+		return time.Time{}, ""
+	}
+	expiration, by := app.Profile.ExpirationDate, "profile"
+	for _, cert := range app.Profile.Certificates {
+		if cert.SHA256 != app.SignerCertSHA256 || cert.NotAfter.IsZero() {
+			continue
+		}
+		if expiration.IsZero() || cert.NotAfter.Before(expiration) {
+			expiration, by = cert.NotAfter, "certificate"
+		}
+	}
+	return expiration, by
+}
+
+// daysBetween 向下取整的天数, 例如: 还有23小时过期时为0, 已经过期1小时为-1
+func daysBetween(now time.Time, t time.Time) int {
+	d := t.Sub(now)
+	days := int(d / (24 * time.Hour))
+	if d < 0 && d%(24*time.Hour) != 0 {
+		days--
+	}
+	return days
+}
+
+// setExpiry 根据当前的时间计算距离过期的天数以及状态
+func setExpiry(app *models.IosAppDirMeta, now time.Time, warningDays int) {
+	app.ExpirationDate, app.ExpiresBy = buildExpiration(app)
+	app.DaysToExpiry, app.ExpiryStatus = 0, ""
+	if app.ExpirationDate.IsZero() {
+		return
+	}
+	app.DaysToExpiry = daysBetween(now, app.ExpirationDate)
+	switch {
+	case !app.ExpirationDate.After(now):
+		app.ExpiryStatus = models.ExpiryExpired
+	case app.DaysToExpiry < warningDays:
+		app.ExpiryStatus = models.ExpiryExpiring
+	}
+}
+
+// RefreshExpiry 重新计算所有Build距离过期的天数
+// 扫描的结果可能正在被其他的请求使用, 因此替换为新的拷贝而不是直接修改
+func RefreshExpiry(now time.Time) {
+	warningDays := ExpiryWarningDays()
+
+	gIndexLock.Lock()
+	defer gIndexLock.Unlock()
+	iosAppDirs := make([]*models.IosAppDirMeta, 0, len(gIosAppDirs))
+	for _, app := range gIosAppDirs {
+		copied := *app
+		setExpiry(&copied, now, warningDays)
+		iosAppDirs = append(iosAppDirs, &copied)
+	}
+	gIosAppDirs = iosAppDirs
+}
+
+// ExpiringBuild 即将过期或者已经过期的Build
+type ExpiringBuild struct {
+	Id             string
+	Name           string
+	BundleId       string
+	Version        string
+	Channel        string
+	Org            string
+	Profile        string
+	ExpirationDate time.Time
+	ExpiresBy      string
+	DaysToExpiry   int
+	ExpiryStatus   string
+}
+
+// ExpiringBuilds 返回days天之内过期(包括已经过期)的Build, 按照过期时间排序
+func ExpiringBuilds(appsRoot string, now time.Time, days int) ([]*ExpiringBuild, error) {
+	iosAppDirs, _, err := ListAppDir(appsRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var builds []*ExpiringBuild
+	for _, app := range iosAppDirs {
+		copied := *app
+		setExpiry(&copied, now, days)
+		if copied.ExpiryStatus == "" {
+			continue
+		}
+		builds = append(builds, &ExpiringBuild{
+			Id:             copied.Id,
+			Name:           copied.Name,
+			BundleId:       copied.BundleId,
+			Version:        copied.Version,
+			Channel:        copied.Channel,
+			Org:            copied.Org,
+			Profile:        copied.Profile.Name,
+			ExpirationDate: copied.ExpirationDate,
+			ExpiresBy:      copied.ExpiresBy,
+			DaysToExpiry:   copied.DaysToExpiry,
+			ExpiryStatus:   copied.ExpiryStatus,
+		})
+	}
+	sort.Sort(expiringBuilds(builds))
+	return builds, nil
+}
+
+type expiringBuilds []*ExpiringBuild
+
+func (s expiringBuilds) Len() int           { return len(s) }
+func (s expiringBuilds) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s expiringBuilds) Less(i, j int) bool { return s[i].ExpirationDate.Before(s[j].ExpirationDate) }
+
+// ExpiryNotifier 定期刷新过期的天数, 并且通过webhook/邮件通知即将过期的Build
+type ExpiryNotifier struct {
+	AppsRoot string
+	Interval time.Duration
+	// 通知多少天之内过期的Build
+	WindowDays int
+	Webhook    string
+	EmailTo    []string
+}
+
+func NewExpiryNotifier(appsRoot string) *ExpiryNotifier {
+	return &ExpiryNotifier{
+		AppsRoot:   appsRoot,
+		Interval:   time.Duration(beego.AppConfig.DefaultInt("expiry_notify_interval", 24)) * time.Hour,
+		WindowDays: ExpiryWarningDays(),
+		Webhook:    beego.AppConfig.String("expiry_webhook"),
+		EmailTo:    ConfigStrings("expiry_email_to"),
+	}
+}
+
+// FormatExpiringBuilds 通知以及命令行输出的文本
+func FormatExpiringBuilds(builds []*ExpiringBuild, days int) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d builds expire within %d days:\n", len(builds), days)
+	for _, b := range builds {
+		state := fmt.Sprintf("in %d days", b.DaysToExpiry)
+		if b.ExpiryStatus == models.ExpiryExpired {
+			state = "expired"
+		}
+		fmt.Fprintf(&buf, "  %s %s %s (%s): %s %s at %s\n", b.Id, b.Name, b.Version, b.BundleId,
+			b.ExpiresBy, state, b.ExpirationDate.Format("2006-01-02 15:04"))
+	}
+	return buf.String()
+}
+
+// expiryNotifyState 上次通知的时间以及每个Build最后一次被通知的时间
+type expiryNotifyState struct {
+	LastNotified time.Time            `json:"last_notified"`
+	Builds       map[string]time.Time `json:"builds"`
+}
+
+func expiryStateFile(appsRoot string) string {
+	return path.Join(appsRoot, ".expiry_notified.json")
+}
+
+// readExpiryState 文件不存在或者无法解析时返回空的记录
+func readExpiryState(appsRoot string) *expiryNotifyState {
+	state := &expiryNotifyState{}
+	data, err := ioutil.ReadFile(expiryStateFile(appsRoot))
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			log.WarnErrorf(err, "Parse %s failed", expiryStateFile(appsRoot))
+		}
+	} else if !os.IsNotExist(err) {
+		log.WarnErrorf(err, "Read %s failed", expiryStateFile(appsRoot))
+	}
+	if state.Builds == nil {
+		state.Builds = make(map[string]time.Time)
+	}
+	return state
+}
+
+func writeExpiryState(appsRoot string, state *expiryNotifyState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := expiryStateFile(appsRoot)
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// Enabled 配置了通知的间隔以及webhook或者邮件地址
+func (n *ExpiryNotifier) Enabled() bool {
+	return n.Interval > 0 && (n.Webhook != "" || len(n.EmailTo) > 0)
+}
+
+// Notify 发送一次通知, 跳过Interval之内已经通知过的Build, 没有需要通知的Build时不发送;
+// 成功之后记录通知的时间
+func (n *ExpiryNotifier) Notify(now time.Time) error {
+	builds, err := ExpiringBuilds(n.AppsRoot, now, n.WindowDays)
+	if err != nil {
+		return err
+	}
+
+	state := readExpiryState(n.AppsRoot)
+	notified := make(map[string]time.Time)
+	for id, t := range state.Builds {
+		if now.Sub(t) < n.Interval {
+			notified[id] = t
+		}
+	}
+	pending := make([]*ExpiringBuild, 0, len(builds))
+	for _, build := range builds {
+		if _, ok := notified[build.Id]; !ok {
+			pending = append(pending, build)
+		}
+	}
+	if err := n.send(pending); err != nil {
+		return err
+	}
+
+	for _, build := range pending {
+		notified[build.Id] = now
+	}
+	state.LastNotified, state.Builds = now, notified
+	return writeExpiryState(n.AppsRoot, state)
+}
+
+// notifyIfDue 距离上次通知已经超过了Interval时通知, 启动时以及每小时检查一次
+func (n *ExpiryNotifier) notifyIfDue(now time.Time) {
+	if !n.Enabled() || CheckInitialScan() != nil {
+		return
+	}
+	if last := readExpiryState(n.AppsRoot).LastNotified; !last.IsZero() && now.Sub(last) < n.Interval {
+		return
+	}
+	if err := n.Notify(now); err != nil {
+		log.WarnErrorf(err, "Notify expiring builds failed")
+	}
+}
+
+func (n *ExpiryNotifier) send(builds []*ExpiringBuild) error {
+	if len(builds) == 0 {
+		return nil
+	}
+
+	var errs []string
+	if n.Webhook != "" {
+		if err := n.postWebhook(builds); err != nil {
+			errs = append(errs, fmt.Sprintf("webhook: %v", err))
+		}
+	}
+	if len(n.EmailTo) > 0 {
+		if err := n.sendEmail(builds); err != nil {
+			errs = append(errs, fmt.Sprintf("email: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	log.Infof("Notified %d expiring builds", len(builds))
+	return nil
+}
+
+func (n *ExpiryNotifier) postWebhook(builds []*ExpiringBuild) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"window_days": n.WindowDays,
+		"builds":      builds,
+		"text":        FormatExpiringBuilds(builds, n.WindowDays),
+	})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(n.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", n.Webhook, resp.Status)
+	}
+	return nil
+}
+
+func (n *ExpiryNotifier) sendEmail(builds []*ExpiringBuild) error {
+	subject := fmt.Sprintf("[appserver] %d builds expire within %d days", len(builds), n.WindowDays)
+	return SendEmail(n.EmailTo, subject, FormatExpiringBuilds(builds, n.WindowDays))
+}
+
+// SendEmail 通过 smtp_addr, smtp_from, smtp_user, smtp_password 发送纯文本的邮件
+func SendEmail(to []string, subject string, body string) error {
+	addr := beego.AppConfig.String("smtp_addr")
+	from := beego.AppConfig.String("smtp_from")
+	if addr == "" || from == "" {
+		return fmt.Errorf("smtp_addr and smtp_from are required")
+	}
+	var auth smtp.Auth
+	if user := beego.AppConfig.String("smtp_user"); user != "" {
+		host := strings.Split(addr, ":")[0]
+		auth = smtp.PlainAuth("", user, beego.AppConfig.String("smtp_password"), host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		from, strings.Join(to, ", "), subject, body)
+	return smtp.SendMail(addr, auth, from, to, []byte(msg))
+}
+
+// Start 每小时刷新过期的天数, 并且检查是否需要通知(启动时立即检查一次); 往返回的channel写入数据停止
+func (n *ExpiryNotifier) Start() chan bool {
+	done := make(chan bool, 1)
+	go func() {
+		refresh := time.NewTicker(time.Hour)
+		defer refresh.Stop()
+		n.notifyIfDue(time.Now())
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-refresh.C:
+				RefreshExpiry(now)
+				n.notifyIfDue(now)
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,117 @@
+package backends
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestExpiry"
+//
+func TestExpiry(t *testing.T) {
+	now := time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 0, daysBetween(now, now.Add(23*time.Hour)))
+	assert.Equal(t, 1, daysBetween(now, now.Add(25*time.Hour)))
+	assert.Equal(t, -1, daysBetween(now, now.Add(-time.Hour)))
+
+	app := &models.IosAppDirMeta{
+		SignerCertSHA256: "signer",
+		Profile: &models.ProvisioningProfile{
+			ExpirationDate: now.AddDate(0, 0, 30),
+			Certificates: []*models.ProfileCertificate{
+				{SHA256: "other", NotAfter: now.AddDate(0, 0, 1)},
+				{SHA256: "signer", NotAfter: now.AddDate(0, 0, 10)},
+			},
+		},
+	}
+	// 签名证书比profile先过期
+	setExpiry(app, now, 14)
+	assert.Equal(t, "certificate", app.ExpiresBy)
+	assert.Equal(t, 10, app.DaysToExpiry)
+	assert.Equal(t, models.ExpiryExpiring, app.ExpiryStatus)
+
+	setExpiry(app, now, 7)
+	assert.Equal(t, "", app.ExpiryStatus)
+
+	setExpiry(app, now.AddDate(0, 0, 11), 7)
+	assert.Equal(t, -1, app.DaysToExpiry)
+	assert.Equal(t, models.ExpiryExpired, app.ExpiryStatus)
+
+	setExpiry(&models.IosAppDirMeta{}, now, 7)
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestExpiryNotify"
+//
+func TestExpiryNotify(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+
+	key, cert := testCertificate(t, "iPhone Distribution: Chunyu")
+	cms := testPkcs7(t, key, cert, []byte("CodeDirectory"), true)
+	for id, days := range map[string]int{"soon": 3, "later": 60, "expired": -1} {
+		appDir := path.Join(appsRoot, id)
+		os.MkdirAll(appDir, 0755)
+		expires := time.Now().Add(time.Duration(days)*24*time.Hour + time.Hour)
+		writeTestSignedIpa(t, path.Join(appDir, "app.ipa"), testMachO(cms),
+			testProfile(t, key, cert, "ABCDE12345.me.chunyu.Demo", [][]byte{cert}, expires))
+		ioutil.WriteFile(path.Join(appDir, "app.plist"), []byte(GenerateManifest("me.chunyu.Demo", "1.0", "Demo")), 0644)
+	}
+	assert.NoError(t, ScanAppRootDir(appsRoot))
+
+	builds, err := ExpiringBuilds(appsRoot, time.Now(), 14)
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(builds)) {
+		assert.Equal(t, "expired", builds[0].Id)
+		assert.Equal(t, models.ExpiryExpired, builds[0].ExpiryStatus)
+		assert.Equal(t, "soon", builds[1].Id)
+		assert.Equal(t, 3, builds[1].DaysToExpiry)
+		assert.Equal(t, "Demo AdHoc", builds[1].Profile)
+	}
+
+	var received struct {
+		WindowDays int `json:"window_days"`
+		Builds     []*ExpiringBuild
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	notifier := &ExpiryNotifier{AppsRoot: appsRoot, Interval: 24 * time.Hour, WindowDays: 14, Webhook: server.URL}
+	assert.NoError(t, notifier.Notify(now))
+	assert.Equal(t, 14, received.WindowDays)
+	assert.Equal(t, 2, len(received.Builds))
+
+	// 通知的时间保存在apps_root下, 间隔之内不再通知
+	state := readExpiryState(appsRoot)
+	assert.True(t, state.LastNotified.Equal(now))
+	assert.Equal(t, 2, len(state.Builds))
+	notifier.notifyIfDue(now.Add(time.Hour))
+	assert.Equal(t, 1, requests)
+
+	// 扩大范围之后只通知新增的Build
+	notifier.WindowDays = 90
+	assert.NoError(t, notifier.Notify(now.Add(time.Hour)))
+	assert.Equal(t, 2, requests)
+	if assert.Equal(t, 1, len(received.Builds)) {
+		assert.Equal(t, "later", received.Builds[0].Id)
+	}
+
+	// 超过间隔之后全部重新通知
+	assert.NoError(t, notifier.Notify(now.Add(25*time.Hour)))
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, 3, len(received.Builds))
+}
@@ -0,0 +1,148 @@
+package backends
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"git.chunyu.me/golang/cyutils/utils"
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+)
+
+//
+// 定期将运行时的指标推送到 open-falcon agent
+// 参考: http://book.open-falcon.org/zh/usage/data-push.html
+//
+
+var activeConns int64
+
+// TrackConnState 作为 http.Server.ConnState 统计当前的连接数
+func TrackConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		ActiveConnections.Set(float64(atomic.AddInt64(&activeConns, 1)))
+	case http.StateHijacked, http.StateClosed:
+		ActiveConnections.Set(float64(atomic.AddInt64(&activeConns, -1)))
+	}
+}
+
+// DiskUsage 统计目录下所有文件的大小
+func DiskUsage(root string) (int64, error) {
+	var total int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+type FalconReporter struct {
+	Agent    string
+	Endpoint string
+	Interval time.Duration
+	AppsRoot string
+}
+
+// 每种下载对应的路由(和routers中注册的pattern相同), 上报的字节数为所有路由之和
+var falconDownloadRoutes = []struct {
+	kind   string
+	routes []string
+}{
+	{"ipa", []string{"/api/ipa/:app_id"}},
+	{"apk", []string{"/api/apk/:app_id", "/api/apk/:app_id/:file"}},
+	{"aab", []string{"/api/aab/:app_id"}},
+}
+
+// NewFalconReporter interval <= 0 时(例如: falcon_interval配置错误)使用60秒
+func NewFalconReporter(agent string, interval time.Duration, appsRoot string) *FalconReporter {
+	if interval <= 0 {
+		log.Warnf("Invalid falcon_interval: %v, use 60 seconds", interval)
+		interval = time.Minute
+	}
+	return &FalconReporter{
+		Agent:    agent,
+		Endpoint: utils.Hostname(),
+		Interval: interval,
+		AppsRoot: appsRoot,
+	}
+}
+
+func (r *FalconReporter) metaData(metric string, value interface{}, counterType string, tags string, now int64) *utils.MetaData {
+	return &utils.MetaData{
+		Metric:      metric,
+		Endpoint:    r.Endpoint,
+		Value:       value,
+		CounterType: counterType,
+		Tags:        tags,
+		Timestamp:   now,
+		Step:        int64(r.Interval / time.Second),
+	}
+}
+
+// Collect 收集需要推送的数据
+// 下载的字节数和扫描的错误数以COUNTER上报, 由open-falcon计算速率
+func (r *FalconReporter) Collect() []*utils.MetaData {
+	now := time.Now().Unix()
+	collectIndexMetrics()
+
+	var data []*utils.MetaData
+	for _, download := range falconDownloadRoutes {
+		var total float64
+		for _, route := range download.routes {
+			total += HttpResponseBytes.Value(route)
+		}
+		tags := "kind=" + download.kind
+		data = append(data,
+			r.metaData("appserver.download.bytes", total, utils.DATA_TYPE_COUNTER, tags, now),
+			r.metaData("appserver.download.inflight", DownloadsInFlight.Value(download.kind), utils.DATA_TYPE_GAUGE, tags, now),
+		)
+	}
+
+	data = append(data,
+		r.metaData("appserver.connections.active", atomic.LoadInt64(&activeConns), utils.DATA_TYPE_GAUGE, "", now),
+		r.metaData("appserver.scan.errors", ScanFailuresTotal.Value(), utils.DATA_TYPE_COUNTER, "", now),
+		r.metaData("appserver.scan.broken_dirs", ScanErrorsGauge.Value(), utils.DATA_TYPE_GAUGE, "", now),
+		r.metaData("appserver.builds", BuildsGauge.Value("ios"), utils.DATA_TYPE_GAUGE, "platform=ios", now),
+		r.metaData("appserver.builds", BuildsGauge.Value("android"), utils.DATA_TYPE_GAUGE, "platform=android", now),
+	)
+
+	if usage, err := DiskUsage(r.AppsRoot); err != nil {
+		log.WarnErrorf(err, "Stat disk usage of %s failed", r.AppsRoot)
+	} else {
+		data = append(data, r.metaData("appserver.disk.used_bytes", usage, utils.DATA_TYPE_GAUGE, "", now))
+	}
+	return data
+}
+
+func (r *FalconReporter) Report() error {
+	_, err := utils.SendData(r.Collect(), r.Agent, 5*time.Second)
+	return err
+}
+
+// Start 按照Interval定期推送, 往返回的channel写入数据停止推送
+func (r *FalconReporter) Start() chan bool {
+	done := make(chan bool, 1)
+	go func() {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := r.Report(); err != nil {
+					log.WarnErrorf(err, "Push metrics to open-falcon agent %s failed", r.Agent)
+				}
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,58 @@
+package backends
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"git.chunyu.me/golang/cyutils/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestFalconReporter"
+//
+func TestFalconReporter(t *testing.T) {
+	received := make(chan []*utils.MetaData, 1)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var data []*utils.MetaData
+		json.Unmarshal(body, &data)
+		received <- data
+		w.Write([]byte("success"))
+	}))
+	defer agent.Close()
+
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+	ioutil.WriteFile(appsRoot+"/app.json", []byte("{}"), 0644)
+
+	// 所有apk的下载路由都统计在kind=apk中
+	HttpResponseBytes.Reset()
+	defer HttpResponseBytes.Reset()
+	HttpResponseBytes.Add(100, "/api/apk/:app_id")
+	HttpResponseBytes.Add(20, "/api/apk/:app_id/:file")
+	HttpResponseBytes.Add(3, "/api/aab/:app_id")
+
+	// falcon_interval配置错误时使用60秒
+	reporter := NewFalconReporter(agent.URL, 0, appsRoot)
+	assert.Equal(t, time.Minute, reporter.Interval)
+	assert.NoError(t, reporter.Report())
+
+	data := <-received
+	metrics := make(map[string]*utils.MetaData)
+	for _, d := range data {
+		metrics[d.Metric+"/"+d.Tags] = d
+		assert.Equal(t, int64(60), d.Step)
+	}
+
+	assert.Equal(t, utils.DATA_TYPE_COUNTER, metrics["appserver.download.bytes/kind=ipa"].CounterType)
+	assert.Equal(t, float64(120), metrics["appserver.download.bytes/kind=apk"].Value)
+	assert.Equal(t, float64(3), metrics["appserver.download.bytes/kind=aab"].Value)
+	assert.Equal(t, utils.DATA_TYPE_GAUGE, metrics["appserver.connections.active/"].CounterType)
+	assert.Equal(t, float64(2), metrics["appserver.disk.used_bytes/"].Value)
+}
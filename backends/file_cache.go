@@ -0,0 +1,76 @@
+package backends
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// fileCache 缓存根据文件内容计算的结果(例如: 签名校验), 文件的修改时间或者大小变化时失效
+type fileCache struct {
+	lock    sync.Mutex
+	entries map[string]*fileCacheEntry
+}
+
+type fileCacheEntry struct {
+	modTime time.Time
+	size    int64
+	value   interface{}
+}
+
+// 所有的fileCache, 扫描之后清理已经删除的文件
+var gFileCaches []*fileCache
+var gFileCachesLock sync.Mutex
+
+func newFileCache() *fileCache {
+	c := &fileCache{entries: make(map[string]*fileCacheEntry)}
+	gFileCachesLock.Lock()
+	gFileCaches = append(gFileCaches, c)
+	gFileCachesLock.Unlock()
+	return c
+}
+
+func (c *fileCache) get(name string, info os.FileInfo) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[name]
+	if !ok || !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *fileCache) put(name string, info os.FileInfo, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[name] = &fileCacheEntry{modTime: info.ModTime(), size: info.Size(), value: value}
+}
+
+// evictMissing 删除文件已经不存在的缓存
+func (c *fileCache) evictMissing() {
+	c.lock.Lock()
+	names := make([]string, 0, len(c.entries))
+	for name := range c.entries {
+		names = append(names, name)
+	}
+	c.lock.Unlock()
+
+	// stat时不持有锁, 避免阻塞get/put
+	for _, name := range names {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			c.lock.Lock()
+			delete(c.entries, name)
+			c.lock.Unlock()
+		}
+	}
+}
+
+// evictMissingFiles 清理所有fileCache中已经删除的文件, 在每次扫描之后执行
+func evictMissingFiles() {
+	gFileCachesLock.Lock()
+	caches := append([]*fileCache(nil), gFileCaches...)
+	gFileCachesLock.Unlock()
+	for _, c := range caches {
+		c.evictMissing()
+	}
+}
@@ -0,0 +1,35 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestFileCache"
+//
+func TestFileCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file_cache")
+	defer os.RemoveAll(dir)
+
+	name := path.Join(dir, "app.apk")
+	ioutil.WriteFile(name, []byte("apk"), 0644)
+	info, _ := os.Stat(name)
+
+	c := newFileCache()
+	c.put(name, info, "result")
+	value, ok := c.get(name, info)
+	assert.True(t, ok)
+	assert.Equal(t, "result", value)
+
+	// 文件还在时保留, 删除之后清理
+	evictMissingFiles()
+	assert.Len(t, c.entries, 1)
+	os.Remove(name)
+	evictMissingFiles()
+	assert.Len(t, c.entries, 0)
+}
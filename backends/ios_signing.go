@@ -0,0 +1,250 @@
+package backends
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/DHowett/go-plist"
+)
+
+//
+// ipa的签名以及embedded.mobileprovision的一致性校验:
+//   bundle id 和 profile 中的 application-identifier 匹配
+//   主App可执行文件的签名证书在 profile 的 DeveloperCertificates 中
+//   profile 没有过期
+//
+
+// mobileprovision中的plist
+type profilePlist struct {
+	Name                  string                 `plist:"Name"`
+	UUID                  string                 `plist:"UUID"`
+	TeamName              string                 `plist:"TeamName"`
+	TeamIdentifier        []string               `plist:"TeamIdentifier"`
+	CreationDate          time.Time              `plist:"CreationDate"`
+	ExpirationDate        time.Time              `plist:"ExpirationDate"`
+	Entitlements          map[string]interface{} `plist:"Entitlements"`
+	DeveloperCertificates [][]byte               `plist:"DeveloperCertificates"`
+	ProvisionedDevices    []string               `plist:"ProvisionedDevices"`
+	ProvisionsAllDevices  bool                   `plist:"ProvisionsAllDevices"`
+}
+
+// profileContent 返回mobileprovision(PKCS#7 SignedData)中签名的plist
+func profileContent(data []byte) ([]byte, error) {
+	if signedData, err := parsePkcs7SignedData(data); err == nil {
+		var info pkcs7ContentInfo
+		var content []byte
+		if _, err := asn1.Unmarshal(signedData.ContentInfo.FullBytes, &info); err == nil {
+			if _, err := asn1.Unmarshal(info.Content.Bytes, &content); err == nil {
+				return content, nil
+			}
+		}
+	}
+
+	// 不是DER编码时(例如: 不定长的BER), 直接查找其中的plist
+	start := bytes.Index(data, []byte("<?xml"))
+	end := bytes.LastIndex(data, []byte("</plist>"))
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("plist not found in provisioning profile")
+	}
+	return data[start : end+len("</plist>")], nil
+}
+
+// ParseMobileProvision 解析provisioning profile
+func ParseMobileProvision(data []byte) (*models.ProvisioningProfile, error) {
+	content, err := profileContent(data)
+	if err != nil {
+		return nil, err
+	}
+	var p profilePlist
+	if _, err := plist.Unmarshal(content, &p); err != nil {
+		return nil, fmt.Errorf("provisioning profile: %v", err)
+	}
+
+	profile := &models.ProvisioningProfile{
+		Name:           p.Name,
+		UUID:           p.UUID,
+		TeamName:       p.TeamName,
+		AppId:          firstString(p.Entitlements, "application-identifier"),
+		CreationDate:   p.CreationDate,
+		ExpirationDate: p.ExpirationDate,
+		Devices:        len(p.ProvisionedDevices),
+	}
+	if len(p.TeamIdentifier) > 0 {
+		profile.TeamId = p.TeamIdentifier[0]
+	}
+
+	getTaskAllow, _ := p.Entitlements["get-task-allow"].(bool)
+	switch {
+	case p.ProvisionsAllDevices:
+		profile.Type = models.ProfileEnterprise
+	case len(p.ProvisionedDevices) > 0 && getTaskAllow:
+		profile.Type = models.ProfileDevelopment
+	case len(p.ProvisionedDevices) > 0:
+		profile.Type = models.ProfileAdHoc
+	default:
+		profile.Type = models.ProfileAppStore
+	}
+
+	for _, raw := range p.DeveloperCertificates {
+		sum := sha256.Sum256(raw)
+		cert := &models.ProfileCertificate{SHA256: hex.EncodeToString(sum[:])}
+		if c, err := x509.ParseCertificate(raw); err == nil {
+			cert.Subject = c.Subject.String()
+			cert.NotAfter = c.NotAfter
+		}
+		profile.Certificates = append(profile.Certificates, cert)
+	}
+	return profile, nil
+}
+
+// profileMatchesBundleId application-identifier为 <App ID Prefix>.<bundle id>, bundle id可以以*结尾
+func profileMatchesBundleId(appId string, bundleId string) bool {
+	idx := strings.Index(appId, ".")
+	if idx < 0 {
+		return false
+	}
+	pattern := appId[idx+1:]
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(bundleId, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == bundleId
+}
+
+// IpaVerifyResult ipa签名校验的结果
+type IpaVerifyResult struct {
+	Profile  *models.ProvisioningProfile
+	Signer   *ApkSigner
+	Problems []string
+}
+
+func (r *IpaVerifyResult) addProblem(format string, a ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, a...))
+}
+
+// ReadIpaProfile 只读取主App的embedded.mobileprovision, 没有时返回nil
+func ReadIpaProfile(name string, bundle *IpaBundle) (*models.ProvisioningProfile, error) {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readIpaProfile(r.File, bundle)
+}
+
+func readIpaProfile(files []*zip.File, bundle *IpaBundle) (*models.ProvisioningProfile, error) {
+	for _, f := range files {
+		if f.Name != bundle.Path+"/embedded.mobileprovision" {
+			continue
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		return ParseMobileProvision(data)
+	}
+	return nil, nil
+}
+
+// VerifyIpa 校验主App的签名证书, bundle id以及profile是否一致, profile是否过期参考ProblemsAt
+// 只有在读取文件失败时返回error, 发现的问题记录在Problems中
+func VerifyIpa(name string, bundle *IpaBundle) (*IpaVerifyResult, error) {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	result := new(IpaVerifyResult)
+	if result.Profile, err = readIpaProfile(r.File, bundle); err != nil {
+		result.addProblem("embedded.mobileprovision: %v", err)
+	} else if result.Profile == nil {
+		result.addProblem("embedded.mobileprovision not found")
+	}
+
+	executable, _ := bundle.Info["CFBundleExecutable"].(string)
+	var executableFile *zip.File
+	for _, f := range r.File {
+		if executable != "" && f.Name == bundle.Path+"/"+executable {
+			executableFile = f
+		}
+	}
+	if executableFile == nil {
+		result.addProblem("main executable not found")
+	} else {
+		rc, err := executableFile.Open()
+		if err != nil {
+			return nil, err
+		}
+		cms, err := MachOCodeSignature(rc, int64(executableFile.UncompressedSize64))
+		rc.Close()
+		switch {
+		case err != nil:
+			result.addProblem("read code signature failed: %v", err)
+		case cms == nil:
+			result.addProblem("main executable is not signed")
+		default:
+			if _, raw, _, err := pkcs7Signer(cms); err != nil {
+				result.addProblem("code signature: %v", err)
+			} else {
+				result.Signer = newApkSigner("cms", raw)
+			}
+		}
+	}
+
+	profile := result.Profile
+	if profile == nil {
+		return result, nil
+	}
+
+	bundleId, _ := bundle.Info["CFBundleIdentifier"].(string)
+	if !profileMatchesBundleId(profile.AppId, bundleId) {
+		result.addProblem("bundle id %s does not match application-identifier %s", bundleId, profile.AppId)
+	}
+	if result.Signer != nil {
+		found := false
+		for _, cert := range profile.Certificates {
+			if cert.SHA256 == result.Signer.CertSHA256 {
+				found = true
+			}
+		}
+		if !found {
+			result.addProblem("signer %s (%s) is not in the DeveloperCertificates of %s", result.Signer.CertSHA256, result.Signer.Subject, profile.Name)
+		}
+	}
+	return result, nil
+}
+
+// ProblemsAt 返回校验发现的问题, 以及profile在now时是否已经过期
+// profile是否过期和时间有关, 不能和其他的问题一起缓存
+func (r *IpaVerifyResult) ProblemsAt(now time.Time) []string {
+	problems := r.Problems
+	if profile := r.Profile; profile != nil && !profile.ExpirationDate.IsZero() && profile.ExpirationDate.Before(now) {
+		problems = append(problems[:len(problems):len(problems)],
+			fmt.Sprintf("provisioning profile %s expired at %s", profile.Name, profile.ExpirationDate.Format("2006-01-02 15:04")))
+	}
+	return problems
+}
+
+var ipaVerifyCache = newFileCache()
+
+// CachedVerifyIpa 文件没有变化时返回上次校验的结果
+func CachedVerifyIpa(name string, bundle *IpaBundle, info os.FileInfo) (*IpaVerifyResult, error) {
+	if result, ok := ipaVerifyCache.get(name, info); ok {
+		return result.(*IpaVerifyResult), nil
+	}
+	result, err := VerifyIpa(name, bundle)
+	if err != nil {
+		return nil, err
+	}
+	ipaVerifyCache.put(name, info, result)
+	return result, nil
+}
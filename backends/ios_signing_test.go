@@ -0,0 +1,152 @@
+package backends
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/DHowett/go-plist"
+	"github.com/stretchr/testify/assert"
+)
+
+// testMachO 生成只有LC_CODE_SIGNATURE的arm64可执行文件, cms为nil时没有签名
+func testMachO(cms []byte) []byte {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	ncmds := uint32(0)
+	if cms != nil {
+		ncmds = 1
+	}
+	// mach_header_64: magic, cputype, cpusubtype, filetype, ncmds, sizeofcmds, flags, reserved
+	for _, v := range []uint32{machoMagic64, cpuTypeArm | cpuArch64, 0, 2, ncmds, 16 * ncmds, 0, 0} {
+		binary.Write(&buf, le, v)
+	}
+	if cms == nil {
+		return buf.Bytes()
+	}
+
+	var blob bytes.Buffer
+	be := binary.BigEndian
+	for _, v := range []uint32{csMagicEmbeddedSignature, uint32(28 + len(cms)), 1, csSlotSignature, 20, csMagicBlobWrapper, uint32(8 + len(cms))} {
+		binary.Write(&blob, be, v)
+	}
+	blob.Write(cms)
+
+	// linkedit_data_command: cmd, cmdsize, dataoff, datasize
+	for _, v := range []uint32{lcCodeSignature, 16, 4096, uint32(blob.Len())} {
+		binary.Write(&buf, le, v)
+	}
+	buf.Write(make([]byte, 4096-buf.Len()))
+	buf.Write(blob.Bytes())
+	return buf.Bytes()
+}
+
+// testFatMachO 把可执行文件放在fat binary中偏移16K的位置
+func testFatMachO(thin []byte) []byte {
+	var buf bytes.Buffer
+	for _, v := range []uint32{machoFatMagic, 1, cpuTypeArm | cpuArch64, 0, 16384, uint32(len(thin)), 14} {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+	buf.Write(make([]byte, 16384-buf.Len()))
+	buf.Write(thin)
+	return buf.Bytes()
+}
+
+func testProfile(t *testing.T, key *ecdsa.PrivateKey, cert []byte, appId string, certs [][]byte, expires time.Time) []byte {
+	content, err := plist.Marshal(map[string]interface{}{
+		"Name":                  "Demo AdHoc",
+		"UUID":                  "8c6e4e3a-0000-0000-0000-000000000000",
+		"TeamName":              "Chunyu",
+		"TeamIdentifier":        []string{"ABCDE12345"},
+		"CreationDate":          expires.AddDate(-1, 0, 0),
+		"ExpirationDate":        expires,
+		"Entitlements":          map[string]interface{}{"application-identifier": appId, "get-task-allow": false},
+		"DeveloperCertificates": certs,
+		"ProvisionedDevices":    []string{"0123456789abcdef"},
+	}, plist.XMLFormat)
+	assert.NoError(t, err)
+	return testPkcs7(t, key, cert, content, false)
+}
+
+func writeTestSignedIpa(t *testing.T, file string, executable []byte, profile []byte) {
+	files := map[string][]byte{
+		"Payload/Demo.app/Info.plist": []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+  <key>CFBundleIdentifier</key><string>me.chunyu.Demo</string>
+  <key>CFBundleExecutable</key><string>Demo</string>
+</dict></plist>`),
+		"Payload/Demo.app/Demo": executable,
+	}
+	if profile != nil {
+		files["Payload/Demo.app/embedded.mobileprovision"] = profile
+	}
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range files {
+		f, err := w.Create(name)
+		assert.NoError(t, err)
+		f.Write(data)
+	}
+	assert.NoError(t, w.Close())
+	assert.NoError(t, ioutil.WriteFile(file, buf.Bytes(), 0644))
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestVerifyIpa"
+//
+func TestVerifyIpa(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ipa")
+	defer os.RemoveAll(dir)
+
+	key, cert := testCertificate(t, "iPhone Distribution: Chunyu")
+	_, other := testCertificate(t, "iPhone Distribution: Other")
+	cms := testPkcs7(t, key, cert, []byte("CodeDirectory"), true)
+	expires := time.Now().Add(24 * time.Hour)
+
+	verify := func(name string, executable []byte, profile []byte) *IpaVerifyResult {
+		ipaPath := path.Join(dir, name)
+		writeTestSignedIpa(t, ipaPath, executable, profile)
+		bundle, err := ParseIpaBundle(ipaPath)
+		assert.NoError(t, err)
+		result, err := VerifyIpa(ipaPath, bundle)
+		assert.NoError(t, err)
+		return result
+	}
+
+	result := verify("good.ipa", testFatMachO(testMachO(cms)), testProfile(t, key, cert, "ABCDE12345.me.chunyu.*", [][]byte{other, cert}, expires))
+	assert.Empty(t, result.Problems)
+	if assert.NotNil(t, result.Signer) {
+		assert.Equal(t, fingerprint(cert), result.Signer.CertSHA256)
+	}
+	if assert.NotNil(t, result.Profile) {
+		assert.Equal(t, "Demo AdHoc", result.Profile.Name)
+		assert.Equal(t, "ABCDE12345", result.Profile.TeamId)
+		assert.Equal(t, models.ProfileAdHoc, result.Profile.Type)
+		assert.Equal(t, 1, result.Profile.Devices)
+		assert.Equal(t, expires.Unix(), result.Profile.ExpirationDate.Unix())
+		assert.Equal(t, 2, len(result.Profile.Certificates))
+	}
+	assert.Empty(t, result.ProblemsAt(time.Now()))
+	assert.Equal(t, 1, len(result.ProblemsAt(expires.Add(time.Hour))))
+	assert.Empty(t, result.Problems)
+
+	result = verify("mismatch.ipa", testMachO(cms), testProfile(t, key, cert, "ABCDE12345.com.other.App", [][]byte{other}, expires))
+	assert.Equal(t, []string{
+		"bundle id me.chunyu.Demo does not match application-identifier ABCDE12345.com.other.App",
+		"signer " + fingerprint(cert) + " (CN=iPhone Distribution: Chunyu) is not in the DeveloperCertificates of Demo AdHoc",
+	}, result.Problems)
+
+	result = verify("unsigned.ipa", testMachO(nil), nil)
+	assert.Equal(t, []string{"embedded.mobileprovision not found", "main executable is not signed"}, result.Problems)
+
+	assert.True(t, profileMatchesBundleId("ABCDE12345.*", "com.other.App"))
+	assert.True(t, profileMatchesBundleId("ABCDE12345.me.chunyu.Demo", "me.chunyu.Demo"))
+	assert.False(t, profileMatchesBundleId("ABCDE12345.me.chunyu.Demo", "me.chunyu.Demo.share"))
+}
@@ -5,14 +5,24 @@ import (
 	"fmt"
 	"net/url"
 	"gopkg.in/flosch/pongo2.v3"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 func init() {
 	pongo2.RegisterFilter("itemservice_url", GenerateItemServiceUrlFilter)
+	pongo2.RegisterFilter("os_unsupported", OsVersionUnsupportedFilter)
 }
 
+// GenerateItemServiceUrlFilter {{ios_app.Plist|itemservice_url:download_query}}, 参数为plist链接的query,
+// 例如测试者的token以及私有组织的download_token, 为空时不带参数
 func GenerateItemServiceUrlFilter(in *pongo2.Value, param *pongo2.Value) (out *pongo2.Value, err *pongo2.Error) {
 	plist := in.String()
+	if query := param.String(); query != "" {
+		plist += "?" + query
+	}
 	result := GenerateItemServiceUrl(plist)
 	return pongo2.AsValue(result), nil
 }
@@ -23,3 +33,124 @@ func GenerateItemServiceUrl(plist string) (out string) {
 	log.Infof("Input: %s, Output: %s", plist, out)
 	return out
 }
+
+var deviceFamilies = map[uint64]string{
+	1: "iPhone",
+	2: "iPad",
+	3: "TV",
+	4: "Watch",
+}
+
+// iosDeviceFamily UIDeviceFamily 一般为整数数组, 也可能是单个整数或者字符串
+func iosDeviceFamily(value interface{}) []string {
+	var items []interface{}
+	switch v := value.(type) {
+	case []interface{}:
+		items = v
+	case nil:
+		return nil
+	default:
+		items = []interface{}{v}
+	}
+
+	families := make([]string, 0, len(items))
+	for _, item := range items {
+		var family uint64
+		switch v := item.(type) {
+		case uint64:
+			family = v
+		case int64:
+			family = uint64(v)
+		case string:
+			family, _ = strconv.ParseUint(v, 10, 64)
+		}
+		if name, ok := deviceFamilies[family]; ok {
+			families = append(families, name)
+		} else {
+			families = append(families, fmt.Sprintf("%v", item))
+		}
+	}
+	return families
+}
+
+// iosCapabilities UIRequiredDeviceCapabilities 可以是字符串数组, 也可以是 capability => bool 的字典
+func iosCapabilities(value interface{}) []string {
+	var capabilities []string
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				capabilities = append(capabilities, s)
+			}
+		}
+	case map[string]interface{}:
+		for key, required := range v {
+			if b, ok := required.(bool); ok && b {
+				capabilities = append(capabilities, key)
+			}
+		}
+		sort.Strings(capabilities)
+	}
+	return capabilities
+}
+
+// xcodeVersion DTXcode 转换为版本号, 例如: 0731 => 7.3.1, 1000 => 10.0
+func xcodeVersion(dtXcode string) string {
+	if len(dtXcode) != 4 {
+		return dtXcode
+	}
+	major, err := strconv.Atoi(dtXcode[:2])
+	if err != nil {
+		return dtXcode
+	}
+	version := fmt.Sprintf("%d.%c", major, dtXcode[2])
+	if dtXcode[3] != '0' {
+		version += "." + dtXcode[3:]
+	}
+	return version
+}
+
+// 例如: Mozilla/5.0 (iPhone; CPU iPhone OS 9_3_2 like Mac OS X) 或者 (iPad; CPU OS 9_3 like Mac OS X)
+var iosUserAgentRegexp = regexp.MustCompile(`(?:iPhone|CPU) OS (\d+(?:_\d+)*) like Mac OS X`)
+
+// IosVersionFromUserAgent 从User-Agent中获取iOS的版本, 例如: 9.3.2, 不是iOS时返回空字符串
+func IosVersionFromUserAgent(userAgent string) string {
+	match := iosUserAgentRegexp.FindStringSubmatch(userAgent)
+	if match == nil {
+		return ""
+	}
+	return strings.Replace(match[1], "_", ".", -1)
+}
+
+// CompareVersion 按照数字比较两个版本号, 例如: 9.3 < 10.0, 9.0 == 9
+func CompareVersion(a string, b string) int {
+	pa := strings.Split(a, ".")
+	pb := strings.Split(b, ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var va, vb int
+		if i < len(pa) {
+			va, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			vb, _ = strconv.Atoi(pb[i])
+		}
+		if va != vb {
+			if va < vb {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// OsVersionUnsupportedFilter {{ios_app.MinimumOSVersion|os_unsupported:visitor_os}}
+// 访问者的版本低于App要求的最低版本时返回true, 版本未知时返回false
+func OsVersionUnsupportedFilter(in *pongo2.Value, param *pongo2.Value) (out *pongo2.Value, err *pongo2.Error) {
+	minVersion := in.String()
+	visitorVersion := param.String()
+	if minVersion == "" || visitorVersion == "" {
+		return pongo2.AsValue(false), nil
+	}
+	return pongo2.AsValue(CompareVersion(visitorVersion, minVersion) < 0), nil
+}
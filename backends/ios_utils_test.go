@@ -0,0 +1,26 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestIosVersion"
+//
+func TestIosVersion(t *testing.T) {
+	assert.Equal(t, "9.3.2", IosVersionFromUserAgent("Mozilla/5.0 (iPhone; CPU iPhone OS 9_3_2 like Mac OS X) AppleWebKit/601.1.46"))
+	assert.Equal(t, "8.1", IosVersionFromUserAgent("Mozilla/5.0 (iPad; CPU OS 8_1 like Mac OS X) AppleWebKit/600.1.4"))
+	assert.Equal(t, "", IosVersionFromUserAgent("Mozilla/5.0 (Linux; Android 6.0; Nexus 5 Build/MRA58N)"))
+
+	assert.Equal(t, -1, CompareVersion("9.3.2", "10.0"))
+	assert.Equal(t, 0, CompareVersion("9.0", "9"))
+	assert.Equal(t, 1, CompareVersion("9.3.2", "9.3"))
+
+	assert.Equal(t, "7.3.1", xcodeVersion("0731"))
+	assert.Equal(t, "10.0", xcodeVersion("1000"))
+
+	assert.Equal(t, []string{"iPhone", "iPad"}, iosDeviceFamily([]interface{}{uint64(1), uint64(2)}))
+	assert.Equal(t, []string{"arm64", "metal"}, iosCapabilities(map[string]interface{}{"metal": true, "arm64": true, "gps": false}))
+}
@@ -2,15 +2,57 @@ package backends
 
 import (
 	"archive/zip"
-	"errors"
+	"fmt"
 	"github.com/DHowett/go-plist"
 	"io"
 	"log"
+	"regexp"
+	"sort"
 	"strings"
+
+	"git.chunyu.me/feiwang/appserver/models"
 )
 
-//ParseIpa : It parses the given ipa and returns a map from the contents of Info.plist in it
-func ParseIpa(name string, bundleFilter string) (map[string]interface{}, error) {
+// 主App的Info.plist: Payload/Xxx.app/Info.plist
+var mainInfoPlistRegexp = regexp.MustCompile(`^Payload/[^/]+\.app/Info\.plist$`)
+
+// IpaBundle ipa中主App以及内嵌的extension, watch app, framework
+type IpaBundle struct {
+	// 主App的Info.plist
+	Info map[string]interface{}
+	// 主App在ipa中的路径, 例如: Payload/Xxx.app
+	Path     string
+	Embedded []*models.EmbeddedBundle
+	// 主App可执行文件支持的架构, 例如: [armv7 arm64]
+	Architectures []string
+}
+
+// ParseIpa : It parses the given ipa and returns a map from the contents of Info.plist in it
+// bundleFilter 为nil时不过滤bundle id
+func ParseIpa(name string, bundleFilter *BundleIdMatcher) (map[string]interface{}, error) {
+	bundle, err := ParseIpaBundle(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBundleId(bundle.Info, bundleFilter); err != nil {
+		return nil, err
+	}
+	return bundle.Info, nil
+}
+
+func checkBundleId(info map[string]interface{}, bundleFilter *BundleIdMatcher) error {
+	id, _ := info["CFBundleIdentifier"].(string)
+	if id == "" {
+		return fmt.Errorf("CFBundleIdentifier not found in Info.plist")
+	}
+	if !bundleFilter.Match(id) {
+		return fmt.Errorf("bundle id %s does not match %s", id, bundleFilter)
+	}
+	return nil
+}
+
+// ParseIpaBundle 解析主App的Info.plist, 并且列出所有内嵌的bundle
+func ParseIpaBundle(name string) (*IpaBundle, error) {
 	r, err := zip.OpenReader(name)
 	if err != nil {
 		log.Println("Error opening ipa/zip ", err.Error())
@@ -18,38 +60,149 @@ func ParseIpa(name string, bundleFilter string) (map[string]interface{}, error)
 	}
 	defer r.Close()
 
+	// 只有 Payload/Xxx.app/Info.plist 是主App的, 其他的Info.plist属于framework, extension等
+	var mainPlist *zip.File
 	for _, file := range r.File {
-		// fmt.Printf("FileName: %s\n", file.FileInfo().Name())
+		if !mainInfoPlistRegexp.MatchString(file.Name) {
+			continue
+		}
+		if mainPlist != nil {
+			return nil, fmt.Errorf("multiple apps found in Payload: %s, %s", mainPlist.Name, file.Name)
+		}
+		mainPlist = file
+	}
+	if mainPlist == nil {
+		return nil, fmt.Errorf("Payload/*.app/Info.plist not found")
+	}
 
-		// 存在多个Info.plist 如何处理呢?
-		if file.FileInfo().Name() == "Info.plist" {
-			rc, err := file.Open()
-			if err != nil {
-				log.Println("Error opening Info.plist in zip", err.Error())
-				return nil, err
+	info, err := readZipPlist(mainPlist)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &IpaBundle{
+		Info: info,
+		Path: strings.TrimSuffix(mainPlist.Name, "/Info.plist"),
+	}
+	bundle.Embedded, err = listEmbeddedBundles(r.File, bundle.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if executable, _ := info["CFBundleExecutable"].(string); executable != "" {
+		for _, file := range r.File {
+			if file.Name != bundle.Path+"/"+executable {
+				continue
 			}
-			buf := make([]byte, file.FileInfo().Size())
-			_, err = io.ReadFull(rc, buf)
-			if err != nil {
-				log.Println("Error reading Info.plist", err.Error())
-				return nil, err
+			// 架构只用于展示, 解析失败不影响整个ipa
+			if bundle.Architectures, err = readArchitectures(file); err != nil {
+				log.Println("Error reading architectures of", file.Name, err.Error())
 			}
+			break
+		}
+	}
+	return bundle, nil
+}
 
+// readArchitectures 只读取可执行文件的头部
+func readArchitectures(file *zip.File) ([]string, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
 
-			var info_map map[string]interface{}
-			_, err = plist.Unmarshal(buf, &info_map)
-			if err != nil {
-				log.Println("Error reading Info.plist", err.Error())
-				return nil, err
-			}
+	header := make([]byte, MachOHeaderSize)
+	n, err := io.ReadFull(rc, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return MachOArchitectures(header[:n])
+}
 
+func readZipPlist(file *zip.File) (map[string]interface{}, error) {
+	rc, err := file.Open()
+	if err != nil {
+		log.Println("Error opening Info.plist in zip", err.Error())
+		return nil, err
+	}
+	defer rc.Close()
+
+	buf := make([]byte, file.UncompressedSize64)
+	_, err = io.ReadFull(rc, buf)
+	if err != nil {
+		log.Println("Error reading Info.plist", err.Error())
+		return nil, err
+	}
 
-			if id, ok := info_map["CFBundleIdentifier"].(string); !ok || !strings.Contains(strings.ToLower(id), bundleFilter) {
+	var info_map map[string]interface{}
+	_, err = plist.Unmarshal(buf, &info_map)
+	if err != nil {
+		log.Println("Error reading Info.plist", err.Error())
+		return nil, fmt.Errorf("%s: %v", file.Name, err)
+	}
+	return info_map, nil
+}
+
+// embeddedKind 根据路径判断是否为内嵌的bundle, 例如: PlugIns/Share.appex, Watch/Watch.app, Frameworks/Foo.framework
+func embeddedKind(parent string, name string) string {
+	switch {
+	case parent == "PlugIns" && strings.HasSuffix(name, ".appex"):
+		return models.EmbeddedExtension
+	case parent == "Watch" && strings.HasSuffix(name, ".app"):
+		return models.EmbeddedWatchApp
+	case parent == "Frameworks" && (strings.HasSuffix(name, ".framework") || strings.HasSuffix(name, ".dylib")):
+		return models.EmbeddedFramework
+	}
+	return ""
+}
+
+// listEmbeddedBundles 列出主App中所有的内嵌bundle(包括watch app中的extension), 大小为解压之后的大小
+func listEmbeddedBundles(files []*zip.File, appPath string) ([]*models.EmbeddedBundle, error) {
+	bundles := make(map[string]*models.EmbeddedBundle)
+	sizes := make(map[string]int64)
+	plists := make(map[string]*zip.File)
+
+	prefix := appPath + "/"
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name, prefix) {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(file.Name, prefix), "/")
+		for i := 1; i < len(parts); i++ {
+			kind := embeddedKind(parts[i-1], parts[i])
+			if kind == "" {
+				continue
+			}
+			// dylib是文件, 其他的都是目录
+			if i == len(parts)-1 && kind != models.EmbeddedFramework {
 				continue
 			}
+			bundlePath := strings.Join(parts[:i+1], "/")
+			if bundles[bundlePath] == nil {
+				bundles[bundlePath] = &models.EmbeddedBundle{Kind: kind, Path: bundlePath}
+			}
+			sizes[bundlePath] += int64(file.UncompressedSize64)
+			if i == len(parts)-2 && parts[i+1] == "Info.plist" {
+				plists[bundlePath] = file
+			}
+		}
+	}
 
-			return info_map, nil
+	result := make([]*models.EmbeddedBundle, 0, len(bundles))
+	for bundlePath, b := range bundles {
+		b.SizeBytes = sizes[bundlePath]
+		b.Size = formatSize(b.SizeBytes)
+		if file, ok := plists[bundlePath]; ok {
+			info, err := readZipPlist(file)
+			if err != nil {
+				return nil, err
+			}
+			b.BundleId = firstString(info, "CFBundleIdentifier")
+			b.Version = firstString(info, "CFBundleShortVersionString", "CFBundleVersion")
 		}
+		result = append(result, b)
 	}
-	return nil, errors.New("Info.plist not found")
-}
\ No newline at end of file
+	sort.Sort(models.EmbeddedBundles(result))
+	return result, nil
+}
@@ -1,9 +1,14 @@
 package backends
 
 import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+
 	"github.com/stretchr/testify/assert"
-	"fmt"
 )
 
 //
@@ -12,10 +17,71 @@ import (
 func TestIpaParser(t *testing.T) {
 	//TODO
 	path := "/Users/feiwang/goprojects/apps/src/git.chunyu.me/feiwang/appserver/apps_root/app.zip"
-	metaInfo, err := ParseIpa(path, "chunyu")
+	matcher, _ := NewBundleIdMatcher([]string{"re:(?i)chunyu"})
+	metaInfo, err := ParseIpa(path, matcher)
 
 	assert.NoError(t, err)
 
 	fmt.Printf("CFBundleDisplayName: %s\n", metaInfo["CFBundleDisplayName"])
 	fmt.Printf("CFBundleShortVersionString: %s\n", metaInfo["CFBundleShortVersionString"])
 }
+
+func testInfoPlist(bundleId string, version string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+  <key>CFBundleIdentifier</key><string>%s</string>
+  <key>CFBundleShortVersionString</key><string>%s</string>
+</dict></plist>`, bundleId, version)
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestParseIpaBundle"
+//
+func TestParseIpaBundle(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ipa")
+	defer os.RemoveAll(dir)
+
+	ipaPath := path.Join(dir, "app.ipa")
+	f, err := os.Create(ipaPath)
+	assert.NoError(t, err)
+	w := zip.NewWriter(f)
+	// framework, extension的Info.plist在主App之前, 并且bundle id也包含chunyu
+	entries := []struct{ name, content string }{
+		{"Payload/Demo.app/Frameworks/Chunyu.framework/Info.plist", testInfoPlist("com.chunyu.Framework", "2.0")},
+		{"Payload/Demo.app/Frameworks/Chunyu.framework/Chunyu", "0123456789"},
+		{"Payload/Demo.app/Frameworks/libswiftCore.dylib", "01234"},
+		{"Payload/Demo.app/PlugIns/Share.appex/Info.plist", testInfoPlist("com.chunyu.Demo.Share", "1.0")},
+		{"Payload/Demo.app/Watch/Watch.app/Info.plist", testInfoPlist("com.chunyu.Demo.watchkitapp", "1.0")},
+		{"Payload/Demo.app/Watch/Watch.app/PlugIns/Ext.appex/Info.plist", testInfoPlist("com.chunyu.Demo.watchkitapp.ext", "1.0")},
+		{"Payload/Demo.app/Info.plist", testInfoPlist("com.chunyu.Demo", "1.4.0")},
+	}
+	for _, e := range entries {
+		entry, err := w.Create(e.name)
+		assert.NoError(t, err)
+		entry.Write([]byte(e.content))
+	}
+	assert.NoError(t, w.Close())
+	f.Close()
+
+	bundle, err := ParseIpaBundle(ipaPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "com.chunyu.Demo", bundle.Info["CFBundleIdentifier"])
+	assert.Equal(t, "Payload/Demo.app", bundle.Path)
+
+	assert.Equal(t, 5, len(bundle.Embedded))
+	paths := make(map[string]string)
+	for _, b := range bundle.Embedded {
+		paths[b.Path] = b.Kind + " " + b.BundleId
+	}
+	assert.Equal(t, "framework com.chunyu.Framework", paths["Frameworks/Chunyu.framework"])
+	assert.Equal(t, "framework ", paths["Frameworks/libswiftCore.dylib"])
+	assert.Equal(t, "extension com.chunyu.Demo.Share", paths["PlugIns/Share.appex"])
+	assert.Equal(t, "watch com.chunyu.Demo.watchkitapp", paths["Watch/Watch.app"])
+	assert.Equal(t, "extension com.chunyu.Demo.watchkitapp.ext", paths["Watch/Watch.app/PlugIns/Ext.appex"])
+	assert.Equal(t, "Frameworks/Chunyu.framework", bundle.Embedded[0].Path)
+	assert.Equal(t, int64(len(entries[0].content)+10), bundle.Embedded[0].SizeBytes)
+
+	matcher, _ := NewBundleIdMatcher([]string{"com.other."})
+	_, err = ParseIpa(ipaPath, matcher)
+	assert.Error(t, err)
+}
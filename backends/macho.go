@@ -0,0 +1,249 @@
+package backends
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+//
+// 解析Mach-O(包括fat binary)的头部, 获取可执行文件支持的架构
+// 参考: /usr/include/mach-o/loader.h, /usr/include/mach-o/fat.h
+//
+
+const (
+	machoFatMagic   = 0xcafebabe
+	machoFatMagic64 = 0xcafebabf
+	machoMagic32    = 0xfeedface
+	machoMagic64    = 0xfeedfacf
+	machoCigam32    = 0xcefaedfe
+	machoCigam64    = 0xcffaedfe
+
+	cpuArch64    = 0x01000000
+	cpuArch64_32 = 0x02000000
+
+	lcCodeSignature = 0x1d
+
+	// 代码签名的SuperBlob以及其中的CMS签名, 都是big endian
+	csMagicEmbeddedSignature = 0xfade0cc0
+	csMagicBlobWrapper       = 0xfade0b01
+	csSlotSignature          = 0x10000
+
+	cpuTypeX86     = 7
+	cpuTypeArm     = 12
+	cpuSubtypeMask = 0x00ffffff
+)
+
+// MachOHeaderSize 解析架构需要读取的文件头的大小
+const MachOHeaderSize = 4096
+
+// 读取代码签名时load commands以及签名数据的上限, 超过时认为文件已损坏, 避免按照文件中的长度分配内存
+const (
+	maxMachOLoadCommandsSize  = 1 << 20
+	maxMachOCodeSignatureSize = 64 << 20
+)
+
+func machoArchName(cpuType uint32, cpuSubtype uint32) string {
+	cpuSubtype &= cpuSubtypeMask
+	switch cpuType {
+	case cpuTypeX86:
+		return "i386"
+	case cpuTypeX86 | cpuArch64:
+		return "x86_64"
+	case cpuTypeArm:
+		switch cpuSubtype {
+		case 6:
+			return "armv6"
+		case 9:
+			return "armv7"
+		case 11:
+			return "armv7s"
+		case 12:
+			return "armv7k"
+		}
+		return "arm"
+	case cpuTypeArm | cpuArch64:
+		if cpuSubtype == 2 {
+			return "arm64e"
+		}
+		return "arm64"
+	case cpuTypeArm | cpuArch64_32:
+		return "arm64_32"
+	}
+	return fmt.Sprintf("cpu(%d,%d)", cpuType, cpuSubtype)
+}
+
+// MachOArchitectures 根据可执行文件的头部返回所有的架构, 例如: [armv7 arm64]
+func MachOArchitectures(header []byte) ([]string, error) {
+	if len(header) < 12 {
+		return nil, fmt.Errorf("mach-o header too short")
+	}
+
+	switch magic := binary.BigEndian.Uint32(header); magic {
+	case machoFatMagic, machoFatMagic64:
+		// fat header 以及 fat_arch 都是big endian
+		archSize := 20
+		if magic == machoFatMagic64 {
+			archSize = 32
+		}
+		count := int(binary.BigEndian.Uint32(header[4:]))
+		if 8+count*archSize > len(header) {
+			return nil, fmt.Errorf("invalid fat header: %d architectures", count)
+		}
+		archs := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			arch := header[8+i*archSize:]
+			archs = append(archs, machoArchName(binary.BigEndian.Uint32(arch), binary.BigEndian.Uint32(arch[4:])))
+		}
+		return archs, nil
+
+	case machoMagic32, machoMagic64:
+		return []string{machoArchName(binary.BigEndian.Uint32(header[4:]), binary.BigEndian.Uint32(header[8:]))}, nil
+
+	case machoCigam32, machoCigam64:
+		return []string{machoArchName(binary.LittleEndian.Uint32(header[4:]), binary.LittleEndian.Uint32(header[8:]))}, nil
+
+	default:
+		return nil, fmt.Errorf("not a mach-o file: magic %#x", magic)
+	}
+}
+
+// forwardReader 从zip中读取可执行文件时不能seek, 只能向前读取
+// 保留最近一次读取的数据, 允许在其中重复读取
+type forwardReader struct {
+	r        io.Reader
+	buf      []byte
+	bufStart int64
+}
+
+func (f *forwardReader) readAt(offset int64, n int) ([]byte, error) {
+	if offset < f.bufStart {
+		return nil, fmt.Errorf("cannot read backward at %d", offset)
+	}
+	if end := f.bufStart + int64(len(f.buf)); offset > end {
+		if _, err := io.CopyN(ioutil.Discard, f.r, offset-end); err != nil {
+			return nil, err
+		}
+		f.buf, f.bufStart = nil, offset
+	}
+	start := int(offset - f.bufStart)
+	if missing := start + n - len(f.buf); missing > 0 {
+		more := make([]byte, missing)
+		if _, err := io.ReadFull(f.r, more); err != nil {
+			return nil, err
+		}
+		f.buf = append(f.buf, more...)
+	}
+	return f.buf[start : start+n], nil
+}
+
+// MachOCodeSignature 返回可执行文件代码签名中的CMS签名(DER), 没有签名或者ad-hoc签名时返回nil
+// fat binary中所有架构的签名者相同, 只读取第一个架构; size为文件的大小(例如: zip中的UncompressedSize64)
+func MachOCodeSignature(r io.Reader, size int64) ([]byte, error) {
+	f := &forwardReader{r: r}
+	header, err := f.readAt(0, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	var slice int64
+	switch magic := binary.BigEndian.Uint32(header); magic {
+	case machoFatMagic, machoFatMagic64:
+		if binary.BigEndian.Uint32(header[4:]) == 0 {
+			return nil, fmt.Errorf("invalid fat header: no architectures")
+		}
+		if magic == machoFatMagic64 {
+			arch, err := f.readAt(8, 32)
+			if err != nil {
+				return nil, err
+			}
+			slice = int64(binary.BigEndian.Uint64(arch[8:]))
+		} else {
+			arch, err := f.readAt(8, 20)
+			if err != nil {
+				return nil, err
+			}
+			slice = int64(binary.BigEndian.Uint32(arch[8:]))
+		}
+		if slice < 0 || slice+28 > size {
+			return nil, fmt.Errorf("invalid fat arch offset: %d", slice)
+		}
+	}
+
+	header, err = f.readAt(slice, 28)
+	if err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	headerSize := 28
+	switch binary.BigEndian.Uint32(header) {
+	case machoMagic32:
+		order = binary.BigEndian
+	case machoMagic64:
+		order, headerSize = binary.BigEndian, 32
+	case machoCigam32:
+		order = binary.LittleEndian
+	case machoCigam64:
+		order, headerSize = binary.LittleEndian, 32
+	default:
+		return nil, fmt.Errorf("not a mach-o file: magic %#x", binary.BigEndian.Uint32(header))
+	}
+	ncmds := int(order.Uint32(header[16:]))
+	sizeofcmds := int64(order.Uint32(header[20:]))
+	if sizeofcmds > maxMachOLoadCommandsSize || slice+int64(headerSize)+sizeofcmds > size {
+		return nil, fmt.Errorf("invalid load commands size: %d", sizeofcmds)
+	}
+
+	cmds, err := f.readAt(slice+int64(headerSize), int(sizeofcmds))
+	if err != nil {
+		return nil, err
+	}
+	var dataOff, dataSize uint32
+	for i := 0; i < ncmds && len(cmds) >= 8; i++ {
+		cmd, cmdSize := order.Uint32(cmds), order.Uint32(cmds[4:])
+		if cmdSize < 8 || int(cmdSize) > len(cmds) {
+			return nil, fmt.Errorf("invalid load command size: %d", cmdSize)
+		}
+		if cmd == lcCodeSignature && cmdSize >= 16 {
+			dataOff, dataSize = order.Uint32(cmds[8:]), order.Uint32(cmds[12:])
+			break
+		}
+		cmds = cmds[cmdSize:]
+	}
+	if dataSize < 12 {
+		return nil, nil
+	}
+	if dataSize > maxMachOCodeSignatureSize || slice+int64(dataOff)+int64(dataSize) > size {
+		return nil, fmt.Errorf("invalid code signature size: %d", dataSize)
+	}
+
+	blob, err := f.readAt(slice+int64(dataOff), int(dataSize))
+	if err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(blob) != csMagicEmbeddedSignature {
+		return nil, fmt.Errorf("invalid code signature magic: %#x", binary.BigEndian.Uint32(blob))
+	}
+	count := int(binary.BigEndian.Uint32(blob[8:]))
+	for i := 0; i < count && 12+i*8+8 <= len(blob); i++ {
+		index := blob[12+i*8:]
+		if binary.BigEndian.Uint32(index) != csSlotSignature {
+			continue
+		}
+		offset := int(binary.BigEndian.Uint32(index[4:]))
+		if offset+8 > len(blob) || binary.BigEndian.Uint32(blob[offset:]) != csMagicBlobWrapper {
+			return nil, fmt.Errorf("invalid signature blob")
+		}
+		length := int(binary.BigEndian.Uint32(blob[offset+4:]))
+		if length < 8 || offset+length > len(blob) {
+			return nil, fmt.Errorf("invalid signature blob length: %d", length)
+		}
+		// ad-hoc签名的CMS为空
+		if length == 8 {
+			return nil, nil
+		}
+		return append([]byte(nil), blob[offset+8:offset+length]...), nil
+	}
+	return nil, nil
+}
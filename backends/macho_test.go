@@ -0,0 +1,78 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestMachOArchitectures"
+//
+func TestMachOArchitectures(t *testing.T) {
+	// fat binary: armv7 + arm64
+	fat := make([]byte, 8+2*20)
+	binary.BigEndian.PutUint32(fat, machoFatMagic)
+	binary.BigEndian.PutUint32(fat[4:], 2)
+	binary.BigEndian.PutUint32(fat[8:], cpuTypeArm)
+	binary.BigEndian.PutUint32(fat[12:], 9)
+	binary.BigEndian.PutUint32(fat[28:], cpuTypeArm|cpuArch64)
+	binary.BigEndian.PutUint32(fat[32:], 0)
+	archs, err := MachOArchitectures(fat)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"armv7", "arm64"}, archs)
+
+	// little endian 64位
+	thin := make([]byte, 32)
+	binary.LittleEndian.PutUint32(thin, machoMagic64)
+	binary.LittleEndian.PutUint32(thin[4:], cpuTypeArm|cpuArch64)
+	binary.LittleEndian.PutUint32(thin[8:], 0x80000002)
+	archs, err = MachOArchitectures(thin)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"arm64e"}, archs)
+
+	_, err = MachOArchitectures([]byte("#!/bin/sh\necho hello\n"))
+	assert.Error(t, err)
+
+	// fat header中架构的数目超出了读取的范围
+	binary.BigEndian.PutUint32(fat[4:], 1000)
+	_, err = MachOArchitectures(fat)
+	assert.Error(t, err)
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestMachOCodeSignature"
+//
+func TestMachOCodeSignature(t *testing.T) {
+	cms := []byte("cms")
+	signed := testMachO(cms)
+	result, err := MachOCodeSignature(bytes.NewReader(signed), int64(len(signed)))
+	assert.NoError(t, err)
+	assert.Equal(t, cms, result)
+
+	fat := testFatMachO(signed)
+	result, err = MachOCodeSignature(bytes.NewReader(fat), int64(len(fat)))
+	assert.NoError(t, err)
+	assert.Equal(t, cms, result)
+
+	// sizeofcmds, datasize超过文件大小或者上限时不分配内存, 直接返回错误
+	broken := append([]byte(nil), signed...)
+	binary.LittleEndian.PutUint32(broken[20:], 0xffffffff)
+	_, err = MachOCodeSignature(bytes.NewReader(broken), int64(len(broken)))
+	assert.Error(t, err)
+
+	broken = append([]byte(nil), signed...)
+	binary.LittleEndian.PutUint32(broken[32+12:], 0xfffffff0)
+	_, err = MachOCodeSignature(bytes.NewReader(broken), int64(len(broken)))
+	assert.Error(t, err)
+	_, err = MachOCodeSignature(bytes.NewReader(signed), int64(len(signed))-1)
+	assert.Error(t, err)
+
+	// fat binary中架构的偏移超出文件
+	broken = append([]byte(nil), fat...)
+	binary.BigEndian.PutUint32(broken[16:], 0x7fffffff)
+	_, err = MachOCodeSignature(bytes.NewReader(broken), int64(len(broken)))
+	assert.Error(t, err)
+}
@@ -0,0 +1,331 @@
+package backends
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Prometheus 指标
+// 没有引入 client_golang, 这里只实现了我们需要的 counter/gauge/histogram, 输出为 text exposition format(0.0.4)
+//
+
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var defaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+type MetricVec struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// 按照label的顺序保存的序列化的key
+func labelKey(labelNames []string, labelValues []string) string {
+	if len(labelNames) != len(labelValues) {
+		panic(fmt.Sprintf("metrics: expect %d label values, got %d", len(labelNames), len(labelValues)))
+	}
+	var buf bytes.Buffer
+	for i, name := range labelNames {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(name)
+		buf.WriteString(`="`)
+		buf.WriteString(escapeLabelValue(labelValues[i]))
+		buf.WriteByte('"')
+	}
+	return buf.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *MetricVec) Add(delta float64, labelValues ...string) {
+	key := labelKey(m.labelNames, labelValues)
+	m.lock.Lock()
+	m.values[key] += delta
+	m.lock.Unlock()
+}
+
+func (m *MetricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *MetricVec) Dec(labelValues ...string) {
+	m.Add(-1, labelValues...)
+}
+
+func (m *MetricVec) Set(v float64, labelValues ...string) {
+	key := labelKey(m.labelNames, labelValues)
+	m.lock.Lock()
+	m.values[key] = v
+	m.lock.Unlock()
+}
+
+// Reset 清除所有的label组合(例如: 重新扫描之后app的数目)
+func (m *MetricVec) Reset() {
+	m.lock.Lock()
+	m.values = make(map[string]float64)
+	m.lock.Unlock()
+}
+
+func (m *MetricVec) Value(labelValues ...string) float64 {
+	key := labelKey(m.labelNames, labelValues)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.values[key]
+}
+
+func (m *MetricVec) writeTo(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.metricType)
+
+	if len(m.labelNames) == 0 {
+		fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.values[""]))
+		return
+	}
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %s\n", m.name, key, formatFloat(m.values[key]))
+	}
+}
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type HistogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+
+	lock   sync.Mutex
+	values map[string]*histogramValue
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := labelKey(h.labelNames, labelValues)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			value.counts[i]++
+		}
+	}
+	value.sum += v
+	value.count++
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := h.values[key]
+		prefix := key
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, formatFloat(upper), value.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, value.count)
+		if key == "" {
+			fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(value.sum))
+			fmt.Fprintf(w, "%s_count %d\n", h.name, value.count)
+		} else {
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, key, formatFloat(value.sum))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, key, value.count)
+		}
+	}
+}
+
+var (
+	metricsLock sync.Mutex
+	allMetrics  []metric
+
+	// 在输出之前刷新的gauge(例如: 从扫描结果中统计)
+	metricsCollectors []func()
+)
+
+func registerMetric(m metric) {
+	metricsLock.Lock()
+	allMetrics = append(allMetrics, m)
+	metricsLock.Unlock()
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) *MetricVec {
+	m := &MetricVec{name: name, help: help, metricType: "counter", labelNames: labelNames, values: make(map[string]float64)}
+	registerMetric(m)
+	return m
+}
+
+func NewGaugeVec(name string, help string, labelNames ...string) *MetricVec {
+	m := &MetricVec{name: name, help: help, metricType: "gauge", labelNames: labelNames, values: make(map[string]float64)}
+	registerMetric(m)
+	return m
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labelNames: labelNames, buckets: buckets, values: make(map[string]*histogramValue)}
+	registerMetric(h)
+	return h
+}
+
+// RegisterMetricsCollector 注册在每次输出指标之前执行的回调
+func RegisterMetricsCollector(collector func()) {
+	metricsLock.Lock()
+	metricsCollectors = append(metricsCollectors, collector)
+	metricsLock.Unlock()
+}
+
+// WriteMetrics 按照Prometheus的文本格式输出所有的指标
+func WriteMetrics(w io.Writer) {
+	metricsLock.Lock()
+	collectors := metricsCollectors
+	metrics := allMetrics
+	metricsLock.Unlock()
+
+	for _, collector := range collectors {
+		collector()
+	}
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
+
+var (
+	HttpRequestsTotal = NewCounterVec("appserver_http_requests_total",
+		"Total number of HTTP requests by route, method and status code.", "route", "method", "code")
+	HttpRequestDuration = NewHistogramVec("appserver_http_request_duration_seconds",
+		"HTTP request latency by route.", defaultDurationBuckets, "route")
+	HttpResponseBytes = NewCounterVec("appserver_http_response_bytes_total",
+		"Total number of bytes served by route.", "route")
+	DownloadsInFlight = NewGaugeVec("appserver_downloads_in_flight",
+		"Number of binary downloads currently being served.", "kind")
+	ActiveConnections = NewGaugeVec("appserver_active_connections",
+		"Number of open client connections.")
+
+	AppsGauge = NewGaugeVec("appserver_apps",
+		"Number of distinct apps per platform.", "platform")
+	BuildsGauge = NewGaugeVec("appserver_builds",
+		"Number of builds per platform.", "platform")
+
+	ScansTotal = NewCounterVec("appserver_scans_total",
+		"Total number of scans of apps_root.")
+	ScanFailuresTotal = NewCounterVec("appserver_scan_failures_total",
+		"Total number of failed scans of apps_root.")
+	ScanDuration = NewHistogramVec("appserver_scan_duration_seconds",
+		"Duration of scans of apps_root.", defaultDurationBuckets)
+	ScanErrorsGauge = NewGaugeVec("appserver_scan_broken_dirs",
+		"Number of app dirs that failed to parse in the last scan.")
+	LastScanTimestamp = NewGaugeVec("appserver_last_scan_timestamp_seconds",
+		"Unix time of the last completed scan.")
+
+	WatcherEventsTotal = NewCounterVec("appserver_watcher_events_total",
+		"Total number of file system events seen by the watcher, by result.", "result")
+	WatchedDirs = NewGaugeVec("appserver_watched_dirs",
+		"Number of directories watched under apps_root.")
+	IndexSize = NewGaugeVec("appserver_index_size",
+		"Number of builds in the in-memory index.")
+
+	ReplicationLagSeconds = NewGaugeVec("appserver_replication_lag_seconds",
+		"Seconds since the follower was last in sync with the leader.")
+	ReplicationPendingBuilds = NewGaugeVec("appserver_replication_pending_builds",
+		"Number of leader builds not yet replicated.")
+	ReplicatedBuildsTotal = NewCounterVec("appserver_replicated_builds_total",
+		"Total number of builds replicated from the leader.")
+	ReplicationFailuresTotal = NewCounterVec("appserver_replication_failures_total",
+		"Total number of failed replication polls.")
+
+	EventSubscribers = NewGaugeVec("appserver_event_subscribers",
+		"Number of clients subscribed to /api/events.")
+	BuildEventsTotal = NewCounterVec("appserver_build_events_total",
+		"Total number of build events published, by type.", "type")
+)
+
+func init() {
+	RegisterMetricsCollector(collectIndexMetrics)
+}
+
+// 从扫描的结果中统计App和Build的数目
+func collectIndexMetrics() {
+	gIndexLock.RLock()
+	iosAppDirs, androidAppDirs := gIosAppDirs, gAndroidAppDirs
+	gIndexLock.RUnlock()
+
+	iosApps := make(map[string]bool)
+	for _, app := range iosAppDirs {
+		iosApps[app.Name] = true
+	}
+	androidApps := make(map[string]bool)
+	for _, app := range androidAppDirs {
+		androidApps[app.Name] = true
+	}
+
+	AppsGauge.Set(float64(len(iosApps)), "ios")
+	AppsGauge.Set(float64(len(androidApps)), "android")
+	BuildsGauge.Set(float64(len(iosAppDirs)), "ios")
+	BuildsGauge.Set(float64(len(androidAppDirs)), "android")
+	IndexSize.Set(float64(len(iosAppDirs) + len(androidAppDirs)))
+}
+
+// ObserveScan 记录一次扫描的结果
+func ObserveScan(start time.Time, err error) {
+	ScansTotal.Inc()
+	ScanDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		ScanFailuresTotal.Inc()
+	} else {
+		LastScanTimestamp.Set(float64(time.Now().Unix()))
+	}
+}
@@ -0,0 +1,43 @@
+package backends
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestMetrics"
+//
+func TestMetricsExposition(t *testing.T) {
+	counter := &MetricVec{name: "test_requests_total", help: "Test counter.", metricType: "counter",
+		labelNames: []string{"route"}, values: make(map[string]float64)}
+	counter.Inc("/api/ipa/:app_id/")
+	counter.Add(2, `/a"b`)
+
+	histogram := &HistogramVec{name: "test_duration_seconds", help: "Test histogram.",
+		buckets: []float64{0.1, 1}, values: make(map[string]*histogramValue)}
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+
+	var buf bytes.Buffer
+	counter.writeTo(&buf)
+	histogram.writeTo(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	assert.Equal(t, []string{
+		"# HELP test_requests_total Test counter.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{route="/a\"b"} 2`,
+		`test_requests_total{route="/api/ipa/:app_id/"} 1`,
+		"# HELP test_duration_seconds Test histogram.",
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{le="0.1"} 1`,
+		`test_duration_seconds_bucket{le="1"} 2`,
+		`test_duration_seconds_bucket{le="+Inf"} 2`,
+		"test_duration_seconds_sum 0.55",
+		"test_duration_seconds_count 2",
+	}, lines)
+}
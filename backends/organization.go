@@ -0,0 +1,227 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego"
+)
+
+//
+// bundle id的过滤以及多组织(团队)的支持, 在app.conf中配置:
+//   bundle_id_patterns: 允许的bundle id, 以";"分隔, 默认为前缀匹配, "re:"开头的为正则表达式
+//                       为空时允许所有的bundle id, 否则各个组织的bundle id也被允许
+//   organizations_file: 组织的定义(json), 参考 conf/organizations.json.template
+//
+
+// BundleIdMatcher 按照前缀或者正则表达式匹配bundle id, nil或者没有任何pattern时匹配所有
+type BundleIdMatcher struct {
+	patterns []string
+	prefixes []string
+	regexps  []*regexp.Regexp
+	exacts   map[string]bool
+}
+
+func NewBundleIdMatcher(patterns []string) (*BundleIdMatcher, error) {
+	m := &BundleIdMatcher{exacts: make(map[string]bool)}
+	for _, p := range patterns {
+		if err := m.add(p); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *BundleIdMatcher) add(pattern string) error {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || m.has(pattern) {
+		return nil
+	}
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(pattern[len("re:"):])
+		if err != nil {
+			return fmt.Errorf("invalid bundle id pattern %q: %v", pattern, err)
+		}
+		m.regexps = append(m.regexps, re)
+	} else {
+		m.prefixes = append(m.prefixes, pattern)
+	}
+	m.patterns = append(m.patterns, pattern)
+	return nil
+}
+
+// addExact 添加需要完全匹配的bundle id
+func (m *BundleIdMatcher) addExact(bundleId string) {
+	if m.exacts[bundleId] {
+		return
+	}
+	m.exacts[bundleId] = true
+	m.patterns = append(m.patterns, bundleId)
+}
+
+func (m *BundleIdMatcher) has(pattern string) bool {
+	for _, p := range m.patterns {
+		if p == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *BundleIdMatcher) Empty() bool {
+	return m == nil || len(m.patterns) == 0
+}
+
+func (m *BundleIdMatcher) Match(bundleId string) bool {
+	if m.Empty() {
+		return true
+	}
+	return m.matchAny(bundleId)
+}
+
+// matchAny 是否匹配其中的一个pattern, 没有pattern时返回false
+func (m *BundleIdMatcher) matchAny(bundleId string) bool {
+	if m == nil || bundleId == "" {
+		return false
+	}
+	if m.exacts[bundleId] {
+		return true
+	}
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(bundleId, prefix) {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(bundleId) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *BundleIdMatcher) String() string {
+	if m.Empty() {
+		return "*"
+	}
+	return strings.Join(m.patterns, ";")
+}
+
+var (
+	gOrgLock         sync.RWMutex
+	gOrganizations   []*models.Organization
+	gOrgMatchers     map[string]*BundleIdMatcher
+	gBundleIdMatcher *BundleIdMatcher
+)
+
+// LoadOrganizations 读取bundle_id_patterns以及organizations_file
+func LoadOrganizations() error {
+	var orgs []*models.Organization
+	if file := beego.AppConfig.String("organizations_file"); file != "" {
+		if !filepath.IsAbs(file) {
+			file, _ = filepath.Abs(file)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &orgs); err != nil {
+			return fmt.Errorf("parse %s failed: %v", file, err)
+		}
+	}
+	return SetOrganizations(ConfigStrings("bundle_id_patterns"), orgs)
+}
+
+// SetOrganizations 设置允许的bundle id以及所有的组织
+func SetOrganizations(patterns []string, orgs []*models.Organization) error {
+	matcher, err := NewBundleIdMatcher(patterns)
+	if err != nil {
+		return err
+	}
+
+	orgMatchers := make(map[string]*BundleIdMatcher)
+	for _, org := range orgs {
+		if org.Id == "" {
+			return fmt.Errorf("organization without id: %q", org.Name)
+		}
+		if _, ok := orgMatchers[org.Id]; ok {
+			return fmt.Errorf("duplicated organization: %s", org.Id)
+		}
+		orgMatcher, err := NewBundleIdMatcher(org.BundleIds)
+		if err != nil {
+			return fmt.Errorf("organization %s: %v", org.Id, err)
+		}
+		for _, app := range org.Apps {
+			orgMatcher.addExact(app)
+		}
+		orgMatchers[org.Id] = orgMatcher
+
+		// 配置了bundle_id_patterns时, 组织的bundle id也是允许的
+		if !matcher.Empty() {
+			for _, p := range org.BundleIds {
+				matcher.add(p)
+			}
+			for _, app := range org.Apps {
+				matcher.addExact(app)
+			}
+		}
+		log.Infof("Organization %s: %s", org.Id, orgMatcher)
+	}
+
+	gOrgLock.Lock()
+	gOrganizations = orgs
+	gOrgMatchers = orgMatchers
+	gBundleIdMatcher = matcher
+	gOrgLock.Unlock()
+	return nil
+}
+
+// AllowedBundleIds 允许发布的bundle id
+func AllowedBundleIds() *BundleIdMatcher {
+	gOrgLock.RLock()
+	defer gOrgLock.RUnlock()
+	return gBundleIdMatcher
+}
+
+func ListOrganizations() []*models.Organization {
+	gOrgLock.RLock()
+	defer gOrgLock.RUnlock()
+	return gOrganizations
+}
+
+func GetOrganization(orgId string) *models.Organization {
+	gOrgLock.RLock()
+	defer gOrgLock.RUnlock()
+	for _, org := range gOrganizations {
+		if org.Id == orgId {
+			return org
+		}
+	}
+	return nil
+}
+
+// OrganizationOf 返回bundle id所属的组织, 按照配置的顺序第一个匹配的组织
+func OrganizationOf(bundleId string) *models.Organization {
+	gOrgLock.RLock()
+	defer gOrgLock.RUnlock()
+	for _, org := range gOrganizations {
+		if gOrgMatchers[org.Id].matchAny(bundleId) {
+			return org
+		}
+	}
+	return nil
+}
+
+func organizationId(bundleId string) string {
+	if org := OrganizationOf(bundleId); org != nil {
+		return org.Id
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+package backends
+
+import (
+	"testing"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestOrganizations"
+//
+func TestOrganizations(t *testing.T) {
+	defer SetOrganizations(nil, nil)
+
+	orgs := []*models.Organization{
+		{Id: "chunyu", BundleIds: []string{"com.chunyu."}},
+		{Id: "partner", BundleIds: []string{`re:^com\.partner\.(foo|bar)$`}, Apps: []string{"com.example.WhiteLabel"}},
+	}
+	assert.NoError(t, SetOrganizations([]string{"me.chunyu."}, orgs))
+
+	matcher := AllowedBundleIds()
+	assert.True(t, matcher.Match("me.chunyu.Demo"))
+	assert.True(t, matcher.Match("com.chunyu.Demo"))
+	assert.True(t, matcher.Match("com.partner.foo"))
+	assert.True(t, matcher.Match("com.example.WhiteLabel"))
+	assert.False(t, matcher.Match("com.partner.baz"))
+	assert.False(t, matcher.Match("com.example.WhiteLabel.share"))
+
+	assert.Equal(t, "chunyu", organizationId("com.chunyu.Demo"))
+	assert.Equal(t, "partner", organizationId("com.example.WhiteLabel"))
+	assert.Equal(t, "", organizationId("me.chunyu.Demo"))
+
+	// 没有配置bundle_id_patterns时允许所有的bundle id
+	assert.NoError(t, SetOrganizations(nil, orgs))
+	assert.True(t, AllowedBundleIds().Match("com.other.App"))
+
+	assert.Error(t, SetOrganizations([]string{"re:("}, nil))
+	assert.Error(t, SetOrganizations(nil, []*models.Organization{{Id: "a"}, {Id: "a"}}))
+}
@@ -0,0 +1,160 @@
+package backends
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego"
+)
+
+//
+// 保留策略, 在app.conf中配置:
+//   retention_keep_builds: 每个App保留最新的N个Build, 0表示不限制
+//   retention_max_age_days: 超过N天的Build被清理, 0表示不限制; 每个App最新的(没有置顶的)Build总是保留
+// 被清理的Build移动到trash_dir(默认为 apps_root/.trash), 而不是直接删除
+//
+
+type RetentionPolicy struct {
+	KeepBuilds int
+	MaxAge     time.Duration
+}
+
+func RetentionPolicyFromConfig() RetentionPolicy {
+	return RetentionPolicy{
+		KeepBuilds: beego.AppConfig.DefaultInt("retention_keep_builds", 0),
+		MaxAge:     time.Duration(beego.AppConfig.DefaultInt("retention_max_age_days", 0)) * 24 * time.Hour,
+	}
+}
+
+// TrashDir 被删除的Build的存放目录
+func TrashDir(appsRootDir string) string {
+	trashDir := beego.AppConfig.String("trash_dir")
+	if trashDir == "" {
+		return path.Join(appsRootDir, ".trash")
+	}
+	if !filepath.IsAbs(trashDir) {
+		trashDir, _ = filepath.Abs(trashDir)
+	}
+	return trashDir
+}
+
+// MoveToTrash 将App目录移动到trash目录中, 返回在trash中的名字
+func MoveToTrash(appsRootDir string, appId string) (string, error) {
+	trashDir := TrashDir(appsRootDir)
+	if err := os.MkdirAll(trashDir, 0755); err != nil {
+		return "", err
+	}
+
+	trashId := fmt.Sprintf("%s.%d", appId, time.Now().Unix())
+	if err := os.Rename(path.Join(appsRootDir, appId), path.Join(trashDir, trashId)); err != nil {
+		return "", err
+	}
+	return trashId, nil
+}
+
+// PruneCandidate 按照保留策略应该被清理的Build
+type PruneCandidate struct {
+	Id       string
+	Platform string
+	App      string
+	Reason   string
+}
+
+type retentionBuild struct {
+	id          string
+	app         string
+	releaseDate string
+	pinned      bool
+}
+
+// 同一个App的Build已经按照ReleaseDate降序排列
+func selectPruneCandidates(platform string, builds []retentionBuild, policy RetentionPolicy, now time.Time) []*PruneCandidate {
+	var candidates []*PruneCandidate
+	kept := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, b := range builds {
+		// 置顶的Build不清理, 也不占用保留的数目
+		if b.pinned {
+			continue
+		}
+		// 最新的Build即使过期也保留, 否则App长期没有发布时会被整个清理掉
+		newest := !seen[b.app]
+		seen[b.app] = true
+		if policy.MaxAge > 0 && !newest {
+			released, err := time.ParseInLocation("2006-01-02 15:04", b.releaseDate, time.Local)
+			if err == nil && now.Sub(released) > policy.MaxAge {
+				candidates = append(candidates, &PruneCandidate{Id: b.id, Platform: platform, App: b.app,
+					Reason: fmt.Sprintf("released at %s, older than %d days", b.releaseDate, int(policy.MaxAge.Hours()/24))})
+				continue
+			}
+		}
+
+		kept[b.app]++
+		if policy.KeepBuilds > 0 && kept[b.app] > policy.KeepBuilds {
+			candidates = append(candidates, &PruneCandidate{Id: b.id, Platform: platform, App: b.app,
+				Reason: fmt.Sprintf("more than %d builds", policy.KeepBuilds)})
+		}
+	}
+	return candidates
+}
+
+// appKey 用于将Build归类到App: 优先使用bundle id
+func appKey(bundleId string, name string) string {
+	if bundleId != "" {
+		return bundleId
+	}
+	return name
+}
+
+// PruneCandidates 根据扫描的结果计算需要被清理的Build
+func PruneCandidates(appsRootDir string, policy RetentionPolicy) ([]*PruneCandidate, error) {
+	iosAppDirs, androidAppDirs, err := ListAppDir(appsRootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	iosBuilds := make([]retentionBuild, 0, len(iosAppDirs))
+	for _, app := range iosAppDirs {
+		iosBuilds = append(iosBuilds, retentionBuild{id: app.Id, app: appKey(app.BundleId, app.Name), releaseDate: app.ReleaseDate, pinned: app.Pinned})
+	}
+	androidBuilds := make([]retentionBuild, 0, len(androidAppDirs))
+	for _, app := range androidAppDirs {
+		androidBuilds = append(androidBuilds, retentionBuild{id: app.Id, app: appKey(app.BundleId, app.Name), releaseDate: app.ReleaseDate, pinned: app.Pinned})
+	}
+
+	candidates := selectPruneCandidates("ios", iosBuilds, policy, now)
+	candidates = append(candidates, selectPruneCandidates("android", androidBuilds, policy, now)...)
+	return candidates, nil
+}
+
+// Prune 按照保留策略将过期的Build移动到trash目录
+func Prune(appsRootDir string, policy RetentionPolicy, dryRun bool) ([]*PruneCandidate, error) {
+	candidates, err := PruneCandidates(appsRootDir, policy)
+	if err != nil || dryRun {
+		return candidates, err
+	}
+
+	for _, c := range candidates {
+		trashId, err := MoveToTrash(appsRootDir, c.Id)
+		if err != nil {
+			return candidates, err
+		}
+		// 存储中的文件直接删除, trash中仍然保留一份
+		if err := DeleteAppDir(GetStorage(), appsRootDir, c.Id); err != nil {
+			return candidates, err
+		}
+		log.Infof("Pruned %s (%s) to trash: %s", c.Id, c.Reason, trashId)
+		RecordAudit(appsRootDir, &AuditEntry{Actor: AuditActorRetention, Action: AuditPrune, Target: c.Id, Detail: c.Reason + ", trash: " + trashId})
+	}
+
+	if len(candidates) > 0 {
+		return candidates, ScanAppRootDir(appsRootDir)
+	}
+	return candidates, nil
+}
@@ -0,0 +1,47 @@
+package backends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestSelectPruneCandidates"
+//
+func TestSelectPruneCandidates(t *testing.T) {
+	now := time.Date(2016, 7, 1, 12, 0, 0, 0, time.Local)
+	builds := []retentionBuild{
+		{id: "a3", app: "com.chunyu.A", releaseDate: "2016-06-30 10:00"},
+		{id: "b1", app: "com.chunyu.B", releaseDate: "2016-06-29 10:00"},
+		{id: "a2", app: "com.chunyu.A", releaseDate: "2016-06-20 10:00"},
+		{id: "a1", app: "com.chunyu.A", releaseDate: "2016-01-01 10:00"},
+	}
+
+	candidates := selectPruneCandidates("ios", builds, RetentionPolicy{KeepBuilds: 1}, now)
+	ids := []string{}
+	for _, c := range candidates {
+		ids = append(ids, c.Id)
+	}
+	assert.Equal(t, []string{"a2", "a1"}, ids)
+
+	candidates = selectPruneCandidates("ios", builds, RetentionPolicy{MaxAge: 30 * 24 * time.Hour}, now)
+	assert.Equal(t, 1, len(candidates))
+	assert.Equal(t, "a1", candidates[0].Id)
+
+	candidates = selectPruneCandidates("ios", builds, RetentionPolicy{}, now)
+	assert.Equal(t, 0, len(candidates))
+
+	// 所有的Build都过期时保留每个App最新的没有置顶的Build
+	old := []retentionBuild{
+		{id: "c3", app: "com.chunyu.C", releaseDate: "2016-01-03 10:00", pinned: true},
+		{id: "c2", app: "com.chunyu.C", releaseDate: "2016-01-02 10:00"},
+		{id: "c1", app: "com.chunyu.C", releaseDate: "2016-01-01 10:00"},
+		{id: "d1", app: "com.chunyu.D", releaseDate: "2016-01-01 10:00"},
+	}
+	candidates = selectPruneCandidates("ios", old, RetentionPolicy{KeepBuilds: 2, MaxAge: 30 * 24 * time.Hour}, now)
+	if assert.Equal(t, 1, len(candidates)) {
+		assert.Equal(t, "c1", candidates[0].Id)
+	}
+}
@@ -0,0 +1,648 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego"
+)
+
+//
+// 两个appserver实例之间的复制, 在app.conf中配置:
+//   replication_token: leader和follower共享的token, leader上为空时不提供复制的接口
+//   replication_leader: follower上配置, leader的地址, 例如: http://appserver-sh:8080
+//   replication_interval: follower轮询leader的间隔(秒), 默认300
+//   replication_followers: leader上配置, Build有变化时通知的follower(以";"分隔)
+//   replication_delete: 是否删除leader上已经删除的Build, 只删除复制来的Build, 默认true
+//   replication_delete_after: 连续多少次轮询leader上都没有的Build才删除, 默认3
+//
+// follower从 /api/replication/builds 获取leader上所有的Build以及文件的校验和,
+// 通过 /api/replication/files/:app_id/:file 下载本地没有或者不一致的文件, 校验SHA-256之后再使用
+//
+
+const ReplicationTokenHeader = "X-Replication-Token"
+
+// 复制来的Build, 只有这些Build会被更新或者删除
+const replicationStateFile = ".replication.json"
+
+func ReplicationToken() string {
+	return beego.AppConfig.String("replication_token")
+}
+
+// ReplicaFile leader上Build中的一个文件
+type ReplicaFile struct {
+	SHA256  string    `json:"sha256"`
+	MD5     string    `json:"md5"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// ReplicaBuild leader上的一个Build
+type ReplicaBuild struct {
+	Id       string                  `json:"id"`
+	Platform string                  `json:"platform"`
+	Files    map[string]*ReplicaFile `json:"files"`
+	// 暂时不能复制的Build(还没有计算校验和, 文件变化之后还没有重新扫描或者解析失败), follower保留已经复制的版本
+	Pending bool `json:"pending,omitempty"`
+}
+
+// ReplicationManifest leader上所有的Build, 不能复制的Build只有id并且标记为pending;
+// follower只删除不在列表中的Build
+func ReplicationManifest(appsRootDir string) ([]*ReplicaBuild, error) {
+	iosAppDirs, androidAppDirs, err := ListAppDir(appsRootDir)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := ioutil.ReadDir(appsRootDir)
+	if err != nil {
+		return nil, err
+	}
+	builds := make([]*ReplicaBuild, 0, len(dirs))
+	listed := make(map[string]bool)
+	add := func(appId string, platform string) {
+		if listed[appId] {
+			return
+		}
+		listed[appId] = true
+		if build := replicaBuild(appsRootDir, appId, platform); build != nil {
+			builds = append(builds, build)
+		} else {
+			builds = append(builds, &ReplicaBuild{Id: appId, Platform: platform, Pending: true})
+		}
+	}
+	for _, app := range iosAppDirs {
+		add(app.Id, "ios")
+	}
+	for _, app := range androidAppDirs {
+		add(app.Id, "android")
+	}
+	// 扫描之后新增的或者解析失败的目录
+	for _, fi := range dirs {
+		if fi.IsDir() && !isHiddenDir(fi.Name()) && !listed[fi.Name()] {
+			listed[fi.Name()] = true
+			builds = append(builds, &ReplicaBuild{Id: fi.Name(), Pending: true})
+		}
+	}
+	return builds, nil
+}
+
+func replicaBuild(appsRootDir string, appId string, platform string) *ReplicaBuild {
+	appDir := path.Join(appsRootDir, appId)
+	checksums := cachedChecksums(appDir)
+	if len(checksums) == 0 {
+		return nil
+	}
+	blobs := cachedBuildBlobs(appDir)
+	build := &ReplicaBuild{Id: appId, Platform: platform, Files: make(map[string]*ReplicaFile)}
+	for file, c := range checksums {
+		info, err := os.Stat(path.Join(appDir, file))
+		if err != nil || c.stale(info) {
+			// 文件变化之后还没有重新扫描
+			return nil
+		}
+		build.Files[file] = &ReplicaFile{SHA256: c.SHA256, MD5: c.MD5, Size: c.Size, ModTime: blobs.ModTime(file, info)}
+	}
+	return build
+}
+
+// ReplicationStatus follower的复制状态
+type ReplicationStatus struct {
+	Leader string
+	// 最近一次轮询的时间, 以及最近一次和leader完全一致的时间
+	LastPollTime time.Time
+	LastSyncTime time.Time
+	LastError    string
+	// 连续失败的次数
+	ConsecutiveFailures int
+	// leader上有但是本地还没有(或者不一致)的Build
+	Pending    []string
+	Replicated int64
+	Deleted    int64
+}
+
+// Lag 距离最近一次和leader一致的时间, 从来没有一致过时从启动开始计算
+func (s ReplicationStatus) Lag(now time.Time) time.Duration {
+	if s.LastSyncTime.IsZero() {
+		return now.Sub(StartTime)
+	}
+	return now.Sub(s.LastSyncTime)
+}
+
+// Replicator follower定期从leader复制Build, 收到leader的通知时立即复制
+type Replicator struct {
+	Leader   string
+	Token    string
+	Interval time.Duration
+	AppsRoot string
+	Delete   bool
+	// 连续DeleteAfter次轮询leader上都没有的Build才删除
+	DeleteAfter int
+	Client      *http.Client
+
+	trigger chan bool
+	// 同一时间只进行一次复制, 同时保护missing
+	syncLock sync.Mutex
+	// 复制来的Build连续不在leader列表中的次数
+	missing    map[string]int
+	statusLock sync.RWMutex
+	status     ReplicationStatus
+}
+
+func NewReplicator(leader string, appsRoot string) *Replicator {
+	return &Replicator{
+		Leader:      strings.TrimRight(leader, "/"),
+		Token:       ReplicationToken(),
+		Interval:    time.Duration(beego.AppConfig.DefaultInt("replication_interval", 300)) * time.Second,
+		AppsRoot:    appsRoot,
+		Delete:      beego.AppConfig.DefaultBool("replication_delete", true),
+		DeleteAfter: beego.AppConfig.DefaultInt("replication_delete_after", 3),
+		Client:      newReplicationClient(),
+		trigger:     make(chan bool, 1),
+		missing:     make(map[string]int),
+		status:      ReplicationStatus{Leader: strings.TrimRight(leader, "/")},
+	}
+}
+
+// newReplicationClient 下载大文件时不能设置整体的超时, 只限制连接以及等待响应头的时间,
+// 否则leader没有响应时Sync一直持有syncLock
+func newReplicationClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			Dial:                  dialer.Dial,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+		},
+	}
+}
+
+var (
+	gReplicatorLock sync.RWMutex
+	gReplicator     *Replicator
+)
+
+// LoadReplicator 配置了replication_leader时创建Replicator, 否则返回nil
+func LoadReplicator(appsRoot string) *Replicator {
+	var replicator *Replicator
+	if leader := beego.AppConfig.String("replication_leader"); leader != "" {
+		replicator = NewReplicator(leader, appsRoot)
+		if replicator.Interval <= 0 {
+			log.Warnf("Invalid replication_interval: %v, use 300 seconds", replicator.Interval)
+			replicator.Interval = 300 * time.Second
+		}
+		if replicator.DeleteAfter < 1 {
+			replicator.DeleteAfter = 1
+		}
+	}
+	SetReplicator(replicator)
+	return replicator
+}
+
+func SetReplicator(replicator *Replicator) {
+	gReplicatorLock.Lock()
+	gReplicator = replicator
+	gReplicatorLock.Unlock()
+}
+
+// GetReplicator 没有配置replication_leader时为nil
+func GetReplicator() *Replicator {
+	gReplicatorLock.RLock()
+	defer gReplicatorLock.RUnlock()
+	return gReplicator
+}
+
+func (r *Replicator) Status() ReplicationStatus {
+	r.statusLock.RLock()
+	defer r.statusLock.RUnlock()
+	status := r.status
+	status.Pending = append([]string{}, r.status.Pending...)
+	return status
+}
+
+// Trigger 收到leader的通知, 尽快开始复制
+func (r *Replicator) Trigger() {
+	select {
+	case r.trigger <- true:
+	default:
+	}
+}
+
+// Start 启动时以及每隔Interval复制一次; 往返回的channel写入数据停止
+func (r *Replicator) Start() chan bool {
+	done := make(chan bool, 1)
+	go func() {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		r.Trigger()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			case <-r.trigger:
+			}
+			if err := r.Sync(); err != nil {
+				log.WarnErrorf(err, "Replicate from %s failed", r.Leader)
+			}
+		}
+	}()
+	return done
+}
+
+func (r *Replicator) request(p string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", r.Leader+p, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(ReplicationTokenHeader, r.Token)
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s %s", p, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (r *Replicator) fetchManifest() ([]*ReplicaBuild, error) {
+	resp, err := r.request("/api/replication/builds")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var builds []*ReplicaBuild
+	if err := json.NewDecoder(resp.Body).Decode(&builds); err != nil {
+		return nil, fmt.Errorf("decode manifest failed: %v", err)
+	}
+	return builds, nil
+}
+
+// Sync 和leader同步一次, 单个Build失败时继续复制其他的Build
+func (r *Replicator) Sync() error {
+	r.syncLock.Lock()
+	defer r.syncLock.Unlock()
+
+	start := time.Now()
+	pending, changed, err := r.sync()
+	if changed {
+		if scanErr := ScanAppRootDir(r.AppsRoot); scanErr != nil && err == nil {
+			err = scanErr
+		}
+	}
+
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	r.status.LastPollTime = start
+	r.status.Pending = pending
+	if err != nil {
+		r.status.LastError = err.Error()
+		r.status.ConsecutiveFailures++
+		ReplicationFailuresTotal.Inc()
+	} else {
+		r.status.LastError = ""
+		r.status.ConsecutiveFailures = 0
+		if len(pending) == 0 {
+			r.status.LastSyncTime = start
+		}
+	}
+	return err
+}
+
+func (r *Replicator) sync() (pending []string, changed bool, err error) {
+	builds, err := r.fetchManifest()
+	if err != nil {
+		return nil, false, err
+	}
+	state, err := readReplicationState(r.AppsRoot)
+	if err != nil {
+		return nil, false, err
+	}
+
+	leaderIds := make(map[string]bool)
+	var lastErr error
+	for _, build := range builds {
+		if !validReplicaBuild(build) {
+			log.Warnf("Ignore invalid build from leader: %q", build.Id)
+			continue
+		}
+		leaderIds[build.Id] = true
+		if build.Pending {
+			// leader上暂时不能复制, 保留已经复制的版本
+			continue
+		}
+		appDir := path.Join(r.AppsRoot, build.Id)
+		if IsExist(appDir) && !state[build.Id] {
+			// 本地上传的同名Build, 不覆盖
+			continue
+		}
+		updated, err := r.syncBuild(build)
+		if err != nil {
+			log.WarnErrorf(err, "Replicate %s failed", build.Id)
+			pending = append(pending, build.Id)
+			lastErr = err
+			continue
+		}
+		if !state[build.Id] {
+			state[build.Id] = true
+			if err := writeReplicationState(r.AppsRoot, state); err != nil {
+				return pending, true, err
+			}
+		}
+		if updated {
+			changed = true
+			ReplicatedBuildsTotal.Inc()
+			r.statusLock.Lock()
+			r.status.Replicated++
+			r.statusLock.Unlock()
+			log.Infof("Replicated %s from %s", build.Id, r.Leader)
+			RecordAudit(r.AppsRoot, &AuditEntry{Actor: AuditActorReplication, Action: AuditReplicate, Target: build.Id, Detail: "from " + r.Leader})
+		}
+	}
+
+	if r.Delete {
+		for id := range state {
+			if leaderIds[id] {
+				delete(r.missing, id)
+				continue
+			}
+			// 连续多次不在leader的列表中才删除
+			r.missing[id]++
+			if r.missing[id] < r.DeleteAfter {
+				continue
+			}
+			delete(r.missing, id)
+			if IsExist(path.Join(r.AppsRoot, id)) {
+				trashId, err := MoveToTrash(r.AppsRoot, id)
+				if err != nil {
+					return pending, changed, err
+				}
+				if err := DeleteAppDir(GetStorage(), r.AppsRoot, id); err != nil {
+					return pending, changed, err
+				}
+				log.Infof("Build %s was deleted on %s, moved to trash: %s", id, r.Leader, trashId)
+				RecordAudit(r.AppsRoot, &AuditEntry{Actor: AuditActorReplication, Action: AuditTrash, Target: id, Detail: trashId})
+				changed = true
+				r.statusLock.Lock()
+				r.status.Deleted++
+				r.statusLock.Unlock()
+			}
+			delete(state, id)
+			if err := writeReplicationState(r.AppsRoot, state); err != nil {
+				return pending, changed, err
+			}
+		}
+	}
+	sort.Strings(pending)
+	return pending, changed, lastErr
+}
+
+func validReplicaBuild(build *ReplicaBuild) bool {
+	if build.Id == "" || isHiddenDir(build.Id) || strings.ContainsAny(build.Id, `/\`) {
+		return false
+	}
+	if build.Pending {
+		return true
+	}
+	if len(build.Files) == 0 {
+		return false
+	}
+	for file := range build.Files {
+		if file == "" || isHiddenDir(file) || strings.ContainsAny(file, `/\`) || file == ChecksumsFile || file == BlobsFile {
+			return false
+		}
+	}
+	return true
+}
+
+// syncBuild 下载本地没有或者不一致的文件, 新的Build先下载到隐藏的临时目录, 完整之后再rename
+// 返回Build是否有变化
+func (r *Replicator) syncBuild(build *ReplicaBuild) (bool, error) {
+	appDir := path.Join(r.AppsRoot, build.Id)
+	exists := IsExist(appDir)
+	dir := appDir
+	if !exists {
+		tmpDir, err := ioutil.TempDir(r.AppsRoot, ".replicate-")
+		if err != nil {
+			return false, err
+		}
+		defer os.RemoveAll(tmpDir)
+		dir = tmpDir
+	}
+
+	var local map[string]*fileChecksum
+	if exists {
+		var err error
+		if local, err = readChecksums(appDir); err != nil {
+			return false, err
+		}
+	}
+
+	checksums := make(map[string]*fileChecksum)
+	updated := false
+	for file, remote := range build.Files {
+		if c := local[file]; c != nil && c.SHA256 == remote.SHA256 && c.Size == remote.Size {
+			if info, err := os.Stat(path.Join(dir, file)); err == nil && !c.stale(info) {
+				checksums[file] = c
+				continue
+			}
+		}
+		c, err := r.downloadFile(build.Id, file, remote, path.Join(dir, file))
+		if err != nil {
+			return false, err
+		}
+		checksums[file] = c
+		updated = true
+	}
+
+	// 删除leader上已经没有的文件
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, info := range files {
+		if isArtifactFile(info) && build.Files[info.Name()] == nil {
+			if err := os.Remove(path.Join(dir, info.Name())); err != nil {
+				return false, err
+			}
+			updated = true
+		}
+	}
+	if !updated {
+		return false, nil
+	}
+
+	// 已经校验过, 扫描时不需要重新计算
+	if err := writeChecksums(dir, checksums); err != nil {
+		return false, err
+	}
+	if !exists {
+		if err := renamePulledDir(dir, appDir); err != nil {
+			return false, err
+		}
+	}
+	// 使用s3等存储或者启用blob_store时同时保存到存储
+	return true, PushAppDir(GetStorage(), r.AppsRoot, build.Id)
+}
+
+// downloadFile 下载到临时文件, 校验大小和SHA-256之后再rename, 并且保留leader上的修改时间
+func (r *Replicator) downloadFile(appId string, file string, remote *ReplicaFile, dst string) (*fileChecksum, error) {
+	resp, err := r.request(fmt.Sprintf("/api/replication/files/%s/%s", url.QueryEscape(appId), url.QueryEscape(file)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	var c *fileChecksum
+	if err == nil {
+		c, err = verifyReplicaFile(tmp, remote)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("download %s/%s failed: %v", appId, file, err)
+	}
+	return c, nil
+}
+
+func verifyReplicaFile(name string, remote *ReplicaFile) (*fileChecksum, error) {
+	actual, err := HashFileChecksum(name)
+	if err != nil {
+		return nil, err
+	}
+	if actual.Size != remote.Size {
+		return nil, fmt.Errorf("size mismatch, expected %d, got %d", remote.Size, actual.Size)
+	}
+	if actual.SHA256 != remote.SHA256 {
+		return nil, fmt.Errorf("sha256 mismatch, expected %s, got %s", remote.SHA256, actual.SHA256)
+	}
+	if !remote.ModTime.IsZero() {
+		if err := os.Chtimes(name, remote.ModTime, remote.ModTime); err != nil {
+			return nil, err
+		}
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileChecksum{SHA256: actual.SHA256, MD5: actual.MD5, Size: actual.Size, ModTime: info.ModTime()}, nil
+}
+
+func readReplicationState(appsRootDir string) (map[string]bool, error) {
+	state := make(map[string]bool)
+	data, err := ioutil.ReadFile(path.Join(appsRootDir, replicationStateFile))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("parse %s failed: %v", replicationStateFile, err)
+	}
+	for _, id := range ids {
+		state[id] = true
+	}
+	return state, nil
+}
+
+func writeReplicationState(appsRootDir string, state map[string]bool) error {
+	ids := make([]string, 0, len(state))
+	for id := range state {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	data, err := json.MarshalIndent(ids, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := path.Join(appsRootDir, replicationStateFile)
+	if err := ioutil.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+var (
+	followerNotifyLock sync.Mutex
+	// 上次通知时leader上的Build
+	notifiedBuilds string
+)
+
+// NotifyFollowers leader上扫描之后调用, Build有变化时通知配置的follower立即复制
+func NotifyFollowers(appsRootDir string) {
+	followers := ConfigStrings("replication_followers")
+	if len(followers) == 0 {
+		return
+	}
+	builds, err := ReplicationManifest(appsRootDir)
+	if err != nil {
+		return
+	}
+	data, _ := json.Marshal(builds)
+
+	followerNotifyLock.Lock()
+	unchanged := string(data) == notifiedBuilds
+	notifiedBuilds = string(data)
+	followerNotifyLock.Unlock()
+	if unchanged {
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, follower := range followers {
+		go func(follower string) {
+			req, err := http.NewRequest("POST", strings.TrimRight(follower, "/")+"/api/replication/notify", nil)
+			if err != nil {
+				log.WarnErrorf(err, "Notify follower %s failed", follower)
+				return
+			}
+			req.Header.Set(ReplicationTokenHeader, ReplicationToken())
+			resp, err := client.Do(req)
+			if err != nil {
+				log.WarnErrorf(err, "Notify follower %s failed", follower)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Warnf("Notify follower %s failed: %s", follower, resp.Status)
+			}
+		}(follower)
+	}
+}
+
+func init() {
+	RegisterMetricsCollector(func() {
+		if r := GetReplicator(); r != nil {
+			status := r.Status()
+			ReplicationLagSeconds.Set(status.Lag(time.Now()).Seconds())
+			ReplicationPendingBuilds.Set(float64(len(status.Pending)))
+		}
+	})
+}
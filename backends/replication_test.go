@@ -0,0 +1,158 @@
+package backends
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const replicaInfoPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+  <key>CFBundleIdentifier</key><string>com.chunyu.Demo</string>
+  <key>CFBundleName</key><string>Demo</string>
+  <key>CFBundleShortVersionString</key><string>1.0</string>
+</dict></plist>`
+
+// testLeader 和ReplicationController一致的leader接口, corrupt为true时模拟损坏文件的代理,
+// pending中的Build模拟还没有重新扫描
+type testLeader struct {
+	appsRoot string
+	corrupt  bool
+	pending  map[string]bool
+}
+
+func (l *testLeader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(ReplicationTokenHeader) != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/api/replication/builds" {
+		ScanAppRootDir(l.appsRoot)
+		builds, _ := ReplicationManifest(l.appsRoot)
+		for _, build := range builds {
+			if l.pending[build.Id] {
+				build.Files, build.Pending = nil, true
+			}
+		}
+		json.NewEncoder(w).Encode(builds)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/replication/files/"), "/")
+	data, err := ioutil.ReadFile(path.Join(l.appsRoot, parts[0], parts[1]))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if l.corrupt {
+		data[len(data)-1] ^= 0xff
+	}
+	w.Write(data)
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestReplication"
+//
+func TestReplication(t *testing.T) {
+	leaderRoot, _ := ioutil.TempDir("", "leader")
+	defer os.RemoveAll(leaderRoot)
+	followerRoot, _ := ioutil.TempDir("", "follower")
+	defer os.RemoveAll(followerRoot)
+
+	released := time.Date(2016, 5, 1, 10, 0, 0, 0, time.Local)
+	for _, id := range []string{"demo_1", "demo_2", "demo_3"} {
+		writeTestAppDir(t, leaderRoot, id, replicaInfoPlist)
+		writeBuild(t, leaderRoot, id, map[string]string{"app.png": "png " + id}, released)
+		os.Chtimes(path.Join(leaderRoot, id, "app.ipa"), released, released)
+	}
+	// follower上本地上传的同名Build不会被覆盖
+	writeBuild(t, followerRoot, "demo_3", map[string]string{"app.ipa": "local"}, released)
+
+	leader := &testLeader{appsRoot: leaderRoot}
+	server := httptest.NewServer(leader)
+	defer server.Close()
+
+	replicator := NewReplicator(server.URL+"/", followerRoot)
+	replicator.Token = "wrong"
+	assert.Error(t, replicator.Sync())
+	assert.Equal(t, 1, replicator.Status().ConsecutiveFailures)
+	assert.True(t, replicator.Status().LastSyncTime.IsZero())
+
+	// 代理损坏了文件, 校验失败时不使用
+	replicator.Token = "secret"
+	leader.corrupt = true
+	err := replicator.Sync()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "sha256 mismatch")
+	}
+	assert.Equal(t, []string{"demo_1", "demo_2"}, replicator.Status().Pending)
+	assert.Equal(t, 2, replicator.Status().ConsecutiveFailures)
+	assert.False(t, IsExist(path.Join(followerRoot, "demo_1")))
+
+	leader.corrupt = false
+	assert.NoError(t, replicator.Sync())
+	status := replicator.Status()
+	assert.Empty(t, status.Pending)
+	assert.Equal(t, 0, status.ConsecutiveFailures)
+	assert.Equal(t, int64(2), status.Replicated)
+	assert.False(t, status.LastSyncTime.IsZero())
+	assert.True(t, status.Lag(time.Now()) < time.Minute)
+
+	expected, _ := ioutil.ReadFile(path.Join(leaderRoot, "demo_1", "app.ipa"))
+	data, _ := ioutil.ReadFile(path.Join(followerRoot, "demo_1", "app.ipa"))
+	assert.Equal(t, expected, data)
+	info, _ := os.Stat(path.Join(followerRoot, "demo_1", "app.ipa"))
+	assert.True(t, released.Equal(info.ModTime()))
+	assert.Empty(t, VerifyChecksums(path.Join(followerRoot, "demo_1")))
+	data, _ = ioutil.ReadFile(path.Join(followerRoot, "demo_3", "app.ipa"))
+	assert.Equal(t, "local", string(data))
+
+	// 没有变化时不重新下载
+	assert.NoError(t, replicator.Sync())
+	assert.Equal(t, int64(2), replicator.Status().Replicated)
+
+	// leader上暂时不能复制的Build不删除
+	leader.pending = map[string]bool{"demo_1": true, "demo_2": true}
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, replicator.Sync())
+	}
+	assert.True(t, IsExist(path.Join(followerRoot, "demo_1", "app.ipa")))
+	assert.True(t, IsExist(path.Join(followerRoot, "demo_2", "app.ipa")))
+	assert.Equal(t, int64(0), replicator.Status().Deleted)
+	leader.pending = nil
+
+	// leader上替换的文件以及删除的Build, 连续3次轮询都没有时才删除
+	writeBuild(t, leaderRoot, "demo_1", map[string]string{"app.png": "new png"}, time.Now())
+	os.RemoveAll(path.Join(leaderRoot, "demo_2"))
+	assert.NoError(t, replicator.Sync())
+	data, _ = ioutil.ReadFile(path.Join(followerRoot, "demo_1", "app.png"))
+	assert.Equal(t, "new png", string(data))
+	assert.True(t, IsExist(path.Join(followerRoot, "demo_2")))
+	assert.NoError(t, replicator.Sync())
+	assert.NoError(t, replicator.Sync())
+	assert.False(t, IsExist(path.Join(followerRoot, "demo_2")))
+	assert.True(t, IsExist(path.Join(followerRoot, "demo_3")))
+	assert.Equal(t, int64(1), replicator.Status().Deleted)
+
+	state, err := readReplicationState(followerRoot)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"demo_1": true}, state)
+
+	// 解析失败的目录也在列表中
+	os.MkdirAll(path.Join(leaderRoot, "broken"), 0755)
+	assert.NoError(t, ScanAppRootDir(leaderRoot))
+	builds, err := ReplicationManifest(leaderRoot)
+	assert.NoError(t, err)
+	pending := make(map[string]bool)
+	for _, build := range builds {
+		pending[build.Id] = build.Pending
+	}
+	assert.Equal(t, map[string]bool{"demo_1": false, "demo_3": false, "broken": true}, pending)
+}
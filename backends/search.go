@@ -0,0 +1,263 @@
+package backends
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/astaxie/beego"
+)
+
+// 排序方式, 默认最新发布的在前
+const (
+	SortNewest  = "newest"
+	SortOldest  = "oldest"
+	SortName    = "name"
+	SortVersion = "version"
+)
+
+// 每页最多的Build数目
+const maxPageSize = 200
+
+// BuildQuery 首页以及/api/builds的搜索条件
+type BuildQuery struct {
+	// 名字, bundle id, 版本, 发布说明中包含的关键字, 不区分大小写
+	Query    string
+	// ios, android, 为空时不限
+	Platform string
+	Channel  string
+	Uploader string
+	// 发布时间的范围, 零值时不限
+	From     time.Time
+	To       time.Time
+	Sort     string
+	// 从1开始
+	Page     int
+	// 为0时返回所有的结果
+	PageSize int
+}
+
+// DefaultPageSize 首页每页的Build数目, 默认20
+func DefaultPageSize() int {
+	return beego.AppConfig.DefaultInt("page_size", 20)
+}
+
+// ParseBuildQuery 从请求参数中解析搜索条件, 日期的格式为2006-01-02, to包含当天
+func ParseBuildQuery(param func(key string) string) (*BuildQuery, error) {
+	query := &BuildQuery{
+		Query:    strings.TrimSpace(param("q")),
+		Platform: strings.ToLower(param("platform")),
+		Channel:  param("channel"),
+		Uploader: param("uploader"),
+		Sort:     param("sort"),
+		Page:     1,
+	}
+	switch query.Platform {
+	case "", "ios", "android":
+	default:
+		return nil, fmt.Errorf("invalid platform: %s", query.Platform)
+	}
+	switch query.Sort {
+	case "":
+		query.Sort = SortNewest
+	case SortNewest, SortOldest, SortName, SortVersion:
+	default:
+		return nil, fmt.Errorf("invalid sort: %s", query.Sort)
+	}
+
+	var err error
+	if s := param("from"); s != "" {
+		if query.From, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return nil, fmt.Errorf("invalid from: %s", s)
+		}
+	}
+	if s := param("to"); s != "" {
+		if query.To, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+			return nil, fmt.Errorf("invalid to: %s", s)
+		}
+		query.To = query.To.AddDate(0, 0, 1)
+	}
+	if s := param("page"); s != "" {
+		if _, err := fmt.Sscanf(s, "%d", &query.Page); err != nil || query.Page < 1 {
+			return nil, fmt.Errorf("invalid page: %s", s)
+		}
+	}
+	if s := param("page_size"); s != "" {
+		if _, err := fmt.Sscanf(s, "%d", &query.PageSize); err != nil || query.PageSize < 1 || query.PageSize > maxPageSize {
+			return nil, fmt.Errorf("invalid page_size: %s", s)
+		}
+	}
+	return query, nil
+}
+
+// Filtered 是否有搜索或者过滤条件
+func (q *BuildQuery) Filtered() bool {
+	return q.Query != "" || q.Channel != "" || q.Uploader != "" || !q.From.IsZero() || !q.To.IsZero()
+}
+
+// BuildPage 一页搜索结果, 以及用于过滤的渠道和上传者
+type BuildPage struct {
+	Ios       []*models.IosAppDirMeta     `json:"ios"`
+	Android   []*models.AndroidAppDirMeta `json:"android"`
+	Total     int                         `json:"total"`
+	Page      int                         `json:"page"`
+	PageSize  int                         `json:"page_size"`
+	Pages     int                         `json:"pages"`
+	Channels  []string                    `json:"channels"`
+	Uploaders []string                    `json:"uploaders"`
+}
+
+// 两个平台的Build统一排序和分页
+type searchItem struct {
+	ios      *models.IosAppDirMeta
+	android  *models.AndroidAppDirMeta
+	platform string
+	released string
+	name     string
+	version  string
+	channel  string
+	author   string
+	pinned   bool
+	// 搜索的字段, 小写
+	text     string
+}
+
+func searchItems(iosAppDirs []*models.IosAppDirMeta, androidAppDirs []*models.AndroidAppDirMeta) []*searchItem {
+	items := make([]*searchItem, 0, len(iosAppDirs)+len(androidAppDirs))
+	for _, app := range iosAppDirs {
+		items = append(items, &searchItem{
+			ios: app, platform: "ios", released: app.ReleaseDate, name: app.Name, version: app.Version,
+			channel: app.Channel, author: app.Author, pinned: app.Pinned,
+			text: strings.ToLower(strings.Join([]string{app.Id, app.Name, app.BundleId, app.Version, app.BuildNumber, app.Notes}, "\n")),
+		})
+	}
+	for _, app := range androidAppDirs {
+		items = append(items, &searchItem{
+			android: app, platform: "android", released: app.ReleaseDate, name: app.Name, version: app.Version,
+			channel: app.Channel, author: app.Author, pinned: app.Pinned,
+			text: strings.ToLower(strings.Join([]string{app.Id, app.Name, app.BundleId, app.Version, app.VersionCode, app.Notes}, "\n")),
+		})
+	}
+	return items
+}
+
+func (q *BuildQuery) match(item *searchItem) bool {
+	if q.Platform != "" && item.platform != q.Platform {
+		return false
+	}
+	if q.Channel != "" && item.channel != q.Channel {
+		return false
+	}
+	if q.Uploader != "" && !strings.EqualFold(item.author, q.Uploader) {
+		return false
+	}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		released, err := time.ParseInLocation("2006-01-02 15:04", item.released, time.Local)
+		if err != nil || (!q.From.IsZero() && released.Before(q.From)) || (!q.To.IsZero() && !released.Before(q.To)) {
+			return false
+		}
+	}
+	// 多个关键字时需要都包含
+	for _, word := range strings.Fields(strings.ToLower(q.Query)) {
+		if !strings.Contains(item.text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+type sortedItems struct {
+	items []*searchItem
+	less  func(a, b *searchItem) bool
+}
+
+func (s sortedItems) Len() int           { return len(s.items) }
+func (s sortedItems) Swap(i, j int)      { s.items[i], s.items[j] = s.items[j], s.items[i] }
+func (s sortedItems) Less(i, j int) bool { return s.less(s.items[i], s.items[j]) }
+
+func (q *BuildQuery) sort(items []*searchItem) {
+	newest := func(a, b *searchItem) bool {
+		return a.released > b.released
+	}
+	// 默认的排序中置顶的Build在最前面
+	less := func(a, b *searchItem) bool {
+		if a.pinned != b.pinned {
+			return a.pinned
+		}
+		return newest(a, b)
+	}
+	switch q.Sort {
+	case SortOldest:
+		less = func(a, b *searchItem) bool {
+			return a.released < b.released
+		}
+	case SortName:
+		less = func(a, b *searchItem) bool {
+			if na, nb := strings.ToLower(a.name), strings.ToLower(b.name); na != nb {
+				return na < nb
+			}
+			return newest(a, b)
+		}
+	case SortVersion:
+		less = func(a, b *searchItem) bool {
+			if c := CompareVersion(a.version, b.version); c != 0 {
+				return c > 0
+			}
+			return newest(a, b)
+		}
+	}
+	sort.Stable(sortedItems{items: items, less: less})
+}
+
+// SearchBuilds 过滤, 排序并返回一页Build; 渠道和上传者从所有的Build中统计
+func SearchBuilds(iosAppDirs []*models.IosAppDirMeta, androidAppDirs []*models.AndroidAppDirMeta, q *BuildQuery) *BuildPage {
+	page := &BuildPage{
+		Ios:       make([]*models.IosAppDirMeta, 0),
+		Android:   make([]*models.AndroidAppDirMeta, 0),
+		Page:      q.Page,
+		PageSize:  q.PageSize,
+		Channels:  make([]string, 0),
+		Uploaders: make([]string, 0),
+	}
+
+	seen := make(map[string]bool)
+	var matched []*searchItem
+	for _, item := range searchItems(iosAppDirs, androidAppDirs) {
+		if item.channel != "" && !seen["c/"+item.channel] {
+			seen["c/"+item.channel] = true
+			page.Channels = append(page.Channels, item.channel)
+		}
+		if item.author != "" && !seen["u/"+item.author] {
+			seen["u/"+item.author] = true
+			page.Uploaders = append(page.Uploaders, item.author)
+		}
+		if q.match(item) {
+			matched = append(matched, item)
+		}
+	}
+	sort.Strings(page.Channels)
+	sort.Strings(page.Uploaders)
+
+	q.sort(matched)
+	page.Total = len(matched)
+	pageSize := q.PageSize
+	if pageSize == 0 {
+		pageSize = len(matched)
+		page.PageSize = len(matched)
+	}
+	page.Pages = 1
+	if page.Total > pageSize {
+		page.Pages = (page.Total + pageSize - 1) / pageSize
+	}
+	start := (q.Page - 1) * pageSize
+	for i := start; i < len(matched) && i < start+pageSize; i++ {
+		if matched[i].ios != nil {
+			page.Ios = append(page.Ios, matched[i].ios)
+		} else {
+			page.Android = append(page.Android, matched[i].android)
+		}
+	}
+	return page
+}
@@ -0,0 +1,108 @@
+package backends
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseTestQuery(t *testing.T, rawQuery string) *BuildQuery {
+	values, _ := url.ParseQuery(rawQuery)
+	query, err := ParseBuildQuery(values.Get)
+	assert.NoError(t, err)
+	return query
+}
+
+func pageIds(page *BuildPage) []string {
+	var ids []string
+	for _, app := range page.Ios {
+		ids = append(ids, app.Id)
+	}
+	for _, app := range page.Android {
+		ids = append(ids, app.Id)
+	}
+	return ids
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestSearchBuilds"
+//
+func TestSearchBuilds(t *testing.T) {
+	iosAppDirs := []*models.IosAppDirMeta{
+		{Id: "ios_3", Name: "Doctor", BundleId: "com.chunyu.Doctor", Version: "3.10", ReleaseDate: "2016-05-03 10:00", Channel: "beta", Author: "alice"},
+		{Id: "ios_1", Name: "Patient", BundleId: "com.chunyu.Patient", Version: "3.9", ReleaseDate: "2016-05-01 10:00", Notes: "Fix login crash"},
+	}
+	androidAppDirs := []*models.AndroidAppDirMeta{
+		{Id: "android_2", Name: "doctor", BundleId: "me.chunyu.doctor", Version: "3.2", ReleaseDate: "2016-05-02 23:59", Channel: "nightly", Author: "Bob"},
+	}
+
+	page := SearchBuilds(iosAppDirs, androidAppDirs, parseTestQuery(t, ""))
+	assert.Equal(t, []string{"ios_3", "ios_1", "android_2"}, pageIds(page))
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, 1, page.Pages)
+	assert.Equal(t, []string{"beta", "nightly"}, page.Channels)
+	assert.Equal(t, []string{"Bob", "alice"}, page.Uploaders)
+
+	// 关键字不区分大小写, 多个关键字都需要匹配
+	assert.Equal(t, []string{"ios_1"}, pageIds(SearchBuilds(iosAppDirs, androidAppDirs, parseTestQuery(t, "q=LOGIN"))))
+	assert.Equal(t, []string{"ios_3"}, pageIds(SearchBuilds(iosAppDirs, androidAppDirs, parseTestQuery(t, "q=doctor+3.10"))))
+	assert.Equal(t, []string{"android_2"}, pageIds(SearchBuilds(iosAppDirs, androidAppDirs, parseTestQuery(t, "q=me.chunyu"))))
+
+	assert.Equal(t, []string{"ios_3"}, pageIds(SearchBuilds(iosAppDirs, androidAppDirs, parseTestQuery(t, "platform=iOs&channel=beta"))))
+	assert.Equal(t, []string{"android_2"}, pageIds(SearchBuilds(iosAppDirs, androidAppDirs, parseTestQuery(t, "uploader=bob"))))
+	// to包含当天
+	assert.Equal(t, []string{"android_2"}, pageIds(SearchBuilds(iosAppDirs, androidAppDirs, parseTestQuery(t, "from=2016-05-02&to=2016-05-02"))))
+
+	// 版本按照数字比较
+	assert.Equal(t, []string{"ios_3", "ios_1", "android_2"}, pageIds(SearchBuilds(iosAppDirs, androidAppDirs, parseTestQuery(t, "sort=version"))))
+	// 两个平台一起排序之后分页
+	assert.Equal(t, []string{"ios_3", "android_2"}, pageIds(SearchBuilds(iosAppDirs, androidAppDirs, parseTestQuery(t, "sort=name&page_size=2"))))
+
+	page = SearchBuilds(iosAppDirs, androidAppDirs, parseTestQuery(t, "sort=oldest&page=2&page_size=2"))
+	assert.Equal(t, []string{"ios_3"}, pageIds(page))
+	assert.Equal(t, 2, page.Pages)
+	page = SearchBuilds(iosAppDirs, androidAppDirs, parseTestQuery(t, "page=3&page_size=2"))
+	assert.Empty(t, pageIds(page))
+	assert.NotNil(t, page.Ios)
+
+	for _, rawQuery := range []string{"platform=windows", "sort=size", "from=yesterday", "page=0", "page_size=1000"} {
+		values, _ := url.ParseQuery(rawQuery)
+		_, err := ParseBuildQuery(values.Get)
+		assert.Error(t, err, rawQuery)
+	}
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestReadBuildInfo"
+//
+func TestReadBuildInfo(t *testing.T) {
+	appDir, _ := ioutil.TempDir("", "demo_1")
+	defer os.RemoveAll(appDir)
+
+	// app.json中的值作为默认值
+	appJson := map[string]interface{}{"title": "Demo", "notes": "from app.json", "channel": "beta"}
+	info, err := ReadBuildInfo(appDir, appJson)
+	assert.NoError(t, err)
+	assert.Equal(t, &BuildInfo{Notes: "from app.json", Channel: "beta"}, info)
+
+	assert.NoError(t, WriteBuildInfo(appDir, &BuildInfo{Notes: "from build.json", Uploader: "alice"}))
+	assert.False(t, IsExist(path.Join(appDir, BuildInfoFile+".tmp")))
+	info, err = ReadBuildInfo(appDir, appJson)
+	assert.NoError(t, err)
+	assert.Equal(t, &BuildInfo{Notes: "from build.json", Uploader: "alice"}, info)
+
+	// 之前的版本没有写入空的字段, 仍然使用app.json中的值
+	ioutil.WriteFile(path.Join(appDir, BuildInfoFile), []byte(`{"notes": "from build.json"}`), 0644)
+	info, err = ReadBuildInfo(appDir, appJson)
+	assert.NoError(t, err)
+	assert.Equal(t, &BuildInfo{Notes: "from build.json", Channel: "beta"}, info)
+
+	ioutil.WriteFile(path.Join(appDir, BuildInfoFile), []byte("{"), 0644)
+	_, err = ReadBuildInfo(appDir, nil)
+	assert.Error(t, err)
+}
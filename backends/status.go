@@ -0,0 +1,113 @@
+package backends
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// 由main设置的版本号
+var Version string
+
+var StartTime = time.Now()
+
+// ScanStatus 记录最近一次扫描的结果
+type ScanStatus struct {
+	Scanned      bool
+	LastScanTime time.Time
+	LastDuration time.Duration
+	LastError    string
+	ScanCount    int64
+	ErrorCount   int64
+}
+
+var (
+	scanStatusLock sync.RWMutex
+	scanStatus     ScanStatus
+)
+
+func recordScan(start time.Time, err error) {
+	scanStatusLock.Lock()
+	defer scanStatusLock.Unlock()
+
+	scanStatus.LastScanTime = start
+	scanStatus.LastDuration = time.Since(start)
+	scanStatus.ScanCount++
+	if err != nil {
+		scanStatus.LastError = err.Error()
+		scanStatus.ErrorCount++
+	} else {
+		scanStatus.LastError = ""
+		scanStatus.Scanned = true
+	}
+}
+
+func GetScanStatus() ScanStatus {
+	scanStatusLock.RLock()
+	defer scanStatusLock.RUnlock()
+	return scanStatus
+}
+
+// WatchedDirCount 返回被watch的App目录的数目
+func WatchedDirCount() int {
+	return int(WatchedDirs.Value())
+}
+
+type readyCheck struct {
+	name  string
+	check func() error
+}
+
+var (
+	readyChecksLock sync.Mutex
+	readyChecks     []readyCheck
+)
+
+// RegisterReadyCheck 注册 /readyz 需要检查的依赖
+func RegisterReadyCheck(name string, check func() error) {
+	readyChecksLock.Lock()
+	readyChecks = append(readyChecks, readyCheck{name: name, check: check})
+	readyChecksLock.Unlock()
+}
+
+// CheckReady 执行所有的检查, 返回每一项的错误信息(空字符串表示正常)
+func CheckReady() (results map[string]string, ready bool) {
+	readyChecksLock.Lock()
+	checks := readyChecks
+	readyChecksLock.Unlock()
+
+	ready = true
+	results = make(map[string]string)
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			results[c.name] = err.Error()
+			ready = false
+		} else {
+			results[c.name] = ""
+		}
+	}
+	return results, ready
+}
+
+// CheckInitialScan 初次扫描是否已经完成
+func CheckInitialScan() error {
+	if !GetScanStatus().Scanned {
+		return fmt.Errorf("initial scan not completed")
+	}
+	return nil
+}
+
+// CheckDirWritable 检查目录可读可写
+func CheckDirWritable(dir string) error {
+	if _, err := ioutil.ReadDir(dir); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".readyz")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,434 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego"
+)
+
+//
+// Build文件的存储, 在app.conf中配置:
+//   storage: local(默认, 直接使用apps_root) 或者 s3(兼容S3的对象存储, 例如: MinIO, Ceph)
+//   storage_redirect: 下载时重定向到预签名的地址, 而不是由appserver转发
+//   storage_presign_expires: 预签名地址的有效期(秒), 默认3600
+//   s3_*: 参考 NewS3StorageFromConfig
+//
+// key和apps_root中的路径一致, 例如: <app_id>/app.ipa; 启用blob_store时参考 blobs.go
+// 解析元数据仍然使用apps_root中的文件, 使用s3时通过 storage push/pull 和存储同步
+//
+
+// ObjectInfo 存储中的一个文件
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	ETag    string
+}
+
+var ErrPresignNotSupported = errors.New("presigned url is not supported")
+
+type Storage interface {
+	// Put 写入size字节, size为-1时表示未知
+	Put(key string, r io.Reader, size int64) error
+	Get(key string) (io.ReadCloser, error)
+	// GetRange 读取从offset开始的length字节, length为-1时读到结尾
+	GetRange(key string, offset int64, length int64) (io.ReadCloser, error)
+	// Stat 文件不存在时返回的error满足os.IsNotExist
+	Stat(key string) (*ObjectInfo, error)
+	// List 返回以prefix开头的所有文件, 按照key排序
+	List(prefix string) ([]*ObjectInfo, error)
+	Delete(key string) error
+	// PresignedURL 不支持时返回ErrPresignNotSupported
+	PresignedURL(key string, expires time.Duration) (string, error)
+}
+
+// ArtifactKey App目录中的文件在存储中的key
+func ArtifactKey(appId string, file string) string {
+	return appId + "/" + file
+}
+
+func notExistError(op string, key string) error {
+	return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+}
+
+// LocalStorage 本地文件系统, Root一般为apps_root
+type LocalStorage struct {
+	Root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+// file key转换为Root中的路径, 不允许访问Root之外的文件
+func (s *LocalStorage) file(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if key == "" || cleaned != "/"+key {
+		return "", fmt.Errorf("invalid key: %q", key)
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(cleaned)), nil
+}
+
+func (s *LocalStorage) Put(key string, r io.Reader, size int64) error {
+	name, err := s.file(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	// 先写入临时文件再rename, watcher忽略.tmp文件
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("%s: wrote %d bytes, expected %d", key, n, size)
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (s *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	return s.GetRange(key, 0, -1)
+}
+
+type sectionReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (s *LocalStorage) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	name, err := s.file(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		length = info.Size() - offset
+	}
+	return sectionReadCloser{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+func (s *LocalStorage) Stat(key string) (*ObjectInfo, error) {
+	name, err := s.file(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, notExistError("stat", key)
+	}
+	return &ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// List 忽略隐藏的目录(例如: .trash, .import-xxx)以及.tmp文件, prefix指定了隐藏目录时除外(例如: .blobs/)
+func (s *LocalStorage) List(prefix string) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
+	err := filepath.Walk(s.Root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == s.Root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if name == s.Root {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if info.IsDir() {
+			if isHiddenDir(info.Name()) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(key, prefix) && !strings.HasSuffix(key, ".tmp") {
+			objects = append(objects, &ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	sort.Sort(objectInfos(objects))
+	return objects, err
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	name, err := s.file(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStorage) PresignedURL(key string, expires time.Duration) (string, error) {
+	return "", ErrPresignNotSupported
+}
+
+type objectInfos []*ObjectInfo
+
+func (s objectInfos) Len() int           { return len(s) }
+func (s objectInfos) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s objectInfos) Less(i, j int) bool { return s[i].Key < s[j].Key }
+
+var (
+	gStorageLock sync.RWMutex
+	gStorage     Storage
+)
+
+// LoadStorage 根据app.conf创建存储
+func LoadStorage() error {
+	var storage Storage
+	switch driver := beego.AppConfig.DefaultString("storage", "local"); driver {
+	case "local":
+		storage = NewLocalStorage(beego.AppConfig.String("apps_root"))
+	case "s3":
+		s3, err := NewS3StorageFromConfig()
+		if err != nil {
+			return err
+		}
+		log.Infof("Storage: s3 %s/%s", s3.Endpoint, s3.Bucket)
+		storage = s3
+	default:
+		return fmt.Errorf("unknown storage: %s", driver)
+	}
+	SetStorage(storage)
+	return nil
+}
+
+func SetStorage(storage Storage) {
+	gStorageLock.Lock()
+	gStorage = storage
+	gStorageLock.Unlock()
+}
+
+// GetStorage 没有调用LoadStorage时使用apps_root
+func GetStorage() Storage {
+	gStorageLock.RLock()
+	defer gStorageLock.RUnlock()
+	if gStorage == nil {
+		return NewLocalStorage(beego.AppConfig.String("apps_root"))
+	}
+	return gStorage
+}
+
+// isAppsRoot 存储就是apps_root本身, 不需要同步
+func isAppsRoot(storage Storage, appsRootDir string) bool {
+	local, ok := storage.(*LocalStorage)
+	return ok && filepath.Clean(local.Root) == filepath.Clean(appsRootDir)
+}
+
+// PushAppDir 将App目录中的文件上传到存储, 启用blob_store时保存为blob
+func PushAppDir(storage Storage, appsRootDir string, appId string) error {
+	if BlobStoreEnabled() {
+		_, err := StoreBuildBlobs(storage, appsRootDir, appId)
+		return err
+	}
+	if isAppsRoot(storage, appsRootDir) {
+		return nil
+	}
+	appDir := path.Join(appsRootDir, appId)
+	files, err := ioutil.ReadDir(appDir)
+	if err != nil {
+		return err
+	}
+	for _, info := range files {
+		if !info.Mode().IsRegular() || strings.HasSuffix(info.Name(), ".tmp") {
+			continue
+		}
+		f, err := os.Open(path.Join(appDir, info.Name()))
+		if err != nil {
+			return err
+		}
+		err = storage.Put(ArtifactKey(appId, info.Name()), f, info.Size())
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("push %s/%s failed: %v", appId, info.Name(), err)
+		}
+	}
+	return nil
+}
+
+// DeleteAppDir 从存储中删除App目录中的所有文件
+func DeleteAppDir(storage Storage, appsRootDir string, appId string) error {
+	if isAppsRoot(storage, appsRootDir) {
+		return nil
+	}
+	objects, err := storage.List(appId + "/")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := storage.Delete(object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StorageAppIds 存储中所有的App目录, 忽略隐藏的目录(例如: .blobs)
+func StorageAppIds(objects []*ObjectInfo) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, object := range objects {
+		idx := strings.Index(object.Key, "/")
+		if idx <= 0 || seen[object.Key[:idx]] || isHiddenDir(object.Key) {
+			continue
+		}
+		seen[object.Key[:idx]] = true
+		ids = append(ids, object.Key[:idx])
+	}
+	return ids
+}
+
+// PushAppDirs 上传存储中没有的App目录, 返回上传的目录
+func PushAppDirs(storage Storage, appsRootDir string) ([]string, error) {
+	if isAppsRoot(storage, appsRootDir) {
+		return nil, nil
+	}
+	objects, err := storage.List("")
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	for _, id := range StorageAppIds(objects) {
+		existing[id] = true
+	}
+
+	dirs, err := ioutil.ReadDir(appsRootDir)
+	if err != nil {
+		return nil, err
+	}
+	var pushed []string
+	for _, fi := range dirs {
+		if !fi.IsDir() || isHiddenDir(fi.Name()) || existing[fi.Name()] {
+			continue
+		}
+		if err := PushAppDir(storage, appsRootDir, fi.Name()); err != nil {
+			return pushed, err
+		}
+		pushed = append(pushed, fi.Name())
+	}
+	return pushed, nil
+}
+
+// PullAppDirs 下载本地没有的App目录, 先下载到隐藏的临时目录, 完整之后再rename
+func PullAppDirs(storage Storage, appsRootDir string) ([]string, error) {
+	if isAppsRoot(storage, appsRootDir) {
+		return nil, nil
+	}
+	objects, err := storage.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	var pulled []string
+	for _, appId := range StorageAppIds(objects) {
+		if IsExist(path.Join(appsRootDir, appId)) {
+			continue
+		}
+		if err := pullAppDir(storage, appsRootDir, appId, objects); err != nil {
+			return pulled, err
+		}
+		pulled = append(pulled, appId)
+	}
+	return pulled, nil
+}
+
+func pullAppDir(storage Storage, appsRootDir string, appId string, objects []*ObjectInfo) error {
+	tmpDir, err := ioutil.TempDir(appsRootDir, ".pull-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// 保存为blob的Build只有blobs.json
+	for _, object := range objects {
+		if object.Key == ArtifactKey(appId, BlobsFile) {
+			if err := pullBuildBlobs(storage, appId, tmpDir); err != nil {
+				return fmt.Errorf("pull %s failed: %v", appId, err)
+			}
+			return renamePulledDir(tmpDir, path.Join(appsRootDir, appId))
+		}
+	}
+
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Key, appId+"/") {
+			continue
+		}
+		file := strings.TrimPrefix(object.Key, appId+"/")
+		if strings.Contains(file, "/") {
+			continue
+		}
+		if err := downloadObject(storage, object, path.Join(tmpDir, file)); err != nil {
+			return fmt.Errorf("pull %s failed: %v", object.Key, err)
+		}
+	}
+	return renamePulledDir(tmpDir, path.Join(appsRootDir, appId))
+}
+
+func renamePulledDir(tmpDir string, appDir string) error {
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, appDir)
+}
+
+func downloadObject(storage Storage, object *ObjectInfo, dst string) error {
+	r, err := storage.Get(object.Key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n != object.Size {
+		err = fmt.Errorf("read %d bytes, expected %d", n, object.Size)
+	}
+	return err
+}
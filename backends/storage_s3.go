@@ -0,0 +1,379 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego"
+)
+
+//
+// 兼容S3的对象存储, 使用AWS Signature Version 4签名, 在app.conf中配置:
+//   s3_endpoint: 例如: https://s3.cn-north-1.amazonaws.com.cn, http://127.0.0.1:9000
+//   s3_region: 默认us-east-1
+//   s3_bucket, s3_access_key, s3_secret_key
+//   s3_prefix: key的前缀, 例如: appserver/
+//   s3_path_style: 使用 <endpoint>/<bucket>/<key> 而不是 <bucket>.<host>/<key>, 默认true(MinIO)
+//
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+)
+
+type S3Storage struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string
+	PathStyle bool
+	Client    *http.Client
+
+	// 测试时替换当前时间
+	now func() time.Time
+}
+
+func NewS3StorageFromConfig() (*S3Storage, error) {
+	s := &S3Storage{
+		Endpoint:  strings.TrimSuffix(beego.AppConfig.String("s3_endpoint"), "/"),
+		Region:    beego.AppConfig.DefaultString("s3_region", "us-east-1"),
+		Bucket:    beego.AppConfig.String("s3_bucket"),
+		AccessKey: beego.AppConfig.String("s3_access_key"),
+		SecretKey: beego.AppConfig.String("s3_secret_key"),
+		Prefix:    beego.AppConfig.String("s3_prefix"),
+		PathStyle: beego.AppConfig.DefaultBool("s3_path_style", true),
+	}
+	if s.Endpoint == "" || s.Bucket == "" {
+		return nil, fmt.Errorf("s3_endpoint and s3_bucket are required")
+	}
+	if _, err := url.Parse(s.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid s3_endpoint: %v", err)
+	}
+	return s, nil
+}
+
+func (s *S3Storage) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+func (s *S3Storage) currentTime() time.Time {
+	if s.now != nil {
+		return s.now().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// objectURL key为空时为bucket的地址
+func (s *S3Storage) objectURL(key string) *url.URL {
+	u, _ := url.Parse(s.Endpoint)
+	objectPath := "/"
+	if key != "" {
+		objectPath += s.Prefix + key
+	}
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + objectPath
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = objectPath
+	}
+	// 发送的路径和签名时的路径一致
+	u.RawPath = s3Escape(u.Path, false)
+	return u
+}
+
+// s3Escape 按照SigV4的规则编码, 只保留 A-Z a-z 0-9 - _ . ~, 路径中的/不编码
+func s3Escape(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			buf.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+// s3CanonicalQuery 按照编码之后的参数名排序
+func s3CanonicalQuery(query url.Values) string {
+	var keys []string
+	escaped := make(map[string]string)
+	for key := range query {
+		escaped[s3Escape(key, true)] = key
+		keys = append(keys, s3Escape(key, true))
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[escaped[key]]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, key+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// signature 计算SigV4签名, headers为参与签名的header(小写)
+func (s *S3Storage) signature(method string, u *url.URL, headers map[string]string, t time.Time, payloadHash string) (string, string) {
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		s3Escape(u.Path, false),
+		s3CanonicalQuery(u.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := t.Format("20060102")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{s3Algorithm, t.Format(s3TimeFormat), scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)), signedHeaders
+}
+
+func (s *S3Storage) credentialScope(t time.Time) string {
+	return s.AccessKey + "/" + t.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// do 发送签名的请求, body的长度必须已知(size), 内容不参与签名
+func (s *S3Storage) do(method string, u *url.URL, body io.Reader, size int64, extra map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	t := s.currentTime()
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-date":           t.Format(s3TimeFormat),
+		"x-amz-content-sha256": s3UnsignedPayload,
+	}
+	for name, value := range extra {
+		headers[strings.ToLower(name)] = value
+	}
+	for name, value := range headers {
+		if name != "host" {
+			req.Header.Set(name, value)
+		}
+	}
+	if s.AccessKey != "" {
+		signature, signedHeaders := s.signature(method, req.URL, headers, t, s3UnsignedPayload)
+		req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, SignedHeaders=%s, Signature=%s",
+			s3Algorithm, s.credentialScope(t), signedHeaders, signature))
+	}
+	return s.client().Do(req)
+}
+
+// s3Error 读取S3返回的错误, 404转换为os.IsNotExist的错误
+func s3Error(op string, key string, resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return notExistError(op, key)
+	}
+	var e struct {
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3 %s %s: %s: %s", op, key, e.Code, e.Message)
+	}
+	return fmt.Errorf("s3 %s %s: %s", op, key, resp.Status)
+}
+
+func (s *S3Storage) Put(key string, r io.Reader, size int64) error {
+	if size < 0 {
+		// 单次PUT需要Content-Length
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		r, size = bytes.NewReader(data), int64(len(data))
+	}
+	resp, err := s.do("PUT", s.objectURL(key), r, size, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return s3Error("put", key, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	return s.GetRange(key, 0, -1)
+}
+
+func (s *S3Storage) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	var extra map[string]string
+	switch {
+	case length == 0:
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	case length > 0:
+		extra = map[string]string{"range": fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}
+	case offset > 0:
+		extra = map[string]string{"range": fmt.Sprintf("bytes=%d-", offset)}
+	}
+	resp, err := s.do("GET", s.objectURL(key), nil, 0, extra)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, s3Error("get", key, resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Stat(key string) (*ObjectInfo, error) {
+	resp, err := s.do("HEAD", s.objectURL(key), nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, s3Error("stat", key, resp)
+	}
+	resp.Body.Close()
+	info := &ObjectInfo{Key: key, Size: resp.ContentLength, ETag: strings.Trim(resp.Header.Get("ETag"), `"`)}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+		ETag         string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List 使用ListObjectsV2分页读取
+func (s *S3Storage) List(prefix string) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
+	token := ""
+	for {
+		u := s.objectURL("")
+		query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = query.Encode()
+		resp, err := s.do("GET", u, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 != 2 {
+			return nil, s3Error("list", prefix, resp)
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %v", prefix, err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, &ObjectInfo{
+				Key:     strings.TrimPrefix(c.Key, s.Prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+				ETag:    strings.Trim(c.ETag, `"`),
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Sort(objectInfos(objects))
+	return objects, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	resp, err := s.do("DELETE", s.objectURL(key), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return s3Error("delete", key, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PresignedURL 使用query参数签名的GET地址, 最长7天
+func (s *S3Storage) PresignedURL(key string, expires time.Duration) (string, error) {
+	if s.AccessKey == "" {
+		return s.objectURL(key).String(), nil
+	}
+	if expires <= 0 || expires > 7*24*time.Hour {
+		return "", fmt.Errorf("invalid expires: %v", expires)
+	}
+	t := s.currentTime()
+	u := s.objectURL(key)
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.credentialScope(t)},
+		"X-Amz-Date":          {t.Format(s3TimeFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+	signature, _ := s.signature("GET", u, map[string]string{"host": u.Host}, t, s3UnsignedPayload)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
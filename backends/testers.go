@@ -0,0 +1,444 @@
+package backends
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/astaxie/beego"
+)
+
+//
+// 测试组以及邀请, 在管理后台中维护, 保存在 testers_file 中(默认为 apps_root/.testers.json)
+//   invite_expire_days: 邀请的有效期(天), 默认7天
+//
+
+// TesterData testers_file的内容
+type TesterData struct {
+	Groups      []*models.TesterGroup `json:"groups"`
+	Testers     []*models.Tester      `json:"testers"`
+	Invitations []*models.Invitation  `json:"invitations"`
+}
+
+var gTesterLock sync.RWMutex
+
+var testerGroupIdPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// TestersFile 测试组的文件, 默认为 apps_root/.testers.json
+func TestersFile(appsRootDir string) string {
+	file := beego.AppConfig.String("testers_file")
+	if file == "" {
+		return path.Join(appsRootDir, ".testers.json")
+	}
+	return file
+}
+
+// InviteExpiration 邀请的有效期, 默认7天
+func InviteExpiration() time.Duration {
+	return time.Duration(beego.AppConfig.DefaultInt("invite_expire_days", 7)) * 24 * time.Hour
+}
+
+// InvitationURL 接受邀请的链接
+func InvitationURL(token string) string {
+	return fmt.Sprintf("https://%s/invite/%s", beego.AppConfig.String("server_host"), token)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func readTesterData(appsRootDir string) (*TesterData, error) {
+	data := &TesterData{}
+	content, err := ioutil.ReadFile(TestersFile(appsRootDir))
+	if os.IsNotExist(err) {
+		return data, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeTesterData(appsRootDir string, data *TesterData) error {
+	content, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := TestersFile(appsRootDir)
+	if err := ioutil.WriteFile(file+".tmp", content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// LoadTesterData 读取所有的测试组, 测试者以及邀请
+func LoadTesterData(appsRootDir string) (*TesterData, error) {
+	gTesterLock.RLock()
+	defer gTesterLock.RUnlock()
+	return readTesterData(appsRootDir)
+}
+
+var testerDataCache = newFileCache()
+
+// CachedTesterData 每个请求都需要判断测试者以及测试组, testers_file没有变化时不重复解析;
+// 返回的数据是共享的, 不能修改
+func CachedTesterData(appsRootDir string) (*TesterData, error) {
+	gTesterLock.RLock()
+	defer gTesterLock.RUnlock()
+
+	file := TestersFile(appsRootDir)
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return &TesterData{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if data, ok := testerDataCache.get(file, info); ok {
+		return data.(*TesterData), nil
+	}
+	data, err := readTesterData(appsRootDir)
+	if err != nil {
+		return nil, err
+	}
+	testerDataCache.put(file, info, data)
+	return data, nil
+}
+
+// updateTesterData 修改之后写回testers_file, update返回错误时不写入
+func updateTesterData(appsRootDir string, update func(data *TesterData) error) error {
+	gTesterLock.Lock()
+	defer gTesterLock.Unlock()
+
+	data, err := readTesterData(appsRootDir)
+	if err != nil {
+		return err
+	}
+	if err := update(data); err != nil {
+		return err
+	}
+	return writeTesterData(appsRootDir, data)
+}
+
+func (d *TesterData) group(id string) *models.TesterGroup {
+	for _, group := range d.Groups {
+		if group.Id == id {
+			return group
+		}
+	}
+	return nil
+}
+
+func (d *TesterData) testerByEmail(email string) *models.Tester {
+	for _, tester := range d.Testers {
+		if strings.EqualFold(tester.Email, email) {
+			return tester
+		}
+	}
+	return nil
+}
+
+// GroupTesters 测试组内的测试者
+func (d *TesterData) GroupTesters(groupId string) []*models.Tester {
+	var testers []*models.Tester
+	for _, tester := range d.Testers {
+		if containsString(tester.Groups, groupId) {
+			testers = append(testers, tester)
+		}
+	}
+	return testers
+}
+
+// GroupInvitations 测试组的邀请, 包括已经过期的
+func (d *TesterData) GroupInvitations(groupId string) []*models.Invitation {
+	var invitations []*models.Invitation
+	for _, invitation := range d.Invitations {
+		if invitation.Group == groupId {
+			invitations = append(invitations, invitation)
+		}
+	}
+	return invitations
+}
+
+func validEmail(email string) bool {
+	idx := strings.Index(email, "@")
+	return idx > 0 && idx < len(email)-1 && !strings.ContainsAny(email, " \t\r\n<>,;")
+}
+
+// SaveTesterGroup 新建或者修改测试组
+func SaveTesterGroup(appsRootDir string, group *models.TesterGroup) error {
+	if !testerGroupIdPattern.MatchString(group.Id) {
+		return fmt.Errorf("invalid group id: %q", group.Id)
+	}
+	if group.Name == "" {
+		group.Name = group.Id
+	}
+	return updateTesterData(appsRootDir, func(data *TesterData) error {
+		if old := data.group(group.Id); old != nil {
+			*old = *group
+			return nil
+		}
+		data.Groups = append(data.Groups, group)
+		sort.Sort(testerGroups(data.Groups))
+		return nil
+	})
+}
+
+type testerGroups []*models.TesterGroup
+
+func (a testerGroups) Len() int {
+	return len(a)
+}
+func (a testerGroups) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a testerGroups) Less(i, j int) bool {
+	return a[i].Id < a[j].Id
+}
+
+// DeleteTesterGroup 删除测试组以及组的邀请, 不再属于任何组的测试者同时被删除
+func DeleteTesterGroup(appsRootDir string, groupId string) error {
+	return updateTesterData(appsRootDir, func(data *TesterData) error {
+		if data.group(groupId) == nil {
+			return fmt.Errorf("group not found: %s", groupId)
+		}
+		groups := data.Groups[:0]
+		for _, group := range data.Groups {
+			if group.Id != groupId {
+				groups = append(groups, group)
+			}
+		}
+		data.Groups = groups
+
+		invitations := data.Invitations[:0]
+		for _, invitation := range data.Invitations {
+			if invitation.Group != groupId {
+				invitations = append(invitations, invitation)
+			}
+		}
+		data.Invitations = invitations
+
+		for _, tester := range data.GroupTesters(groupId) {
+			removeTesterGroup(data, tester, groupId)
+		}
+		return nil
+	})
+}
+
+func removeTesterGroup(data *TesterData, tester *models.Tester, groupId string) {
+	groups := tester.Groups[:0]
+	for _, id := range tester.Groups {
+		if id != groupId {
+			groups = append(groups, id)
+		}
+	}
+	tester.Groups = groups
+	if len(tester.Groups) > 0 {
+		return
+	}
+	testers := data.Testers[:0]
+	for _, t := range data.Testers {
+		if t != tester {
+			testers = append(testers, t)
+		}
+	}
+	data.Testers = testers
+}
+
+// RemoveTester 将测试者移出测试组
+func RemoveTester(appsRootDir string, groupId string, email string) error {
+	return updateTesterData(appsRootDir, func(data *TesterData) error {
+		tester := data.testerByEmail(email)
+		if tester == nil || !containsString(tester.Groups, groupId) {
+			return fmt.Errorf("tester %s not found in %s", email, groupId)
+		}
+		removeTesterGroup(data, tester, groupId)
+		return nil
+	})
+}
+
+// CreateInvitation 邀请加入测试组, email为空时创建链接邀请
+func CreateInvitation(appsRootDir string, groupId string, email string, createdBy string, now time.Time) (*models.Invitation, error) {
+	if email != "" && !validEmail(email) {
+		return nil, fmt.Errorf("invalid email: %s", email)
+	}
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	invitation := &models.Invitation{
+		Token:     token,
+		Group:     groupId,
+		Email:     email,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(InviteExpiration()),
+	}
+	err = updateTesterData(appsRootDir, func(data *TesterData) error {
+		if data.group(groupId) == nil {
+			return fmt.Errorf("group not found: %s", groupId)
+		}
+		data.Invitations = append(data.Invitations, invitation)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+// SendInvitation 发送邀请的邮件
+func SendInvitation(invitation *models.Invitation, group *models.TesterGroup) error {
+	body := fmt.Sprintf("You are invited to test the apps of %s.\n\nOpen the following link on your phone before %s to accept the invitation:\n%s\n",
+		group.Name, invitation.ExpiresAt.Format("2006-01-02 15:04"), InvitationURL(invitation.Token))
+	return SendEmail([]string{invitation.Email}, "[appserver] Invitation to "+group.Id, body)
+}
+
+// RevokeInvitation 撤销邀请, 已经加入的测试者不受影响
+func RevokeInvitation(appsRootDir string, token string) (*models.Invitation, error) {
+	var revoked *models.Invitation
+	err := updateTesterData(appsRootDir, func(data *TesterData) error {
+		for _, invitation := range data.Invitations {
+			if invitation.Token == token {
+				invitation.Revoked = true
+				revoked = invitation
+				return nil
+			}
+		}
+		return fmt.Errorf("invitation not found")
+	})
+	return revoked, err
+}
+
+// GetInvitation 邀请以及对应的测试组, 不存在时返回nil
+func GetInvitation(appsRootDir string, token string) (*models.Invitation, *models.TesterGroup) {
+	data, err := LoadTesterData(appsRootDir)
+	if err != nil || token == "" {
+		return nil, nil
+	}
+	for _, invitation := range data.Invitations {
+		if invitation.Token == token {
+			return invitation, data.group(invitation.Group)
+		}
+	}
+	return nil, nil
+}
+
+// AcceptInvitation 接受邀请, 加入测试组; 邮件邀请使用邀请的email, 链接邀请使用测试者填写的email.
+// 链接邀请无法证明email属于测试者, 因此不能用于已经存在的测试者, 否则任何人都可以拿到别人的token;
+// 邮件邀请遇到没有验证过的测试者(之前通过链接邀请加入)时重新生成token, 之前填写这个email的人不再能够访问
+func AcceptInvitation(appsRootDir string, token string, email string, now time.Time) (*models.Tester, error) {
+	var accepted *models.Tester
+	err := updateTesterData(appsRootDir, func(data *TesterData) error {
+		var invitation *models.Invitation
+		for _, i := range data.Invitations {
+			if i.Token == token {
+				invitation = i
+			}
+		}
+		if invitation == nil || data.group(invitation.Group) == nil {
+			return fmt.Errorf("invitation not found")
+		}
+		if !invitation.Usable(now) {
+			return fmt.Errorf("invitation is expired or already used")
+		}
+		if invitation.Email != "" {
+			email = invitation.Email
+		}
+		if !validEmail(email) {
+			return fmt.Errorf("invalid email: %s", email)
+		}
+
+		tester := data.testerByEmail(email)
+		if tester != nil && invitation.Email == "" {
+			return fmt.Errorf("%s has already joined, please ask for an email invitation", email)
+		}
+		if tester == nil || (invitation.Email != "" && !tester.Verified) {
+			token, err := randomToken()
+			if err != nil {
+				return err
+			}
+			if tester == nil {
+				tester = &models.Tester{Email: email, JoinedAt: now}
+				data.Testers = append(data.Testers, tester)
+			}
+			tester.Token = token
+		}
+		if invitation.Email != "" {
+			tester.Verified = true
+		}
+		if !containsString(tester.Groups, invitation.Group) {
+			tester.Groups = append(tester.Groups, invitation.Group)
+		}
+		invitation.Accepted++
+		invitation.AcceptedAt = now
+		accepted = tester
+		return nil
+	})
+	return accepted, err
+}
+
+// FindTester 根据token查找测试者以及所在的测试组, 不存在时返回nil
+func FindTester(appsRootDir string, token string) (*models.Tester, []*models.TesterGroup) {
+	data, err := CachedTesterData(appsRootDir)
+	if err != nil {
+		return nil, nil
+	}
+	return data.FindTester(token)
+}
+
+// FindTester 根据token查找测试者以及所在的测试组, 不存在时返回nil
+func (d *TesterData) FindTester(token string) (*models.Tester, []*models.TesterGroup) {
+	if token == "" {
+		return nil, nil
+	}
+	for _, tester := range d.Testers {
+		if tester.Token != token {
+			continue
+		}
+		var groups []*models.TesterGroup
+		for _, id := range tester.Groups {
+			if group := d.group(id); group != nil {
+				groups = append(groups, group)
+			}
+		}
+		return tester, groups
+	}
+	return nil, nil
+}
+
+// BuildRestricted Build是否指定给了测试组(通过apps或者channels), 指定给测试组的Build只有组内的测试者可以看到和下载;
+// apps和channels都为空的测试组不限定任何Build
+func BuildRestricted(groups []*models.TesterGroup, bundleId string, channel string) bool {
+	for _, group := range groups {
+		if (len(group.Apps) > 0 || len(group.Channels) > 0) && group.Allows(bundleId, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// TesterCanInstall 任意一个测试组允许安装即可
+func TesterCanInstall(groups []*models.TesterGroup, bundleId string, channel string) bool {
+	for _, group := range groups {
+		if group.Allows(bundleId, channel) {
+			return true
+		}
+	}
+	return false
+}
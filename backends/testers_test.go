@@ -0,0 +1,126 @@
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestTesterInvitations"
+//
+func TestTesterInvitations(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+	now := time.Date(2016, 7, 1, 10, 0, 0, 0, time.Local)
+
+	assert.Error(t, SaveTesterGroup(appsRoot, &models.TesterGroup{Id: "a b"}))
+	assert.NoError(t, SaveTesterGroup(appsRoot, &models.TesterGroup{Id: "doctor", Apps: []string{"com.chunyu.Doctor"}}))
+	assert.NoError(t, SaveTesterGroup(appsRoot, &models.TesterGroup{Id: "beta", Name: "Beta", Channels: []string{"beta"}}))
+	data, err := LoadTesterData(appsRoot)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(data.Groups))
+	assert.Equal(t, "beta", data.Groups[0].Id)
+	assert.Equal(t, "doctor", data.Groups[1].Name)
+
+	_, err = CreateInvitation(appsRoot, "nurse", "", "admin", now)
+	assert.Error(t, err)
+	_, err = CreateInvitation(appsRoot, "doctor", "alice", "admin", now)
+	assert.Error(t, err)
+
+	// 邮件邀请只能使用一次, 使用邀请中的email
+	invitation, err := CreateInvitation(appsRoot, "doctor", "alice@chunyu.me", "admin", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(7*24*time.Hour), invitation.ExpiresAt)
+	alice, err := AcceptInvitation(appsRoot, invitation.Token, "mallory@chunyu.me", now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@chunyu.me", alice.Email)
+	assert.Equal(t, []string{"doctor"}, alice.Groups)
+	assert.True(t, alice.Verified)
+	_, err = AcceptInvitation(appsRoot, invitation.Token, "", now.Add(time.Hour))
+	assert.Error(t, err)
+
+	// 链接邀请在过期之前可以被多人使用, 但是不能用于已经存在的测试者
+	link, err := CreateInvitation(appsRoot, "beta", "", "admin", now)
+	assert.NoError(t, err)
+	_, err = AcceptInvitation(appsRoot, link.Token, "", now)
+	assert.Error(t, err)
+	_, err = AcceptInvitation(appsRoot, link.Token, "ALICE@chunyu.me", now)
+	assert.Error(t, err)
+	found, groups := FindTester(appsRoot, alice.Token)
+	assert.Equal(t, []string{"doctor"}, found.Groups)
+	bob, err := AcceptInvitation(appsRoot, link.Token, "bob@chunyu.me", now)
+	assert.NoError(t, err)
+	assert.NotEqual(t, alice.Token, bob.Token)
+	assert.False(t, bob.Verified)
+	_, err = AcceptInvitation(appsRoot, link.Token, "carol@chunyu.me", link.ExpiresAt)
+	assert.Error(t, err)
+
+	// 已经验证的测试者通过邮件邀请加入其他组时token不变
+	invitation, err = CreateInvitation(appsRoot, "beta", "alice@chunyu.me", "admin", now)
+	assert.NoError(t, err)
+	tester, err := AcceptInvitation(appsRoot, invitation.Token, "", now)
+	assert.NoError(t, err)
+	assert.Equal(t, alice.Token, tester.Token)
+	assert.Equal(t, []string{"doctor", "beta"}, tester.Groups)
+
+	// 没有验证过的测试者接受邮件邀请时重新生成token
+	invitation, err = CreateInvitation(appsRoot, "doctor", "bob@chunyu.me", "admin", now)
+	assert.NoError(t, err)
+	tester, err = AcceptInvitation(appsRoot, invitation.Token, "", now)
+	assert.NoError(t, err)
+	assert.NotEqual(t, bob.Token, tester.Token)
+	assert.True(t, tester.Verified)
+	found, _ = FindTester(appsRoot, bob.Token)
+	assert.Nil(t, found)
+	bob = tester
+
+	revoked, err := RevokeInvitation(appsRoot, link.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "beta", revoked.Group)
+	_, err = AcceptInvitation(appsRoot, link.Token, "carol@chunyu.me", now)
+	assert.Error(t, err)
+
+	// 测试组允许安装的App和渠道
+	found, groups = FindTester(appsRoot, alice.Token)
+	assert.Equal(t, "alice@chunyu.me", found.Email)
+	assert.True(t, TesterCanInstall(groups, "com.chunyu.Doctor", ""))
+	assert.True(t, TesterCanInstall(groups, "com.chunyu.Patient", "beta"))
+	assert.False(t, TesterCanInstall(groups, "com.chunyu.Patient", "nightly"))
+	found, groups = FindTester(appsRoot, bob.Token)
+	assert.False(t, TesterCanInstall(groups, "com.chunyu.Patient", ""))
+	found, _ = FindTester(appsRoot, "")
+	assert.Nil(t, found)
+
+	// 指定给测试组的Build
+	data, _ = LoadTesterData(appsRoot)
+	assert.True(t, BuildRestricted(data.Groups, "com.chunyu.Doctor", ""))
+	assert.True(t, BuildRestricted(data.Groups, "com.chunyu.Patient", "beta"))
+	assert.False(t, BuildRestricted(data.Groups, "com.chunyu.Patient", ""))
+	assert.False(t, BuildRestricted([]*models.TesterGroup{{Id: "all"}}, "com.chunyu.Patient", ""))
+
+	// 不再属于任何组的测试者被删除
+	assert.NoError(t, RemoveTester(appsRoot, "doctor", "alice@chunyu.me"))
+	assert.Error(t, RemoveTester(appsRoot, "doctor", "alice@chunyu.me"))
+	assert.NoError(t, RemoveTester(appsRoot, "doctor", "bob@chunyu.me"))
+	assert.NoError(t, DeleteTesterGroup(appsRoot, "beta"))
+	data, _ = LoadTesterData(appsRoot)
+	assert.Equal(t, 1, len(data.Groups))
+	assert.Empty(t, data.Testers)
+	assert.Equal(t, 2, len(data.Invitations))
+
+	// 文件没有变化时使用缓存, 文件损坏时返回错误
+	cached, err := CachedTesterData(appsRoot)
+	assert.NoError(t, err)
+	again, _ := CachedTesterData(appsRoot)
+	assert.True(t, cached == again)
+	ioutil.WriteFile(TestersFile(appsRoot), []byte("{"), 0600)
+	_, err = CachedTesterData(appsRoot)
+	assert.Error(t, err)
+	found, _ = FindTester(appsRoot, alice.Token)
+	assert.Nil(t, found)
+}
@@ -0,0 +1,253 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"git.chunyu.me/feiwang/appserver/models"
+)
+
+// ErrNoUpdateBuilds 没有bundle id(以及渠道)对应的Build
+var ErrNoUpdateBuilds = errors.New("no builds found")
+
+// UpdateCheck App内检查更新的参数, iOS和Android相同
+type UpdateCheck struct {
+	BundleId string
+	// 当前安装的版本, 即CFBundleShortVersionString或者versionName
+	Version string
+	// 当前安装的build号, 即CFBundleVersion或者versionCode, 为空时只比较版本
+	Build string
+	// 为空时不限渠道
+	Channel string
+	// ios, android, 为空时根据bundle id判断
+	Platform string
+	// 根据User-Agent判断的平台, 没有指定Platform并且两个平台都有Build时使用
+	PlatformHint string
+	// 安装链接中带上的参数, 例如测试者的token以及私有组织的download_token, 否则安装时返回403/401
+	DownloadQuery string
+}
+
+// UpdateBuild 最新的Build
+type UpdateBuild struct {
+	Id          string `json:"id"`
+	Version     string `json:"version"`
+	Build       string `json:"build"`
+	Channel     string `json:"channel,omitempty"`
+	ReleaseDate string `json:"release_date"`
+}
+
+// UpdateInfo 检查更新的结果, 没有更新时install_url和notes为空
+type UpdateInfo struct {
+	UpdateAvailable bool         `json:"update_available"`
+	BundleId        string       `json:"bundle_id"`
+	Platform        string       `json:"platform"`
+	Version         string       `json:"version"`
+	Build           string       `json:"build"`
+	Latest          *UpdateBuild `json:"latest"`
+	// iOS为itms-services链接, Android为apk的下载链接
+	InstallURL string `json:"install_url,omitempty"`
+	Notes      string `json:"notes,omitempty"`
+	// 当前版本和最新版本之间(包括最新版本)有强制更新的Build
+	Mandatory bool `json:"mandatory"`
+}
+
+// 两个平台的Build统一比较
+type updateCandidate struct {
+	build *UpdateBuild
+	// iOS为plist的链接, Android为apk的下载链接
+	url       string
+	notes     string
+	mandatory bool
+}
+
+// PlatformFromUserAgent 根据App的User-Agent判断平台, 无法判断时返回空字符串
+func PlatformFromUserAgent(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "Android") || strings.HasPrefix(userAgent, "okhttp/"):
+		return "android"
+	case strings.Contains(userAgent, "CFNetwork") || strings.Contains(userAgent, "iPhone") || strings.Contains(userAgent, "iPad"):
+		return "ios"
+	}
+	return ""
+}
+
+// CompareSemver 按照semantic version比较两个版本号, 例如: 1.2.0-beta.2 < 1.2.0-rc.1 < 1.2.0 < 1.10.0;
+// 忽略开头的v以及+之后的build metadata, 数字部分和CompareVersion相同
+func CompareSemver(a string, b string) int {
+	coreA, preA := splitSemver(a)
+	coreB, preB := splitSemver(b)
+	if c := CompareVersion(coreA, coreB); c != 0 {
+		return c
+	}
+	// 正式版本高于预发布版本
+	switch {
+	case preA == "" && preB == "":
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+
+	pa := strings.Split(preA, ".")
+	pb := strings.Split(preB, ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if c := comparePrerelease(pa[i], pb[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(pa) < len(pb):
+		return -1
+	case len(pa) > len(pb):
+		return 1
+	}
+	return 0
+}
+
+func splitSemver(version string) (core string, prerelease string) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if idx := strings.Index(version, "+"); idx >= 0 {
+		version = version[:idx]
+	}
+	if idx := strings.Index(version, "-"); idx >= 0 {
+		return version[:idx], version[idx+1:]
+	}
+	return version, ""
+}
+
+// 数字标识按照数字比较, 并且低于非数字的标识
+func comparePrerelease(a string, b string) int {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		if na == nb {
+			return 0
+		} else if na < nb {
+			return -1
+		}
+		return 1
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareBuild 先比较版本, 版本相同时比较build号
+func compareBuild(version string, build string, otherVersion string, otherBuild string) int {
+	if c := CompareSemver(version, otherVersion); c != 0 {
+		return c
+	}
+	if build == "" || otherBuild == "" {
+		return 0
+	}
+	return CompareVersion(build, otherBuild)
+}
+
+// CheckUpdate 在没有隐藏的Build中查找bundle id(以及渠道)最新的Build, 和当前安装的版本比较
+func CheckUpdate(iosAppDirs []*models.IosAppDirMeta, androidAppDirs []*models.AndroidAppDirMeta, check *UpdateCheck) (*UpdateInfo, error) {
+	var iosCandidates, androidCandidates []*updateCandidate
+	for _, app := range iosAppDirs {
+		if app.Hidden || app.BundleId != check.BundleId || (check.Channel != "" && app.Channel != check.Channel) {
+			continue
+		}
+		iosCandidates = append(iosCandidates, &updateCandidate{
+			build: &UpdateBuild{
+				Id: app.Id, Version: app.Version, Build: app.BuildNumber, Channel: app.Channel, ReleaseDate: app.ReleaseDate,
+			},
+			url:       app.Plist,
+			notes:     app.Notes,
+			mandatory: app.Mandatory,
+		})
+	}
+	for _, app := range androidAppDirs {
+		if app.Hidden || app.BundleId != check.BundleId || (check.Channel != "" && app.Channel != check.Channel) {
+			continue
+		}
+		androidCandidates = append(androidCandidates, &updateCandidate{
+			build: &UpdateBuild{
+				Id: app.Id, Version: app.Version, Build: app.VersionCode, Channel: app.Channel, ReleaseDate: app.ReleaseDate,
+			},
+			url:       app.Apk,
+			notes:     app.Notes,
+			mandatory: app.Mandatory,
+		})
+	}
+
+	platform := check.Platform
+	if platform == "" {
+		switch {
+		case len(iosCandidates) > 0 && len(androidCandidates) > 0:
+			if check.PlatformHint == "" {
+				return nil, fmt.Errorf("%s has both ios and android builds, platform is required", check.BundleId)
+			}
+			platform = check.PlatformHint
+		case len(iosCandidates) > 0:
+			platform = "ios"
+		case len(androidCandidates) > 0:
+			platform = "android"
+		}
+	}
+	var candidates []*updateCandidate
+	switch platform {
+	case "ios":
+		candidates = iosCandidates
+	case "android":
+		candidates = androidCandidates
+	case "":
+	default:
+		return nil, fmt.Errorf("invalid platform: %s", platform)
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoUpdateBuilds
+	}
+
+	latest := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if compareBuild(candidate.build.Version, candidate.build.Build, latest.build.Version, latest.build.Build) > 0 {
+			latest = candidate
+		}
+	}
+
+	info := &UpdateInfo{
+		BundleId: check.BundleId,
+		Platform: platform,
+		Version:  check.Version,
+		Build:    check.Build,
+		Latest:   latest.build,
+	}
+	if compareBuild(latest.build.Version, latest.build.Build, check.Version, check.Build) <= 0 {
+		return info, nil
+	}
+	info.UpdateAvailable = true
+	installURL := latest.url
+	if check.DownloadQuery != "" {
+		if strings.Contains(installURL, "?") {
+			installURL += "&" + check.DownloadQuery
+		} else {
+			installURL += "?" + check.DownloadQuery
+		}
+	}
+	info.InstallURL = installURL
+	if platform == "ios" {
+		info.InstallURL = GenerateItemServiceUrl(installURL)
+	}
+	info.Notes = latest.notes
+	for _, candidate := range candidates {
+		if candidate.mandatory && compareBuild(candidate.build.Version, candidate.build.Build, check.Version, check.Build) > 0 {
+			info.Mandatory = true
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,99 @@
+package backends
+
+import (
+	"testing"
+
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestCompareSemver"
+//
+func TestCompareSemver(t *testing.T) {
+	ordered := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.10.0"}
+	for i := 0; i < len(ordered)-1; i++ {
+		assert.Equal(t, -1, CompareSemver(ordered[i], ordered[i+1]), ordered[i]+" < "+ordered[i+1])
+		assert.Equal(t, 1, CompareSemver(ordered[i+1], ordered[i]), ordered[i+1]+" > "+ordered[i])
+	}
+	assert.Equal(t, 0, CompareSemver("v1.2", "1.2.0"))
+	assert.Equal(t, 0, CompareSemver("1.2.0+20160501", "1.2.0"))
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/backends -v -run "TestCheckUpdate"
+//
+func TestCheckUpdate(t *testing.T) {
+	iosAppDirs := []*models.IosAppDirMeta{
+		{Id: "ios_1", BundleId: "com.chunyu.Doctor", Version: "3.9", BuildNumber: "90", Plist: "https://apps/api/plist/ios_1", Mandatory: true},
+		{Id: "ios_2", BundleId: "com.chunyu.Doctor", Version: "3.10", BuildNumber: "100", Plist: "https://apps/api/plist/ios_2", Notes: "3.10"},
+		{Id: "ios_3", BundleId: "com.chunyu.Doctor", Version: "3.10", BuildNumber: "101", Plist: "https://apps/api/plist/ios_3", Notes: "3.10 fix"},
+		{Id: "ios_4", BundleId: "com.chunyu.Doctor", Version: "3.11-beta.1", BuildNumber: "110", Plist: "https://apps/api/plist/ios_4", Channel: "beta", Notes: "beta"},
+		{Id: "ios_5", BundleId: "com.chunyu.Doctor", Version: "4.0", BuildNumber: "200", Hidden: true},
+		{Id: "ios_6", BundleId: "me.chunyu.doctor", Version: "1.0", BuildNumber: "1"},
+	}
+	androidAppDirs := []*models.AndroidAppDirMeta{
+		{Id: "android_1", BundleId: "me.chunyu.doctor", Version: "1.0", Apk: "https://apps/api/apk/android_1", ApkMetadata: models.ApkMetadata{VersionCode: "9"}},
+		{Id: "android_2", BundleId: "me.chunyu.doctor", Version: "1.0", Apk: "https://apps/api/apk/android_2", ApkMetadata: models.ApkMetadata{VersionCode: "10"}, Notes: "fix", Mandatory: true},
+	}
+
+	// 没有指定渠道时包括预发布版本, 隐藏的Build被忽略
+	info, err := CheckUpdate(iosAppDirs, androidAppDirs, &UpdateCheck{BundleId: "com.chunyu.Doctor", Version: "3.10", Build: "100"})
+	assert.NoError(t, err)
+	assert.True(t, info.UpdateAvailable)
+	assert.Equal(t, "ios", info.Platform)
+	assert.Equal(t, "ios_4", info.Latest.Id)
+	assert.Equal(t, "itms-services://?action=download-manifest&url=https%3A%2F%2Fapps%2Fapi%2Fplist%2Fios_4", info.InstallURL)
+	assert.Equal(t, "beta", info.Notes)
+	assert.False(t, info.Mandatory)
+
+	// 版本相同时比较build号
+	info, err = CheckUpdate(iosAppDirs[:3], nil, &UpdateCheck{BundleId: "com.chunyu.Doctor", Version: "3.10", Build: "100"})
+	assert.NoError(t, err)
+	assert.True(t, info.UpdateAvailable)
+	assert.Equal(t, "ios_3", info.Latest.Id)
+	assert.Equal(t, "3.10 fix", info.Notes)
+
+	// 跳过的版本中有强制更新
+	info, err = CheckUpdate(iosAppDirs[:3], nil, &UpdateCheck{BundleId: "com.chunyu.Doctor", Version: "3.8", Build: "80"})
+	assert.NoError(t, err)
+	assert.True(t, info.Mandatory)
+
+	// 已经是最新的版本
+	info, err = CheckUpdate(iosAppDirs[:3], nil, &UpdateCheck{BundleId: "com.chunyu.Doctor", Version: "3.10", Build: "101"})
+	assert.NoError(t, err)
+	assert.False(t, info.UpdateAvailable)
+	assert.Equal(t, "ios_3", info.Latest.Id)
+	assert.Empty(t, info.InstallURL)
+
+	// 渠道
+	info, err = CheckUpdate(iosAppDirs, androidAppDirs, &UpdateCheck{BundleId: "com.chunyu.Doctor", Version: "3.10", Build: "101", Channel: "beta"})
+	assert.NoError(t, err)
+	assert.True(t, info.UpdateAvailable)
+	_, err = CheckUpdate(iosAppDirs, androidAppDirs, &UpdateCheck{BundleId: "com.chunyu.Doctor", Version: "3.10", Channel: "nightly"})
+	assert.Equal(t, ErrNoUpdateBuilds, err)
+
+	// 两个平台都有Build时需要platform或者User-Agent
+	_, err = CheckUpdate(iosAppDirs, androidAppDirs, &UpdateCheck{BundleId: "me.chunyu.doctor", Version: "1.0", Build: "9"})
+	assert.Error(t, err)
+	info, err = CheckUpdate(iosAppDirs, androidAppDirs, &UpdateCheck{BundleId: "me.chunyu.doctor", Version: "1.0", Build: "9", PlatformHint: "android"})
+	assert.NoError(t, err)
+	assert.Equal(t, "android", info.Platform)
+	assert.True(t, info.UpdateAvailable)
+	assert.True(t, info.Mandatory)
+	assert.Equal(t, "https://apps/api/apk/android_2", info.InstallURL)
+	info, err = CheckUpdate(iosAppDirs, androidAppDirs, &UpdateCheck{BundleId: "me.chunyu.doctor", Version: "1.0", Build: "1", Platform: "ios", PlatformHint: "android"})
+	assert.NoError(t, err)
+	assert.False(t, info.UpdateAvailable)
+
+	// 指定给测试组的Build, 安装链接带上测试者的token
+	info, err = CheckUpdate(iosAppDirs[3:4], nil, &UpdateCheck{BundleId: "com.chunyu.Doctor", Version: "3.10", Channel: "beta", DownloadQuery: "token=abc"})
+	assert.NoError(t, err)
+	assert.Equal(t, "itms-services://?action=download-manifest&url=https%3A%2F%2Fapps%2Fapi%2Fplist%2Fios_4%3Ftoken%3Dabc", info.InstallURL)
+	info, err = CheckUpdate(nil, androidAppDirs, &UpdateCheck{BundleId: "me.chunyu.doctor", Version: "1.0", Build: "9", DownloadQuery: "token=abc&download_token=1.62.ff"})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://apps/api/apk/android_2?token=abc&download_token=1.62.ff", info.InstallURL)
+
+	assert.Equal(t, "android", PlatformFromUserAgent("okhttp/3.2.0"))
+	assert.Equal(t, "ios", PlatformFromUserAgent("Doctor/3.10 CFNetwork/758.4.3 Darwin/15.5.0"))
+}
@@ -0,0 +1,219 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/models"
+)
+
+// VerifyResult 记录一个App目录的检查结果
+type VerifyResult struct {
+	Id       string
+	Platform string
+	Problems []string
+}
+
+func (r *VerifyResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyResult) addProblem(format string, a ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, a...))
+}
+
+// VerifyAppRootDir 检查apps_root下所有的App目录, checksums为true时重新计算文件的校验和, 检查磁盘上的文件是否损坏
+func VerifyAppRootDir(appsRootDir string, checksums bool) ([]*VerifyResult, error) {
+	dir, err := ioutil.ReadDir(appsRootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*VerifyResult, 0, len(dir))
+	for _, fi := range dir {
+		if !fi.IsDir() || isHiddenDir(fi.Name()) {
+			continue
+		}
+		result := VerifyAppDir(path.Join(appsRootDir, fi.Name()))
+		if checksums {
+			result.Problems = append(result.Problems, VerifyChecksums(path.Join(appsRootDir, fi.Name()))...)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// VerifyAppDir 检查App目录中的ipa/plist/icon(或apk/json/icon)是否完整并且一致
+func VerifyAppDir(appDir string) *VerifyResult {
+	result := &VerifyResult{Id: path.Base(appDir)}
+
+	ipaPath := path.Join(appDir, "app.ipa")
+	apks, _ := ApkArtifactFiles(appDir)
+
+	switch {
+	case IsExist(ipaPath):
+		result.Platform = "ios"
+		verifyIosAppDir(appDir, result)
+	case len(apks) > 0 || IsExist(path.Join(appDir, "app.aab")):
+		result.Platform = "android"
+		verifyAndroidAppDir(appDir, result)
+	default:
+		result.addProblem("neither app.ipa nor app.apk/app.aab found")
+	}
+	return result
+}
+
+func verifyIosAppDir(appDir string, result *VerifyResult) {
+	ipaPath := path.Join(appDir, "app.ipa")
+	var metaInfo map[string]interface{}
+	bundle, err := ParseIpaBundle(ipaPath)
+	if err == nil {
+		err = checkBundleId(bundle.Info, AllowedBundleIds())
+	}
+	if err != nil {
+		result.addProblem("app.ipa: %v", err)
+	} else {
+		metaInfo = bundle.Info
+		if IosSignaturePolicy() != SignaturePolicyOff {
+			if signature, err := VerifyIpa(ipaPath, bundle); err != nil {
+				result.addProblem("app.ipa: %v", err)
+			} else {
+				for _, problem := range signature.ProblemsAt(time.Now()) {
+					result.addProblem("app.ipa: %s", problem)
+				}
+			}
+		}
+	}
+
+	plistPath := path.Join(appDir, "app.plist")
+	if !IsExist(plistPath) {
+		result.addProblem("app.plist not found")
+	} else if metadata, err := readManifestMetadata(plistPath); err != nil {
+		result.addProblem("app.plist: %v", err)
+	} else if metaInfo != nil {
+		bundleId, _ := metaInfo["CFBundleIdentifier"].(string)
+		version, _ := metaInfo["CFBundleShortVersionString"].(string)
+		if id, _ := metadata["bundle-identifier"].(string); id != bundleId {
+			result.addProblem("app.plist bundle-identifier %q does not match app.ipa %q", id, bundleId)
+		}
+		if v, _ := metadata["bundle-version"].(string); v != version {
+			result.addProblem("app.plist bundle-version %q does not match app.ipa %q", v, version)
+		}
+	}
+
+	verifyIcon(appDir, result)
+}
+
+func verifyAndroidAppDir(appDir string, result *VerifyResult) {
+	files, err := ApkArtifactFiles(appDir)
+	if err != nil {
+		result.addProblem("%v", err)
+	}
+	if len(files) == 0 {
+		result.addProblem("app.apk not found")
+	}
+
+	// 所有的apk(app.apk以及app-*.apk)的包名必须相同
+	var apkMeta *models.ApkMetadata
+	for _, file := range files {
+		filePath := path.Join(appDir, file)
+		meta, err := ParseApk(filePath)
+		if err != nil {
+			result.addProblem("%s: %v", file, err)
+			continue
+		}
+		if apkMeta == nil {
+			apkMeta = meta
+		} else if meta.PackageName != apkMeta.PackageName {
+			result.addProblem("%s: package %s does not match %s", file, meta.PackageName, apkMeta.PackageName)
+		}
+		if ApkSignaturePolicy() == SignaturePolicyOff {
+			continue
+		}
+		if signature, err := VerifyApk(filePath, meta.PackageName); err != nil {
+			result.addProblem("%s: %v", file, err)
+		} else {
+			for _, problem := range signature.Problems {
+				result.addProblem("%s: %s", file, problem)
+			}
+		}
+	}
+
+	aabPath := path.Join(appDir, "app.aab")
+	if IsExist(aabPath) {
+		if aabMeta, err := ParseAab(aabPath); err != nil {
+			result.addProblem("app.aab: %v", err)
+		} else if apkMeta != nil && files[0] == "app.apk" {
+			if err := checkUniversalApk(aabMeta, apkMeta); err != nil {
+				result.addProblem("%v", err)
+			}
+		}
+	}
+
+	jsonPath := path.Join(appDir, "app.json")
+	data, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		result.addProblem("app.json: %v", err)
+	} else {
+		var appJson map[string]interface{}
+		if err := json.Unmarshal(data, &appJson); err != nil {
+			result.addProblem("app.json: %v", err)
+		} else {
+			for _, key := range []string{"title", "versionName"} {
+				if _, ok := appJson[key].(string); !ok {
+					result.addProblem("app.json: missing %s", key)
+				}
+			}
+		}
+	}
+
+	verifyIcon(appDir, result)
+}
+
+func verifyIcon(appDir string, result *VerifyResult) {
+	f, err := os.Open(path.Join(appDir, "app.png"))
+	if err != nil {
+		result.addProblem("app.png: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := png.DecodeConfig(f); err != nil {
+		result.addProblem("app.png: %v", err)
+	}
+}
+
+// readManifestMetadata 读取itms-services的manifest(app.plist)中的metadata
+func readManifestMetadata(plistPath string) (Dict, error) {
+	data, err := ioutil.ReadFile(plistPath)
+	if err != nil {
+		return nil, err
+	}
+	var plist Plist
+	if err := Unmarshal(data, &plist); err != nil {
+		return nil, err
+	}
+
+	root, ok := plist.Root.(Dict)
+	if !ok {
+		return nil, fmt.Errorf("root is not a dict")
+	}
+	items, ok := root["items"].(Array)
+	if !ok || len(items) == 0 {
+		return nil, fmt.Errorf("items not found")
+	}
+	item, ok := items[0].(Dict)
+	if !ok {
+		return nil, fmt.Errorf("items[0] is not a dict")
+	}
+	metadata, ok := item["metadata"].(Dict)
+	if !ok {
+		return nil, fmt.Errorf("metadata not found")
+	}
+	return metadata, nil
+}
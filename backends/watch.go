@@ -33,17 +33,18 @@ func addWatchPath(appsRootDir string, watcher *fsnotify.Watcher) {
 
 
 	// 扫描目录
+	// 扫描过程中目录可能被删除, 出错时只记录日志, 不能让整个进程退出
 	dir, err := ioutil.ReadDir(appsRootDir)
 	if err != nil {
-		log.Errorf("[ERRO] Fail to create new Watcher[ %s ]\n", err)
-		os.Exit(2)
+		log.Errorf("[ERRO] Fail to read apps root dir[ %s ]\n", err)
+		return
 	}
 
 	log.Infof("[INFO] Initializing watcher...\n")
 	// 遍历所有的目录
 	for _, fi := range dir {
-		if !fi.IsDir() {
-			// 忽略目录
+		if !fi.IsDir() || isHiddenDir(fi.Name()) {
+			// 忽略文件以及隐藏目录
 			continue
 		}
 		appDir := path.Join(appsRootDir, fi.Name())
@@ -52,10 +53,11 @@ func addWatchPath(appsRootDir string, watcher *fsnotify.Watcher) {
 		err = watcher.Watch(appDir)
 		if err != nil {
 			log.Errorf("[ERRO] Fail to watch directory[ %s ]\n", err)
-			os.Exit(2)
+			delete(appDirs, appDir)
 		}
 
 	}
+	WatchedDirs.Set(float64(len(appDirs)))
 }
 
 // 来自beego
@@ -79,9 +81,11 @@ func NewWatcher(appsRootDir string, autoScan func()) chan bool {
 			// TODO: 自动扫描
 			// Skip ignored files
 				if shouldIgnoreFile(e.Name) {
+					WatcherEventsTotal.Inc("ignored")
 					continue
 				}
 				if !checkIfWatchExt(e.Name) {
+					WatcherEventsTotal.Inc("ignored")
 					continue
 				}
 
@@ -89,6 +93,7 @@ func NewWatcher(appsRootDir string, autoScan func()) chan bool {
 				mt := getFileModTime(e.Name)
 				if t := eventTime[e.Name]; mt == t {
 					ColorLog("[SKIP] # %s #\n", e.String())
+					WatcherEventsTotal.Inc("skipped")
 					isbuild = false
 				}
 
@@ -97,6 +102,7 @@ func NewWatcher(appsRootDir string, autoScan func()) chan bool {
 			// 如果已经Schedule了，则跳过
 				if isbuild && scheduleTime.Unix() < mt {
 					ColorLog("[EVEN] %s\n", e)
+					WatcherEventsTotal.Inc("scheduled")
 					go func() {
 						// Wait 1s before autobuild util there is no file change.
 						scheduleTime = time.Now().Add(10 * time.Second)
@@ -155,8 +161,12 @@ func checkTMPFile(name string) bool {
 
 
 // Should ignore filenames generated by
-// Emacs, Vim or SublimeText
+// Emacs, Vim or SublimeText, and hidden files
 func shouldIgnoreFile(filename string) bool {
+	// apps_root中的隐藏文件, 例如: .testers.json
+	if isHiddenDir(path.Base(filename)) {
+		return true
+	}
 	for _, regex := range ignoredFilesRegExps {
 		r, err := regexp.Compile(regex)
 		if err != nil {
@@ -171,7 +181,7 @@ func shouldIgnoreFile(filename string) bool {
 	return false
 }
 
-var watchExts = []string{".ipa", ".apk", ".plist", ".png", "mobileprovision", ".json"}
+var watchExts = []string{".ipa", ".apk", ".aab", ".plist", ".png", "mobileprovision", ".json"}
 var ignoredFilesRegExps = []string{
 	`(\w+)___`,
 	`.#(\w+).go`,
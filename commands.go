@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+)
+
+//
+// 运维相关的子命令: scan, verify, prune, import, export, expiry, storage, blobs
+//
+
+var commands = []string{"scan", "verify", "prune", "import", "export", "expiry", "storage", "blobs"}
+
+func commandName(args map[string]interface{}) string {
+	for _, command := range commands {
+		if b, ok := args[command].(bool); ok && b {
+			return command
+		}
+	}
+	return ""
+}
+
+// runCommand 执行子命令, 返回进程的exit code
+func runCommand(command string, args map[string]interface{}, appsRoot string) int {
+	var err error
+	switch command {
+	case "scan":
+		err = scanCommand(appsRoot)
+	case "verify":
+		var ok bool
+		checksums, _ := args["--checksums"].(bool)
+		ok, err = verifyCommand(appsRoot, checksums)
+		if err == nil && !ok {
+			return 2
+		}
+	case "prune":
+		dryRun, _ := args["--dry-run"].(bool)
+		err = pruneCommand(appsRoot, dryRun)
+	case "import":
+		err = importCommand(appsRoot, args)
+	case "export":
+		err = exportCommand(appsRoot, args)
+	case "expiry":
+		notify, _ := args["--notify"].(bool)
+		days, _ := args["--days"].(string)
+		err = expiryCommand(appsRoot, days, notify)
+	case "storage":
+		push, _ := args["push"].(bool)
+		err = storageCommand(appsRoot, push)
+	case "blobs":
+		gc, _ := args["gc"].(bool)
+		dryRun, _ := args["--dry-run"].(bool)
+		err = blobsCommand(appsRoot, gc, dryRun)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", backends.RedF(command+" failed:"), err)
+		return 1
+	}
+	return 0
+}
+
+func scanCommand(appsRoot string) error {
+	if err := backends.ScanAppRootDir(appsRoot); err != nil {
+		return err
+	}
+	iosAppDirs, androidAppDirs, _ := backends.ListAppDir(appsRoot)
+
+	parsed := make(map[string]bool)
+	for _, app := range iosAppDirs {
+		parsed[app.Id] = true
+		fmt.Printf("%s  [ios] %s %s (%s) size: %s released: %s\n", backends.GreenF(app.Id), app.Name, app.Version, app.BundleId, app.Size, app.ReleaseDate)
+		fmt.Printf("    build: %s min iOS: %s devices: %s sdk: %s xcode: %s archs: %s\n", app.BuildNumber, app.MinimumOSVersion,
+			strings.Join(app.DeviceFamily, ","), app.SDKName, app.XcodeVersion, strings.Join(app.Architectures, ","))
+		for _, b := range app.Embedded {
+			fmt.Printf("    [%s] %s %s (%s) size: %s\n", b.Kind, b.Path, b.Version, b.BundleId, b.Size)
+		}
+		if p := app.Profile; p != nil {
+			fmt.Printf("    profile: %s [%s] %s team: %s expires: %s\n", p.Name, p.Type, p.AppId, p.TeamId, p.ExpirationDate.Format("2006-01-02"))
+		}
+		if app.SignerCertSHA256 != "" {
+			fmt.Printf("    signer: %s %s\n", app.SignerCertSHA256, app.SignerSubject)
+		}
+		for _, problem := range app.SignatureProblems {
+			fmt.Printf("    signature problem: %s\n", problem)
+		}
+		if c := app.Checksum; c != nil {
+			fmt.Printf("    sha256: %s md5: %s\n", c.SHA256, c.MD5)
+		}
+	}
+	for _, app := range androidAppDirs {
+		parsed[app.Id] = true
+		fmt.Printf("%s  [android] %s %s (%s) size: %s released: %s\n", backends.GreenF(app.Id), app.Name, app.Version, app.BundleId, app.Size, app.ReleaseDate)
+		fmt.Printf("    version code: %s sdk: %s/%s abis: %s debuggable: %v launcher: %s\n", app.VersionCode, app.MinSdkVersion, app.TargetSdkVersion,
+			strings.Join(app.Abis, ","), app.Debuggable, app.LauncherActivity)
+		fmt.Printf("    signer: %s %s %s\n", app.SignatureScheme, app.SignerCertSHA256, app.SignerSubject)
+		if len(app.SignatureVerified) > 0 {
+			fmt.Printf("    verified: %s\n", strings.Join(app.SignatureVerified, ","))
+		}
+		for _, problem := range app.SignatureProblems {
+			fmt.Printf("    signature problem: %s\n", problem)
+		}
+		if len(app.Artifacts) > 1 {
+			for _, artifact := range app.Artifacts {
+				fmt.Printf("    variant: %s [%s] size: %s\n", artifact.File, artifact.Label, artifact.Size)
+			}
+		}
+		if c := app.Checksum; c != nil {
+			fmt.Printf("    sha256: %s md5: %s\n", c.SHA256, c.MD5)
+		}
+	}
+
+	// 解析失败的目录
+	for _, e := range backends.ListAppDirErrors() {
+		parsed[e.Id] = true
+		fmt.Printf("%s  [%s] error: %s\n", backends.RedF(e.Id), e.Platform, e.Reason)
+	}
+
+	// 既没有ipa也没有apk的目录, 显示原因
+	results, err := backends.VerifyAppRootDir(appsRoot, false)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if parsed[result.Id] {
+			continue
+		}
+		fmt.Printf("%s  not indexed: %s\n", backends.RedF(result.Id), strings.Join(result.Problems, "; "))
+	}
+	return nil
+}
+
+func verifyCommand(appsRoot string, checksums bool) (bool, error) {
+	results, err := backends.VerifyAppRootDir(appsRoot, checksums)
+	if err != nil {
+		return false, err
+	}
+
+	allOK := true
+	for _, result := range results {
+		if result.OK() {
+			fmt.Printf("%s  [%s] OK\n", backends.GreenF(result.Id), result.Platform)
+			continue
+		}
+		allOK = false
+		fmt.Printf("%s  [%s]\n", backends.RedF(result.Id), result.Platform)
+		for _, problem := range result.Problems {
+			fmt.Printf("    - %s\n", problem)
+		}
+	}
+	return allOK, nil
+}
+
+func pruneCommand(appsRoot string, dryRun bool) error {
+	policy := backends.RetentionPolicyFromConfig()
+	if policy.KeepBuilds == 0 && policy.MaxAge == 0 {
+		fmt.Println("No retention policy configured (retention_keep_builds, retention_max_age_days)")
+		return nil
+	}
+
+	candidates, err := backends.Prune(appsRoot, policy, dryRun)
+	for _, c := range candidates {
+		action := "pruned"
+		if dryRun {
+			action = "would prune"
+		}
+		fmt.Printf("%s %s [%s] %s: %s\n", action, backends.MagentaF(c.Id), c.Platform, c.App, c.Reason)
+	}
+	return err
+}
+
+func expiryCommand(appsRoot string, days string, notify bool) error {
+	notifier := backends.NewExpiryNotifier(appsRoot)
+	if days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return fmt.Errorf("invalid days: %s", days)
+		}
+		notifier.WindowDays = n
+	}
+
+	builds, err := backends.ExpiringBuilds(appsRoot, time.Now(), notifier.WindowDays)
+	if err != nil {
+		return err
+	}
+	fmt.Print(backends.FormatExpiringBuilds(builds, notifier.WindowDays))
+	if !notify {
+		return nil
+	}
+	if notifier.Webhook == "" && len(notifier.EmailTo) == 0 {
+		return fmt.Errorf("neither expiry_webhook nor expiry_email_to is configured")
+	}
+	return notifier.Notify(time.Now())
+}
+
+func importCommand(appsRoot string, args map[string]interface{}) error {
+	file, _ := args["<file>"].(string)
+	options := backends.ImportOptions{}
+	options.Id, _ = args["--id"].(string)
+	options.Title, _ = args["--title"].(string)
+	if icon, ok := args["--icon"].(string); ok && icon != "" {
+		options.Icon = resolveArgPath(icon)
+	}
+	if apk, ok := args["--apk"].(string); ok && apk != "" {
+		options.Apk = resolveArgPath(apk)
+	}
+	options.Notes, _ = args["--notes"].(string)
+	options.Channel, _ = args["--channel"].(string)
+	options.Uploader, _ = args["--uploader"].(string)
+	options.Mandatory, _ = args["--mandatory"].(bool)
+
+	appId, err := backends.ImportBuild(appsRoot, resolveArgPath(file), options)
+	if err != nil {
+		return err
+	}
+	backends.RecordAudit(appsRoot, &backends.AuditEntry{Actor: commandActor(options.Uploader), Action: backends.AuditUpload, Target: appId, Detail: "import " + file})
+	fmt.Printf("imported %s as %s\n", file, backends.GreenF(appId))
+	return nil
+}
+
+func exportCommand(appsRoot string, args map[string]interface{}) error {
+	app, _ := args["<app>"].(string)
+	ids, err := backends.FindBuilds(appsRoot, app)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("no builds found for %s", app)
+	}
+
+	output, _ := args["-o"].(string)
+	if output == "" {
+		output = app + ".tar.gz"
+	}
+	f, err := os.Create(resolveArgPath(output))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := backends.ExportBuilds(appsRoot, ids, f); err != nil {
+		return err
+	}
+	fmt.Printf("exported %d builds of %s to %s\n", len(ids), app, output)
+	return nil
+}
+
+// commandActor 命令行操作的执行者: 指定的用户, 当前的系统用户, 都没有时为system
+func commandActor(user string) string {
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	if user == "" {
+		user = backends.AuditActorSystem
+	}
+	return user
+}
+
+// storageCommand 和配置的存储同步: push上传存储中没有的Build, pull下载本地没有的Build
+func storageCommand(appsRoot string, push bool) error {
+	storage := backends.GetStorage()
+	var ids []string
+	var err error
+	if push {
+		ids, err = backends.PushAppDirs(storage, appsRoot)
+	} else {
+		ids, err = backends.PullAppDirs(storage, appsRoot)
+	}
+	action := map[bool]string{true: backends.AuditStoragePush, false: backends.AuditStoragePull}[push]
+	for _, id := range ids {
+		fmt.Printf("%s %s\n", map[bool]string{true: "pushed", false: "pulled"}[push], backends.GreenF(id))
+		backends.RecordAudit(appsRoot, &backends.AuditEntry{Actor: commandActor(""), Action: action, Target: id})
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d builds synced\n", len(ids))
+	return nil
+}
+
+// blobsCommand sync将所有的Build保存为blob(不需要启用blob_store), gc删除没有被引用的blob
+func blobsCommand(appsRoot string, gc bool, dryRun bool) error {
+	storage := backends.GetStorage()
+	if !gc {
+		ids, err := backends.SyncBuildBlobs(storage, appsRoot)
+		for _, id := range ids {
+			fmt.Printf("stored %s\n", backends.GreenF(id))
+			backends.RecordAudit(appsRoot, &backends.AuditEntry{Actor: commandActor(""), Action: backends.AuditBlobSync, Target: id})
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d builds stored as blobs\n", len(ids))
+		return nil
+	}
+
+	result, err := backends.GCBlobs(storage, backends.BlobGCGrace(), dryRun)
+	if err != nil {
+		return err
+	}
+	for _, object := range result.Removed {
+		fmt.Printf("%s %s (%d bytes)\n", map[bool]string{true: "would remove", false: "removed"}[dryRun], backends.GreenF(object.Key), object.Size)
+	}
+	fmt.Printf("%d builds, %d references to %d blobs (%d referenced), %d removed, %.2fM freed\n", result.Builds, result.References,
+		result.Blobs, result.Referenced, len(result.Removed), float64(result.FreedBytes)/1024/1024)
+	if !dryRun {
+		backends.RecordAudit(appsRoot, &backends.AuditEntry{Actor: commandActor(""), Action: backends.AuditBlobGC, Target: "blobs",
+			Detail: fmt.Sprintf("%d removed, %d bytes freed", len(result.Removed), result.FreedBytes)})
+	}
+	return nil
+}
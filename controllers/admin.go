@@ -0,0 +1,378 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego"
+	"github.com/oal/beego-pongo2"
+)
+
+// 管理后台每页的Build数目
+const adminPageSize = 50
+
+// 操作记录页面中可以选择的操作
+var auditActions = []string{
+	backends.AuditUpload, backends.AuditDownload, backends.AuditEdit, backends.AuditRename,
+	backends.AuditPin, backends.AuditUnpin, backends.AuditHide, backends.AuditUnhide,
+	backends.AuditTrash, backends.AuditRestore, backends.AuditPrune, backends.AuditReplicate,
+	backends.AuditConfig, backends.AuditExport, backends.AuditGroup, backends.AuditDeleteGroup,
+	backends.AuditInvite, backends.AuditRevoke, backends.AuditJoin, backends.AuditRemoveTester,
+	backends.AuditStoragePush, backends.AuditStoragePull, backends.AuditBlobSync, backends.AuditBlobGC,
+}
+
+// AdminController 管理后台, 在AdminAuthFilter中认证
+type AdminController struct {
+	beego.Controller
+}
+
+func (this *AdminController) appsRoot() string {
+	return beego.AppConfig.String("apps_root")
+}
+
+func (this *AdminController) render(tmpl string, context pongo2.Context) {
+	context["admin"] = AdminUser(this.Ctx)
+	pongo2.Render(this.Ctx, tmpl, context)
+}
+
+func (this *AdminController) audit(action string, target string, detail string) {
+	backends.RecordAudit(this.appsRoot(), &backends.AuditEntry{
+		Actor:  AdminUser(this.Ctx),
+		Action: action,
+		Target: target,
+		IP:     this.Ctx.Input.IP(),
+		Detail: detail,
+	})
+}
+
+// 显示操作的结果并且跳转
+func (this *AdminController) redirectWithFlash(label string, err error, redirect string) {
+	flash := beego.NewFlash()
+	if err != nil {
+		log.WarnErrorf(err, "Admin %s %s failed", AdminUser(this.Ctx), label)
+		flash.Error("%s failed: %v", label, err)
+	} else {
+		flash.Notice("%s done", label)
+	}
+	flash.Store(&this.Controller)
+	this.Redirect(redirect, 303)
+}
+
+// 成功时记录到操作记录中, 然后显示结果并且跳转
+func (this *AdminController) finish(action string, target string, detail string, err error, redirect string) {
+	if err == nil {
+		this.audit(action, target, detail)
+	}
+	this.redirectWithFlash(strings.TrimSpace(action+" "+target), err, redirect)
+}
+
+// 修改Build之后在后台重新扫描, 扫描之后通知follower(follower读取的是扫描的结果)
+func (this *AdminController) done(action string, target string, detail string, err error, redirect string) {
+	appsRoot := this.appsRoot()
+	backends.ScheduleScan(appsRoot, func() {
+		backends.NotifyFollowers(appsRoot)
+	})
+	this.finish(action, target, detail, err, redirect)
+}
+
+//
+// @Title 所有的Build, 包括隐藏的以及私有组织的Build, 支持和首页相同的搜索参数
+// @Router /admin/
+//
+func (this *AdminController) Index() {
+	query, err := backends.ParseBuildQuery(this.Ctx.Input.Query)
+	if err != nil {
+		this.Ctx.Output.SetStatus(400)
+		this.Ctx.Output.Body([]byte(err.Error()))
+		return
+	}
+	if query.PageSize == 0 {
+		query.PageSize = adminPageSize
+	}
+	iosAppDirs, androidAppDirs, _ := backends.ListAppDir(this.appsRoot())
+	page := backends.SearchBuilds(iosAppDirs, androidAppDirs, query)
+
+	params := this.Ctx.Request.URL.Query()
+	context := pongo2.Context{
+		"query":       query,
+		"page":        page,
+		"from":        params.Get("from"),
+		"to":          params.Get("to"),
+		"scan_errors": len(backends.ListAppDirErrors()),
+	}
+	if page.Page > 1 {
+		context["prev_url"] = pageUrl("/admin/", params, page.Page-1)
+	}
+	if page.Page < page.Pages {
+		context["next_url"] = pageUrl("/admin/", params, page.Page+1)
+	}
+	this.render("admin/index.html", context)
+}
+
+//
+// @Title 编辑Build的名字, 发布说明, 渠道, 置顶, 隐藏以及目录名
+// @Router /admin/builds/:app_id
+//
+func (this *AdminController) Build() {
+	appId := this.Ctx.Input.Param(":app_id")
+	iosApp, androidApp := backends.GetAppDir(this.appsRoot(), appId)
+	info, err := backends.GetBuildInfo(this.appsRoot(), appId)
+	if err != nil {
+		this.Ctx.Output.SetStatus(404)
+		this.Ctx.Output.Body([]byte(err.Error()))
+		return
+	}
+	this.render("admin/build.html", pongo2.Context{
+		"app_id":      appId,
+		"info":        info,
+		"ios_app":     iosApp,
+		"android_app": androidApp,
+	})
+}
+
+//
+// @Title 保存Build的修改, 目录名改变时重命名目录
+// @Router /admin/builds/:app_id [post]
+//
+func (this *AdminController) SaveBuild() {
+	appId := this.Ctx.Input.Param(":app_id")
+	err := backends.UpdateBuildInfo(this.appsRoot(), appId, func(info *backends.BuildInfo) {
+		info.Name = strings.TrimSpace(this.GetString("name"))
+		info.Notes = strings.TrimSpace(this.GetString("notes"))
+		info.Channel = strings.TrimSpace(this.GetString("channel"))
+		info.Uploader = strings.TrimSpace(this.GetString("uploader"))
+		info.Pinned = this.GetString("pinned") != ""
+		info.Hidden = this.GetString("hidden") != ""
+		info.Mandatory = this.GetString("mandatory") != ""
+	})
+	if err != nil {
+		this.done(backends.AuditEdit, appId, "", err, "/admin/builds/"+appId)
+		return
+	}
+
+	newId := strings.TrimSpace(this.GetString("id"))
+	if newId == "" || newId == appId {
+		this.done(backends.AuditEdit, appId, "", nil, "/admin/builds/"+appId)
+		return
+	}
+	this.audit(backends.AuditEdit, appId, "")
+	if err := backends.RenameBuild(this.appsRoot(), appId, newId); err != nil {
+		this.done(backends.AuditRename, appId, "", err, "/admin/builds/"+appId)
+		return
+	}
+	this.done(backends.AuditRename, appId, "to "+newId, nil, "/admin/builds/"+newId)
+}
+
+//
+// @Title 置顶, 隐藏, 切换渠道以及删除到trash
+// @Router /admin/builds/:app_id/:action [post]
+//
+func (this *AdminController) BuildAction() {
+	appId := this.Ctx.Input.Param(":app_id")
+	action := this.Ctx.Input.Param(":action")
+	redirect := this.GetString("next", "/admin/")
+	if !strings.HasPrefix(redirect, "/admin/") {
+		redirect = "/admin/"
+	}
+
+	var err error
+	var detail string
+	switch action {
+	case backends.AuditPin, backends.AuditUnpin:
+		err = backends.UpdateBuildInfo(this.appsRoot(), appId, func(info *backends.BuildInfo) {
+			info.Pinned = action == backends.AuditPin
+		})
+	case backends.AuditHide, backends.AuditUnhide:
+		err = backends.UpdateBuildInfo(this.appsRoot(), appId, func(info *backends.BuildInfo) {
+			info.Hidden = action == backends.AuditHide
+		})
+	case "channel":
+		channel := strings.TrimSpace(this.GetString("channel"))
+		action, detail = backends.AuditEdit, "channel: "+channel
+		err = backends.UpdateBuildInfo(this.appsRoot(), appId, func(info *backends.BuildInfo) {
+			info.Channel = channel
+		})
+	case backends.AuditTrash:
+		detail, err = backends.TrashBuild(this.appsRoot(), appId)
+		if redirect == "/admin/builds/"+appId {
+			redirect = "/admin/"
+		}
+	default:
+		this.Ctx.Output.SetStatus(404)
+		this.Ctx.Output.Body([]byte("unknown action: " + action))
+		return
+	}
+	this.done(action, appId, detail, err, redirect)
+}
+
+//
+// @Title 上传ipa/apk/aab
+// @Router /admin/upload
+//
+func (this *AdminController) Upload() {
+	this.render("admin/upload.html", pongo2.Context{})
+}
+
+//
+// @Title 保存上传的文件, 和import命令相同
+// @Router /admin/upload [post]
+//
+func (this *AdminController) SaveUpload() {
+	appId, err := this.importUpload()
+	if err != nil {
+		this.done(backends.AuditUpload, "", "", err, "/admin/upload")
+		return
+	}
+	this.done(backends.AuditUpload, appId, "", nil, "/admin/builds/"+appId)
+}
+
+func (this *AdminController) importUpload() (string, error) {
+	tmpDir, err := ioutil.TempDir(this.appsRoot(), ".upload-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// 保留上传的文件名, ImportBuild根据后缀区分ipa, apk, aab
+	save := func(key string) (string, error) {
+		src, header, err := this.GetFile(key)
+		if err == http.ErrMissingFile {
+			return "", nil
+		} else if err != nil {
+			return "", fmt.Errorf("read %s failed: %v", key, err)
+		}
+		defer src.Close()
+		name := filepath.Base(header.Filename)
+		if name == "." || name == "/" || strings.HasPrefix(name, ".") {
+			return "", fmt.Errorf("invalid file name: %s", header.Filename)
+		}
+		file := path.Join(tmpDir, key+"-"+name)
+		dst, err := os.Create(file)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(dst, src)
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		return file, err
+	}
+
+	file, err := save("file")
+	if err != nil {
+		return "", err
+	} else if file == "" {
+		return "", fmt.Errorf("no file uploaded")
+	}
+	options := backends.ImportOptions{
+		Id:        strings.TrimSpace(this.GetString("id")),
+		Title:     strings.TrimSpace(this.GetString("title")),
+		Notes:     strings.TrimSpace(this.GetString("notes")),
+		Channel:   strings.TrimSpace(this.GetString("channel")),
+		Uploader:  AdminUser(this.Ctx),
+		Mandatory: this.GetString("mandatory") != "",
+	}
+	if options.Icon, err = save("icon"); err != nil {
+		return "", err
+	}
+	if options.Apk, err = save("apk"); err != nil {
+		return "", err
+	}
+	return backends.ImportBuild(this.appsRoot(), file, options)
+}
+
+//
+// @Title trash中的Build
+// @Router /admin/trash
+//
+func (this *AdminController) Trash() {
+	entries, err := backends.ListTrash(this.appsRoot())
+	if err != nil {
+		this.Ctx.Output.SetStatus(500)
+		this.Ctx.Output.Body([]byte(err.Error()))
+		return
+	}
+	this.render("admin/trash.html", pongo2.Context{"entries": entries})
+}
+
+//
+// @Title 从trash中恢复Build
+// @Router /admin/trash/:trash_id/restore [post]
+//
+func (this *AdminController) Restore() {
+	trashId := this.Ctx.Input.Param(":trash_id")
+	appId, err := backends.RestoreBuild(this.appsRoot(), trashId)
+	if err != nil {
+		this.done(backends.AuditRestore, trashId, "", err, "/admin/trash")
+		return
+	}
+	this.done(backends.AuditRestore, appId, "from "+trashId, nil, "/admin/builds/"+appId)
+}
+
+//
+// @Title 最近一次扫描中解析失败的目录
+// @Router /admin/errors
+//
+func (this *AdminController) Errors() {
+	this.render("admin/errors.html", pongo2.Context{"errors": backends.ListAppDirErrors()})
+}
+
+//
+// @Title 操作记录, 参数: actor, action, target, ip, from, to, limit
+// @Router /admin/audit
+//
+func (this *AdminController) Audit() {
+	query, err := backends.ParseAuditQuery(this.Ctx.Input.Query)
+	if err != nil {
+		this.Ctx.Output.SetStatus(400)
+		this.Ctx.Output.Body([]byte(err.Error()))
+		return
+	}
+	entries, err := backends.QueryAuditLog(this.appsRoot(), query)
+	if err != nil {
+		this.Ctx.Output.SetStatus(500)
+		this.Ctx.Output.Body([]byte(err.Error()))
+		return
+	}
+
+	params := this.Ctx.Request.URL.Query()
+	params.Del("limit")
+	this.render("admin/audit.html", pongo2.Context{
+		"entries":    entries,
+		"query":      query,
+		"actions":    auditActions,
+		"from":       params.Get("from"),
+		"to":         params.Get("to"),
+		"export_url": "/admin/audit/export?" + params.Encode(),
+	})
+}
+
+//
+// @Title 导出满足条件的操作记录, 每行一个json(JSON lines), 参数和/admin/audit相同
+// @Router /admin/audit/export
+//
+func (this *AdminController) ExportAudit() {
+	query, err := backends.ParseAuditQuery(this.Ctx.Input.Query)
+	if err != nil {
+		this.Ctx.Output.SetStatus(400)
+		this.Ctx.Output.Body([]byte(err.Error()))
+		return
+	}
+	this.audit(backends.AuditExport, "audit_log", this.Ctx.Request.URL.RawQuery)
+
+	output := this.Ctx.Output
+	output.Header("Content-Type", "application/x-ndjson; charset=utf-8")
+	output.Header("Content-Disposition", fmt.Sprintf("attachment; filename=audit-%s.jsonl", time.Now().Format("20060102-150405")))
+	if err := backends.ExportAuditLog(this.appsRoot(), query, this.Ctx.ResponseWriter); err != nil {
+		log.WarnErrorf(err, "Export audit log failed")
+	}
+}
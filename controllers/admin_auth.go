@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"net/url"
+	"strings"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego/context"
+)
+
+const adminUserKey = "_admin_user"
+
+// 管理员账号, 在app.conf中配置, 例如: admin_users = alice:password1;bob:password2
+func adminUsers() map[string]string {
+	return parseCredentials(backends.ConfigStrings("admin_users"))
+}
+
+// parseCredentials 解析 user:password 格式的账号
+func parseCredentials(items []string) map[string]string {
+	users := make(map[string]string)
+	for _, item := range items {
+		idx := strings.Index(item, ":")
+		if idx <= 0 {
+			continue
+		}
+		users[strings.TrimSpace(item[:idx])] = strings.TrimSpace(item[idx+1:])
+	}
+	return users
+}
+
+// AdminAuthFilter 使用 HTTP Basic Auth 保护管理相关的接口
+func AdminAuthFilter(ctx *context.Context) {
+	users := adminUsers()
+	if len(users) == 0 {
+		log.Warnf("admin_users is not configured, reject admin request: %s", ctx.Request.URL.Path)
+		ctx.Output.SetStatus(403)
+		ctx.Output.Body([]byte("admin is disabled"))
+		return
+	}
+
+	user, password, ok := ctx.Request.BasicAuth()
+	if !ok || users[user] == "" || users[user] != password {
+		ctx.Output.Header("WWW-Authenticate", `Basic realm="appserver admin"`)
+		ctx.Output.SetStatus(401)
+		ctx.Output.Body([]byte("unauthorized"))
+		return
+	}
+	// 浏览器会自动带上Basic Auth, 修改操作需要来自同一个站点的页面
+	if ctx.Request.Method != "GET" && ctx.Request.Method != "HEAD" && !sameOrigin(ctx) {
+		log.Warnf("Reject cross-site admin request from %s: %s", user, ctx.Request.URL.Path)
+		ctx.Output.SetStatus(403)
+		ctx.Output.Body([]byte("cross-site request"))
+		return
+	}
+	ctx.Input.SetData(adminUserKey, user)
+}
+
+// sameOrigin Origin或者Referer和请求的Host一致
+func sameOrigin(ctx *context.Context) bool {
+	source := ctx.Request.Header.Get("Origin")
+	if source == "" {
+		source = ctx.Request.Header.Get("Referer")
+	}
+	u, err := url.Parse(source)
+	return err == nil && source != "" && u.Host == ctx.Request.Host
+}
+
+// AdminUser 返回通过认证的管理员
+func AdminUser(ctx *context.Context) string {
+	user, _ := ctx.Input.GetData(adminUserKey).(string)
+	return user
+}
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/astaxie/beego"
+	"github.com/oal/beego-pongo2"
+)
+
+// 测试组页面中的一个组
+type testerGroupView struct {
+	Group       *models.TesterGroup
+	Testers     []*models.Tester
+	Invitations []*invitationView
+	// 编辑时每行一个
+	Apps     string
+	Channels string
+}
+
+type invitationView struct {
+	*models.Invitation
+	URL    string
+	Usable bool
+}
+
+// 以换行, ","或者";"分隔的多个值
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == '\n' || r == '\r' || r == ',' || r == ';'
+	}) {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+//
+// @Title 测试组, 测试者以及邀请
+// @Router /admin/testers
+//
+func (this *AdminController) Testers() {
+	data, err := backends.LoadTesterData(this.appsRoot())
+	if err != nil {
+		this.Ctx.Output.SetStatus(500)
+		this.Ctx.Output.Body([]byte(err.Error()))
+		return
+	}
+
+	now := time.Now()
+	groups := make([]*testerGroupView, 0, len(data.Groups))
+	for _, group := range data.Groups {
+		view := &testerGroupView{
+			Group:    group,
+			Testers:  data.GroupTesters(group.Id),
+			Apps:     strings.Join(group.Apps, "\n"),
+			Channels: strings.Join(group.Channels, "\n"),
+		}
+		for _, invitation := range data.GroupInvitations(group.Id) {
+			view.Invitations = append(view.Invitations, &invitationView{
+				Invitation: invitation,
+				URL:        backends.InvitationURL(invitation.Token),
+				Usable:     invitation.Usable(now),
+			})
+		}
+		groups = append(groups, view)
+	}
+	this.render("admin/testers.html", pongo2.Context{
+		"groups":      groups,
+		"expire_days": int(backends.InviteExpiration().Hours() / 24),
+		"smtp":        beego.AppConfig.String("smtp_addr") != "",
+	})
+}
+
+//
+// @Title 新建或者修改测试组; apps为bundle id, channels为渠道, 多个时以换行分隔
+// @Router /admin/testers/groups [post]
+//
+func (this *AdminController) SaveTesterGroup() {
+	group := &models.TesterGroup{
+		Id:       strings.TrimSpace(this.GetString("id")),
+		Name:     strings.TrimSpace(this.GetString("name")),
+		Apps:     splitList(this.GetString("apps")),
+		Channels: splitList(this.GetString("channels")),
+	}
+	err := backends.SaveTesterGroup(this.appsRoot(), group)
+	detail := fmt.Sprintf("apps: %s, channels: %s", strings.Join(group.Apps, ";"), strings.Join(group.Channels, ";"))
+	this.finish(backends.AuditGroup, group.Id, detail, err, "/admin/testers")
+}
+
+//
+// @Title 删除测试组
+// @Router /admin/testers/groups/:group/delete [post]
+//
+func (this *AdminController) DeleteTesterGroup() {
+	groupId := this.Ctx.Input.Param(":group")
+	err := backends.DeleteTesterGroup(this.appsRoot(), groupId)
+	this.finish(backends.AuditDeleteGroup, groupId, "", err, "/admin/testers")
+}
+
+//
+// @Title 邀请加入测试组; emails为空时创建链接邀请, 否则给每个email发送邀请的邮件
+// @Router /admin/testers/groups/:group/invite [post]
+//
+func (this *AdminController) InviteTesters() {
+	groupId := this.Ctx.Input.Param(":group")
+	emails := splitList(this.GetString("emails"))
+	if len(emails) == 0 {
+		invitation, err := backends.CreateInvitation(this.appsRoot(), groupId, "", AdminUser(this.Ctx), time.Now())
+		detail := ""
+		if err == nil {
+			detail = "link, expires " + invitation.ExpiresAt.Format("2006-01-02 15:04")
+		}
+		this.finish(backends.AuditInvite, groupId, detail, err, "/admin/testers")
+		return
+	}
+
+	var errs []string
+	for _, email := range emails {
+		invitation, err := backends.CreateInvitation(this.appsRoot(), groupId, email, AdminUser(this.Ctx), time.Now())
+		if err == nil && beego.AppConfig.String("smtp_addr") != "" {
+			_, group := backends.GetInvitation(this.appsRoot(), invitation.Token)
+			if err = backends.SendInvitation(invitation, group); err != nil {
+				err = fmt.Errorf("send email to %s: %v", email, err)
+			}
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		if invitation != nil {
+			this.audit(backends.AuditInvite, groupId, email+", expires "+invitation.ExpiresAt.Format("2006-01-02 15:04"))
+		}
+	}
+	var err error
+	if len(errs) > 0 {
+		err = fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	// 每个邀请已经分别记录
+	this.redirectWithFlash(backends.AuditInvite+" "+groupId, err, "/admin/testers")
+}
+
+//
+// @Title 撤销邀请
+// @Router /admin/testers/invitations/:token/revoke [post]
+//
+func (this *AdminController) RevokeInvitation() {
+	invitation, err := backends.RevokeInvitation(this.appsRoot(), this.Ctx.Input.Param(":token"))
+	target, detail := "", ""
+	if invitation != nil {
+		target, detail = invitation.Group, invitation.Email
+	}
+	this.finish(backends.AuditRevoke, target, detail, err, "/admin/testers")
+}
+
+//
+// @Title 将测试者移出测试组
+// @Router /admin/testers/groups/:group/remove [post]
+//
+func (this *AdminController) RemoveTester() {
+	groupId := this.Ctx.Input.Param(":group")
+	email := strings.TrimSpace(this.GetString("email"))
+	err := backends.RemoveTester(this.appsRoot(), groupId, email)
+	this.finish(backends.AuditRemoveTester, groupId, email, err, "/admin/testers")
+}
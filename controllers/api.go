@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/astaxie/beego"
+)
+
+type ApiController struct {
+	beego.Controller
+}
+
+// 根据参数org返回对应的组织, 私有组织需要认证; ok为false时已经输出了错误
+func (this *ApiController) requestOrg() (org *models.Organization, ok bool) {
+	orgId := this.GetString("org")
+	if orgId == "" {
+		return nil, true
+	}
+	org = backends.GetOrganization(orgId)
+	if org == nil {
+		this.Ctx.Output.SetStatus(404)
+		this.Data["json"] = map[string]string{"error": "organization not found"}
+		this.ServeJSON()
+		return nil, false
+	}
+	return org, CheckOrgMember(this.Ctx, org)
+}
+
+//
+// @Title 所有的Build, 参数org指定组织, 默认只返回公开的Build;
+// 参数q, platform, channel, uploader, from, to, sort, page, page_size和首页相同, 没有page_size时返回所有的结果
+// @Router /api/builds
+//
+func (this *ApiController) List() {
+	org, ok := this.requestOrg()
+	if !ok {
+		return
+	}
+	query, err := backends.ParseBuildQuery(this.Ctx.Input.Query)
+	if err != nil {
+		this.Ctx.Output.SetStatus(400)
+		this.Data["json"] = map[string]string{"error": err.Error()}
+		this.ServeJSON()
+		return
+	}
+
+	appsRoot := beego.AppConfig.String("apps_root")
+	iosAppDirs, androidAppDirs, err := backends.ListAppDir(appsRoot)
+	if err != nil {
+		this.Ctx.Output.SetStatus(500)
+		this.Data["json"] = map[string]string{"error": err.Error()}
+		this.ServeJSON()
+		return
+	}
+
+	viewer := requestViewer(this.Ctx)
+	iosAppDirs = filterIosAppDirsBy(filterIosAppDirs(iosAppDirs, org), viewer.canView)
+	androidAppDirs = filterAndroidAppDirsBy(filterAndroidAppDirs(androidAppDirs, org), viewer.canView)
+	this.Data["json"] = backends.SearchBuilds(iosAppDirs, androidAppDirs, query)
+	this.ServeJSON()
+}
+
+//
+// @Title 单个Build的元数据
+// @Router /api/builds/:app_id
+//
+func (this *ApiController) Build() {
+	appId := this.Ctx.Input.Param(":app_id")
+	appsRoot := beego.AppConfig.String("apps_root")
+
+	iosApp, androidApp := backends.GetAppDir(appsRoot, appId)
+	var result interface{}
+	switch {
+	case iosApp != nil:
+		result = map[string]interface{}{"platform": "ios", "build": iosApp}
+	case androidApp != nil:
+		result = map[string]interface{}{"platform": "android", "build": androidApp}
+	default:
+		this.Ctx.Output.SetStatus(404)
+		this.Data["json"] = map[string]string{"error": "build not found"}
+		this.ServeJSON()
+		return
+	}
+
+	if !CheckBuildAccess(this.Ctx, appId) {
+		return
+	}
+	this.Data["json"] = result
+	this.ServeJSON()
+}
+
+//
+// @Title Build中文件的校验和, 格式和sha256sum(参数algo=md5时为md5sum)一致, 下载之后可以用 sha256sum -c 校验
+// @Router /api/checksums/:app_id
+//
+func (this *ApiController) Checksums() {
+	appId := this.Ctx.Input.Param(":app_id")
+	appsRoot := beego.AppConfig.String("apps_root")
+	algo := this.GetString("algo", "sha256")
+	if algo != "sha256" && algo != "md5" {
+		this.Ctx.Output.SetStatus(400)
+		this.Data["json"] = map[string]string{"error": "algo should be sha256 or md5"}
+		this.ServeJSON()
+		return
+	}
+
+	iosApp, androidApp := backends.GetAppDir(appsRoot, appId)
+	var checksums map[string]*models.Checksum
+	switch {
+	case iosApp != nil:
+		checksums = iosApp.Checksums
+	case androidApp != nil:
+		checksums = androidApp.Checksums
+	}
+	if len(checksums) == 0 {
+		this.Ctx.Output.SetStatus(404)
+		this.Data["json"] = map[string]string{"error": "checksums not found"}
+		this.ServeJSON()
+		return
+	}
+	if !CheckBuildAccess(this.Ctx, appId) {
+		return
+	}
+
+	files := make([]string, 0, len(checksums))
+	for file := range checksums {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	var buf bytes.Buffer
+	for _, file := range files {
+		sum := checksums[file].SHA256
+		if algo == "md5" {
+			sum = checksums[file].MD5
+		}
+		fmt.Fprintf(&buf, "%s  %s\n", sum, file)
+	}
+	this.Ctx.Output.Header("Content-Type", "text/plain; charset=utf-8")
+	this.Ctx.Output.Body(buf.Bytes())
+}
+
+//
+// @Title 即将过期(包括已经过期)的iOS Build, 参数days默认为expiry_warning_days
+// @Router /api/expiring
+//
+func (this *ApiController) Expiring() {
+	org, ok := this.requestOrg()
+	if !ok {
+		return
+	}
+
+	days, err := this.GetInt("days", backends.ExpiryWarningDays())
+	if err != nil {
+		this.Ctx.Output.SetStatus(400)
+		this.Data["json"] = map[string]string{"error": "invalid days"}
+		this.ServeJSON()
+		return
+	}
+
+	appsRoot := beego.AppConfig.String("apps_root")
+	builds, err := backends.ExpiringBuilds(appsRoot, time.Now(), days)
+	if err != nil {
+		this.Ctx.Output.SetStatus(500)
+		this.Data["json"] = map[string]string{"error": err.Error()}
+		this.ServeJSON()
+		return
+	}
+
+	viewer := requestViewer(this.Ctx)
+	result := make([]*backends.ExpiringBuild, 0, len(builds))
+	for _, build := range builds {
+		if visibleOrg(build.Org, org) && viewer.canView(build.BundleId, build.Channel) {
+			result = append(result, build)
+		}
+	}
+	this.Data["json"] = map[string]interface{}{"days": days, "builds": result}
+	this.ServeJSON()
+}
+
+//
+// @Title App内检查更新, iOS和Android相同; 参数version为当前的版本, build为CFBundleVersion或者versionCode,
+// channel为空时不限渠道, platform为空时根据bundle id以及User-Agent判断
+// @Router /api/apps/:bundle_id/update
+//
+func (this *ApiController) Update() {
+	bundleId := this.Ctx.Input.Param(":bundle_id")
+	check := &backends.UpdateCheck{
+		BundleId:     bundleId,
+		Version:      strings.TrimSpace(this.GetString("version")),
+		Build:        strings.TrimSpace(this.GetString("build")),
+		Channel:      this.GetString("channel"),
+		Platform:     strings.ToLower(this.GetString("platform")),
+		PlatformHint: backends.PlatformFromUserAgent(this.Ctx.Request.Header.Get("User-Agent")),
+	}
+	if check.Version == "" {
+		this.Ctx.Output.SetStatus(400)
+		this.Data["json"] = map[string]string{"error": "version is required"}
+		this.ServeJSON()
+		return
+	}
+	orgId := ""
+	if org := backends.OrganizationOf(bundleId); org != nil {
+		if !CheckOrgMember(this.Ctx, org) {
+			return
+		}
+		orgId = org.Id
+	}
+
+	appsRoot := beego.AppConfig.String("apps_root")
+	iosAppDirs, androidAppDirs, err := backends.ListAppDir(appsRoot)
+	if err != nil {
+		this.Ctx.Output.SetStatus(500)
+		this.Data["json"] = map[string]string{"error": err.Error()}
+		this.ServeJSON()
+		return
+	}
+	// 指定给测试组的Build只有组内的测试者可以更新, App可以通过参数token传入测试者的token
+	viewer := requestViewer(this.Ctx)
+	iosAppDirs, androidAppDirs = filterIosAppDirsBy(iosAppDirs, viewer.canView), filterAndroidAppDirsBy(androidAppDirs, viewer.canView)
+	// 安装链接带上测试者的token以及私有组织的download_token
+	check.DownloadQuery = downloadQuery(this.Ctx, orgId, viewer)
+	info, err := backends.CheckUpdate(iosAppDirs, androidAppDirs, check)
+	if err == backends.ErrNoUpdateBuilds {
+		this.Ctx.Output.SetStatus(404)
+		this.Data["json"] = map[string]string{"error": err.Error()}
+		this.ServeJSON()
+		return
+	} else if err != nil {
+		this.Ctx.Output.SetStatus(400)
+		this.Data["json"] = map[string]string{"error": err.Error()}
+		this.ServeJSON()
+		return
+	}
+	this.Data["json"] = info
+	this.ServeJSON()
+}
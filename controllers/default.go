@@ -3,12 +3,12 @@ package controllers
 import (
 	"github.com/astaxie/beego"
 	"strings"
-	"path"
-	"io/ioutil"
 	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
 	"fmt"
 	"net/url"
+	"strconv"
 	"git.chunyu.me/feiwang/appserver/backends"
+	"git.chunyu.me/feiwang/appserver/models"
 	"github.com/oal/beego-pongo2"
 )
 
@@ -20,50 +20,186 @@ type MainController struct {
 // @Router /
 //
 func (this *MainController) Get() {
-	userAgent := this.Ctx.Request.Header.Get("User-Agent")
+	this.renderIndex(nil, nil, nil)
+}
 
+//
+// @Title 组织的首页, 只显示属于组织的Build
+// @Router /org/:org/
+//
+func (this *MainController) OrgIndex() {
+	org := backends.GetOrganization(this.Ctx.Input.Param(":org"))
+	if org == nil {
+		this.Ctx.Output.SetStatus(404)
+		this.Ctx.Output.Body([]byte("organization not found"))
+		return
+	}
+	if !CheckOrgMember(this.Ctx, org) {
+		return
+	}
+	this.renderIndex(org, nil, nil)
+}
 
-	isAndroid := strings.Index(userAgent, "Android") != -1
-	isIos := strings.Index(userAgent, "iPhone") != -1
+// renderIndex 首页, 组织的首页以及测试者的页面; tester不为空时只显示测试组允许安装的Build
+func (this *MainController) renderIndex(org *models.Organization, tester *models.Tester, groups []*models.TesterGroup) {
+	appsRoot := beego.AppConfig.String("apps_root")
+	iosAppDirs, androidDirs, _ := backends.ListAppDir(appsRoot)
+
+	baseUrl := "/"
+	if org != nil {
+		baseUrl = fmt.Sprintf("/org/%s/", org.Id)
+	} else if tester != nil {
+		baseUrl = "/my/"
+	}
+	iosAppDirs, androidDirs = filterIosAppDirs(iosAppDirs, org), filterAndroidAppDirs(androidDirs, org)
+	// 指定给测试组的Build只显示给组内的测试者; 测试者的页面只显示测试组允许安装的Build
+	viewer := requestViewer(this.Ctx)
+	allow := viewer.canView
+	if tester != nil {
+		allow = func(bundleId string, channel string) bool {
+			return backends.TesterCanInstall(groups, bundleId, channel)
+		}
+	}
+	iosAppDirs, androidDirs = filterIosAppDirsBy(iosAppDirs, allow), filterAndroidAppDirsBy(androidDirs, allow)
 
+	context := this.pageContext()
 	platform := this.GetString("platform", "Android")
+	// 页面上显示的平台, 只需要处理这个平台的Build事件
+	listPlatform := "android"
+	if context["is_ios"] == true || (context["is_web"] == true && platform == "iOs") {
+		listPlatform = "ios"
+	}
 
-	appsRoot := beego.AppConfig.String("apps_root")
-	iosAppDirs, androidDirs, _ := backends.ListAppDir(appsRoot)
+	// 搜索和过滤的条件, 首页只显示一个平台, 默认分页
+	query, err := backends.ParseBuildQuery(this.Ctx.Input.Query)
+	if err != nil {
+		this.Ctx.Output.SetStatus(400)
+		this.Ctx.Output.Body([]byte(err.Error()))
+		return
+	}
+	query.Platform = listPlatform
+	if query.PageSize == 0 {
+		query.PageSize = backends.DefaultPageSize()
+	}
+	page := backends.SearchBuilds(iosAppDirs, androidDirs, query)
+
+	params := this.Ctx.Request.URL.Query()
+	context["platform"] = platform
+	context["list_platform"] = listPlatform
+	context["ios_app_dirs"] = page.Ios
+	context["android_app_dirs"] = page.Android
+	context["query"] = query
+	context["page"] = page
+	context["from"] = params.Get("from")
+	context["to"] = params.Get("to")
+	if page.Page > 1 {
+		context["prev_url"] = pageUrl(baseUrl, params, page.Page-1)
+	}
+	if page.Page < page.Pages {
+		context["next_url"] = pageUrl(baseUrl, params, page.Page+1)
+	}
+	// 只有第一页并且没有过滤时才插入新的Build, 其他情况下只更新和删除; 测试者的页面不插入没有分配的Build
+	context["live_insert"] = page.Page == 1 && !query.Filtered() && query.Sort == backends.SortNewest && tester == nil
+	context["org"] = org
+	context["tester"] = tester
+	orgId := ""
+	if org != nil {
+		orgId = org.Id
+	}
+	context["download_query"] = downloadQuery(this.Ctx, orgId, viewer)
+	if tester != nil {
+		// 在其他设备上打开测试者的页面
+		context["my_url"] = fmt.Sprintf("https://%s/my/?token=%s", beego.AppConfig.String("server_host"), tester.Token)
+	}
+	if tester == nil {
+		context["orgs"] = backends.ListOrganizations()
+	}
+	context["base_url"] = baseUrl
+	// 订阅/api/events时补发渲染之后的事件
+	context["event_seq"] = backends.BuildEventSeq()
+	pongo2.Render(this.Ctx, "index.html", context)
+}
+
+// 保留搜索条件的翻页链接
+func pageUrl(baseUrl string, params url.Values, page int) string {
+	values := url.Values{}
+	for key, value := range params {
+		values[key] = value
+	}
+	values.Set("page", strconv.Itoa(page))
+	return baseUrl + "?" + values.Encode()
+}
+
+// 首页以及单个Build的页面片段共用的参数
+func (this *MainController) pageContext() pongo2.Context {
+	userAgent := this.Ctx.Request.Header.Get("User-Agent")
+
+	isAndroid := strings.Index(userAgent, "Android") != -1
+	isIos := strings.Index(userAgent, "iPhone") != -1
+	// 请求浏览器在下载apk时带上DPR, 用于选择对应density的apk
+	this.Ctx.Output.Header("Accept-CH", "DPR")
 
 	// 参考: https://github.com/oal/beego-pongo2
-	context := pongo2.Context{
-		"platform": platform,
+	return pongo2.Context{
 		"is_android": isAndroid,
 		"is_ios": isIos,
 		"is_web": !isIos && !isAndroid,
-		"ios_app_dirs": iosAppDirs,
-		"android_app_dirs": androidDirs,
+		// 访问者的iOS版本, 用于提示App不支持当前的系统
+		"visitor_os": backends.IosVersionFromUserAgent(userAgent),
 	}
-	pongo2.Render(this.Ctx, "index.html", context)
 }
 
 //
-// @Router /api/icon/:app_id/
+// @Title 单个Build在首页中的html片段, 首页收到/api/events的事件之后插入或者替换; 参数platform为ios或者android
+// @Router /item/:app_id
 //
-func (this*MainController)AppIcon() {
+func (this *MainController) Item() {
 	appId := this.Ctx.Input.Param(":app_id")
 	appsRoot := beego.AppConfig.String("apps_root")
-	appRoot := path.Join(appsRoot, appId)
-	appIcon := path.Join(appRoot, "app.png")
-
-	var bodyBytes []byte
-	var err error
-	bodyBytes, err = ioutil.ReadFile(appIcon)
-	if err != nil {
-		this.Ctx.Output.Status = 404
+	iosAppDirs, androidAppDirs, _ := backends.ListAppDir(appsRoot)
+
+	context := this.pageContext()
+	var orgId, bundleId, channel string
+	if this.GetString("platform") == "ios" {
+		for _, app := range iosAppDirs {
+			if app.Id == appId {
+				context["ios_app"], orgId, bundleId, channel = app, app.Org, app.BundleId, app.Channel
+			}
+		}
+	} else {
+		for _, app := range androidAppDirs {
+			if app.Id == appId {
+				context["android_app"], orgId, bundleId, channel = app, app.Org, app.BundleId, app.Channel
+			}
+		}
+	}
+	if context["ios_app"] == nil && context["android_app"] == nil {
+		this.Ctx.Output.SetStatus(404)
+		this.Ctx.Output.Body([]byte("build not found"))
+		return
+	}
+	if org := backends.GetOrganization(orgId); org != nil && !CheckOrgMember(this.Ctx, org) {
+		return
+	}
+	viewer := requestViewer(this.Ctx)
+	if !viewer.canView(bundleId, channel) {
+		this.Ctx.Output.SetStatus(403)
+		this.Ctx.Output.Body([]byte("forbidden"))
 		return
 	}
+	context["download_query"] = downloadQuery(this.Ctx, orgId, viewer)
+	pongo2.Render(this.Ctx, "app_item.html", context)
+}
 
-	output := this.Ctx.Output
-	output.Header("Content-Type", "image/png")
-	output.Header("Content-Length", fmt.Sprintf("%d", len(bodyBytes)))
-	this.Ctx.ResponseWriter.Write(bodyBytes)
+//
+// @Router /api/icon/:app_id/
+//
+func (this*MainController)AppIcon() {
+	appId := this.Ctx.Input.Param(":app_id")
+	if !CheckBuildAccess(this.Ctx, appId) {
+		return
+	}
+	serveArtifact(this.Ctx, appId, "app.png", "image/png", "")
 }
 
 //
@@ -71,54 +207,67 @@ func (this*MainController)AppIcon() {
 //
 func (this*MainController)AppIpa() {
 	appId := this.Ctx.Input.Param(":app_id")
-	appsRoot := beego.AppConfig.String("apps_root")
-	appRoot := path.Join(appsRoot, appId)
-	appIcon := path.Join(appRoot, "app.ipa")
-
-	var bodyBytes []byte
-	var err error
-	bodyBytes, err = ioutil.ReadFile(appIcon)
-	if err != nil {
-		log.Errorf("Error: %v", err)
-		this.Ctx.Output.Status = 404
+	if !CheckBuildAccess(this.Ctx, appId) {
 		return
 	}
+	backends.DownloadsInFlight.Inc("ipa")
+	defer backends.DownloadsInFlight.Dec("ipa")
 
-	output := this.Ctx.Output
-	output.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(fmt.Sprintf("%s.ipa", appId))))
-	output.Header("Content-Type", "application/octet-stream")
-	output.Header("Content-Transfer-Encoding", "binary")
-	output.Header("Content-Length", fmt.Sprintf("%d", len(bodyBytes)))
-	this.Ctx.ResponseWriter.Write(bodyBytes)
+	serveArtifact(this.Ctx, appId, "app.ipa", "application/octet-stream", fmt.Sprintf("%s.ipa", appId))
 }
 
 //
+// @Title 下载apk, 没有指定文件时根据User-Agent, DPR以及参数abi, density, flavor选择最合适的apk
 // @Router /api/apk/:app_id/
+// @Router /api/apk/:app_id/:file
 //
 func (this*MainController)AndroidApk() {
 	appId := this.Ctx.Input.Param(":app_id")
-	appsRoot := beego.AppConfig.String("apps_root")
-	appRoot := path.Join(appsRoot, appId)
-	appIcon := path.Join(appRoot, "app.apk")
+	file := this.Ctx.Input.Param(":file")
+	if !CheckBuildAccess(this.Ctx, appId) {
+		return
+	}
+	backends.DownloadsInFlight.Inc("apk")
+	defer backends.DownloadsInFlight.Dec("apk")
 
-	var bodyBytes []byte
-	var err error
-	bodyBytes, err = ioutil.ReadFile(appIcon)
-	if err != nil {
-		log.Errorf("Error: %v", err)
+	appsRoot := beego.AppConfig.String("apps_root")
+	if file == "" {
+		file = "app.apk"
+		if _, androidApp := backends.GetAppDir(appsRoot, appId); androidApp != nil {
+			request := this.Ctx.Request
+			hints := backends.ApkHintsFromRequest(request.Header.Get("User-Agent"), request.Header.Get("DPR"))
+			hints.Abi = this.GetString("abi", hints.Abi)
+			hints.Density = this.GetString("density", hints.Density)
+			hints.Flavor = this.GetString("flavor")
+			if artifact := backends.PickApkArtifact(androidApp.Artifacts, hints); artifact != nil {
+				file = artifact.File
+			}
+		}
+		this.Ctx.Output.Header("Vary", "User-Agent, DPR")
+	} else if !backends.IsApkArtifactFile(file) {
 		this.Ctx.Output.Status = 404
 		return
 	}
 
-	output := this.Ctx.Output
-	output.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(fmt.Sprintf("%s.apk", appId))))
-	output.Header("Content-Type", "application/octet-stream")
-	output.Header("Content-Transfer-Encoding", "binary")
-	output.Header("Content-Length", fmt.Sprintf("%d", len(bodyBytes)))
-	this.Ctx.ResponseWriter.Write(bodyBytes)
+	// app.apk => <app_id>.apk, app-arm64-v8a.apk => <app_id>-arm64-v8a.apk
+	serveArtifact(this.Ctx, appId, file, "application/octet-stream", appId + strings.TrimPrefix(file, "app"))
 }
 
 
+//
+// @Title 下载Android App Bundle
+// @Router /api/aab/:app_id/
+//
+func (this*MainController)AndroidAab() {
+	appId := this.Ctx.Input.Param(":app_id")
+	if !CheckBuildAccess(this.Ctx, appId) {
+		return
+	}
+	backends.DownloadsInFlight.Inc("aab")
+	defer backends.DownloadsInFlight.Dec("aab")
+
+	serveArtifact(this.Ctx, appId, "app.aab", "application/octet-stream", fmt.Sprintf("%s.aab", appId))
+}
 
 //
 // @Title 下载App的plist文件
@@ -126,13 +275,10 @@ func (this*MainController)AndroidApk() {
 //
 func (this*MainController)PlistFile() {
 	appId := this.Ctx.Input.Param(":app_id")
-	appsRoot := beego.AppConfig.String("apps_root")
-	appRoot := path.Join(appsRoot, appId)
-	pListFile := path.Join(appRoot, "app.plist")
-
-	var bodyBytes []byte
-	var err error
-	bodyBytes, err = ioutil.ReadFile(pListFile)
+	if !CheckBuildAccess(this.Ctx, appId) {
+		return
+	}
+	bodyBytes, err := readArtifact(appId, "app.plist")
 	if err != nil {
 		log.Errorf("Error: %v", err)
 		this.Ctx.Output.Status = 404
@@ -142,8 +288,16 @@ func (this*MainController)PlistFile() {
 	body := string(bodyBytes)
 
 	appHost := beego.AppConfig.String("server_host")
-	ipaUrl := fmt.Sprintf("<![CDATA[https://%s/api/ipa/%s]]>", appHost, appId);
-	iconUrl := fmt.Sprintf("<![CDATA[https://%s/api/icon/%s]]>", appHost, appId);
+	// 测试者的token以及私有组织的download_token, 系统下载ipa时不会带上cookie和认证信息
+	query := ""
+	iosApp, _ := backends.GetAppDir(beego.AppConfig.String("apps_root"), appId)
+	if iosApp != nil {
+		if q := downloadQuery(this.Ctx, iosApp.Org, requestViewer(this.Ctx)); q != "" {
+			query = "?" + q
+		}
+	}
+	ipaUrl := fmt.Sprintf("<![CDATA[https://%s/api/ipa/%s%s]]>", appHost, appId, query);
+	iconUrl := fmt.Sprintf("<![CDATA[https://%s/api/icon/%s%s]]>", appHost, appId, query);
 	body = strings.Replace(body, "__URL__", ipaUrl, -1)
 
 	index := strings.Index(body, "</array>")
@@ -170,27 +324,10 @@ func (this*MainController)PlistFile() {
 //
 func (this*MainController)MobileProvision4Key() {
 	appId := this.Ctx.Input.Param(":app_id")
-
-	appsRoot := beego.AppConfig.String("apps_root")
-	appRoot := path.Join(appsRoot, appId)
-	provision := path.Join(appRoot, "app.mobileprovision")
-
-	var bodyBytes []byte
-	var err error
-	bodyBytes, err = ioutil.ReadFile(provision)
-	if err != nil {
-		log.Errorf("Error: %v", err)
-		this.Ctx.Output.Status = 404
+	if !CheckBuildAccess(this.Ctx, appId) {
 		return
 	}
-
-	output := this.Ctx.Output
-	output.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(path.Base(provision))))
-	output.Header("Content-Type", "application/octet-stream")
-	output.Header("Content-Transfer-Encoding", "binary")
-	output.Header("Content-Length", fmt.Sprintf("%d", len(bodyBytes)))
-	this.Ctx.ResponseWriter.Write(bodyBytes)
-
+	serveArtifact(this.Ctx, appId, "app.mobileprovision", "application/octet-stream", "app.mobileprovision")
 }
 
 
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/astaxie/beego"
+)
+
+// 没有事件时定期发送注释, 防止代理因为空闲断开连接
+const eventsKeepAlive = 30 * time.Second
+
+type EventsController struct {
+	beego.Controller
+}
+
+//
+// @Title Build的变化(added, removed, updated), Server-Sent Events; 参数org指定组织, 默认只推送公开的Build;
+// 指定给测试组的Build只推送给组内的测试者(cookie或者参数token)以及管理员
+// @Router /api/events
+//
+func (this *EventsController) Get() {
+	var org *models.Organization
+	if orgId := this.GetString("org"); orgId != "" {
+		org = backends.GetOrganization(orgId)
+		if org == nil {
+			this.Ctx.Output.SetStatus(404)
+			this.Ctx.Output.Body([]byte("organization not found"))
+			return
+		}
+		if !CheckOrgMember(this.Ctx, org) {
+			return
+		}
+	}
+
+	// 重连时浏览器带上Last-Event-ID, 首次连接时使用页面渲染时的序号
+	lastSeq, _ := strconv.ParseInt(this.Ctx.Input.Header("Last-Event-ID"), 10, 64)
+	if lastSeq == 0 {
+		lastSeq, _ = this.GetInt64("last_event_id", 0)
+	}
+	sub, missed, ok := backends.SubscribeBuildEvents(lastSeq)
+	defer sub.Close()
+
+	w := this.Ctx.ResponseWriter
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx默认会缓存响应
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+
+	fmt.Fprintf(w, "retry: 3000\n\n")
+	if !ok {
+		fmt.Fprintf(w, "event: reload\ndata: {}\n\n")
+	}
+	for _, e := range missed {
+		writeBuildEvent(w, e, org, requestViewer(this.Ctx))
+	}
+	w.Flush()
+
+	closed := w.CloseNotify()
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, open := <-sub.Events:
+			if !open {
+				// 落后太多被断开, 客户端重连之后补发
+				return
+			}
+			// 每个事件重新判断, 连接期间测试组可能被修改
+			writeBuildEvent(w, e, org, requestViewer(this.Ctx))
+		case <-ticker.C:
+			fmt.Fprintf(w, ": keep-alive\n\n")
+		case <-closed:
+			return
+		}
+		w.Flush()
+	}
+}
+
+// 其他组织以及指定给其他测试组的事件不推送, 客户端重连时重复收到的事件不影响结果
+func writeBuildEvent(w io.Writer, e *backends.BuildEvent, org *models.Organization, viewer *buildViewer) {
+	if !visibleOrg(e.Org, org) || !viewer.canView(e.BundleId, e.Channel) {
+		return
+	}
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+}
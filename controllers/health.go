@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+	"github.com/astaxie/beego"
+)
+
+type HealthController struct {
+	beego.Controller
+}
+
+//
+// @Title 进程存活
+// @Router /healthz
+//
+func (this *HealthController) Healthz() {
+	this.Ctx.Output.Body([]byte("ok"))
+}
+
+//
+// @Title 是否可以接收流量: 初次扫描完成, apps_root可读写等
+// @Router /readyz
+//
+func (this *HealthController) Readyz() {
+	checks, ready := backends.CheckReady()
+	if !ready {
+		this.Ctx.Output.SetStatus(503)
+	}
+	this.Data["json"] = map[string]interface{}{
+		"ready":  ready,
+		"checks": checks,
+	}
+	this.ServeJSON()
+}
+
+//
+// @Title 诊断信息, 仅管理员可见
+// @Router /debug/status
+//
+func (this *HealthController) DebugStatus() {
+	appsRoot := beego.AppConfig.String("apps_root")
+	scan := backends.GetScanStatus()
+
+	status := map[string]interface{}{
+		"version":      backends.Version,
+		"start_time":   backends.StartTime.Format(time.RFC3339),
+		"uptime":       time.Since(backends.StartTime).String(),
+		"apps_root":    appsRoot,
+		"watched_dirs": backends.WatchedDirCount(),
+		"scan": map[string]interface{}{
+			"scanned":        scan.Scanned,
+			"last_scan_time": scan.LastScanTime.Format(time.RFC3339),
+			"last_duration":  scan.LastDuration.String(),
+			"last_error":     scan.LastError,
+			"scan_count":     scan.ScanCount,
+			"error_count":    scan.ErrorCount,
+		},
+		"broken_builds": backends.ListAppDirErrors(),
+	}
+
+	if replicator := backends.GetReplicator(); replicator != nil {
+		replication := replicator.Status()
+		status["replication"] = map[string]interface{}{
+			"leader":               replication.Leader,
+			"lag":                  replication.Lag(time.Now()).String(),
+			"lag_seconds":          int64(replication.Lag(time.Now()).Seconds()),
+			"last_poll_time":       formatTime(replication.LastPollTime),
+			"last_sync_time":       formatTime(replication.LastSyncTime),
+			"last_error":           replication.LastError,
+			"consecutive_failures": replication.ConsecutiveFailures,
+			"pending":              replication.Pending,
+			"replicated":           replication.Replicated,
+			"deleted":              replication.Deleted,
+		}
+	}
+
+	if free, err := backends.DiskFree(appsRoot); err != nil {
+		status["disk_free_error"] = err.Error()
+	} else {
+		status["disk_free_bytes"] = free
+	}
+
+	this.Data["json"] = status
+	this.ServeJSON()
+}
+
+// formatTime 零值时为空字符串
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+	"github.com/astaxie/beego"
+)
+
+type MetricsController struct {
+	beego.Controller
+}
+
+//
+// @Router /metrics
+//
+func (this *MetricsController) Get() {
+	var buf bytes.Buffer
+	backends.WriteMetrics(&buf)
+
+	output := this.Ctx.Output
+	output.Header("Content-Type", backends.MetricsContentType)
+	output.Header("Content-Length", fmt.Sprintf("%d", buf.Len()))
+	this.Ctx.ResponseWriter.Write(buf.Bytes())
+}
+
+var (
+	routePatternsLock sync.RWMutex
+	routePatterns     [][]string
+)
+
+// RegisterRoutePattern 记录路由的pattern, 统计指标时将 /api/ipa/xxx/ 归类到 /api/ipa/:app_id/
+func RegisterRoutePattern(pattern string) {
+	routePatternsLock.Lock()
+	routePatterns = append(routePatterns, splitPath(pattern))
+	routePatternsLock.Unlock()
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
+
+func routeLabel(urlPath string) string {
+	segments := splitPath(urlPath)
+
+	routePatternsLock.RLock()
+	defer routePatternsLock.RUnlock()
+
+	for _, pattern := range routePatterns {
+		if len(pattern) != len(segments) {
+			continue
+		}
+		matched := true
+		for i, s := range pattern {
+			if !strings.HasPrefix(s, ":") && s != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return "/" + strings.Join(pattern, "/")
+		}
+	}
+	return "other"
+}
+
+// 统计写出的字节数以及状态码
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+	status  int
+}
+
+func (w *countingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *countingResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("webserver doesn't support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// MetricsHandler 统计所有请求的请求数, 耗时以及字节数;
+// beego在404, 405, 静态文件以及BeforeRouter的filter输出(例如管理后台的401)时会跳过FinishRouter的filter, 因此在Handler外面统计
+func MetricsHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		w := &countingResponseWriter{ResponseWriter: rw}
+		defer func() {
+			err := recover()
+			code := w.status
+			if err != nil {
+				code = http.StatusInternalServerError
+			} else if code == 0 {
+				code = http.StatusOK
+			}
+			route := routeLabel(r.URL.Path)
+			backends.HttpRequestsTotal.Inc(route, r.Method, fmt.Sprintf("%d", code))
+			backends.HttpRequestDuration.Observe(time.Since(start).Seconds(), route)
+			backends.HttpResponseBytes.Add(float64(w.written), route)
+			if err != nil {
+				panic(err)
+			}
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"net/url"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+	"git.chunyu.me/feiwang/appserver/models"
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/context"
+)
+
+type OrgController struct {
+	beego.Controller
+}
+
+// CheckOrgMember 私有组织只有成员和管理员可以访问, 否则返回401
+func CheckOrgMember(ctx *context.Context, org *models.Organization) bool {
+	if !org.Private() {
+		return true
+	}
+
+	if authenticatedUser(ctx, org) != "" {
+		return true
+	}
+
+	ctx.Output.Header("WWW-Authenticate", `Basic realm="`+org.Id+`"`)
+	ctx.Output.SetStatus(401)
+	ctx.Output.Body([]byte("unauthorized"))
+	return false
+}
+
+// CheckBuildAccess 下载Build中的文件之前检查Build所属的组织以及测试组, 私有组织只有成员和管理员(或者带上download_token)可以下载,
+// 指定给测试组的Build只有组内的测试者和管理员可以下载; 索引中没有的Build返回404, 返回false时已经输出了错误
+func CheckBuildAccess(ctx *context.Context, appId string) bool {
+	iosApp, androidApp := backends.GetAppDir(beego.AppConfig.String("apps_root"), appId)
+	var orgId, bundleId, channel string
+	switch {
+	case iosApp != nil:
+		orgId, bundleId, channel = iosApp.Org, iosApp.BundleId, iosApp.Channel
+	case androidApp != nil:
+		orgId, bundleId, channel = androidApp.Org, androidApp.BundleId, androidApp.Channel
+	default:
+		ctx.Output.SetStatus(404)
+		ctx.Output.Body([]byte("build not found"))
+		return false
+	}
+	if org := backends.GetOrganization(orgId); org != nil && downloadTokenUser(ctx, org) == "" && !CheckOrgMember(ctx, org) {
+		return false
+	}
+	return checkBuildViewer(ctx, bundleId, channel)
+}
+
+// downloadTokenUser 链接中的download_token对应的组织成员或者管理员, 签发之后被移出组织的用户不再有效
+func downloadTokenUser(ctx *context.Context, org *models.Organization) string {
+	token := ctx.Input.Query("download_token")
+	if token == "" || !org.Private() {
+		return ""
+	}
+	user, ok := backends.VerifyDownloadToken(beego.AppConfig.String("apps_root"), org.Id, token, time.Now())
+	if !ok {
+		return ""
+	}
+	if _, member := parseCredentials(org.Members)[user]; member {
+		return user
+	}
+	if _, admin := adminUsers()[user]; admin {
+		return user
+	}
+	return ""
+}
+
+// downloadQuery 安装链接(plist, ipa, icon)中带上的参数, iOS系统下载时不会带上cookie以及Basic Auth:
+// 测试者的token, 以及私有组织的成员签名的download_token
+func downloadQuery(ctx *context.Context, orgId string, viewer *buildViewer) string {
+	values := url.Values{}
+	if token := viewer.token(); token != "" {
+		values.Set("token", token)
+	}
+	if org := backends.GetOrganization(orgId); org != nil && org.Private() {
+		user := authenticatedUser(ctx, org)
+		if user == "" {
+			user = downloadTokenUser(ctx, org)
+		}
+		if user != "" {
+			token, err := backends.SignDownloadToken(beego.AppConfig.String("apps_root"), org.Id, user, time.Now())
+			if err != nil {
+				log.WarnErrorf(err, "Sign download token failed")
+			} else {
+				values.Set("download_token", token)
+			}
+		}
+	}
+	return values.Encode()
+}
+
+// authenticatedUser 通过Basic Auth认证的组织成员或者管理员, 没有认证时返回空; org为nil时只认证管理员
+func authenticatedUser(ctx *context.Context, org *models.Organization) string {
+	user, password, ok := ctx.Request.BasicAuth()
+	if !ok || password == "" {
+		return ""
+	}
+	if org != nil {
+		if members := parseCredentials(org.Members); members[user] == password {
+			return user
+		}
+	}
+	if admins := adminUsers(); admins[user] == password {
+		return user
+	}
+	return ""
+}
+
+// 首页只显示公开的Build
+func visibleOrg(orgId string, org *models.Organization) bool {
+	if org != nil {
+		return orgId == org.Id
+	}
+	if orgId == "" {
+		return true
+	}
+	o := backends.GetOrganization(orgId)
+	return o == nil || !o.Private()
+}
+
+func filterIosAppDirs(appDirs []*models.IosAppDirMeta, org *models.Organization) []*models.IosAppDirMeta {
+	result := make([]*models.IosAppDirMeta, 0, len(appDirs))
+	for _, app := range appDirs {
+		if !app.Hidden && visibleOrg(app.Org, org) {
+			result = append(result, app)
+		}
+	}
+	return result
+}
+
+func filterAndroidAppDirs(appDirs []*models.AndroidAppDirMeta, org *models.Organization) []*models.AndroidAppDirMeta {
+	result := make([]*models.AndroidAppDirMeta, 0, len(appDirs))
+	for _, app := range appDirs {
+		if !app.Hidden && visibleOrg(app.Org, org) {
+			result = append(result, app)
+		}
+	}
+	return result
+}
+
+//
+// @Title 所有的组织, 私有组织不返回App列表
+// @Router /api/orgs
+//
+func (this *OrgController) Get() {
+	appsRoot := beego.AppConfig.String("apps_root")
+	iosAppDirs, androidAppDirs, _ := backends.ListAppDir(appsRoot)
+
+	apps := make(map[string][]string)
+	seen := make(map[string]bool)
+	addApp := func(orgId string, bundleId string) {
+		if orgId == "" || bundleId == "" || seen[orgId+"/"+bundleId] {
+			return
+		}
+		seen[orgId+"/"+bundleId] = true
+		apps[orgId] = append(apps[orgId], bundleId)
+	}
+	for _, app := range iosAppDirs {
+		addApp(app.Org, app.BundleId)
+	}
+	for _, app := range androidAppDirs {
+		addApp(app.Org, app.BundleId)
+	}
+
+	orgs := make([]map[string]interface{}, 0)
+	for _, org := range backends.ListOrganizations() {
+		item := map[string]interface{}{
+			"id":       org.Id,
+			"name":     org.Name,
+			"branding": org.Branding,
+			"private":  org.Private(),
+			"url":      "/org/" + org.Id + "/",
+		}
+		if !org.Private() {
+			item["apps"] = apps[org.Id]
+		}
+		orgs = append(orgs, item)
+	}
+
+	this.Data["json"] = orgs
+	this.ServeJSON()
+}
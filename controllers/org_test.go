@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+	"git.chunyu.me/feiwang/appserver/models"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/context"
+	"github.com/stretchr/testify/assert"
+)
+
+const testInfoPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+  <key>CFBundleIdentifier</key><string>%s</string>
+  <key>CFBundleName</key><string>Demo</string>
+  <key>CFBundleShortVersionString</key><string>%s</string>
+</dict></plist>`
+
+// writeTestIosBuild 只有Info.plist的ipa, app.plist以及图标, 返回ipa的内容
+func writeTestIosBuild(t *testing.T, appsRoot string, appId string, bundleId string, version string) []byte {
+	appDir := path.Join(appsRoot, appId)
+	os.MkdirAll(appDir, 0755)
+	f, err := os.Create(path.Join(appDir, "app.ipa"))
+	assert.NoError(t, err)
+	w := zip.NewWriter(f)
+	entry, err := w.Create("Payload/Demo.app/Info.plist")
+	assert.NoError(t, err)
+	fmt.Fprintf(entry, testInfoPlist, bundleId, version)
+	assert.NoError(t, w.Close())
+	f.Close()
+	ioutil.WriteFile(path.Join(appDir, "app.plist"), []byte(backends.GenerateManifest(bundleId, version, "Demo")), 0644)
+	ioutil.WriteFile(path.Join(appDir, "app.png"), []byte("png"), 0644)
+	ipa, _ := ioutil.ReadFile(path.Join(appDir, "app.ipa"))
+	return ipa
+}
+
+func serveTestRequest(handler http.Handler, url string, user string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", url, nil)
+	if user != "" {
+		r.SetBasicAuth(user, "pw")
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/controllers -v -run "TestPrivateOrgInstall"
+//
+func TestPrivateOrgInstall(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+	beego.AppConfig.Set("apps_root", appsRoot)
+	beego.AppConfig.Set("server_host", "apps.example.com")
+	defer beego.AppConfig.Set("apps_root", "")
+
+	org := &models.Organization{Id: "partner", BundleIds: []string{"com.partner."}, Members: []string{"bob:pw", "carol:pw"}}
+	assert.NoError(t, backends.SetOrganizations(nil, []*models.Organization{org}))
+	defer backends.SetOrganizations(nil, nil)
+	ipa := writeTestIosBuild(t, appsRoot, "partner_1", "com.partner.Demo", "1.0")
+	assert.NoError(t, backends.ScanAppRootDir(appsRoot))
+
+	handler := beego.NewControllerRegister()
+	handler.Add("/api/plist/:app_id/", &MainController{}, "get:PlistFile")
+	handler.Add("/api/ipa/:app_id/", &MainController{}, "get,head:AppIpa")
+	handler.Add("/api/icon/:app_id/", &MainController{}, "get,head:AppIcon")
+
+	// 没有认证信息时不能下载
+	assert.Equal(t, 401, serveTestRequest(handler, "/api/plist/partner_1/", "").Code)
+	assert.Equal(t, 401, serveTestRequest(handler, "/api/ipa/partner_1/", "").Code)
+
+	// 页面上的安装链接带上组织成员的download_token
+	r, _ := http.NewRequest("GET", "/org/partner/", nil)
+	r.SetBasicAuth("bob", "pw")
+	ctx := context.NewContext()
+	ctx.Reset(httptest.NewRecorder(), r)
+	query := downloadQuery(ctx, "partner", requestViewer(ctx))
+	assert.True(t, strings.HasPrefix(query, "download_token="), query)
+
+	// 系统下载plist以及其中的ipa和图标时都没有Basic Auth
+	w := serveTestRequest(handler, "/api/plist/partner_1/?"+query, "")
+	assert.Equal(t, 200, w.Code)
+	urls := regexp.MustCompile(`https://apps\.example\.com(/api/[a-z]+/partner_1\?download_token=[0-9a-f.]+)`).FindAllStringSubmatch(w.Body.String(), -1)
+	if assert.Len(t, urls, 2) {
+		w = serveTestRequest(handler, urls[0][1], "")
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, ipa, w.Body.Bytes())
+		w = serveTestRequest(handler, urls[1][1], "")
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "png", w.Body.String())
+	}
+
+	// 修改过的token, 其他组织的token, 被移出组织的成员的token都无效
+	assert.Equal(t, 401, serveTestRequest(handler, "/api/ipa/partner_1/?"+query+"0", "").Code)
+	token, _ := backends.SignDownloadToken(appsRoot, "chunyu", "bob", time.Now())
+	assert.Equal(t, 401, serveTestRequest(handler, "/api/ipa/partner_1/?download_token="+token, "").Code)
+	org.Members = []string{"carol:pw"}
+	assert.Equal(t, 401, serveTestRequest(handler, "/api/ipa/partner_1/?"+query, "").Code)
+}
+
+//
+// go test git.chunyu.me/feiwang/appserver/controllers -v -run "TestUpdateRestrictedBuild"
+//
+func TestUpdateRestrictedBuild(t *testing.T) {
+	appsRoot, _ := ioutil.TempDir("", "apps_root")
+	defer os.RemoveAll(appsRoot)
+	beego.AppConfig.Set("apps_root", appsRoot)
+	beego.AppConfig.Set("server_host", "apps.example.com")
+	defer beego.AppConfig.Set("apps_root", "")
+
+	ipa := writeTestIosBuild(t, appsRoot, "rich_2", "com.chunyu.Rich", "2.0")
+	assert.NoError(t, backends.ScanAppRootDir(appsRoot))
+	ioutil.WriteFile(backends.TestersFile(appsRoot), []byte(`{
+  "groups": [{"id": "vip", "apps": ["com.chunyu.Rich"]}],
+  "testers": [{"email": "carol@chunyu.me", "token": "carol-token", "groups": ["vip"]}]
+}`), 0600)
+
+	handler := beego.NewControllerRegister()
+	handler.Add("/api/apps/:bundle_id/update", &ApiController{}, "get:Update")
+	handler.Add("/api/plist/:app_id/", &MainController{}, "get:PlistFile")
+	handler.Add("/api/ipa/:app_id/", &MainController{}, "get,head:AppIpa")
+
+	// 不是测试者时看不到指定给测试组的Build
+	assert.Equal(t, 404, serveTestRequest(handler, "/api/apps/com.chunyu.Rich/update?version=1.0", "").Code)
+
+	// 测试者得到的安装链接带上token, 系统下载plist和ipa时不会带上cookie
+	w := serveTestRequest(handler, "/api/apps/com.chunyu.Rich/update?version=1.0&token=carol-token", "")
+	assert.Equal(t, 200, w.Code)
+	var info backends.UpdateInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.True(t, info.UpdateAvailable)
+	installURL, err := url.Parse(info.InstallURL)
+	assert.NoError(t, err)
+	plist, err := url.Parse(installURL.Query().Get("url"))
+	assert.NoError(t, err)
+	assert.Equal(t, "token=carol-token", plist.RawQuery)
+
+	w = serveTestRequest(handler, plist.RequestURI(), "")
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "https://apps.example.com/api/ipa/rich_2?token=carol-token")
+	w = serveTestRequest(handler, "/api/ipa/rich_2?token=carol-token", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, ipa, w.Body.Bytes())
+	assert.Equal(t, 403, serveTestRequest(handler, "/api/ipa/rich_2", "").Code)
+}
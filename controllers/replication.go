@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+	"github.com/astaxie/beego"
+)
+
+// ReplicationController 两个实例之间复制Build的接口, 使用replication_token认证
+type ReplicationController struct {
+	beego.Controller
+}
+
+// checkToken token不一致时输出错误, 没有配置replication_token时不提供复制的接口
+func (this *ReplicationController) checkToken() bool {
+	token := backends.ReplicationToken()
+	if token == "" {
+		this.Ctx.Output.SetStatus(403)
+		this.Ctx.Output.Body([]byte("replication is disabled"))
+		return false
+	}
+	given := this.Ctx.Input.Header(backends.ReplicationTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		this.Ctx.Output.SetStatus(401)
+		this.Ctx.Output.Body([]byte("unauthorized"))
+		return false
+	}
+	return true
+}
+
+//
+// @Title 所有可以复制的Build以及文件的校验和
+// @Router /api/replication/builds
+//
+func (this *ReplicationController) Builds() {
+	if !this.checkToken() {
+		return
+	}
+	builds, err := backends.ReplicationManifest(beego.AppConfig.String("apps_root"))
+	if err != nil {
+		this.Ctx.Output.SetStatus(500)
+		this.Data["json"] = map[string]string{"error": err.Error()}
+	} else {
+		this.Data["json"] = builds
+	}
+	this.ServeJSON()
+}
+
+//
+// @Title 下载Build中的文件
+// @Router /api/replication/files/:app_id/:file
+//
+func (this *ReplicationController) File() {
+	if !this.checkToken() {
+		return
+	}
+	appId := this.Ctx.Input.Param(":app_id")
+	file := this.Ctx.Input.Param(":file")
+	if appId == "" || file == "" || strings.HasPrefix(appId, ".") || strings.HasPrefix(file, ".") ||
+		strings.ContainsAny(appId+file, `/\`) {
+		this.Ctx.Output.SetStatus(404)
+		return
+	}
+	this.Ctx.Input.SetData(downloadActorKey, backends.AuditActorReplication)
+	serveArtifact(this.Ctx, appId, file, "application/octet-stream", "")
+}
+
+//
+// @Title leader通知follower有新的Build
+// @Router /api/replication/notify
+//
+func (this *ReplicationController) Notify() {
+	if !this.checkToken() {
+		return
+	}
+	replicator := backends.GetReplicator()
+	if replicator == nil {
+		this.Ctx.Output.SetStatus(404)
+		this.Ctx.Output.Body([]byte("replication_leader is not configured"))
+		return
+	}
+	replicator.Trigger()
+	this.Ctx.Output.SetStatus(202)
+	this.Ctx.Output.Body([]byte("ok"))
+}
@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+	"git.chunyu.me/feiwang/appserver/models"
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/context"
+)
+
+// parseRange 解析单个的Range, 例如: bytes=0-99, bytes=100-, bytes=-100
+// 没有Range或者有多个Range时返回full为true, 返回ok为false时表示Range无效(416)
+func parseRange(header string, size int64) (offset int64, length int64, full bool, ok bool) {
+	if header == "" || !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, size, true, true
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	idx := strings.Index(spec, "-")
+	if idx < 0 {
+		return 0, 0, false, false
+	}
+	start, end := strings.TrimSpace(spec[:idx]), strings.TrimSpace(spec[idx+1:])
+	if start == "" {
+		// 最后的n个字节
+		n, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, false, size > 0
+	}
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || offset < 0 || offset >= size {
+		return 0, 0, false, false
+	}
+	last := size - 1
+	if end != "" {
+		if last, err = strconv.ParseInt(end, 10, 64); err != nil || last < offset {
+			return 0, 0, false, false
+		}
+		if last >= size {
+			last = size - 1
+		}
+	}
+	return offset, last - offset + 1, false, true
+}
+
+// serveArtifact 从存储中下载App目录中的文件, 支持Range请求(断点续传)
+// 扫描时已经计算了校验和的文件返回Digest以及Content-MD5, 客户端可以校验下载的文件
+// 配置了storage_redirect并且存储支持时, 重定向到预签名的地址
+// filename为空时不作为附件下载
+func serveArtifact(ctx *context.Context, appId string, file string, contentType string, filename string) {
+	storage := backends.GetStorage()
+	appsRoot := beego.AppConfig.String("apps_root")
+	key := backends.ResolveArtifactKey(appsRoot, appId, file)
+
+	if beego.AppConfig.DefaultBool("storage_redirect", false) {
+		expires := time.Duration(beego.AppConfig.DefaultInt("storage_presign_expires", 3600)) * time.Second
+		if _, err := storage.Stat(key); err != nil {
+			serveArtifactError(ctx, key, err)
+			return
+		}
+		presigned, err := storage.PresignedURL(key, expires)
+		if err == nil {
+			recordDownload(ctx, appId, file)
+			ctx.Redirect(http.StatusFound, presigned)
+			return
+		}
+		if err != backends.ErrPresignNotSupported {
+			log.WarnErrorf(err, "Presign %s failed", key)
+		}
+	}
+
+	info, err := storage.Stat(key)
+	if err != nil {
+		serveArtifactError(ctx, key, err)
+		return
+	}
+	offset, length, full, ok := parseRange(ctx.Request.Header.Get("Range"), info.Size)
+
+	output := ctx.Output
+	if filename != "" {
+		output.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", url.QueryEscape(filename)))
+		output.Header("Content-Transfer-Encoding", "binary")
+	}
+	output.Header("Content-Type", contentType)
+	output.Header("Accept-Ranges", "bytes")
+	if !info.ModTime.IsZero() {
+		output.Header("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if info.ETag != "" {
+		output.Header("ETag", `"`+info.ETag+`"`)
+	}
+	// Digest是整个文件的校验和; Content-MD5是body的校验和, 只用于完整的文件
+	checksum := backends.ArtifactChecksum(appsRoot, appId, file)
+	if checksum != nil && checksum.Size == info.Size {
+		output.Header("Digest", backends.DigestHeader(checksum))
+		if full {
+			output.Header("Content-MD5", backends.ContentMD5Header(checksum))
+		}
+	}
+	if !ok {
+		output.Header("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		output.SetStatus(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	body, err := storage.GetRange(key, offset, length)
+	if err != nil {
+		serveArtifactError(ctx, key, err)
+		return
+	}
+	defer body.Close()
+
+	output.Header("Content-Length", strconv.FormatInt(length, 10))
+	if !full {
+		output.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size))
+		// 直接写入body, 需要立即发送状态码
+		ctx.ResponseWriter.WriteHeader(http.StatusPartialContent)
+	}
+	if ctx.Request.Method == "HEAD" {
+		return
+	}
+	recordDownload(ctx, appId, file)
+	if _, err := io.Copy(ctx.ResponseWriter, body); err != nil {
+		log.Warnf("Download %s interrupted: %v", key, err)
+	}
+}
+
+func serveArtifactError(ctx *context.Context, key string, err error) {
+	if os.IsNotExist(err) {
+		ctx.Output.SetStatus(http.StatusNotFound)
+		return
+	}
+	log.ErrorErrorf(err, "Read %s failed", key)
+	ctx.Output.SetStatus(http.StatusInternalServerError)
+}
+
+// 下载者的标识, 例如: 复制接口设置为replication
+const downloadActorKey = "_download_actor"
+
+// recordDownload 在操作记录中记录ipa, apk, aab的下载, 下载者为Basic Auth(或者download_token)的用户或者测试者的email;
+// 断点续传时只记录从头开始的请求, 预签名的重定向记录为一次下载
+func recordDownload(ctx *context.Context, appId string, file string) {
+	if ctx.Request.Method != "GET" {
+		return
+	}
+	if header := ctx.Request.Header.Get("Range"); header != "" && !strings.HasPrefix(header, "bytes=0-") {
+		return
+	}
+	switch path.Ext(file) {
+	case ".ipa", ".apk", ".aab":
+	default:
+		return
+	}
+
+	appsRoot := beego.AppConfig.String("apps_root")
+	actor, _ := ctx.Input.GetData(downloadActorKey).(string)
+	if actor == "" {
+		var org *models.Organization
+		iosApp, androidApp := backends.GetAppDir(appsRoot, appId)
+		if iosApp != nil {
+			org = backends.GetOrganization(iosApp.Org)
+		} else if androidApp != nil {
+			org = backends.GetOrganization(androidApp.Org)
+		}
+		actor = authenticatedUser(ctx, org)
+		if actor == "" && org != nil {
+			actor = downloadTokenUser(ctx, org)
+		}
+	}
+	if actor == "" {
+		// 测试者通过cookie或者链接中的token下载
+		if tester, _ := backends.FindTester(appsRoot, testerToken(ctx)); tester != nil {
+			actor = tester.Email
+		}
+	}
+	backends.RecordAudit(appsRoot, &backends.AuditEntry{
+		Actor:  actor,
+		Action: backends.AuditDownload,
+		Target: appId,
+		IP:     ctx.Input.IP(),
+		Detail: file,
+	})
+}
+
+// readArtifact 读取App目录中较小的文件, 例如: app.plist
+func readArtifact(appId string, file string) ([]byte, error) {
+	r, err := backends.GetStorage().Get(backends.ResolveArtifactKey(beego.AppConfig.String("apps_root"), appId, file))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"strings"
+	"time"
+
+	"git.chunyu.me/feiwang/appserver/backends"
+	"git.chunyu.me/feiwang/appserver/models"
+	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/context"
+	"github.com/oal/beego-pongo2"
+)
+
+// 保存测试者token的cookie
+const testerCookie = "tester"
+
+// cookie的有效期, 一年
+const testerCookieMaxAge = 365 * 24 * 3600
+
+type TesterController struct {
+	beego.Controller
+}
+
+// buildViewer 访问Build的人; 指定给测试组的Build只有组内的测试者以及管理员可以看到和下载
+type buildViewer struct {
+	// 所有的测试组
+	groups []*models.TesterGroup
+	// 测试者以及所在的测试组, 不是测试者时为nil
+	tester       *models.Tester
+	testerGroups []*models.TesterGroup
+	admin        bool
+	// testers_file读取失败, 无法判断Build是否指定给了测试组, 除了管理员都不能访问
+	unavailable bool
+}
+
+// testerToken 优先使用参数token; 安装iOS App时系统下载plist和ipa不会带上cookie, 只能通过链接中的token识别
+func testerToken(ctx *context.Context) string {
+	if token := ctx.Input.Query("token"); token != "" {
+		return token
+	}
+	return ctx.GetCookie(testerCookie)
+}
+
+func requestViewer(ctx *context.Context) *buildViewer {
+	appsRoot := beego.AppConfig.String("apps_root")
+	viewer := &buildViewer{admin: authenticatedUser(ctx, nil) != ""}
+	data, err := backends.CachedTesterData(appsRoot)
+	if err != nil {
+		log.WarnErrorf(err, "Load tester data failed")
+		viewer.unavailable = true
+		return viewer
+	}
+	viewer.groups = data.Groups
+	viewer.tester, viewer.testerGroups = data.FindTester(testerToken(ctx))
+	return viewer
+}
+
+func (v *buildViewer) canView(bundleId string, channel string) bool {
+	if v.admin {
+		return true
+	}
+	if v.unavailable {
+		return false
+	}
+	if !backends.BuildRestricted(v.groups, bundleId, channel) {
+		return true
+	}
+	return backends.TesterCanInstall(v.testerGroups, bundleId, channel)
+}
+
+// token 下载链接中带上的测试者token, 不是测试者时为空
+func (v *buildViewer) token() string {
+	if v.tester == nil {
+		return ""
+	}
+	return v.tester.Token
+}
+
+func filterIosAppDirsBy(appDirs []*models.IosAppDirMeta, allow func(bundleId string, channel string) bool) []*models.IosAppDirMeta {
+	result := make([]*models.IosAppDirMeta, 0, len(appDirs))
+	for _, app := range appDirs {
+		if allow(app.BundleId, app.Channel) {
+			result = append(result, app)
+		}
+	}
+	return result
+}
+
+func filterAndroidAppDirsBy(appDirs []*models.AndroidAppDirMeta, allow func(bundleId string, channel string) bool) []*models.AndroidAppDirMeta {
+	result := make([]*models.AndroidAppDirMeta, 0, len(appDirs))
+	for _, app := range appDirs {
+		if allow(app.BundleId, app.Channel) {
+			result = append(result, app)
+		}
+	}
+	return result
+}
+
+// checkBuildViewer 指定给测试组的Build, 不是组内的测试者时返回403
+func checkBuildViewer(ctx *context.Context, bundleId string, channel string) bool {
+	viewer := requestViewer(ctx)
+	if viewer.canView(bundleId, channel) {
+		return true
+	}
+	if viewer.unavailable {
+		ctx.Output.SetStatus(503)
+		ctx.Output.Body([]byte("tester data unavailable"))
+		return false
+	}
+	ctx.Output.SetStatus(403)
+	ctx.Output.Body([]byte("forbidden"))
+	return false
+}
+
+//
+// @Title 测试者的页面, 只显示所在的测试组可以安装的Build; 参数token用于在其他设备上登录
+// @Router /my/
+//
+func (this *MainController) My() {
+	appsRoot := beego.AppConfig.String("apps_root")
+	if token := this.GetString("token"); token != "" {
+		if tester, _ := backends.FindTester(appsRoot, token); tester != nil {
+			this.Ctx.SetCookie(testerCookie, token, testerCookieMaxAge, "/", nil, nil, true)
+		}
+		// 地址栏中不保留token
+		this.Redirect("/my/", 302)
+		return
+	}
+
+	tester, groups := backends.FindTester(appsRoot, this.Ctx.GetCookie(testerCookie))
+	if tester == nil {
+		renderStatus(this.Ctx, 401, "invite.html", pongo2.Context{"error": "请通过邀请链接加入测试组"})
+		return
+	}
+	this.renderIndex(nil, tester, groups)
+}
+
+// renderStatus pongo2直接写入ResponseWriter, 需要先发送状态码
+func renderStatus(ctx *context.Context, status int, tmpl string, data pongo2.Context) {
+	if status != 200 {
+		ctx.Output.Header("Content-Type", "text/html; charset=utf-8")
+		ctx.ResponseWriter.WriteHeader(status)
+	}
+	pongo2.Render(ctx, tmpl, data)
+}
+
+func invitationContext(invitation *models.Invitation, group *models.TesterGroup) pongo2.Context {
+	return pongo2.Context{
+		"invitation": invitation,
+		"group":      group,
+		"usable":     invitation != nil && group != nil && invitation.Usable(time.Now()),
+	}
+}
+
+//
+// @Title 邀请的页面, 链接邀请需要填写email
+// @Router /invite/:token
+//
+func (this *TesterController) Get() {
+	invitation, group := backends.GetInvitation(beego.AppConfig.String("apps_root"), this.Ctx.Input.Param(":token"))
+	context := invitationContext(invitation, group)
+	status := 200
+	if invitation == nil || group == nil {
+		status, context["error"] = 404, "邀请不存在"
+	} else if context["usable"] != true {
+		status, context["error"] = 410, "邀请已经过期或者已经被使用"
+	}
+	renderStatus(this.Ctx, status, "invite.html", context)
+}
+
+//
+// @Title 接受邀请, 加入测试组之后跳转到/my/
+// @Router /invite/:token [post]
+//
+func (this *TesterController) Post() {
+	appsRoot := beego.AppConfig.String("apps_root")
+	token := this.Ctx.Input.Param(":token")
+	tester, err := backends.AcceptInvitation(appsRoot, token, strings.TrimSpace(this.GetString("email")), time.Now())
+	if err != nil {
+		context := invitationContext(backends.GetInvitation(appsRoot, token))
+		context["error"] = err.Error()
+		renderStatus(this.Ctx, 400, "invite.html", context)
+		return
+	}
+
+	invitation, _ := backends.GetInvitation(appsRoot, token)
+	backends.RecordAudit(appsRoot, &backends.AuditEntry{
+		Actor:  tester.Email,
+		Action: backends.AuditJoin,
+		Target: invitation.Group,
+		IP:     this.Ctx.Input.IP(),
+	})
+	this.Ctx.SetCookie(testerCookie, tester.Token, testerCookieMaxAge, "/", nil, nil, true)
+	this.Redirect("/my/", 303)
+}
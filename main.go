@@ -4,31 +4,67 @@ import (
 	_ "git.chunyu.me/feiwang/appserver/routers"
 	"github.com/astaxie/beego"
 	"git.chunyu.me/feiwang/appserver/backends"
+	"git.chunyu.me/feiwang/appserver/controllers"
 	"github.com/docopt/docopt-go"
 	"fmt"
 
 	log "git.chunyu.me/golang/cyutils/utils/rolling_log"
 	"strconv"
 	"os"
+	"time"
+	"net/http"
+	_ "net/http/pprof"
+	"path/filepath"
+	"strings"
 )
 
 var usage = `Usage:
-  %s [-L <log_file>] [--log-level=<loglevel>] [--log-keep-days=<maxdays>] [--nodb]
+  %s [-c <config_file>] [-L <log_file>] [--log-level=<loglevel>] [--log-keep-days=<maxdays>] [--work-dir=<work-dir>] [--profile-addr=<profile-addr>]
+  %s scan [-c <config_file>] [--log-level=<loglevel>] [--work-dir=<work-dir>]
+  %s verify [--checksums] [-c <config_file>] [--log-level=<loglevel>] [--work-dir=<work-dir>]
+  %s prune [-c <config_file>] [--log-level=<loglevel>] [--work-dir=<work-dir>] [--dry-run]
+  %s import <file> [--id=<app_id>] [--title=<title>] [--icon=<icon>] [--apk=<apk>] [--notes=<notes>] [--channel=<channel>] [--uploader=<uploader>] [--mandatory] [-c <config_file>] [--log-level=<loglevel>] [--work-dir=<work-dir>]
+  %s export <app> [-o <output>] [-c <config_file>] [--log-level=<loglevel>] [--work-dir=<work-dir>]
+  %s expiry [--days=<days>] [--notify] [-c <config_file>] [--log-level=<loglevel>] [--work-dir=<work-dir>]
+  %s storage (push | pull) [-c <config_file>] [--log-level=<loglevel>] [--work-dir=<work-dir>]
+  %s blobs (sync | gc) [--dry-run] [-c <config_file>] [--log-level=<loglevel>] [--work-dir=<work-dir>]
   %s -V | --version
 
+commands:
+   scan    scan apps_root once, print the parsed metadata and errors of every app dir
+   verify  check every app dir has a consistent ipa/plist/icon (or apk/json/icon), --checksums also re-hashes every file
+   prune   move builds out of the retention policy to the trash dir
+   import  add an ipa/apk/aab to apps_root
+   export  tar up all builds of an app (dir name, bundle id or name)
+   expiry  list ios builds whose profile or certificate expires soon, --notify sends the webhook/email
+   storage push builds missing in the configured storage, or pull builds missing in apps_root
+   blobs   sync stores every build as sha256 blobs, gc removes blobs no build references
+
 options:
-   -c <config_file>
-   -L	set output log file, default is stdout
-   --log-level=<loglevel>	set log level: info, warn, error, debug [default: info]
+   -c <config_file>  use an alternate beego config file instead of conf/app.conf
+   -L <log_file>  set output log file, default is stdout
+   --log-level=<loglevel>  set log level: info, warn, error, debug [default: info]
    --log-keep-days=<maxdays>  set max log file keep days, default is 3 days
-   --profile-addr=<profile-addr>
-   --work-dir=<work-dir>
-   --code-url-version=<code-url-version>
+   --profile-addr=<profile-addr>  start a net/http/pprof listener, e.g. 127.0.0.1:6060
+   --work-dir=<work-dir>  chdir to work dir, relative paths are resolved against it
+   --dry-run  only print the builds to be pruned (or the blobs to be removed)
+   --id=<app_id>  app dir name of the imported build, generated by default
+   --title=<title>  app name of the imported apk, the package name by default
+   --icon=<icon>  png icon of the imported build
+   --apk=<apk>  universal apk (or apks built with --mode=universal) of the imported aab, built by bundletool_command by default
+   --notes=<notes>  release notes of the imported build, saved in build.json
+   --channel=<channel>  channel of the imported build, e.g. beta
+   --uploader=<uploader>  who uploaded the imported build
+   --mandatory  older versions must update to the imported build
+   -o <output>  output file of export, <app>.tar.gz by default
+   --days=<days>  expiry window in days, expiry_warning_days by default
+   --notify  send the expiry notification now
+   --checksums  compare the files with the checksums recorded by the scanner to detect corruption
 `
 
 func main() {
 	version := "20160629"
-	args, err := docopt.Parse(usage, nil, true, version, true)
+	args, err := docopt.Parse(usage, nil, true, version, false)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -40,8 +76,35 @@ func main() {
 	}
 
 
+	// 1. 工作目录和配置文件
+	// beego在init时已经切换到了可执行文件所在的目录, 命令行中的相对路径按照启动时的目录解析
+	if s, ok := args["--work-dir"].(string); ok && s != "" {
+		workDir := resolveArgPath(s)
+		if err := os.Chdir(workDir); err != nil {
+			fmt.Printf("chdir to work dir %s failed: %v\n", workDir, err)
+			os.Exit(1)
+		}
+		launchDir = workDir
+	}
+
+	configFile := filepath.Join(beego.AppPath, "conf", "app.conf")
+	if s, ok := args["-c"].(string); ok && s != "" {
+		configFile = resolveArgPath(s)
+		if err := beego.LoadAppConfig("ini", configFile); err != nil {
+			fmt.Printf("load config file %s failed: %v\n", s, err)
+			os.Exit(1)
+		}
+	}
+
 	// 2. 解析Log相关的配置
-	log.SetLevel(log.LEVEL_INFO)
+	logLevel := log.LEVEL_INFO
+	if s, ok := args["--log-level"].(string); ok && s != "" {
+		logLevel, ok = parseLogLevel(s)
+		if !ok {
+			fmt.Printf("invalid log level: %s\n", s)
+			os.Exit(1)
+		}
+	}
 
 	var maxKeepDays int = 3
 	if s, ok := args["--log-keep-days"].(string); ok && s != "" {
@@ -55,7 +118,7 @@ func main() {
 
 	// set output log file
 	if s, ok := args["-L"].(string); ok && s != "" {
-		f, err := log.NewRollingFile(s, maxKeepDays)
+		f, err := log.NewRollingFile(resolveArgPath(s), maxKeepDays)
 		if err != nil {
 			log.PanicErrorf(err, "open rolling log file failed: %s", s)
 		} else {
@@ -63,17 +126,137 @@ func main() {
 			log.StdLog = log.New(f, "")
 		}
 	}
-	log.SetLevel(log.LEVEL_INFO)
+	log.SetLevel(logLevel)
 	log.SetFlags(log.Flags() | log.Lshortfile)
 
-	appsRoot := beego.AppConfig.String("apps_root")
+	// 3. 性能分析
+	if s, ok := args["--profile-addr"].(string); ok && s != "" {
+		go func() {
+			log.Infof("Profile server listening on %s", s)
+			if err := http.ListenAndServe(s, nil); err != nil {
+				log.ErrorErrorf(err, "Profile server on %s failed", s)
+			}
+		}()
+	}
+
+	backends.Version = version
+
+	appsRoot := resolveConfigPath(beego.AppConfig.String("apps_root"))
+	beego.AppConfig.Set("apps_root", appsRoot)
+
+	if err := backends.LoadOrganizations(); err != nil {
+		fmt.Printf("load organizations failed: %v\n", err)
+		os.Exit(1)
+	}
+	if err := backends.LoadStorage(); err != nil {
+		fmt.Printf("load storage failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	// 运维命令, 执行完毕之后退出
+	if command := commandName(args); command != "" {
+		os.Exit(runCommand(command, args, appsRoot))
+	}
+
+	// 配置文件和上次启动时不同时记录到操作记录中
+	backends.RecordConfigChanges(appsRoot, []string{configFile, resolveConfigPath(beego.AppConfig.String("organizations_file"))})
+
+	backends.RegisterReadyCheck("initial_scan", backends.CheckInitialScan)
+	backends.RegisterReadyCheck("apps_root", func() error {
+		return backends.CheckDirWritable(appsRoot)
+	})
 	backends.ListAppDir(appsRoot)
 
+	// 新增的Build保存为blob之后再扫描, 扫描时需要blobs.json中的checksum
+	syncBlobs := func() {
+		if backends.BlobStoreEnabled() {
+			backends.SyncBuildBlobs(backends.GetStorage(), appsRoot)
+		}
+	}
+	if backends.BlobStoreEnabled() {
+		go func() {
+			syncBlobs()
+			backends.ScanAppRootDir(appsRoot)
+		}()
+	}
+
 	// 添加Watch
 	done := backends.NewWatcher(appsRoot, func() {
+		syncBlobs()
 		backends.ScanAppRootDir(appsRoot)
+		backends.NotifyFollowers(appsRoot)
 	})
+
+	// 作为follower从leader复制Build
+	if replicator := backends.LoadReplicator(appsRoot); replicator != nil {
+		log.Infof("Replicate builds from %s every %v", replicator.Leader, replicator.Interval)
+		replicatorDone := replicator.Start()
+		defer func() {
+			replicatorDone <- true
+		}()
+	}
+
+	// 推送指标到open-falcon
+	if beego.AppConfig.DefaultBool("falcon_enabled", false) {
+		interval := time.Duration(beego.AppConfig.DefaultInt("falcon_interval", 60)) * time.Second
+		reporter := backends.NewFalconReporter(beego.AppConfig.String("falcon_agent"), interval, appsRoot)
+		log.Infof("Push metrics to open-falcon agent: %s", reporter.Agent)
+		falconDone := reporter.Start()
+		defer func() {
+			falconDone <- true
+		}()
+	}
+
+	// 刷新profile过期的天数, 通知即将过期的Build
+	expiryNotifier := backends.NewExpiryNotifier(appsRoot)
+	if expiryNotifier.Enabled() {
+		log.Infof("Notify builds expiring within %d days every %v", expiryNotifier.WindowDays, expiryNotifier.Interval)
+	}
+	expiryDone := expiryNotifier.Start()
+	defer func() {
+		expiryDone <- true
+	}()
+
+	// beego.Run在所有的模式(包括graceful)下都使用预先设置的Server.Handler以及ConnState
+	beego.BeeApp.Server.ConnState = backends.TrackConnState
+	beego.BeeApp.Server.Handler = controllers.MetricsHandler(beego.BeeApp.Handlers)
 	beego.Run()
 	done <- true
 }
 
+// 启动时所在的目录(指定了--work-dir时为work dir)
+var launchDir = os.Getenv("PWD")
+
+// 命令行中的相对路径相对于启动时的目录
+func resolveArgPath(p string) string {
+	if filepath.IsAbs(p) || launchDir == "" {
+		return p
+	}
+	return filepath.Join(launchDir, p)
+}
+
+// 配置文件中的相对路径相对于当前的工作目录
+func resolveConfigPath(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	return abs
+}
+
+func parseLogLevel(s string) (log.LogLevel, bool) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return log.LEVEL_DEBUG, true
+	case "info":
+		return log.LEVEL_INFO, true
+	case "warn":
+		return log.LEVEL_WARN, true
+	case "error":
+		return log.LEVEL_ERROR, true
+	}
+	return log.LEVEL_INFO, false
+}
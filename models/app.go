@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 type  IosAppDirMeta  struct {
 	Id              string
 	Plist           string
@@ -7,23 +9,214 @@ type  IosAppDirMeta  struct {
 	MobileProvision string
 	Ipa             string
 
+	BundleId        string
 	Name            string
 	Version         string
 	Author          string
 	ReleaseDate     string
 	Size            string
+
+	// 所属的组织, 不属于任何组织时为空
+	Org             string
+	// build.json中的发布说明和渠道, 上传者记录在Author中
+	Notes           string
+	Channel         string
+	// 置顶以及隐藏, 在管理后台中设置
+	Pinned          bool
+	Hidden          bool
+	// 强制更新, 在/api/apps/:bundle_id/update中返回
+	Mandatory       bool
+
+	// 内嵌的extension, watch app, framework
+	Embedded        []*EmbeddedBundle
+
+	// CFBundleVersion
+	BuildNumber          string
+	MinimumOSVersion     string
+	// iPhone, iPad, TV, Watch
+	DeviceFamily         []string
+	RequiredCapabilities []string
+	// DTSDKName, 例如: iphoneos9.3
+	SDKName              string
+	// DTXcode, 例如: 0731 => 7.3.1
+	XcodeVersion         string
+	Architectures        []string
+
+	// embedded.mobileprovision, 没有时为nil
+	Profile              *ProvisioningProfile
+	// 主App可执行文件的签名证书
+	SignerCertSHA256     string
+	SignerSubject        string
+	// 签名和profile的校验发现的问题, 例如: bundle id和profile不匹配, profile已经过期
+	SignatureProblems    []string
+
+	// profile和签名证书中较早的过期时间, 没有profile时为零值
+	ExpirationDate       time.Time
+	// profile 或者 certificate
+	ExpiresBy            string
+	// 距离过期的天数, 已经过期时为负数
+	DaysToExpiry         int
+	// "", expiring, expired
+	ExpiryStatus         string
+
+	// 文件名 => 校验和, 以及app.ipa的校验和
+	Checksums            map[string]*Checksum
+	Checksum             *Checksum
+	ChecksumsUrl         string
+}
+
+const (
+	ExpiryExpiring = "expiring"
+	ExpiryExpired  = "expired"
+)
+
+const (
+	ProfileDevelopment = "development"
+	ProfileAdHoc       = "ad-hoc"
+	ProfileEnterprise  = "enterprise"
+	ProfileAppStore    = "app-store"
+)
+
+// ipa中的provisioning profile
+type ProvisioningProfile struct {
+	Name           string
+	UUID           string
+	TeamId         string
+	TeamName       string
+	// application-identifier, 例如: ABCDE12345.me.chunyu.*
+	AppId          string
+	// development, ad-hoc, enterprise, app-store
+	Type           string
+	CreationDate   time.Time
+	ExpirationDate time.Time
+	// ProvisionedDevices的数目
+	Devices        int
+	Certificates   []*ProfileCertificate
+}
+
+// profile中的DeveloperCertificates
+type ProfileCertificate struct {
+	SHA256   string
+	Subject  string
+	NotAfter time.Time
+}
+
+const (
+	EmbeddedExtension = "extension"
+	EmbeddedWatchApp  = "watch"
+	EmbeddedFramework = "framework"
+)
+
+// ipa中内嵌的bundle, 例如: PlugIns/Share.appex, Watch/Watch.app, Frameworks/Foo.framework
+type EmbeddedBundle struct {
+	Kind      string
+	// 相对于主App的路径
+	Path      string
+	BundleId  string
+	Version   string
+	Size      string
+	SizeBytes int64
 }
 
 type  AndroidAppDirMeta  struct {
 	Id          string
 	AppIcon     string
+	// 下载时根据User-Agent选择Artifacts中的apk
 	Apk         string
+	// 上传的是aab时为aab的下载地址, 否则为空
+	Aab         string
 
+	BundleId    string
 	Name        string
 	Version     string
 	Author      string
 	ReleaseDate string
 	Size        string
+
+	// 所属的组织, 不属于任何组织时为空
+	Org         string
+	// build.json(或者app.json)中的发布说明和渠道, 上传者记录在Author中
+	Notes       string
+	Channel     string
+	// 置顶以及隐藏, 在管理后台中设置
+	Pinned      bool
+	Hidden      bool
+	// 强制更新, 在/api/apps/:bundle_id/update中返回
+	Mandatory   bool
+
+	ApkMetadata
+
+	// 校验通过的签名方案, 例如: [v2 v1]; 没有校验时为空
+	SignatureVerified []string
+	// 签名校验发现的问题, 例如: 文件被修改, 不是期望的签名证书
+	SignatureProblems []string
+
+	// 所有的apk(app.apk以及app-*.apk), 第一个为默认的apk
+	Artifacts []*ApkArtifact
+
+	// 文件名 => 校验和, 以及默认apk的校验和
+	Checksums    map[string]*Checksum
+	Checksum     *Checksum
+	ChecksumsUrl string
+}
+
+// 同一个Build中按照flavor/ABI/density区分的apk
+type ApkArtifact struct {
+	// 文件名, 例如: app-free-arm64-v8a.apk
+	File        string
+	Url         string
+	// 例如: free, 没有flavor时为空
+	Flavor      string
+	// apk中包含的native库, 空或者多个时为universal
+	Abis        []string
+	// 例如: xxhdpi, 包含所有density时为空
+	Density     string
+	VersionCode string
+	Size        string
+	SizeBytes   int64
+	// 页面上显示的名字, 例如: free arm64-v8a
+	Label       string
+	Checksum    *Checksum
+}
+
+// 扫描时计算的文件校验和, 十六进制
+type Checksum struct {
+	SHA256 string
+	MD5    string
+	Size   int64
+}
+
+// Universal 可以安装到任何ABI以及density的设备上
+func (a *ApkArtifact) Universal() bool {
+	return len(a.Abis) != 1 && a.Density == ""
+}
+
+// 从apk中解析出来的元数据
+type ApkMetadata struct {
+	PackageName      string
+	VersionCode      string
+	VersionName      string
+	MinSdkVersion    string
+	TargetSdkVersion string
+	// 例如: arm64-v8a, armeabi-v7a
+	Abis             []string
+	Permissions      []string
+	Features         []string
+	LauncherActivity string
+	Debuggable       bool
+
+	// v1, v2, v3, 没有签名时为空
+	SignatureScheme  string
+	SignerCertSHA256 string
+	SignerSubject    string
+}
+
+// 解析失败的App目录
+type AppDirError struct {
+	Id       string
+	Platform string
+	Reason   string
+	ScanTime string
 }
 
 type IosAppDirMetas []*IosAppDirMeta
@@ -51,3 +244,16 @@ func (a AndroidAppDirMets) Swap(i, j int) {
 func (a AndroidAppDirMets) Less(i, j int) bool {
 	return a[j].ReleaseDate < a[i].ReleaseDate
 }
+
+type EmbeddedBundles []*EmbeddedBundle
+
+func (a EmbeddedBundles) Len() int {
+	return len(a)
+}
+func (a EmbeddedBundles) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+// 按照路径排序
+func (a EmbeddedBundles) Less(i, j int) bool {
+	return a[i].Path < a[j].Path
+}
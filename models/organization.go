@@ -0,0 +1,28 @@
+package models
+
+// 组织(团队), 每个组织有自己的bundle id空间, App列表, 品牌以及成员
+type Organization struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+
+	// bundle id的前缀, "re:"开头的为正则表达式
+	BundleIds []string `json:"bundle_ids"`
+	// 不在BundleIds中, 但是属于这个组织的App的bundle id
+	Apps []string `json:"apps"`
+
+	Branding OrgBranding `json:"branding"`
+
+	// 成员账号, 格式: user:password; 为空时组织的页面是公开的
+	Members []string `json:"members,omitempty"`
+}
+
+type OrgBranding struct {
+	Title string `json:"title"`
+	Logo  string `json:"logo"`
+	Color string `json:"color"`
+}
+
+// Private 只有成员才能访问
+func (org *Organization) Private() bool {
+	return len(org.Members) > 0
+}
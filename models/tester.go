@@ -0,0 +1,69 @@
+package models
+
+import "time"
+
+// 测试组, 组内的测试者可以安装分配给这个组的App和渠道
+type TesterGroup struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+
+	// 可以安装的App的bundle id, 为空时可以安装所有的App
+	Apps []string `json:"apps,omitempty"`
+	// 可以安装的渠道, 为空时不限
+	Channels []string `json:"channels,omitempty"`
+}
+
+// 接受了邀请的测试者, 通过Token(保存在cookie中)识别
+type Tester struct {
+	Email    string    `json:"email"`
+	Token    string    `json:"token"`
+	Groups   []string  `json:"groups"`
+	JoinedAt time.Time `json:"joined_at"`
+	// 接受过邮件邀请, email已经验证; 通过链接邀请加入时email是测试者自己填写的
+	Verified bool `json:"verified,omitempty"`
+}
+
+// 加入测试组的邀请; Email为空时是链接邀请, 在过期之前可以被多人使用, 邮件邀请只能使用一次
+type Invitation struct {
+	Token     string    `json:"token"`
+	Group     string    `json:"group"`
+	Email     string    `json:"email,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// 最后一次接受邀请的时间
+	AcceptedAt time.Time `json:"accepted_at"`
+	Accepted   int       `json:"accepted"`
+	Revoked    bool      `json:"revoked,omitempty"`
+}
+
+// Usable 没有过期, 没有撤销, 邮件邀请没有被使用过
+func (i *Invitation) Usable(now time.Time) bool {
+	if i.Revoked || !now.Before(i.ExpiresAt) {
+		return false
+	}
+	return i.Email == "" || i.Accepted == 0
+}
+
+// Expired 已经过期
+func (i *Invitation) Expired(now time.Time) bool {
+	return !now.Before(i.ExpiresAt)
+}
+
+// Allows 组内的测试者是否可以安装bundleId在channel中的Build
+func (g *TesterGroup) Allows(bundleId string, channel string) bool {
+	if len(g.Apps) > 0 && !containsString(g.Apps, bundleId) {
+		return false
+	}
+	return len(g.Channels) == 0 || containsString(g.Channels, channel)
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -6,11 +6,59 @@ import (
 )
 
 func init() {
-	beego.Router("/", &controllers.MainController{})
+	beego.InsertFilter("/debug/*", beego.BeforeRouter, controllers.AdminAuthFilter)
+	beego.InsertFilter("/admin/*", beego.BeforeRouter, controllers.AdminAuthFilter)
 
-	beego.Router("/api/mp/:app_id/", &controllers.MainController{}, "get:MobileProvision4Key")
-	beego.Router("/api/icon/:app_id/", &controllers.MainController{}, "get:AppIcon")
-	beego.Router("/api/plist/:app_id/", &controllers.MainController{}, "get:PlistFile")
-	beego.Router("/api/ipa/:app_id/", &controllers.MainController{}, "get:AppIpa")
-	beego.Router("/api/apk/:app_id/", &controllers.MainController{}, "get:AndroidApk")
+	router("/", &controllers.MainController{})
+	router("/org/:org/", &controllers.MainController{}, "get:OrgIndex")
+	router("/item/:app_id", &controllers.MainController{}, "get:Item")
+	router("/my/", &controllers.MainController{}, "get:My")
+	router("/invite/:token", &controllers.TesterController{})
+	router("/api/orgs", &controllers.OrgController{})
+	router("/api/builds", &controllers.ApiController{}, "get:List")
+	router("/api/builds/:app_id", &controllers.ApiController{}, "get:Build")
+	router("/api/checksums/:app_id", &controllers.ApiController{}, "get:Checksums")
+	router("/api/expiring", &controllers.ApiController{}, "get:Expiring")
+	router("/api/apps/:bundle_id/update", &controllers.ApiController{}, "get:Update")
+	router("/api/events", &controllers.EventsController{})
+
+	router("/api/mp/:app_id/", &controllers.MainController{}, "get,head:MobileProvision4Key")
+	router("/api/icon/:app_id/", &controllers.MainController{}, "get,head:AppIcon")
+	router("/api/plist/:app_id/", &controllers.MainController{}, "get:PlistFile")
+	router("/api/ipa/:app_id/", &controllers.MainController{}, "get,head:AppIpa")
+	router("/api/apk/:app_id/", &controllers.MainController{}, "get,head:AndroidApk")
+	router("/api/apk/:app_id/:file", &controllers.MainController{}, "get,head:AndroidApk")
+	router("/api/aab/:app_id/", &controllers.MainController{}, "get,head:AndroidAab")
+
+	router("/api/replication/builds", &controllers.ReplicationController{}, "get:Builds")
+	router("/api/replication/files/:app_id/:file", &controllers.ReplicationController{}, "get,head:File")
+	router("/api/replication/notify", &controllers.ReplicationController{}, "post:Notify")
+
+	router("/admin/", &controllers.AdminController{}, "get:Index")
+	router("/admin/builds/:app_id", &controllers.AdminController{}, "get:Build;post:SaveBuild")
+	router("/admin/builds/:app_id/:action", &controllers.AdminController{}, "post:BuildAction")
+	router("/admin/upload", &controllers.AdminController{}, "get:Upload;post:SaveUpload")
+	router("/admin/trash", &controllers.AdminController{}, "get:Trash")
+	router("/admin/trash/:trash_id/restore", &controllers.AdminController{}, "post:Restore")
+	router("/admin/errors", &controllers.AdminController{}, "get:Errors")
+	router("/admin/audit", &controllers.AdminController{}, "get:Audit")
+	router("/admin/audit/export", &controllers.AdminController{}, "get:ExportAudit")
+	router("/admin/testers", &controllers.AdminController{}, "get:Testers")
+	router("/admin/testers/groups", &controllers.AdminController{}, "post:SaveTesterGroup")
+	router("/admin/testers/groups/:group/delete", &controllers.AdminController{}, "post:DeleteTesterGroup")
+	router("/admin/testers/groups/:group/invite", &controllers.AdminController{}, "post:InviteTesters")
+	router("/admin/testers/groups/:group/remove", &controllers.AdminController{}, "post:RemoveTester")
+	router("/admin/testers/invitations/:token/revoke", &controllers.AdminController{}, "post:RevokeInvitation")
+
+	router("/metrics", &controllers.MetricsController{})
+
+	router("/healthz", &controllers.HealthController{}, "get:Healthz")
+	router("/readyz", &controllers.HealthController{}, "get:Readyz")
+	router("/debug/status", &controllers.HealthController{}, "get:DebugStatus")
+}
+
+// 注册路由, 同时记录pattern用于统计指标
+func router(rootpath string, c beego.ControllerInterface, mappingMethods ...string) {
+	controllers.RegisterRoutePattern(rootpath)
+	beego.Router(rootpath, c, mappingMethods...)
 }